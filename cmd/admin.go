@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 )
 
@@ -18,6 +21,10 @@ type serverConfig struct {
 	Update       *AppUpdate `json:"update"`
 	NeedsRestart bool       `json:"needs_restart"`
 	Version      string     `json:"version"`
+
+	// The user making the request.
+	User       models.User `json:"user"`
+	SSOEnabled bool        `json:"sso_enabled"`
 }
 
 // handleGetServerConfig returns general server config.
@@ -53,6 +60,8 @@ func handleGetServerConfig(c echo.Context) error {
 	out.Update = app.update
 	app.Unlock()
 	out.Version = versionString
+	out.User = getUser(c)
+	out.SSOEnabled = app.oidc != nil
 
 	return c.JSON(http.StatusOK, okResp{out})
 }
@@ -87,6 +96,197 @@ func handleGetDashboardCounts(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// dashboardCounts is the counts of dashboard stats.
+type dashboardCounts struct {
+	Sends       int `db:"sends" json:"sends"`
+	Views       int `db:"views" json:"views"`
+	Clicks      int `db:"clicks" json:"clicks"`
+	Bounces     int `db:"bounces" json:"bounces"`
+	Subscribers int `db:"subscribers" json:"subscribers"`
+}
+
+// dashboardStat is the stats of a time bucket on the dashboard.
+type dashboardStat struct {
+	TS time.Time `db:"ts" json:"ts"`
+	dashboardCounts
+}
+
+// dashboardStats is a time series of dashboard stats with its totals.
+type dashboardStats struct {
+	From   time.Time       `json:"from"`
+	To     time.Time       `json:"to"`
+	Series []dashboardStat `json:"series"`
+	Totals dashboardCounts `json:"totals"`
+}
+
+// Max. number of buckets in a dashboard stats series.
+const dashboardMaxBuckets = 1000
+
+var dashboardGranularities = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  time.Hour * 24,
+	"week": time.Hour * 24 * 7,
+}
+
+// handleGetDashboardStats returns a time series of sends, views, clicks,
+// bounces and new subscribers between ?from and ?to (default: the last 30 days)
+// bucketed by ?granularity (hour, day, week). An optional ?compare_from
+// returns the series of a period of the same length starting at that date
+// for comparison.
+func handleGetDashboardStats(c echo.Context) error {
+	var app = c.Get("app").(*App)
+
+	from, to, gran, err := parseDashboardRange(c, app)
+	if err != nil {
+		return err
+	}
+
+	compFrom, err := parseDateFilter(c.QueryParam("compare_from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	out := struct {
+		Current  dashboardStats  `json:"current"`
+		Previous *dashboardStats `json:"previous"`
+	}{}
+
+	cur, err := getDashboardStats(from, to, gran, app)
+	if err != nil {
+		return err
+	}
+	out.Current = cur
+
+	if compFrom != nil {
+		cf := compFrom.(time.Time)
+		prev, err := getDashboardStats(cf, cf.Add(to.Sub(from)), gran, app)
+		if err != nil {
+			return err
+		}
+		out.Previous = &prev
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// parseDashboardRange parses the ?from and ?to dates (default: the last 30 days)
+// and the ?granularity (hour, day, week; default: day) of a dashboard time series.
+func parseDashboardRange(c echo.Context, app *App) (time.Time, time.Time, string, error) {
+	var (
+		gran = c.QueryParam("granularity")
+		from time.Time
+		to   = time.Now()
+	)
+
+	if gran == "" {
+		gran = "day"
+	}
+	step, ok := dashboardGranularities[gran]
+	if !ok {
+		return from, to, gran, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "granularity"))
+	}
+
+	for _, p := range []struct {
+		param string
+		t     *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		d, err := parseDateFilter(c.QueryParam(p.param))
+		if err != nil {
+			return from, to, gran, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+		}
+		if d != nil {
+			*p.t = d.(time.Time)
+		}
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -30)
+	}
+
+	if !from.Before(to) || to.Sub(from)/step > dashboardMaxBuckets {
+		return from, to, gran, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("dashboard.invalidRange", "max", strconv.Itoa(dashboardMaxBuckets)))
+	}
+
+	return from, to, gran, nil
+}
+
+// getDashboardStats fetches the stats series of a period and totals it.
+func getDashboardStats(from, to time.Time, gran string, app *App) (dashboardStats, error) {
+	out := dashboardStats{From: from, To: to, Series: []dashboardStat{}}
+	if err := app.queries.GetDashboardStats.Select(&out.Series, from, to, gran); err != nil {
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching", "name", "dashboard stats", "error", pqErrMsg(err)))
+	}
+
+	for _, s := range out.Series {
+		out.Totals.Sends += s.Sends
+		out.Totals.Views += s.Views
+		out.Totals.Clicks += s.Clicks
+		out.Totals.Bounces += s.Bounces
+		out.Totals.Subscribers += s.Subscribers
+	}
+	return out, nil
+}
+
+// handleGetDashboardSMTPHealth returns the results of the last periodic
+// health check of the SMTP servers.
+func handleGetDashboardSMTPHealth(c echo.Context) error {
+	type pool struct {
+		Name    string              `json:"name"`
+		Servers []email.CheckResult `json:"servers"`
+	}
+
+	var (
+		app = c.Get("app").(*App)
+		out = []pool{}
+	)
+
+	app.Lock()
+	for name, res := range app.smtpHealth {
+		out = append(out, pool{Name: name, Servers: res})
+	}
+	app.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// checkSMTPHealth is a blocking function that checks the connectivity of
+// all the SMTP servers at the given interval and records the results for
+// the dashboard.
+func checkSMTPHealth(interval time.Duration, app *App) {
+	for {
+		out := make(map[string][]email.CheckResult)
+		for name, m := range app.messengers {
+			e, ok := m.(*email.Emailer)
+			if !ok {
+				continue
+			}
+
+			res := e.Check()
+			for _, r := range res {
+				if !r.OK {
+					app.log.Printf("SMTP health check failed for %s:%d (%s) at %s: %s",
+						r.Host, r.Port, name, r.Step, r.Error)
+					app.sendAlert(alertMessengerFailure, fmt.Sprintf("SMTP server %s:%d (%s) is failing", r.Host, r.Port, name),
+						fmt.Sprintf("The health check failed at %s: %s", r.Step, r.Error))
+				}
+			}
+			out[name] = res
+		}
+
+		app.Lock()
+		app.smtpHealth = out
+		app.Unlock()
+
+		time.Sleep(interval)
+	}
+}
+
 // handleReloadApp restarts the app.
 func handleReloadApp(c echo.Context) error {
 	app := c.Get("app").(*App)
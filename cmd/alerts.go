@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alert channel types.
+const (
+	alertChannelSlack   = "slack"
+	alertChannelWebhook = "webhook"
+	alertChannelEmail   = "email"
+)
+
+// Events that admins are alerted of.
+const (
+	alertCampaignError    = "campaign.error"
+	alertMessengerFailure = "messenger.failure"
+	alertBounceRate       = "bounce.rate"
+	alertImportFailed     = "import.failed"
+)
+
+const (
+	notifTplAlert = "alert"
+
+	// Minimum interval between repeated alerts of the same event and subject.
+	alertCooldown = time.Hour
+
+	// Period over which the bounce rate is checked and the minimum number of
+	// sent messages in it for the rate to be meaningful.
+	bounceRateWindow  = time.Hour
+	bounceRateMinSent = 100
+)
+
+var (
+	alertEvents = []string{alertCampaignError, alertMessengerFailure, alertBounceRate, alertImportFailed}
+
+	alertClient = &http.Client{Timeout: time.Second * 10}
+)
+
+// alertChannel is a channel that admins are alerted on. A channel without
+// events receives all of them.
+type alertChannel struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Emails []string `json:"emails"`
+	Events []string `json:"events"`
+}
+
+// alerter sends alerts to the enabled alert channels.
+type alerter struct {
+	channels []alertChannel
+
+	// Last time an alert was sent by event and subject.
+	sent map[string]time.Time
+	sync.Mutex
+}
+
+// alert is the payload that's posted as JSON to webhook channels.
+type alert struct {
+	Event     string    `json:"event"`
+	Subject   string    `json:"subject"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func isAlertEvent(e string) bool {
+	for _, v := range alertEvents {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+// sendAlert alerts admins of an event on the channels that receive it.
+// Repeated alerts of the same event and subject are dropped for
+// alertCooldown. The alerts are sent in the background.
+func (app *App) sendAlert(event, subject, message string) {
+	a := app.alerts
+	if a == nil {
+		return
+	}
+
+	key := event + ":" + subject
+	a.Lock()
+	if t, ok := a.sent[key]; ok && time.Since(t) < alertCooldown {
+		a.Unlock()
+		return
+	}
+	a.sent[key] = time.Now()
+	a.Unlock()
+
+	al := alert{Event: event, Subject: subject, Message: message, Timestamp: time.Now()}
+	for _, ch := range a.channels {
+		if len(ch.Events) > 0 && !inArray(event, ch.Events) {
+			continue
+		}
+
+		go func(ch alertChannel) {
+			if err := ch.send(al, app); err != nil {
+				app.log.Printf("error sending %s alert to %s channel: %v", event, ch.Type, err)
+			}
+		}(ch)
+	}
+}
+
+// send sends an alert to the channel.
+func (ch alertChannel) send(a alert, app *App) error {
+	switch ch.Type {
+	case alertChannelEmail:
+		to := ch.Emails
+		if len(to) == 0 {
+			to = app.constants.NotifyEmails
+		}
+		return app.sendNotification(to, a.Subject, notifTplAlert, a)
+
+	case alertChannelSlack:
+		return postAlert(ch.URL, struct {
+			Text string `json:"text"`
+		}{fmt.Sprintf("*%s*\n%s", a.Subject, a.Message)})
+
+	default:
+		return postAlert(ch.URL, a)
+	}
+}
+
+// postAlert posts an alert payload as JSON to a URL.
+func postAlert(u string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := alertClient.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("non-OK response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkBounceRate alerts admins at the given interval if the bounce rate
+// of transactional messages in the last bounceRateWindow is above the
+// threshold (percentage).
+func checkBounceRate(threshold float64, interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var r struct {
+			Sent    int `db:"sent"`
+			Bounced int `db:"bounced"`
+		}
+		if err := app.queries.GetBounceRate.Get(&r,
+			fmt.Sprintf("%d seconds", int(bounceRateWindow.Seconds()))); err != nil {
+			app.log.Printf("error checking bounce rate: %v", err)
+			continue
+		}
+		if r.Sent < bounceRateMinSent {
+			continue
+		}
+
+		if rate := float64(r.Bounced) * 100 / float64(r.Sent); rate >= threshold {
+			app.sendAlert(alertBounceRate, "High bounce rate",
+				fmt.Sprintf("%.1f%% of the %d messages sent in the last %s bounced (threshold: %.1f%%).",
+					rate, r.Sent, bounceRateWindow, threshold))
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// analyticsCount is the number of events of a kind (eg: a device family).
+type analyticsCount struct {
+	Name  string `db:"name" json:"name"`
+	Count int    `db:"count" json:"count"`
+}
+
+// handleGetCampaignDeviceAnalytics returns the views of a campaign
+// aggregated by device family and e-mail client.
+func handleGetCampaignDeviceAnalytics(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var res []struct {
+		Type string `db:"type"`
+		analyticsCount
+	}
+	if err := app.queries.GetCampaignViewDevices.Select(&res, id); err != nil {
+		app.log.Printf("error fetching campaign device analytics: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	out := struct {
+		Devices []analyticsCount `json:"devices"`
+		Clients []analyticsCount `json:"clients"`
+	}{[]analyticsCount{}, []analyticsCount{}}
+	for _, r := range res {
+		if r.Type == "device" {
+			out.Devices = append(out.Devices, r.analyticsCount)
+		} else {
+			out.Clients = append(out.Clients, r.analyticsCount)
+		}
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignUnsubAnalytics returns the unsubscriptions from a campaign
+// by their source: the unsubscribe page or one-click (RFC 8058) requests
+// from e-mail clients.
+func handleGetCampaignUnsubAnalytics(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out := []analyticsCount{}
+	if err := app.queries.GetCampaignUnsubscribeSources.Select(&out, id); err != nil {
+		app.log.Printf("error fetching campaign unsubscribe analytics: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// geoCount is the number of views and clicks from a country or region.
+type geoCount struct {
+	Country string `db:"country" json:"country"`
+	Region  string `db:"region" json:"region,omitempty"`
+	Views   int    `db:"views" json:"views"`
+	Clicks  int    `db:"clicks" json:"clicks"`
+}
+
+// geoAnalytics is the views and clicks aggregated by country and region.
+type geoAnalytics struct {
+	Countries []geoCount `json:"countries"`
+	Regions   []geoCount `json:"regions"`
+}
+
+// handleGetCampaignGeoAnalytics returns the views and clicks of a campaign
+// aggregated by country and region. Locations are only recorded when a
+// GeoIP DB is configured.
+func handleGetCampaignGeoAnalytics(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := getGeoAnalytics(id, 0, app)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetDashboardGeo returns the views and clicks of all campaigns in
+// the last N days (default 30) aggregated by country and region.
+func handleGetDashboardGeo(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		days, _ = strconv.Atoi(c.QueryParam("days"))
+	)
+
+	if days < 1 {
+		days = 30
+	}
+
+	out, err := getGeoAnalytics(0, days, app)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// getGeoAnalytics fetches the location aggregates of a campaign, or of all
+// campaigns in the last N days if campID is 0, and rolls regions up into
+// countries.
+func getGeoAnalytics(campID, days int, app *App) (geoAnalytics, error) {
+	var res []geoCount
+	if err := app.queries.GetCampaignGeo.Select(&res, campID, days); err != nil {
+		app.log.Printf("error fetching geo analytics: %v", err)
+		return geoAnalytics{}, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	var (
+		out = geoAnalytics{Countries: []geoCount{}, Regions: []geoCount{}}
+		idx = map[string]int{}
+	)
+	for _, r := range res {
+		if r.Region != "" {
+			out.Regions = append(out.Regions, r)
+		}
+
+		i, ok := idx[r.Country]
+		if !ok {
+			idx[r.Country] = len(out.Countries)
+			out.Countries = append(out.Countries, geoCount{Country: r.Country})
+			i = len(out.Countries) - 1
+		}
+		out.Countries[i].Views += r.Views
+		out.Countries[i].Clicks += r.Clicks
+	}
+
+	sort.SliceStable(out.Countries, func(i, j int) bool {
+		return out.Countries[i].Views > out.Countries[j].Views
+	})
+
+	return out, nil
+}
+
+// linkClicks is the click report of a link in a campaign.
+type linkClicks struct {
+	ID           int            `db:"id" json:"id"`
+	URL          string         `db:"url" json:"url"`
+	Clicks       int            `db:"clicks" json:"clicks"`
+	UniqueClicks int            `db:"unique_clicks" json:"unique_clicks"`
+	FirstClick   null.Time      `db:"first_click" json:"first_click"`
+	LastClick    null.Time      `db:"last_click" json:"last_click"`
+	Timing       types.JSONText `db:"timing" json:"timing"`
+}
+
+// handleGetCampaignLinks returns the links clicked in a campaign ordered
+// by clicks, each with total and unique clicks and the distribution of
+// the clicks over time since the campaign started.
+func handleGetCampaignLinks(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out := []linkClicks{}
+	if err := app.queries.GetCampaignLinkClicks.Select(&out, id); err != nil {
+		app.log.Printf("error fetching campaign link clicks: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// trackingEvent is a raw campaign view or link click event.
+type trackingEvent struct {
+	Type           string    `db:"type" json:"type"`
+	CampaignID     int       `db:"campaign_id" json:"campaign_id"`
+	CampaignUUID   string    `db:"campaign_uuid" json:"campaign_uuid"`
+	SubscriberUUID string    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	URL            string    `db:"url" json:"url"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+}
+
+// handleExportTrackingEvents streams the raw view and click events of
+// campaigns in an optional date range as CSV or NDJSON (?format=ndjson).
+// Subscriber UUIDs are only available with individual subscriber tracking.
+func handleExportTrackingEvents(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		typ       = c.QueryParam("type")
+		format    = c.QueryParam("format")
+		campID, _ = strconv.Atoi(c.QueryParam("campaign_id"))
+	)
+
+	if typ != "" && typ != "view" && typ != "click" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "type"))
+	}
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "format"))
+	}
+
+	from, err := parseDateFilter(c.QueryParam("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+	to, err := parseDateFilter(c.QueryParam("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	// Stream the rows from the DB as they're read.
+	rows, err := app.queries.ExportTrackingEvents.Queryx(typ, campID, from, to)
+	if err != nil {
+		app.log.Printf("error fetching tracking events: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+	defer rows.Close()
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	if format == "csv" {
+		h.Set("Content-type", "text/csv")
+	} else {
+		h.Set("Content-type", "application/x-ndjson")
+	}
+	h.Set(echo.HeaderContentDisposition, "attachment; filename="+"events."+format)
+	h.Set("Content-Transfer-Encoding", "binary")
+	h.Set("Cache-Control", "no-cache")
+
+	var (
+		wr  = csv.NewWriter(c.Response())
+		enc = json.NewEncoder(c.Response())
+	)
+	if format == "csv" {
+		wr.Write([]string{"type", "campaign_id", "campaign_uuid", "subscriber_uuid", "url", "created_at"})
+	}
+
+	for n := 1; rows.Next(); n++ {
+		var e trackingEvent
+		if err := rows.StructScan(&e); err != nil {
+			app.log.Printf("error scanning tracking event: %v", err)
+			break
+		}
+
+		if format == "csv" {
+			err = wr.Write([]string{e.Type, strconv.Itoa(e.CampaignID), e.CampaignUUID,
+				e.SubscriberUUID, e.URL, e.CreatedAt.Format(time.RFC3339)})
+		} else {
+			err = enc.Encode(e)
+		}
+		if err != nil {
+			app.log.Printf("error streaming tracking events: %v", err)
+			break
+		}
+
+		// Flush in batches.
+		if n%app.constants.DBBatchSize == 0 {
+			wr.Flush()
+			c.Response().Flush()
+		}
+	}
+	wr.Flush()
+
+	return nil
+}
+
+// Deliverability rate (%) thresholds beyond which mailbox providers are
+// likely to throttle or block a sender. The block rate is the rate of
+// messages that were rejected or failed to send.
+var deliverabilityThresholds = map[string]float64{
+	"bounce_rate":    2,
+	"complaint_rate": 0.1,
+	"block_rate":     1,
+}
+
+// Max. number of recipient domains in the deliverability breakdown.
+const deliverabilityMaxDomains = 25
+
+// deliverability is the delivery outcomes of a time bucket, messenger,
+// or recipient domain.
+type deliverability struct {
+	Type string    `db:"type" json:"-"`
+	TS   null.Time `db:"ts" json:"ts,omitempty"`
+	Name string    `db:"name" json:"name,omitempty"`
+
+	Attempts   int `db:"attempts" json:"attempts"`
+	Sent       int `db:"sent" json:"sent"`
+	Bounced    int `db:"bounced" json:"bounced"`
+	Complained int `db:"complained" json:"complained"`
+	Failed     int `db:"failed" json:"failed"`
+
+	BounceRate    float64 `db:"-" json:"bounce_rate"`
+	ComplaintRate float64 `db:"-" json:"complaint_rate"`
+	BlockRate     float64 `db:"-" json:"block_rate"`
+}
+
+// deliverabilityAnnotation marks a time bucket where a rate crossed
+// its threshold.
+type deliverabilityAnnotation struct {
+	TS        time.Time `json:"ts"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+}
+
+// handleGetDeliverability returns the bounce, complaint, and block rates of
+// transactional messages over time (see parseDashboardRange for the range
+// params) and broken down by messenger and recipient domain, along with
+// annotations of the time buckets where the rates crossed their thresholds.
+// The rates are only available with the transactional message log enabled.
+func handleGetDeliverability(c echo.Context) error {
+	var app = c.Get("app").(*App)
+
+	from, to, gran, err := parseDashboardRange(c, app)
+	if err != nil {
+		return err
+	}
+
+	var res []deliverability
+	if err := app.queries.GetDeliverability.Select(&res, from, to, gran); err != nil {
+		app.log.Printf("error fetching deliverability stats: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "deliverability stats", "error", pqErrMsg(err)))
+	}
+
+	out := struct {
+		Series      []deliverability           `json:"series"`
+		Messengers  []deliverability           `json:"messengers"`
+		Domains     []deliverability           `json:"domains"`
+		Thresholds  map[string]float64         `json:"thresholds"`
+		Annotations []deliverabilityAnnotation `json:"annotations"`
+	}{
+		Series:      []deliverability{},
+		Messengers:  []deliverability{},
+		Domains:     []deliverability{},
+		Thresholds:  deliverabilityThresholds,
+		Annotations: []deliverabilityAnnotation{},
+	}
+
+	for _, d := range res {
+		if d.Attempts > 0 {
+			d.BlockRate = pct(d.Failed, d.Attempts)
+		}
+		if d.Sent > 0 {
+			d.BounceRate = pct(d.Bounced, d.Sent)
+			d.ComplaintRate = pct(d.Complained, d.Sent)
+		}
+
+		switch d.Type {
+		case "series":
+			out.Series = append(out.Series, d)
+
+			for _, r := range []struct {
+				metric string
+				val    float64
+			}{{"bounce_rate", d.BounceRate}, {"complaint_rate", d.ComplaintRate}, {"block_rate", d.BlockRate}} {
+				if t := deliverabilityThresholds[r.metric]; r.val > t {
+					out.Annotations = append(out.Annotations, deliverabilityAnnotation{
+						TS: d.TS.Time, Metric: r.metric, Value: r.val, Threshold: t,
+					})
+				}
+			}
+		case "messenger":
+			out.Messengers = append(out.Messengers, d)
+		default:
+			if len(out.Domains) < deliverabilityMaxDomains {
+				out.Domains = append(out.Domains, d)
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// analyticsPruneResult is the number of pruned partitions, views and clicks.
+type analyticsPruneResult struct {
+	Partitions int `db:"-" json:"partitions"`
+	Views      int `db:"views" json:"views"`
+	Clicks     int `db:"clicks" json:"clicks"`
+}
+
+// handlePruneAnalytics deletes the campaign views and link clicks older than
+// ?days, which defaults to the analytics retention setting. Their daily
+// counts are retained.
+func handlePruneAnalytics(c echo.Context) error {
+	var (
+		app  = c.Get("app").(*App)
+		days = ko.Int("privacy.analytics_retention_days")
+	)
+
+	if v := c.QueryParam("days"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "days"))
+		}
+		days = d
+	}
+	if days < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "days"))
+	}
+
+	out, err := pruneAnalytics(days, app)
+	if err != nil {
+		app.log.Printf("error pruning analytics: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// pct returns n as a percentage of total rounded to two decimals.
+func pct(n, total int) float64 {
+	return math.Round(float64(n)*10000/float64(total)) / 100
+}
+
+// trackingTables are the tables of campaign views and link clicks that are
+// partitioned by month.
+var trackingTables = []string{"campaign_views", "link_clicks"}
+
+const (
+	// Number of months ahead of the current month that partitions of the
+	// tracking tables are created for.
+	trackingPartitionsAhead = 2
+
+	// Format of the month suffix of partition names, eg: campaign_views_2021_01.
+	partitionMonthFormat = "2006_01"
+)
+
+// maintainTrackingPartitions periodically creates the monthly partitions
+// of the tracking tables ahead of time.
+func maintainTrackingPartitions(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		createTrackingPartitions(app)
+		<-ticker.C
+	}
+}
+
+// createTrackingPartitions creates the partitions of the tracking tables
+// for the current month and the months ahead that don't exist.
+func createTrackingPartitions(app *App) {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	for _, t := range trackingTables {
+		for i := 0; i <= trackingPartitionsAhead; i++ {
+			if err := createMonthPartition(t, month.AddDate(0, i, 0), app); err != nil {
+				app.log.Printf("error creating partition of %s: %v", t, err)
+			}
+		}
+	}
+}
+
+// createMonthPartition creates the partition of a tracking table for the
+// month (UTC) starting at from if it doesn't exist.
+func createMonthPartition(table string, from time.Time, app *App) error {
+	name := table + "_" + from.Format(partitionMonthFormat)
+
+	var exists bool
+	if err := app.queries.PartitionExists.Get(&exists, name); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf(app.queries.CreatePartition,
+		pq.QuoteIdentifier(table), pq.QuoteIdentifier(name), pq.QuoteIdentifier(table+"_default"),
+		pq.QuoteLiteral(from.Format(time.RFC3339)),
+		pq.QuoteLiteral(from.AddDate(0, 1, 0).Format(time.RFC3339)))); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	app.log.Printf("created partition %s", name)
+	return nil
+}
+
+// pruneAnalytics deletes the campaign views and link clicks older than the
+// given number of days after adding them to the daily rollups that campaign
+// and dashboard counts retain. Whole monthly partitions are dropped and the
+// remaining rows deleted. It returns the number of dropped partitions and
+// deleted views and clicks.
+func pruneAnalytics(days int, app *App) (analyticsPruneResult, error) {
+	var (
+		out    analyticsPruneResult
+		before = time.Now().AddDate(0, 0, -days)
+	)
+
+	n, err := dropTrackingPartitions(before, app)
+	if err != nil {
+		return out, err
+	}
+	out.Partitions = n
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return out, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(app.queries.RollupTracking).Exec(time.Time{}, before); err != nil {
+		return out, err
+	}
+	if err := tx.Stmtx(app.queries.DeleteTracking).Get(&out, before); err != nil {
+		return out, err
+	}
+
+	return out, tx.Commit()
+}
+
+// dropTrackingPartitions rolls up and drops the monthly partitions of the
+// tracking tables whose months end before the given time, which is much
+// faster than deleting their rows. The number of dropped partitions is returned.
+func dropTrackingPartitions(before time.Time, app *App) (int, error) {
+	months := make(map[string]time.Time)
+	for _, t := range trackingTables {
+		var names []string
+		if err := app.queries.GetPartitions.Select(&names, t); err != nil {
+			return 0, err
+		}
+
+		for _, name := range names {
+			suffix := strings.TrimPrefix(name, t+"_")
+			month, err := time.Parse(partitionMonthFormat, suffix)
+			if err != nil {
+				// The default partition.
+				continue
+			}
+			if !month.AddDate(0, 1, 0).After(before) {
+				months[suffix] = month
+			}
+		}
+	}
+
+	n := 0
+	for suffix, month := range months {
+		tx, err := app.db.Beginx()
+		if err != nil {
+			return n, err
+		}
+
+		if _, err := tx.Stmtx(app.queries.RollupTracking).Exec(month, month.AddDate(0, 1, 0)); err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		for _, t := range trackingTables {
+			if _, err := tx.Exec(fmt.Sprintf(app.queries.DropPartition, pq.QuoteIdentifier(t+"_"+suffix))); err != nil {
+				tx.Rollback()
+				return n, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return n, err
+		}
+
+		app.log.Printf("dropped tracking partitions of %s", suffix)
+		n++
+	}
+
+	return n, nil
+}
+
+// pruneAnalyticsPeriodically prunes the views and clicks older than the
+// retention period at the given interval.
+func pruneAnalyticsPeriodically(days int, interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		res, err := pruneAnalytics(days, app)
+		if err != nil {
+			app.log.Printf("error pruning analytics: %v", err)
+			continue
+		}
+		if res.Partitions > 0 || res.Views > 0 || res.Clicks > 0 {
+			app.log.Printf("pruned analytics older than %d days: %d partitions, %d views, %d clicks",
+				days, res.Partitions, res.Views, res.Clicks)
+		}
+	}
+}
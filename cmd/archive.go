@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+const (
+	tplArchive = "archive"
+
+	archivePerPage    = 20
+	archiveMaxPerPage = 50
+
+	// UUID of the placeholder subscriber that archived campaigns are rendered for.
+	archiveSubUUID = "00000000-0000-0000-0000-000000000000"
+)
+
+// archivedCampaign is a campaign on the public archive. Only the fields
+// that are published on the archive are fetched.
+type archivedCampaign struct {
+	ID      int            `db:"id" json:"-"`
+	UUID    string         `db:"uuid" json:"uuid"`
+	Subject string         `db:"subject" json:"subject"`
+	Tags    pq.StringArray `db:"tags" json:"tags"`
+	SendAt  null.Time      `db:"send_at" json:"send_at"`
+	URL     string         `db:"-" json:"url"`
+
+	Total int `db:"total" json:"-"`
+}
+
+type archiveWrap struct {
+	Results []archivedCampaign `json:"results"`
+
+	Query   string   `json:"query"`
+	Tags    []string `json:"tags"`
+	Total   int      `json:"total"`
+	PerPage int      `json:"per_page"`
+	Page    int      `json:"page"`
+}
+
+// archiveTpl is the data that's passed to the archive page template.
+type archiveTpl struct {
+	publicTpl
+	archiveWrap
+
+	// All the tags of archived campaigns for filtering.
+	AllTags []string
+
+	TotalPages int
+	PrevURL    string
+	NextURL    string
+}
+
+// handleGetArchive renders the public archive page of campaigns that are
+// published on the archive.
+func handleGetArchive(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if !app.constants.EnablePublicArchive {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.invalidFeature")))
+	}
+
+	res, err := queryArchive(c.QueryParams(), app)
+	if err != nil {
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorFetchingCampaign")))
+	}
+
+	out := archiveTpl{archiveWrap: res}
+	out.Title = app.i18n.T("public.archiveTitle")
+	if err := app.queries.GetArchiveTags.Select(&out.AllTags); err != nil {
+		app.log.Printf("error fetching archive tags: %v", err)
+	}
+
+	// Pagination links that retain the query and tag filters.
+	if res.PerPage > 0 {
+		out.TotalPages = int(math.Ceil(float64(res.Total) / float64(res.PerPage)))
+	}
+	q := c.QueryParams()
+	if res.Page > 1 {
+		q.Set("page", strconv.Itoa(res.Page-1))
+		out.PrevURL = "?" + q.Encode()
+	}
+	if res.Page < out.TotalPages {
+		q.Set("page", strconv.Itoa(res.Page+1))
+		out.NextURL = "?" + q.Encode()
+	}
+
+	return c.Render(http.StatusOK, tplArchive, out)
+}
+
+// handleGetArchiveJSON returns the campaigns that are published on the
+// public archive as JSON.
+func handleGetArchiveJSON(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if !app.constants.EnablePublicArchive {
+		return echo.NewHTTPError(http.StatusNotFound, app.i18n.T("public.invalidFeature"))
+	}
+
+	out, err := queryArchive(c.QueryParams(), app)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaigns}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleViewArchivedCampaign renders a campaign that's published on the
+// public archive for a placeholder subscriber.
+func handleViewArchivedCampaign(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		campUUID = c.Param("campUUID")
+	)
+
+	if !app.constants.EnablePublicArchive {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.invalidFeature")))
+	}
+
+	var camp models.Campaign
+	if err := app.queries.GetCampaign.Get(&camp, 0, campUUID); err != nil && err != sql.ErrNoRows {
+		app.log.Printf("error fetching campaign: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorFetchingCampaign")))
+	}
+	if !camp.Archive || camp.Type != models.CampaignTypeRegular ||
+		(camp.Status != models.CampaignStatusRunning && camp.Status != models.CampaignStatusFinished) {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl(app.i18n.T("public.notFoundTitle"), "",
+				app.i18n.T("public.campaignNotFound")))
+	}
+
+	if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
+		app.log.Printf("error compiling template: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorFetchingCampaign")))
+	}
+
+	msg, err := app.manager.NewCampaignMessage(&camp, models.Subscriber{
+		UUID:    archiveSubUUID,
+		Attribs: models.SubscriberAttribs{},
+	})
+	if err != nil {
+		app.log.Printf("error rendering message: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("public.errorFetchingCampaign")))
+	}
+
+	return c.HTML(http.StatusOK, string(msg.Body()))
+}
+
+// handleUpdateCampaignArchive publishes a campaign on the public archive or
+// removes it from it. Unlike other fields, this can be changed after a
+// campaign is sent.
+func handleUpdateCampaignArchive(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Archive bool `json:"archive"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateCampaignArchive.Exec(id, req.Archive)
+	if err != nil {
+		app.log.Printf("error updating campaign archive: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return handleGetCampaigns(c)
+}
+
+// queryArchive queries the campaigns on the public archive with the search
+// query (?query=), tags (?tag=) and pagination params of a request.
+func queryArchive(q url.Values, app *App) (archiveWrap, error) {
+	var (
+		pg    = getPagination(q, archivePerPage)
+		query = strings.TrimSpace(q.Get("query"))
+		tags  = normalizeTags(q["tag"])
+	)
+	if pg.PerPage < 1 || pg.PerPage > archiveMaxPerPage {
+		pg.PerPage, pg.Limit = archivePerPage, archivePerPage
+		pg.Offset = (pg.Page - 1) * archivePerPage
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+
+	out := archiveWrap{Query: query, Tags: tags, PerPage: pg.PerPage, Page: pg.Page}
+	if err := app.queries.QueryArchivedCampaigns.Select(&out.Results, query,
+		pq.StringArray(tags), pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error querying archive: %v", err)
+		return out, err
+	}
+
+	if len(out.Results) > 0 {
+		out.Total = out.Results[0].Total
+	} else {
+		out.Results = []archivedCampaign{}
+	}
+	for i, c := range out.Results {
+		out.Results[i].URL = app.constants.RootURL + "/archive/" + c.UUID
+	}
+
+	return out, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+// auditMaxBody is the max size of a request body that's recorded in
+// the audit log. Larger bodies are recorded without their contents.
+const auditMaxBody = 64 * 1024
+
+// auditRedactKeys are the (sub)strings of the JSON keys in request bodies
+// whose values aren't recorded in the audit log.
+var auditRedactKeys = []string{"password", "secret", "token", "private_key", "api_key"}
+
+type auditLogWrap struct {
+	Results []models.AuditLog `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// auditLogQuery represents the filters for querying the audit log.
+type auditLogQuery struct {
+	Username   string
+	Resource   string
+	ResourceID string
+	Method     string
+	From       interface{}
+	To         interface{}
+}
+
+// auditData is the request data recorded with an audit log entry.
+type auditData struct {
+	Query map[string][]string `json:"query,omitempty"`
+	Body  interface{}         `json:"body,omitempty"`
+}
+
+// handleGetAuditLog returns the audit log, newest first.
+func handleGetAuditLog(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams(), 50)
+		out auditLogWrap
+	)
+
+	q, err := getAuditLogQuery(c, app)
+	if err != nil {
+		return err
+	}
+
+	if err := app.queries.QueryAuditLog.Select(&out.Results, q.Username, q.Resource, q.ResourceID,
+		q.Method, q.From, q.To, 0, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching audit log: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{audit.log}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.AuditLog{}
+	} else {
+		out.Total = out.Results[0].Total
+	}
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleExportAuditLog streams the (filtered) audit log as CSV or
+// newline delimited JSON (?format=ndjson).
+func handleExportAuditLog(c echo.Context) error {
+	var app = c.Get("app").(*App)
+
+	q, err := getAuditLogQuery(c, app)
+	if err != nil {
+		return err
+	}
+
+	format := c.QueryParam("format")
+	switch format {
+	case "", "csv":
+		format = "csv"
+	case "ndjson":
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "format"))
+	}
+
+	var (
+		h  = c.Response().Header()
+		wr = csv.NewWriter(c.Response())
+		js = json.NewEncoder(c.Response())
+	)
+
+	h.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	if format == "csv" {
+		h.Set("Content-type", "text/csv")
+	} else {
+		h.Set("Content-type", "application/x-ndjson")
+	}
+	h.Set(echo.HeaderContentDisposition, "attachment; filename="+"audit-log."+format)
+	h.Set("Content-Transfer-Encoding", "binary")
+	h.Set("Cache-Control", "no-cache")
+	if format == "csv" {
+		wr.Write([]string{"id", "username", "method", "path", "resource", "resource_id",
+			"data", "ip", "created_at"})
+	}
+
+	// Page through the entries with the ID cursor until they're exhausted.
+	var lastID int64
+loop:
+	for {
+		var out []models.AuditLog
+		if err := app.queries.QueryAuditLog.Select(&out, q.Username, q.Resource, q.ResourceID,
+			q.Method, q.From, q.To, lastID, 0, app.constants.DBBatchSize); err != nil {
+			app.log.Printf("error fetching audit log: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{audit.log}", "error", pqErrMsg(err)))
+		}
+		if len(out) == 0 {
+			break loop
+		}
+
+		for _, r := range out {
+			if format == "ndjson" {
+				if err := js.Encode(r); err != nil {
+					app.log.Printf("error streaming NDJSON export: %v", err)
+					break loop
+				}
+				continue
+			}
+
+			if err := wr.Write([]string{strconv.FormatInt(r.ID, 10), r.Username, r.Method, r.Path,
+				r.Resource, r.ResourceID, string(r.Data), r.IP, r.CreatedAt.Time.String()}); err != nil {
+				app.log.Printf("error streaming CSV export: %v", err)
+				break loop
+			}
+		}
+		wr.Flush()
+
+		lastID = out[len(out)-1].ID
+	}
+
+	return nil
+}
+
+// auditRequest is a middleware that records the successful admin requests
+// that change data in the audit log along with the user that made them.
+// Handlers can replace the recorded request body with setAuditData(), eg:
+// to record a summary of a large or sensitive body.
+func auditRequest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if isReadRequest(req.Method, c.Path()) {
+			return next(c)
+		}
+
+		// Read the JSON body and restore it for the handler.
+		var body []byte
+		if strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) &&
+			req.Body != nil {
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(b))
+			body = b
+		}
+
+		if err := next(c); err != nil {
+			return err
+		}
+		if c.Response().Status >= http.StatusBadRequest {
+			return nil
+		}
+
+		var (
+			app = c.Get("app").(*App)
+			d   = auditData{Query: c.QueryParams()}
+		)
+		if v := c.Get("audit"); v != nil {
+			d.Body = v
+		} else if len(body) > 0 && len(body) <= auditMaxBody {
+			var v interface{}
+			if err := json.Unmarshal(body, &v); err == nil {
+				d.Body = redactAuditData(v)
+			}
+		}
+
+		b, err := json.Marshal(d)
+		if err != nil {
+			app.log.Printf("error encoding audit log data: %v", err)
+			b = []byte("{}")
+		}
+
+		if _, err := app.queries.InsertAuditLog.Exec(getUser(c).Username, req.Method, c.Path(),
+			getPathResource(c.Path()), c.Param("id"), b, clientIP(c, app)); err != nil {
+			app.log.Printf("error recording audit log: %v", err)
+		}
+
+		return nil
+	}
+}
+
+// auditLogin records a user's login on the login page or with single
+// sign-on in the audit log.
+func auditLogin(c echo.Context, u models.User, app *App) {
+	var id string
+	if u.ID > 0 {
+		id = strconv.Itoa(u.ID)
+	}
+
+	if _, err := app.queries.InsertAuditLog.Exec(u.Username, c.Request().Method, c.Path(),
+		"login", id, []byte("{}"), clientIP(c, app)); err != nil {
+		app.log.Printf("error recording audit log: %v", err)
+	}
+}
+
+// setAuditData sets the data recorded in the audit log for a request in
+// place of its body.
+func setAuditData(c echo.Context, v interface{}) {
+	c.Set("audit", v)
+}
+
+// redactAuditData recursively blanks the values of sensitive keys in
+// a decoded JSON body.
+func redactAuditData(v interface{}) interface{} {
+	switch o := v.(type) {
+	case map[string]interface{}:
+		for k, val := range o {
+			if isAuditRedactKey(k) {
+				if val != "" {
+					o[k] = "********"
+				}
+				continue
+			}
+			o[k] = redactAuditData(val)
+		}
+	case []interface{}:
+		for i, val := range o {
+			o[i] = redactAuditData(val)
+		}
+	}
+	return v
+}
+
+// isAuditRedactKey checks whether a JSON key holds a sensitive value.
+func isAuditRedactKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range auditRedactKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAuditLogQuery returns the audit log filters from a request's params.
+func getAuditLogQuery(c echo.Context, app *App) (auditLogQuery, error) {
+	var (
+		q = auditLogQuery{
+			Username:   strings.TrimSpace(c.QueryParam("username")),
+			Resource:   strings.TrimSpace(c.QueryParam("resource")),
+			ResourceID: strings.TrimSpace(c.QueryParam("resource_id")),
+			Method:     strings.ToUpper(c.QueryParam("method")),
+		}
+		err error
+	)
+
+	if q.From, err = parseDateFilter(c.QueryParam("from")); err != nil {
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+	if q.To, err = parseDateFilter(c.QueryParam("to")); err != nil {
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	return q, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/knadh/listmonk/internal/media/providers/s3"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05"
+
+// backupRunning is set while a backup is being created.
+var backupRunning int32
+
+var errBackupRunning = errors.New("a backup is already running")
+
+// handleCreateBackup starts a backup to the backup directory or S3 bucket
+// in the background and returns the name of the archive.
+func handleCreateBackup(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	name := makeBackupName()
+	if !atomic.CompareAndSwapInt32(&backupRunning, 0, 1) {
+		return echo.NewHTTPError(http.StatusConflict, app.i18n.T("globals.messages.backupRunning"))
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&backupRunning, 0)
+		if err := saveBackup(name, app); err != nil {
+			app.log.Printf("error creating backup %s: %v", name, err)
+			return
+		}
+		app.log.Printf("created backup %s", name)
+	}()
+
+	return c.JSON(http.StatusAccepted, okResp{struct {
+		Name string `json:"name"`
+	}{name}})
+}
+
+// createBackup creates a backup for the --backup flag and the scheduled
+// backups and returns the name of the archive.
+func createBackup(app *App) (string, error) {
+	if !atomic.CompareAndSwapInt32(&backupRunning, 0, 1) {
+		return "", errBackupRunning
+	}
+	defer atomic.StoreInt32(&backupRunning, 0)
+
+	name := makeBackupName()
+	return name, saveBackup(name, app)
+}
+
+// createBackupsPeriodically creates backups at the given interval.
+func createBackupsPeriodically(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		name, err := createBackup(app)
+		if err != nil {
+			app.log.Printf("error creating backup: %v", err)
+			continue
+		}
+		app.log.Printf("created backup %s", name)
+	}
+}
+
+func makeBackupName() string {
+	return "listmonk-" + time.Now().UTC().Format(backupTimeFormat) + ".tar.gz"
+}
+
+// saveBackup writes a backup archive to the backup directory, or uploads it
+// to the S3 bucket if one is configured.
+func saveBackup(name string, app *App) error {
+	if ko.Exists("backup.s3") {
+		var o s3.Opts
+		if err := ko.Unmarshal("backup.s3", &o); err != nil {
+			return err
+		}
+		store, err := s3.NewS3Store(o)
+		if err != nil {
+			return err
+		}
+
+		// The archive is uploaded from a temp file as the upload has to be seekable.
+		f, err := ioutil.TempFile("", "listmonk-backup-*.tar.gz")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		if err := writeBackup(f, app); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = store.Put(name, "application/gzip", f)
+		return err
+	}
+
+	dir := ko.String("backup.path")
+	if dir == "" {
+		dir = "backups"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := writeBackup(f, app); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// writeBackup writes a .tar.gz archive with a dump of the DB (db.sql), the
+// settings with secrets (settings.json) and the media files (media/) to w.
+// The dump is a consistent snapshot of the DB. It can be restored with psql
+// into an empty database.
+func writeBackup(w io.Writer, app *App) error {
+	var (
+		gz = gzip.NewWriter(w)
+		tw = tar.NewWriter(gz)
+	)
+
+	// Dump the DB to a temp file as the size of archive entries has to be
+	// known before they're written.
+	f, err := ioutil.TempFile("", "listmonk-*.sql")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := dumpDB(f); err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := addBackupFile(tw, "db.sql", st.Size(), f); err != nil {
+		return err
+	}
+
+	// Settings.
+	s, err := getSettings(app)
+	if err != nil {
+		return fmt.Errorf("%v", err.(*echo.HTTPError).Message)
+	}
+	b, err := exportSettings(s, "json")
+	if err != nil {
+		return err
+	}
+	if err := addBackupFile(tw, "settings.json", int64(len(b)), bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	// Media files along with their thumbnails and resized variants.
+	var files []media.Media
+	if err := app.queries.QueryMedia.Select(&files, app.constants.MediaProvider, "", 0,
+		pq.StringArray{}, nil, nil, 0, 0); err != nil {
+		return err
+	}
+	for _, m := range files {
+		names := []string{m.Filename, thumbPrefix + m.Filename}
+		for _, v := range getMediaVariants(m) {
+			names = append(names, v)
+		}
+
+		for i, n := range names {
+			b, err := app.media.GetBlob(n)
+			if err != nil {
+				// Only images have thumbnails and variants.
+				if i == 0 {
+					app.log.Printf("error reading media file %s for backup: %v", n, err)
+				}
+				continue
+			}
+			if err := addBackupFile(tw, "media/"+n, int64(len(b)), bytes.NewReader(b)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// dumpDB writes a plain SQL dump of the DB with pg_dump to w.
+func dumpDB(w io.Writer) error {
+	bin := ko.String("backup.pg_dump")
+	if bin == "" {
+		bin = "pg_dump"
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(bin, "--no-owner", "--no-acl", "--format=plain")
+	cmd.Env = append(os.Environ(),
+		"PGHOST="+ko.String("db.host"),
+		"PGPORT="+strconv.Itoa(ko.Int("db.port")),
+		"PGUSER="+ko.String("db.user"),
+		"PGPASSWORD="+ko.String("db.password"),
+		"PGDATABASE="+ko.String("db.database"),
+		"PGSSLMODE="+ko.String("db.ssl_mode"))
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running pg_dump: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// addBackupFile adds a file to a backup archive.
+func addBackupFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(tw, r)
+	return err
+}
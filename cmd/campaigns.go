@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -12,8 +13,10 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
@@ -57,6 +60,15 @@ type campaignStats struct {
 	Started   null.Time `db:"started_at" json:"started_at"`
 	UpdatedAt null.Time `db:"updated_at" json:"updated_at"`
 	Rate      float64   `json:"rate"`
+
+	// Live send rate (messages a second) over the last minute.
+	EffectiveRate float64 `json:"effective_rate"`
+}
+
+// campStreamEvent is an event of the running campaign stats stream.
+type campStreamEvent struct {
+	Campaigns  []campaignStats                   `json:"campaigns"`
+	Messengers map[string]manager.MessengerStats `json:"messengers"`
 }
 
 type campsWrap struct {
@@ -68,6 +80,9 @@ type campsWrap struct {
 	Page    int    `json:"page"`
 }
 
+// Interval at which running campaign stats are streamed.
+const campStreamInterval = time.Second
+
 var (
 	regexFromAddress   = regexp.MustCompile(`(.+?)\s<(.+?)@(.+?)>`)
 	regexFullTextQuery = regexp.MustCompile(`\s+`)
@@ -82,12 +97,13 @@ func handleGetCampaigns(c echo.Context) error {
 		pg  = getPagination(c.QueryParams(), 20)
 		out campsWrap
 
-		id, _     = strconv.Atoi(c.Param("id"))
-		status    = c.QueryParams()["status"]
-		query     = strings.TrimSpace(c.FormValue("query"))
-		orderBy   = c.FormValue("order_by")
-		order     = c.FormValue("order")
-		noBody, _ = strconv.ParseBool(c.QueryParam("no_body"))
+		id, _       = strconv.Atoi(c.Param("id"))
+		status      = c.QueryParams()["status"]
+		query       = strings.TrimSpace(c.FormValue("query"))
+		orderBy     = c.FormValue("order_by")
+		order       = c.FormValue("order")
+		noBody, _   = strconv.ParseBool(c.QueryParam("no_body"))
+		folderID, _ = strconv.Atoi(c.FormValue("folder_id"))
 	)
 
 	// Fetch one list.
@@ -108,10 +124,17 @@ func handleGetCampaigns(c echo.Context) error {
 		order = sortDesc
 	}
 
+	// Limit the campaigns to the lists in a particular folder?
+	folderListIDs, err := getFolderListIDs(folderID, app)
+	if err != nil {
+		return err
+	}
+
 	stmt := fmt.Sprintf(app.queries.QueryCampaigns, orderBy, order)
 
 	// Unsafe to ignore scanning fields not present in models.Campaigns.
-	if err := db.Select(&out.Results, stmt, id, pq.StringArray(status), query, pg.Offset, pg.Limit); err != nil {
+	if err := db.Select(&out.Results, stmt, id, pq.StringArray(status), query,
+		pg.Offset, pg.Limit, folderListIDs); err != nil {
 		app.log.Printf("error fetching campaigns: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -188,6 +211,11 @@ func handlePreviewCampaign(c echo.Context) error {
 		camp.Body = c.FormValue("body")
 	}
 
+	sub, err := getPreviewSubscriber(c, app)
+	if err != nil {
+		return err
+	}
+
 	// Use a dummy campaign ID to prevent views and clicks from {{ TrackView }}
 	// and {{ TrackLink }} being registered on preview.
 	camp.UUID = dummySubscriber.UUID
@@ -198,7 +226,7 @@ func handlePreviewCampaign(c echo.Context) error {
 	}
 
 	// Render the message body.
-	msg, err := app.manager.NewCampaignMessage(&camp, dummySubscriber)
+	msg, err := app.manager.NewCampaignMessage(&camp, sub)
 	if err != nil {
 		app.log.Printf("error rendering message: %v", err)
 		return echo.NewHTTPError(http.StatusBadRequest,
@@ -208,6 +236,30 @@ func handlePreviewCampaign(c echo.Context) error {
 	return c.HTML(http.StatusOK, string(msg.Body()))
 }
 
+// getPreviewSubscriber returns the subscriber to render previews with. It's either
+// an existing subscriber (?subscriber_id=), an inline subscriber JSON object
+// (?subscriber=), or the dummy subscriber if neither is given.
+func getPreviewSubscriber(c echo.Context, app *App) (models.Subscriber, error) {
+	if id, _ := strconv.Atoi(c.FormValue("subscriber_id")); id > 0 {
+		return getSubscriber(id, "", "", app)
+	}
+
+	s := c.FormValue("subscriber")
+	if s == "" {
+		return dummySubscriber, nil
+	}
+
+	sub := dummySubscriber
+	if err := json.Unmarshal([]byte(s), &sub); err != nil {
+		return sub, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("campaigns.invalidPreviewSubscriber", "error", err.Error()))
+	}
+
+	// The UUID goes into URLs such as {{ UnsubscribeURL }} and isn't overridable.
+	sub.UUID = dummySubscriber.UUID
+	return sub, nil
+}
+
 // handleCampaignContent handles campaign content (body) format conversions.
 func handleCampaignContent(c echo.Context) error {
 	var (
@@ -283,6 +335,11 @@ func handleCreateCampaign(c echo.Context) error {
 		o.Messenger,
 		o.TemplateID,
 		o.ListIDs,
+		o.ReplyTo,
+		o.Archive,
+		o.UnsubHeader,
+		o.UnsubHeaderVal,
+		o.Lang,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.noSubs"))
@@ -356,7 +413,12 @@ func handleUpdateCampaign(c echo.Context) error {
 		pq.StringArray(normalizeTags(o.Tags)),
 		o.Messenger,
 		o.TemplateID,
-		o.ListIDs)
+		o.ListIDs,
+		o.ReplyTo,
+		o.Archive,
+		o.UnsubHeader,
+		o.UnsubHeaderVal,
+		o.Lang)
 	if err != nil {
 		app.log.Printf("error updating campaign: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -486,22 +548,82 @@ func handleDeleteCampaign(c echo.Context) error {
 
 // handleGetRunningCampaignStats returns stats of a given set of campaign IDs.
 func handleGetRunningCampaignStats(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := getRunningCampaignStats(app)
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleStreamRunningCampaignStats streams the stats of running campaigns
+// and the messengers as server-sent events every campStreamInterval until
+// the client disconnects.
+func handleStreamRunningCampaignStats(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
-		out []campaignStats
+		ctx = c.Request().Context()
 	)
 
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+
+	// Disable proxy buffering (nginx) so that events aren't held back.
+	h.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(http.StatusOK)
+
+	t := time.NewTicker(campStreamInterval)
+	defer t.Stop()
+
+	for {
+		camps, err := getRunningCampaignStats(app)
+		if err != nil {
+			return nil
+		}
+		if camps == nil {
+			camps = []campaignStats{}
+		}
+
+		b, err := json.Marshal(campStreamEvent{
+			Campaigns:  camps,
+			Messengers: app.manager.Stats().Messengers,
+		})
+		if err != nil {
+			app.log.Printf("error marshalling campaign stats event: %v", err)
+			return nil
+		}
+		if _, err := fmt.Fprintf(c.Response(), "event: stats\ndata: %s\n\n", b); err != nil {
+			return nil
+		}
+		c.Response().Flush()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// getRunningCampaignStats returns the stats of running campaigns.
+func getRunningCampaignStats(app *App) ([]campaignStats, error) {
+	var out []campaignStats
 	if err := app.queries.GetCampaignStatus.Select(&out, models.CampaignStatusRunning); err != nil {
 		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+			return nil, nil
 		}
 
 		app.log.Printf("error fetching campaign stats: %v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError,
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
-	} else if len(out) == 0 {
-		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
 	}
 
 	// Compute rate.
@@ -519,9 +641,10 @@ func handleGetRunningCampaignStats(c echo.Context) error {
 				out[i].Rate = rate
 			}
 		}
+		out[i].EffectiveRate = app.manager.CampaignRate(c.ID)
 	}
 
-	return c.JSON(http.StatusOK, okResp{out})
+	return out, nil
 }
 
 // handleTestCampaign handles the sending of a campaign message to
@@ -585,6 +708,10 @@ func handleTestCampaign(c echo.Context) error {
 	camp.Name = req.Name
 	camp.Subject = req.Subject
 	camp.FromEmail = req.FromEmail
+	camp.ReplyTo = req.ReplyTo
+	camp.UnsubHeader = req.UnsubHeader
+	camp.UnsubHeaderVal = req.UnsubHeaderVal
+	camp.Lang = req.Lang
 	camp.Body = req.Body
 	camp.AltBody = req.AltBody
 	camp.Messenger = req.Messenger
@@ -625,12 +752,41 @@ func sendTestMessage(sub models.Subscriber, camp *models.Campaign, app *App) err
 
 // validateCampaignFields validates incoming campaign field values.
 func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
+	// Default to the sender, reply-to and List-Unsubscribe header of the
+	// campaign's lists, if any.
+	if (c.FromEmail == "" || c.ReplyTo == "" || c.UnsubHeader == "") && len(c.ListIDs) > 0 {
+		var l models.List
+		if err := app.queries.GetListSender.Get(&l, c.ListIDs); err != nil {
+			app.log.Printf("error fetching list sender: %v", err)
+			return c, errors.New(app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.list}", "error", pqErrMsg(err)))
+		}
+		if c.FromEmail == "" {
+			c.FromEmail = l.FromEmail
+		}
+		if c.ReplyTo == "" {
+			c.ReplyTo = l.ReplyTo
+		}
+		if c.UnsubHeader == "" {
+			c.UnsubHeader, c.UnsubHeaderVal = l.UnsubHeader, l.UnsubHeaderVal
+		}
+	}
+
 	if c.FromEmail == "" {
 		c.FromEmail = app.constants.FromEmail
-	} else if !regexFromAddress.Match([]byte(c.FromEmail)) {
-		if !subimporter.IsEmail(c.FromEmail) {
-			return c, errors.New(app.i18n.T("campaigns.fieldInvalidFromEmail"))
-		}
+	} else if !isFromAddress(c.FromEmail) {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidFromEmail"))
+	}
+	if c.ReplyTo != "" && !isFromAddress(c.ReplyTo) {
+		return c, errors.New(app.i18n.T("campaigns.fieldInvalidReplyTo"))
+	}
+	if v, err := validateUnsubHeader(c.UnsubHeader, c.UnsubHeaderVal, app); err != nil {
+		return c, err
+	} else {
+		c.UnsubHeaderVal = v
+	}
+	if c.Lang != "" && !isLangAvailable(c.Lang, app) {
+		return c, errors.New(app.i18n.T("campaigns.invalidLang"))
 	}
 
 	if !strHasLen(c.Name, 1, stdInputMaxLen) {
@@ -644,6 +800,17 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 	// 	return c,errors.New("invalid length for `body`")
 	// }
 
+	switch c.ContentType {
+	case models.CampaignContentTypeVisual:
+		if _, err := models.ParseBlocks(c.Body); err != nil {
+			return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidBody", "error", err.Error()))
+		}
+	case models.CampaignContentTypeSMS:
+		if n := utf8.RuneCountInString(c.Body); n < 1 || n > smsMaxLen {
+			return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidSMSBody", "max", strconv.Itoa(smsMaxLen)))
+		}
+	}
+
 	// If there's a "send_at" date, it should be in the future.
 	if c.SendAt.Valid {
 		if c.SendAt.Time.Before(time.Now()) {
@@ -667,6 +834,36 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 	return c, nil
 }
 
+// isFromAddress checks if the given string is an e-mail or
+// an e-mail with a name, eg: `Name <email@domain.com>`.
+func isFromAddress(s string) bool {
+	return regexFromAddress.MatchString(s) || subimporter.IsEmail(s)
+}
+
+// validateUnsubHeader validates the List-Unsubscribe header mode of a list or
+// campaign and returns its value, which is the mailto address for the mailto
+// modes and the header value for the custom mode, and is discarded otherwise.
+func validateUnsubHeader(mode, val string, app *App) (string, error) {
+	val = strings.TrimSpace(val)
+
+	switch mode {
+	case models.UnsubHeaderDefault, models.UnsubHeaderURL, models.UnsubHeaderNone:
+		return "", nil
+	case models.UnsubHeaderMailto, models.UnsubHeaderBoth:
+		if !subimporter.IsEmail(val) {
+			return "", errors.New(app.i18n.T("lists.invalidUnsubMailto"))
+		}
+	case models.UnsubHeaderCustom:
+		if !strHasLen(val, 1, 1000) || strings.ContainsAny(val, "\r\n") {
+			return "", errors.New(app.i18n.T("lists.invalidUnsubHeader"))
+		}
+	default:
+		return "", errors.New(app.i18n.T("lists.invalidUnsubHeader"))
+	}
+
+	return val, nil
+}
+
 // isCampaignalMutable tells if a campaign's in a state where it's
 // properties can be mutated.
 func isCampaignalMutable(status string) bool {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/captcha"
+	"github.com/labstack/echo"
+)
+
+// formGuardTpl is the anti-spam data that's rendered into public
+// subscription forms: the CAPTCHA widget and the signed time at which
+// the form was loaded.
+type formGuardTpl struct {
+	CaptchaClass   string
+	CaptchaScript  string
+	CaptchaSiteKey string
+	LoadedAt       string
+}
+
+// makeFormGuard returns the anti-spam data for a public form. Embeddable
+// snippets that are rendered once carry the time at which they were
+// generated.
+func makeFormGuard(app *App) formGuardTpl {
+	var out formGuardTpl
+	if app.captcha != nil {
+		out.CaptchaClass = app.captcha.Class()
+		out.CaptchaScript = app.captcha.Script()
+		out.CaptchaSiteKey = app.captcha.SiteKey()
+	}
+	if app.constants.Security.FormMinSubmitTime > 0 {
+		out.LoadedAt = signFormTime(time.Now().Unix(), app.constants.Security.FormKey)
+	}
+	return out
+}
+
+// checkFormGuard checks a public form submission for the signs of a bot:
+// a filled honeypot (nonce) field, a form that's submitted faster than
+// a human can fill it, and a missing or invalid CAPTCHA response. The
+// CAPTCHA response is read from the provider's form field or from
+// captchaToken for JSON requests. The submit time is only checked for
+// form posts (isForm) as JSON requests don't come from rendered forms.
+// The returned error is a message for the user.
+func checkFormGuard(c echo.Context, captchaToken string, isForm bool, app *App) error {
+	if c.FormValue("nonce") != "" {
+		return errors.New(app.i18n.T("public.invalidFeature"))
+	}
+
+	// Rendered forms carry their signed load time. A missing or invalid
+	// one is a form that wasn't rendered by listmonk.
+	if minTime := app.constants.Security.FormMinSubmitTime; minTime > 0 && isForm {
+		t, ok := verifyFormTime(c.FormValue("loaded_at"), app.constants.Security.FormKey)
+		if !ok || time.Since(time.Unix(t, 0)) < time.Duration(minTime)*time.Second {
+			return errors.New(app.i18n.T("public.formTooFast"))
+		}
+	}
+
+	if app.captcha == nil {
+		return nil
+	}
+	if captchaToken == "" {
+		captchaToken = c.FormValue(app.captcha.Field())
+	}
+	if err := app.captcha.Verify(captchaToken, c.RealIP()); err != nil {
+		if err != captcha.ErrFailed {
+			app.log.Printf("error verifying CAPTCHA: %v", err)
+		}
+		return errors.New(app.i18n.T("public.captchaFailed"))
+	}
+
+	return nil
+}
+
+// signFormTime returns a form's load time (unix seconds) with its HMAC
+// so that it can't be forged.
+func signFormTime(t int64, key string) string {
+	ts := strconv.FormatInt(t, 10)
+	return ts + "." + formTimeMAC(ts, key)
+}
+
+// verifyFormTime verifies a signed form load time and returns it.
+func verifyFormTime(v, key string) (int64, bool) {
+	parts := strings.SplitN(v, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(formTimeMAC(parts[0], key))) {
+		return 0, false
+	}
+
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return t, true
+}
+
+func formTimeMAC(ts, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(ts))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
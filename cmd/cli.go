@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// runAdminCommand runs the administrative command given on the command line,
+// if there's one, so that installations can be administered from scripts
+// without the HTTP API. It returns false if there's no command to run.
+func runAdminCommand(app *App) (bool, error) {
+	switch {
+	case ko.String("set-admin") != "":
+		return true, setAdminUser(ko.String("set-admin"), app)
+	case ko.String("import-subscribers") != "":
+		return true, importSubscribersFile(ko.String("import-subscribers"), app)
+	case ko.Int("start-campaign") > 0:
+		return true, startCampaign(ko.Int("start-campaign"), app)
+	case ko.Bool("maintenance"):
+		return true, runMaintenance(app)
+	}
+
+	return false, nil
+}
+
+// setAdminUser creates an admin user or resets the password of an existing
+// user, who's made an enabled admin with 2FA turned off. The password is
+// read from stdin if it's piped, or else a random one is generated and printed.
+func setAdminUser(username string, app *App) error {
+	if !strHasLen(username, 1, stdInputMaxLen) {
+		return errors.New("invalid username")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	generated := password == ""
+	if generated {
+		if password, err = generateRandomString(16); err != nil {
+			return err
+		}
+	} else if !strHasLen(password, userPasswordMinLen, stdInputMaxLen) {
+		return fmt.Errorf("the password should be %d to %d characters", userPasswordMinLen, stdInputMaxLen)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, err := app.queries.UpsertAdminUser.Exec(username, string(hash)); err != nil {
+		return err
+	}
+
+	if generated {
+		fmt.Printf("password: %s\n", password)
+	}
+	lo.Printf("set admin user %s", username)
+	return nil
+}
+
+// readPassword reads a password from the first line of stdin if it isn't
+// a terminal.
+func readPassword() (string, error) {
+	st, err := os.Stdin.Stat()
+	if err != nil {
+		return "", err
+	}
+	if st.Mode()&os.ModeCharDevice != 0 {
+		return "", nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", nil
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// importSubscribersFile imports subscribers from a CSV file into the lists
+// given with --lists and waits for the import to finish.
+func importSubscribersFile(path string, app *App) error {
+	opt := subimporter.SessionOpt{
+		Filename:  filepath.Base(path),
+		Mode:      ko.String("import-mode"),
+		Overwrite: ko.Bool("overwrite"),
+		Delim:     ",",
+		ListIDs:   ko.Ints("lists"),
+	}
+
+	switch opt.Mode {
+	case subimporter.ModeSubscribe:
+		opt.SubStatus = models.SubscriptionStatusUnconfirmed
+	case subimporter.ModeBlocklist:
+		opt.SubStatus = models.SubscriptionStatusUnsubscribed
+	default:
+		return fmt.Errorf("invalid import mode: %s", opt.Mode)
+	}
+
+	// Import notifications aren't e-mailed from the CLI.
+	im := subimporter.New(subimporter.Options{
+		UpsertStmt:         app.queries.UpsertSubscriber.Stmt,
+		BlocklistStmt:      app.queries.UpsertBlocklistSubscriber.Stmt,
+		UpdateListDateStmt: app.queries.UpdateListsDate.Stmt,
+		NotifCB: func(subject string, data interface{}) error {
+			return nil
+		},
+	}, app.db.DB)
+
+	sess, err := im.NewSession(opt)
+	if err != nil {
+		return err
+	}
+	go sess.Start()
+
+	if err := sess.LoadCSV(path, rune(opt.Delim[0])); err != nil {
+		return err
+	}
+
+	// Wait for the queued subscribers to be committed.
+	for im.GetStats().Status == subimporter.StatusImporting {
+		time.Sleep(time.Millisecond * 500)
+	}
+
+	os.Stderr.Write(im.GetLogs())
+	st := im.GetStats()
+	if st.Status != subimporter.StatusFinished {
+		return fmt.Errorf("import %s", st.Status)
+	}
+
+	lo.Printf("imported %d of %d subscribers from %s", st.Imported, st.Total, path)
+	return nil
+}
+
+// startCampaign starts a draft or paused campaign. It's picked up and sent
+// by the campaign manager of the running instances.
+func startCampaign(id int, app *App) error {
+	var c models.Campaign
+	if err := app.queries.GetCampaign.Get(&c, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("campaign %d not found", id)
+		}
+		return err
+	}
+
+	if c.Status != models.CampaignStatusPaused && c.Status != models.CampaignStatusDraft {
+		return fmt.Errorf("only paused and draft campaigns can be started. campaign %d is %s", id, c.Status)
+	}
+
+	if _, err := app.queries.UpdateCampaignStatus.Exec(c.ID, models.CampaignStatusRunning); err != nil {
+		return err
+	}
+
+	lo.Printf("started campaign %d (%s)", c.ID, c.Name)
+	return nil
+}
+
+// runMaintenance runs the periodic maintenance jobs once: it creates the
+// partitions of the tracking tables, prunes the analytics and the
+// transactional message log as per their retention settings and vacuums
+// the DB.
+func runMaintenance(app *App) error {
+	createTrackingPartitions(app)
+
+	if days := ko.Int("privacy.analytics_retention_days"); days > 0 {
+		res, err := pruneAnalytics(days, app)
+		if err != nil {
+			return fmt.Errorf("error pruning analytics: %v", err)
+		}
+		lo.Printf("pruned analytics older than %d days: %d partitions, %d views, %d clicks",
+			days, res.Partitions, res.Views, res.Clicks)
+	}
+
+	if days := ko.Int("app.tx_log_retention_days"); days > 0 {
+		res, err := app.queries.DeleteTxLog.Exec(days)
+		if err != nil {
+			return fmt.Errorf("error pruning tx log: %v", err)
+		}
+		n, _ := res.RowsAffected()
+		lo.Printf("pruned %d tx log entries older than %d days", n, days)
+	}
+
+	if _, err := app.queries.DeleteTxCallbacks.Exec(txCallbackRetentionDays); err != nil {
+		return fmt.Errorf("error pruning tx callbacks: %v", err)
+	}
+
+	lo.Println("vacuuming the database")
+	if _, err := app.db.Exec(app.queries.VacuumDB); err != nil {
+		return fmt.Errorf("error vacuuming the database: %v", err)
+	}
+
+	lo.Println("maintenance finished")
+	return nil
+}
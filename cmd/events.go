@@ -0,0 +1,33 @@
+package main
+
+// Payloads of the events that are published to the event firehose.
+
+type campaignSentEvent struct {
+	CampaignID     int    `json:"campaign_id"`
+	CampaignUUID   string `json:"campaign_uuid"`
+	SubscriberUUID string `json:"subscriber_uuid"`
+}
+
+// campaignTrackEvent is a campaign view or link click. The subscriber UUID
+// is empty when individual subscriber tracking is disabled.
+type campaignTrackEvent struct {
+	CampaignUUID   string `json:"campaign_uuid"`
+	SubscriberUUID string `json:"subscriber_uuid"`
+	URL            string `json:"url,omitempty"`
+	Device         string `json:"device,omitempty"`
+	Client         string `json:"client,omitempty"`
+	Country        string `json:"country,omitempty"`
+	Region         string `json:"region,omitempty"`
+}
+
+type txEvent struct {
+	MessageID    string `json:"message_id"`
+	SubscriberID int    `json:"subscriber_id"`
+	Email        string `json:"email"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+type subscriptionEvent struct {
+	SubscriberIDs []int64 `json:"subscriber_ids"`
+	ListIDs       []int64 `json:"list_ids"`
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+const (
+	tplSubForm       = "sub-form"
+	tplSubFormFields = "sub-form-fields"
+)
+
+var (
+	reFormFieldName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+	// Field names that are already taken by the fixed subscription form fields.
+	subFormReservedFields = map[string]bool{"email": true, "name": true, "nonce": true, "l": true,
+		"loaded_at": true, "captcha": true}
+)
+
+// subFormTplData is the data that's passed to subscription form templates.
+type subFormTplData struct {
+	publicTpl
+	Form  models.SubForm
+	Guard formGuardTpl
+
+	// Language that the page is rendered in, if it's not the app's language.
+	Lang string
+}
+
+// handleGetSubForms handles retrieval of subscription forms.
+func handleGetSubForms(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.SubForm
+
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if err := app.queries.GetSubForms.Select(&out, id, ""); err != nil {
+		app.log.Printf("error fetching forms: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.forms}", "error", pqErrMsg(err)))
+	}
+	if id > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.form}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetSubFormHTML returns the embeddable HTML snippet of a subscription form.
+func handleGetSubFormHTML(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	var out []models.SubForm
+	if err := app.queries.GetSubForms.Select(&out, id, ""); err != nil {
+		app.log.Printf("error fetching form: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.form}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.form}"))
+	}
+
+	var b bytes.Buffer
+	if err := c.Echo().Renderer.Render(&b, tplSubFormFields, subFormTplData{Form: out[0], Guard: makeFormGuard(app)}, c); err != nil {
+		app.log.Printf("error rendering form: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+	}
+
+	return c.JSON(http.StatusOK, okResp{b.String()})
+}
+
+// handleCreateSubForm handles subscription form creation.
+func handleCreateSubForm(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.SubForm
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validateSubForm(o, app); err != nil {
+		return err
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	var newID int
+	if err := app.queries.CreateSubForm.Get(&newID, uu, o.Name, o.ListID, o.Fields); err != nil {
+		app.log.Printf("error creating form: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.form}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetSubForms(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateSubForm handles subscription form modification.
+func handleUpdateSubForm(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o models.SubForm
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validateSubForm(o, app); err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateSubForm.Exec(id, o.Name, o.ListID, o.Fields)
+	if err != nil {
+		app.log.Printf("error updating form: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.form}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.form}"))
+	}
+
+	return handleGetSubForms(c)
+}
+
+// handleDeleteSubForm handles subscription form deletion.
+func handleDeleteSubForm(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeleteSubForm.Exec(id); err != nil {
+		app.log.Printf("error deleting form: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.form}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateSubForm validates the name, list, and custom field definitions
+// of a subscription form.
+func validateSubForm(o models.SubForm, app *App) error {
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("forms.invalidName"))
+	}
+	if o.ListID < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("forms.invalidList"))
+	}
+
+	names := make(map[string]bool)
+	for _, f := range o.Fields {
+		if !reFormFieldName.MatchString(f.Name) || subFormReservedFields[f.Name] || names[f.Name] {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("forms.invalidFieldName", "name", f.Name))
+		}
+		names[f.Name] = true
+
+		if !strHasLen(f.Label, 1, stdInputMaxLen) {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("forms.invalidFieldLabel", "name", f.Name))
+		}
+
+		switch f.Type {
+		case models.SubFormFieldText, models.SubFormFieldNumber,
+			models.SubFormFieldCheckbox, models.SubFormFieldDate:
+		case models.SubFormFieldSelect:
+			if len(f.Options) == 0 {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("forms.invalidFieldOptions", "name", f.Name))
+			}
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("forms.invalidFieldType", "name", f.Name))
+		}
+	}
+
+	return nil
+}
+
+// makeSubFormAttribs validates incoming custom field values against the
+// field definitions of a form and returns them as typed subscriber attributes.
+// Values may either be strings (HTML form posts) or JSON types.
+func makeSubFormAttribs(fields models.SubFormFields, vals map[string]interface{}, app *App) (models.SubscriberAttribs, error) {
+	out := make(models.SubscriberAttribs, len(fields))
+	for _, f := range fields {
+		v, ok := vals[f.Name]
+		if s, isStr := v.(string); isStr {
+			v = strings.TrimSpace(s)
+			ok = v != ""
+		}
+
+		// Unchecked checkboxes aren't posted by HTML forms.
+		if !ok || v == nil {
+			if f.Type == models.SubFormFieldCheckbox && !f.Required {
+				out[f.Name] = false
+				continue
+			}
+			if f.Required {
+				return nil, errors.New(app.i18n.Ts("forms.fieldRequired", "name", f.Label))
+			}
+			continue
+		}
+
+		val, err := parseSubFormValue(f, v)
+		if err != nil {
+			return nil, errors.New(app.i18n.Ts("forms.fieldInvalid", "name", f.Label))
+		}
+
+		// Required checkboxes (eg: consent) have to be checked.
+		if f.Type == models.SubFormFieldCheckbox && f.Required && val != true {
+			return nil, errors.New(app.i18n.Ts("forms.fieldRequired", "name", f.Label))
+		}
+
+		out[f.Name] = val
+	}
+
+	return out, nil
+}
+
+// parseSubFormValue converts an incoming custom field value to its type.
+func parseSubFormValue(f models.SubFormField, v interface{}) (interface{}, error) {
+	switch f.Type {
+	case models.SubFormFieldText:
+		s, ok := v.(string)
+		if !ok || len(s) > stdInputMaxLen {
+			return nil, errors.New("invalid text")
+		}
+		return s, nil
+
+	case models.SubFormFieldNumber:
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case string:
+			return strconv.ParseFloat(n, 64)
+		}
+
+	case models.SubFormFieldCheckbox:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if b == "on" {
+				return true, nil
+			}
+			return strconv.ParseBool(b)
+		}
+
+	case models.SubFormFieldSelect:
+		if s, ok := v.(string); ok {
+			for _, o := range f.Options {
+				if s == o {
+					return s, nil
+				}
+			}
+		}
+
+	case models.SubFormFieldDate:
+		if s, ok := v.(string); ok {
+			if _, err := time.Parse("2006-01-02", s); err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+
+	return nil, errors.New("invalid value")
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"crypto/subtle"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 
+	"github.com/knadh/listmonk/internal/ratelimit"
+	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 )
@@ -15,8 +19,21 @@ const (
 	// stdInputMaxLen is the maximum allowed length for a standard input field.
 	stdInputMaxLen = 200
 
+	// smsMaxLen is the maximum length of a text message (sms) campaign body.
+	// Longer messages are split by carriers into segments of 153-160 characters.
+	smsMaxLen = 1600
+
 	sortAsc  = "asc"
 	sortDesc = "desc"
+
+	// Groups of public endpoints with separate rate limits. The archive
+	// has the subscription limits.
+	rateLimitSubscription = "subscription"
+	rateLimitTracking     = "tracking"
+	rateLimitArchive      = "archive"
+
+	// Context key that's set on tracking requests over the rate limit.
+	ctxRateLimited = "rate_limited"
 )
 
 type okResp struct {
@@ -34,35 +51,70 @@ type pagination struct {
 var (
 	reUUID     = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
 	reLangCode = regexp.MustCompile("[^a-zA-Z_0-9]")
+	reLangTag  = regexp.MustCompile("^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})?$")
 )
 
 // registerHandlers registers HTTP handlers.
 func registerHTTPHandlers(e *echo.Echo, app *App) {
-	// Group of private handlers with BasicAuth.
-	var g *echo.Group
-
-	if len(app.constants.AdminUsername) == 0 ||
-		len(app.constants.AdminPassword) == 0 {
-		g = e.Group("")
-	} else {
-		g = e.Group("", middleware.BasicAuth(basicAuth))
-	}
+	// Group of private handlers with BasicAuth (or SSO sessions). The roles of
+	// users are checked against the routes after they're authenticated and
+	// the changes they make are recorded in the audit log.
+	g := e.Group("", authenticate(app), checkPermission, auditRequest)
 
 	g.GET("/", handleIndexPage)
 	g.GET("/api/health", handleHealthCheck)
+
+	// Prometheus metrics are protected by the admin credentials, or a
+	// separate bearer token for scrapers if one is set.
+	if app.constants.MetricsEnabled {
+		if app.constants.MetricsToken != "" {
+			e.GET("/metrics", handleGetMetrics, metricsAuth(app.constants.MetricsToken))
+		} else {
+			g.GET("/metrics", handleGetMetrics)
+		}
+	}
 	g.GET("/api/config", handleGetServerConfig)
+	g.GET("/api/spec", handleGetAPISpec)
 	g.GET("/api/lang/:lang", handleGetI18nLang)
 	g.GET("/api/dashboard/charts", handleGetDashboardCharts)
 	g.GET("/api/dashboard/counts", handleGetDashboardCounts)
+	g.GET("/api/dashboard/stats", handleGetDashboardStats)
+	g.GET("/api/dashboard/smtp-health", handleGetDashboardSMTPHealth)
+	g.GET("/api/dashboard/geo", handleGetDashboardGeo)
+	g.GET("/api/dashboard/deliverability", handleGetDeliverability)
 
 	g.GET("/api/settings", handleGetSettings)
 	g.PUT("/api/settings", handleUpdateSettings)
+	g.GET("/api/settings/export", handleExportSettings)
+	g.POST("/api/settings/import", handleImportSettings)
+	g.PUT("/api/settings/rate-limits", handleUpdateRateLimits)
+	g.GET("/api/settings/smtp/stats", handleGetSMTPStats)
+	g.POST("/api/settings/smtp/:index/test", handleTestSMTP)
+	g.GET("/api/settings/messengers/stats", handleGetPostbackStats)
+	g.GET("/api/settings/dkim", handleGetDKIMRecords)
+	g.POST("/api/settings/dkim/generate", handleGenerateDKIMKey)
 	g.POST("/api/admin/reload", handleReloadApp)
 	g.GET("/api/logs", handleGetLogs)
+	g.GET("/api/logs/files", handleGetLogFiles)
+	g.GET("/api/logs/files/:name", handleDownloadLogFile)
+	g.DELETE("/api/maintenance/analytics", handlePruneAnalytics)
+	g.POST("/api/maintenance/backup", handleCreateBackup)
+
+	g.GET("/api/users", handleGetUsers)
+	g.GET("/api/users/:id", handleGetUsers)
+	g.POST("/api/users", handleCreateUser)
+	g.PUT("/api/users/:id", handleUpdateUser)
+	g.DELETE("/api/users/:id", handleDeleteUser)
+	g.DELETE("/api/users/:id/totp", handleResetUserTOTP)
+
+	g.GET("/api/profile", handleGetProfile)
+	g.POST("/api/profile/totp", handleSetupTOTP)
+	g.PUT("/api/profile/totp", handleEnableTOTP)
+	g.DELETE("/api/profile/totp", handleDisableTOTP)
 
 	g.GET("/api/subscribers/:id", handleGetSubscriber)
 	g.GET("/api/subscribers/:id/export", handleExportSubscriberData)
-	g.POST("/api/subscribers", handleCreateSubscriber)
+	g.POST("/api/subscribers", idempotent(handleCreateSubscriber))
 	g.PUT("/api/subscribers/:id", handleUpdateSubscriber)
 	g.POST("/api/subscribers/:id/optin", handleSubscriberSendOptin)
 	g.PUT("/api/subscribers/blocklist", handleBlocklistSubscribers)
@@ -91,33 +143,95 @@ func registerHTTPHandlers(e *echo.Echo, app *App) {
 	g.POST("/api/lists", handleCreateList)
 	g.PUT("/api/lists/:id", handleUpdateList)
 	g.DELETE("/api/lists/:id", handleDeleteLists)
+	g.GET("/api/lists/:id/webhooks", handleGetListWebhooks)
+	g.GET("/api/lists/:id/webhooks/:webhookID", handleGetListWebhooks)
+	g.POST("/api/lists/:id/webhooks", handleCreateListWebhook)
+	g.PUT("/api/lists/:id/webhooks/:webhookID", handleUpdateListWebhook)
+	g.DELETE("/api/lists/:id/webhooks/:webhookID", handleDeleteListWebhook)
+
+	g.GET("/api/list-folders", handleGetListFolders)
+	g.GET("/api/list-folders/:id", handleGetListFolders)
+	g.POST("/api/list-folders", handleCreateListFolder)
+	g.PUT("/api/list-folders/:id", handleUpdateListFolder)
+	g.DELETE("/api/list-folders/:id", handleDeleteListFolder)
+
+	g.GET("/api/forms", handleGetSubForms)
+	g.GET("/api/forms/:id", handleGetSubForms)
+	g.GET("/api/forms/:id/html", handleGetSubFormHTML)
+	g.POST("/api/forms", handleCreateSubForm)
+	g.PUT("/api/forms/:id", handleUpdateSubForm)
+	g.DELETE("/api/forms/:id", handleDeleteSubForm)
+
+	g.GET("/api/page-templates", handleGetPageTemplates)
+	g.GET("/api/page-templates/:id", handleGetPageTemplates)
+	g.POST("/api/page-templates", handleCreatePageTemplate)
+	g.PUT("/api/page-templates/:id", handleUpdatePageTemplate)
+	g.DELETE("/api/page-templates/:id", handleDeletePageTemplate)
 
 	g.GET("/api/campaigns", handleGetCampaigns)
 	g.GET("/api/campaigns/running/stats", handleGetRunningCampaignStats)
+	g.GET("/api/campaigns/running/stream", handleStreamRunningCampaignStats)
+	g.GET("/api/campaigns/events/export", handleExportTrackingEvents)
 	g.GET("/api/campaigns/:id", handleGetCampaigns)
+	g.GET("/api/campaigns/:id/analytics/devices", handleGetCampaignDeviceAnalytics)
+	g.GET("/api/campaigns/:id/analytics/geo", handleGetCampaignGeoAnalytics)
+	g.GET("/api/campaigns/:id/analytics/unsubscribes", handleGetCampaignUnsubAnalytics)
+	g.GET("/api/campaigns/:id/links", handleGetCampaignLinks)
 	g.GET("/api/campaigns/:id/preview", handlePreviewCampaign)
 	g.POST("/api/campaigns/:id/preview", handlePreviewCampaign)
 	g.POST("/api/campaigns/:id/content", handleCampaignContent)
 	g.POST("/api/campaigns/:id/text", handlePreviewCampaign)
 	g.POST("/api/campaigns/:id/test", handleTestCampaign)
-	g.POST("/api/campaigns", handleCreateCampaign)
+	g.POST("/api/campaigns", idempotent(handleCreateCampaign))
 	g.PUT("/api/campaigns/:id", handleUpdateCampaign)
 	g.PUT("/api/campaigns/:id/status", handleUpdateCampaignStatus)
+	g.PUT("/api/campaigns/:id/archive", handleUpdateCampaignArchive)
 	g.DELETE("/api/campaigns/:id", handleDeleteCampaign)
 
 	g.GET("/api/media", handleGetMedia)
+	g.GET("/api/media/tags", handleGetMediaTags)
+	g.GET("/api/media/orphans", handleGetOrphanMedia)
+	g.DELETE("/api/media/orphans", handleDeleteOrphanMedia)
+	g.GET("/api/media/:id", handleGetMediaItem)
 	g.POST("/api/media", handleUploadMedia)
+	g.PUT("/api/media/:id", handleUpdateMedia)
 	g.DELETE("/api/media/:id", handleDeleteMedia)
 
+	g.GET("/api/media-folders", handleGetMediaFolders)
+	g.GET("/api/media-folders/:id", handleGetMediaFolders)
+	g.POST("/api/media-folders", handleCreateMediaFolder)
+	g.PUT("/api/media-folders/:id", handleUpdateMediaFolder)
+	g.DELETE("/api/media-folders/:id", handleDeleteMediaFolder)
+
 	g.GET("/api/templates", handleGetTemplates)
 	g.GET("/api/templates/:id", handleGetTemplates)
 	g.GET("/api/templates/:id/preview", handlePreviewTemplate)
 	g.POST("/api/templates/preview", handlePreviewTemplate)
+	g.POST("/api/templates/:id/render", handleRenderTxTemplate)
+	g.POST("/api/templates/validate", handleValidateTemplate)
 	g.POST("/api/templates", handleCreateTemplate)
 	g.PUT("/api/templates/:id", handleUpdateTemplate)
 	g.PUT("/api/templates/:id/default", handleTemplateSetDefault)
+	g.GET("/api/templates/:id/versions", handleGetTemplateVersions)
+	g.GET("/api/templates/:id/versions/:version", handleGetTemplateVersions)
+	g.GET("/api/templates/:id/versions/:version/diff", handleDiffTemplateVersions)
+	g.PUT("/api/templates/:id/versions/:version/rollback", handleRollbackTemplate)
 	g.DELETE("/api/templates/:id", handleDeleteTemplate)
 
+	g.POST("/api/tx", idempotent(handleSendTxMessage))
+	g.POST("/api/tx/batch", idempotent(handleSendTxBatch))
+	g.POST("/api/tx/events", handleTxStatusEvent)
+	g.GET("/api/tx/scheduled", handleGetTxScheduled)
+	g.DELETE("/api/tx/scheduled/:id", handleDeleteTxScheduled)
+	g.GET("/api/tx/log", handleGetTxLog)
+	g.GET("/api/tx/log/export", handleExportTxLog)
+
+	g.GET("/api/unsubscribes", handleGetUnsubscribeFeedback)
+	g.GET("/api/unsubscribes/summary", handleGetUnsubscribeFeedbackSummary)
+
+	g.GET("/api/audit", handleGetAuditLog)
+	g.GET("/api/audit/export", handleExportAuditLog)
+
 	// Static admin views.
 	g.GET("/lists", handleIndexPage)
 	g.GET("/lists/forms", handleIndexPage)
@@ -131,28 +245,59 @@ func registerHTTPHandlers(e *echo.Echo, app *App) {
 	g.GET("/campaigns/:campignID", handleIndexPage)
 	g.GET("/settings", handleIndexPage)
 	g.GET("/settings/logs", handleIndexPage)
+	g.GET("/settings/users", handleIndexPage)
+	g.GET("/profile", handleIndexPage)
+
+	// Login and single sign-on.
+	e.GET("/auth/login", handleLoginPage)
+	e.POST("/auth/login", limitRate(handleLoginPage, rateLimitSubscription))
+	e.GET("/auth/oidc", handleOIDCLogin)
+	e.GET("/auth/oidc/callback", handleOIDCCallback)
+	e.GET("/auth/logout", handleLogout)
 
 	// Public subscriber facing views.
 	e.GET("/subscription/form", handleSubscriptionFormPage)
-	e.POST("/subscription/form", handleSubscriptionForm)
+	e.POST("/subscription/form", limitRate(handleSubscriptionForm, rateLimitSubscription))
+	e.GET("/subscription/form/:formUUID", validateUUID(handleSubFormPage, "formUUID"))
+	e.POST("/subscription/form/:formUUID", limitRate(validateUUID(handleSubFormSubmit, "formUUID"),
+		rateLimitSubscription))
 	e.GET("/subscription/:campUUID/:subUUID", noIndex(validateUUID(subscriberExists(handleSubscriptionPage),
 		"campUUID", "subUUID")))
-	e.POST("/subscription/:campUUID/:subUUID", validateUUID(subscriberExists(handleSubscriptionPage),
-		"campUUID", "subUUID"))
+	e.POST("/subscription/:campUUID/:subUUID", limitRate(validateUUID(subscriberExists(handleSubscriptionPage),
+		"campUUID", "subUUID"), rateLimitSubscription))
+	e.POST("/subscription/:campUUID/:subUUID/survey", limitRate(validateUUID(subscriberExists(handleUnsubscribeSurvey),
+		"campUUID", "subUUID"), rateLimitSubscription))
 	e.GET("/subscription/optin/:subUUID", noIndex(validateUUID(subscriberExists(handleOptinPage), "subUUID")))
-	e.POST("/subscription/optin/:subUUID", validateUUID(subscriberExists(handleOptinPage), "subUUID"))
-	e.POST("/subscription/export/:subUUID", validateUUID(subscriberExists(handleSelfExportSubscriberData),
-		"subUUID"))
-	e.POST("/subscription/wipe/:subUUID", validateUUID(subscriberExists(handleWipeSubscriberData),
+	e.POST("/subscription/optin/:subUUID", limitRate(validateUUID(subscriberExists(handleOptinPage), "subUUID"),
+		rateLimitSubscription))
+	e.POST("/subscription/export/:subUUID", limitRate(validateUUID(subscriberExists(handleSelfExportSubscriberData),
+		"subUUID"), rateLimitSubscription))
+	e.POST("/subscription/wipe/:subUUID", limitRate(validateUUID(subscriberExists(handleWipeSubscriberData),
+		"subUUID"), rateLimitSubscription))
+	e.GET("/push/key", handleGetPushKey)
+	e.POST("/subscription/push/:subUUID", limitRate(validateUUID(subscriberExists(handleAddPushSubscription),
+		"subUUID"), rateLimitSubscription))
+	e.DELETE("/subscription/push/:subUUID", validateUUID(subscriberExists(handleDeletePushSubscription),
 		"subUUID"))
-	e.GET("/link/:linkUUID/:campUUID/:subUUID", noIndex(validateUUID(handleLinkRedirect,
-		"linkUUID", "campUUID", "subUUID")))
+	e.GET("/link/:linkUUID/:campUUID/:subUUID", noIndex(limitRate(validateUUID(handleLinkRedirect,
+		"linkUUID", "campUUID", "subUUID"), rateLimitTracking)))
+	e.GET("/archive", limitRate(handleGetArchive, rateLimitArchive))
+	e.GET("/archive.json", limitRate(handleGetArchiveJSON, rateLimitArchive))
+	e.GET("/archive/:campUUID", limitRate(validateUUID(handleViewArchivedCampaign, "campUUID"), rateLimitArchive))
+
+	// Public JSON API for subscribing from external sites.
+	e.GET("/api/public/lists", publicCORS(handleGetPublicLists))
+	e.POST("/api/public/subscription", publicCORS(limitRate(handlePublicSubscription, rateLimitSubscription)))
+	e.POST("/api/public/optin/:subUUID", publicCORS(limitRate(handlePublicOptin, rateLimitSubscription)))
+	e.OPTIONS("/api/public/*", publicCORS(handlePublicPreflight))
+
 	e.GET("/campaign/:campUUID/:subUUID", noIndex(validateUUID(handleViewCampaignMessage,
 		"campUUID", "subUUID")))
-	e.GET("/campaign/:campUUID/:subUUID/px.png", noIndex(validateUUID(handleRegisterCampaignView,
-		"campUUID", "subUUID")))
-	// Public health API endpoint.
-	e.GET("/health", handleHealthCheck)
+	e.GET("/campaign/:campUUID/:subUUID/px.png", noIndex(limitRate(validateUUID(handleRegisterCampaignView,
+		"campUUID", "subUUID"), rateLimitTracking)))
+	// Public liveness and readiness probes.
+	e.GET("/health", handleLiveness)
+	e.GET("/ready", handleReadiness)
 }
 
 // handleIndex is the root handler that renders the Javascript frontend.
@@ -174,20 +319,54 @@ func handleHealthCheck(c echo.Context) error {
 }
 
 // basicAuth middleware does an HTTP BasicAuth authentication for admin handlers.
+// The superuser in the config is checked first and then the users in the DB.
+// The authenticated user is set on the context as "user".
 func basicAuth(username, password string, c echo.Context) (bool, error) {
-	app := c.Get("app").(*App)
+	var (
+		app = c.Get("app").(*App)
+		ip  = clientIP(c, app)
+	)
 
-	// Auth is disabled.
-	if len(app.constants.AdminUsername) == 0 &&
-		len(app.constants.AdminPassword) == 0 {
-		return true, nil
+	if app.loginGuard.locked(username, ip) {
+		return false, nil
 	}
 
-	if subtle.ConstantTimeCompare([]byte(username), app.constants.AdminUsername) == 1 &&
+	// The superuser is optional if there's single sign-on.
+	if len(app.constants.AdminUsername) > 0 && len(app.constants.AdminPassword) > 0 &&
+		subtle.ConstantTimeCompare([]byte(username), app.constants.AdminUsername) == 1 &&
 		subtle.ConstantTimeCompare([]byte(password), app.constants.AdminPassword) == 1 {
+		c.Set("user", makeSuperuser(username))
 		return true, nil
 	}
-	return false, nil
+
+	// Users with 2FA can only log in on the login page.
+	u, ok := authUser(username, password, app)
+	if !ok {
+		app.loginGuard.fail(username, ip)
+		return false, nil
+	}
+	if u.TOTPEnabled {
+		return false, nil
+	}
+	c.Set("user", u)
+	return true, nil
+}
+
+// makeSuperuser returns the superuser in the config, who is an admin.
+func makeSuperuser(username string) models.User {
+	return models.User{
+		Username: username,
+		Name:     username,
+		Role:     models.UserRoleAdmin,
+		Status:   models.UserStatusEnabled,
+	}
+}
+
+// getAuthUser returns the name of the admin user making the request.
+// It's empty if auth is disabled.
+func getAuthUser(c echo.Context) string {
+	u, _, _ := c.Request().BasicAuth()
+	return u
 }
 
 // validateUUID middleware validates the UUID string format for a given set of params.
@@ -207,7 +386,7 @@ func validateUUID(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 }
 
 // subscriberExists middleware checks if a subscriber exists given the UUID
-// param in a request.
+// param in a request and sets the subscriber's language on the request.
 func subscriberExists(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		var (
@@ -228,6 +407,14 @@ func subscriberExists(next echo.HandlerFunc, params ...string) echo.HandlerFunc
 				makeMsgTpl(app.i18n.T("public.notFoundTitle"), "",
 					app.i18n.T("public.subNotFound")))
 		}
+
+		// Render the subscriber's pages in their language.
+		var lang string
+		if err := app.queries.GetSubscriberLang.Get(&lang, subUUID); err != nil {
+			app.log.Printf("error fetching subscriber language: %v", err)
+		}
+		setPublicLang(c, lang, app)
+
 		return next(c)
 	}
 }
@@ -240,6 +427,67 @@ func noIndex(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 	}
 }
 
+// limitRate middleware limits the rate of requests to a group of public
+// endpoints (subscription, tracking or archive) per IP when rate limiting
+// is enabled.
+// Tracking requests over the limit aren't rejected so that links still
+// redirect. They're marked for the handlers to skip recording them.
+func limitRate(next echo.HandlerFunc, group string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		app := c.Get("app").(*App)
+		if app.limiter == nil {
+			return next(c)
+		}
+
+		// One-click (RFC 8058) unsubscriptions are POSTed by the servers of
+		// e-mail providers from a few IPs that are shared by all their users.
+		if c.Path() == "/subscription/:campUUID/:subUUID" && c.Request().Method == http.MethodPost &&
+			c.FormValue("List-Unsubscribe") == "One-Click" {
+			return next(c)
+		}
+
+		var (
+			cs = app.constants.Security
+			l  = ratelimit.Limit{Rate: cs.RateLimitSubscriptionRate, Burst: cs.RateLimitSubscriptionBurst}
+		)
+		if group == rateLimitTracking {
+			l = ratelimit.Limit{Rate: cs.RateLimitTrackingRate, Burst: cs.RateLimitTrackingBurst}
+		}
+
+		if !app.limiter.Allow(group+":"+clientIP(c, app), l) {
+			if group == rateLimitTracking {
+				c.Set(ctxRateLimited, true)
+				return next(c)
+			}
+			if strings.HasPrefix(c.Path(), publicAPIPrefix) {
+				return newPublicAPIError(http.StatusTooManyRequests, pubErrRateLimited, app.i18n.T("public.tooManyRequests"))
+			}
+			if strings.HasSuffix(c.Path(), ".json") {
+				return echo.NewHTTPError(http.StatusTooManyRequests, app.i18n.T("public.tooManyRequests"))
+			}
+			return c.Render(http.StatusTooManyRequests, tplMessage,
+				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+					app.i18n.T("public.tooManyRequests")))
+		}
+		return next(c)
+	}
+}
+
+// clientIP returns the IP of the client making a request. The IP in the
+// X-Forwarded-For and X-Real-IP headers is only used if proxies are trusted
+// as clients can set the headers to anything.
+func clientIP(c echo.Context, app *App) string {
+	if app.constants.Security.RateLimitTrustProxy {
+		return c.RealIP()
+	}
+
+	ip, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		return c.Request().RemoteAddr
+	}
+	return ip
+}
+
 // getPagination takes form values and extracts pagination values from it.
 func getPagination(q url.Values, perPage int) pagination {
 	var (
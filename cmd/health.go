@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthError    = "error"
+
+	// Interval at which the campaign manager scans for campaigns.
+	campScanInterval = time.Second * 5
+
+	// Timeout of the DB checks of a readiness probe.
+	healthDBTimeout = time.Second * 3
+
+	// Duration for which the result of a readiness check is reused.
+	healthReadyTTL = time.Second * 5
+)
+
+// healthReport is the status of the app and its components. As the probes
+// are public, only the overall status is sent and the failed components are
+// logged.
+type healthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]healthComponent `json:"-"`
+}
+
+// readinessCache holds the last readiness report so that the probes,
+// which are public, don't hit the DB on every request.
+type readinessCache struct {
+	report healthReport
+	at     time.Time
+	sync.Mutex
+}
+
+type healthComponent struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleLiveness is the liveness probe (/health). It checks that the
+// background workers are running and doesn't depend on the DB so that the
+// app isn't restarted when the DB is unavailable.
+func handleLiveness(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	r := healthReport{Components: make(map[string]healthComponent)}
+	r.add("campaign_manager", checkCampaignManager(app), true)
+
+	return r.send(c)
+}
+
+// handleReadiness is the readiness probe (/ready). It checks the DB, the
+// read replica, the migrations and the background workers, which have to
+// be healthy for the app to serve requests. Unreachable messengers, as of
+// their last periodic check, degrade the status without failing the probe.
+// The checks run at most once every healthReadyTTL and the requests in
+// between get the last report.
+func handleReadiness(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	app.readiness.Lock()
+	defer app.readiness.Unlock()
+
+	if time.Since(app.readiness.at) >= healthReadyTTL {
+		app.readiness.report = checkReadiness(app)
+		app.readiness.at = time.Now()
+
+		if r := app.readiness.report; r.Status != healthOK {
+			for name, cm := range r.Components {
+				if cm.Status != healthOK {
+					app.log.Printf("readiness check: %s: %s", name, cm.Error)
+				}
+			}
+		}
+	}
+
+	r := app.readiness.report
+	return r.send(c)
+}
+
+// checkReadiness runs the checks of the readiness probe.
+func checkReadiness(app *App) healthReport {
+	ctx, cancel := context.WithTimeout(context.Background(), healthDBTimeout)
+	defer cancel()
+
+	r := healthReport{Components: make(map[string]healthComponent)}
+	r.add("database", checkDB(ctx, app.db.DB), true)
+	if app.readDB != app.db {
+		r.add("read_replica", checkDB(ctx, app.readDB.DB), true)
+	}
+	r.add("migrations", checkMigrations(), true)
+	r.add("campaign_manager", checkCampaignManager(app), true)
+
+	app.Lock()
+	for name, res := range app.smtpHealth {
+		n := 0
+		for _, s := range res {
+			if !s.OK {
+				n++
+			}
+		}
+
+		var err error
+		if n > 0 {
+			err = fmt.Errorf("%d of %d servers unreachable", n, len(res))
+		}
+		r.add("messenger."+name, err, false)
+	}
+	app.Unlock()
+
+	return r
+}
+
+// add adds the result of a component's check to the report. A failed
+// required component fails the report and any other degrades it.
+func (r *healthReport) add(name string, err error, required bool) {
+	if err == nil {
+		r.Components[name] = healthComponent{Status: healthOK}
+		if r.Status == "" {
+			r.Status = healthOK
+		}
+		return
+	}
+
+	r.Components[name] = healthComponent{Status: healthError, Error: err.Error()}
+	if required {
+		r.Status = healthError
+	} else if r.Status != healthError {
+		r.Status = healthDegraded
+	}
+}
+
+// send responds with the report, with a 503 if it has failed.
+func (r *healthReport) send(c echo.Context) error {
+	code := http.StatusOK
+	if r.Status == healthError {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, okResp{r})
+}
+
+// checkDB checks that a DB is reachable.
+func checkDB(ctx context.Context, d *sql.DB) error {
+	if err := d.PingContext(ctx); err != nil {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+// checkCampaignManager checks that the campaign manager is scanning for
+// campaigns.
+func checkCampaignManager(app *App) error {
+	last := app.manager.LastScan()
+	if last.IsZero() {
+		return errors.New("not running")
+	}
+	if d := time.Since(last); d > campScanInterval*3 {
+		return fmt.Errorf("last scanned %s ago", d.Round(time.Second))
+	}
+	return nil
+}
+
+// checkMigrations checks that the DB doesn't have pending migrations, eg:
+// after the binary has been upgraded without the DB.
+func checkMigrations() error {
+	_, toRun, err := getPendingMigrations(db)
+	if err != nil {
+		return errors.New("error checking migrations")
+	}
+	if len(toRun) > 0 {
+		return fmt.Errorf("%d pending migrations", len(toRun))
+	}
+	return nil
+}
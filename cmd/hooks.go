@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/hooks"
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+// Payloads of the events that hooks are run at.
+
+// renderHookData is the payload of message.render hooks, which are run
+// once for every batch of subscribers of a campaign. Only the subscribers'
+// names and attributes can be modified. Subscribers with skip set aren't
+// sent the message.
+type renderHookData struct {
+	Campaign    hookCampaign           `json:"campaign"`
+	Subscribers []renderHookSubscriber `json:"subscribers"`
+}
+
+type renderHookSubscriber struct {
+	listWebhookSubscriber
+	Skip bool `json:"skip"`
+}
+
+type hookCampaign struct {
+	ID      int    `json:"id"`
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+}
+
+// subscribeHookData is the payload of subscriber.subscribe hooks.
+type subscribeHookData struct {
+	Email     string                   `json:"email"`
+	Name      string                   `json:"name"`
+	Attribs   models.SubscriberAttribs `json:"attribs"`
+	Lists     []int64                  `json:"lists"`
+	ListUUIDs []string                 `json:"list_uuids"`
+}
+
+// bounceHookData is the payload of bounce.record hooks.
+type bounceHookData struct {
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+}
+
+// runRenderHooks runs the message.render hooks before campaign messages
+// are rendered for a batch of subscribers and returns the subscribers to
+// send the messages to. A veto skips the whole batch.
+func runRenderHooks(c *models.Campaign, subs []models.Subscriber, app *App) ([]models.Subscriber, error) {
+	d := renderHookData{
+		Campaign:    hookCampaign{ID: c.ID, UUID: c.UUID, Name: c.Name, Subject: c.Subject},
+		Subscribers: make([]renderHookSubscriber, len(subs)),
+	}
+	for i, s := range subs {
+		d.Subscribers[i].listWebhookSubscriber = listWebhookSubscriber{
+			ID:      s.ID,
+			UUID:    s.UUID,
+			Email:   s.Email,
+			Name:    s.Name,
+			Attribs: s.Attribs,
+			Status:  s.Status,
+		}
+	}
+	if err := app.hooks.Run(hooks.EventMessageRender, &d); err != nil {
+		if _, ok := err.(*hooks.VetoError); ok {
+			app.log.Printf("skipped %d messages (%s): %v", len(subs), c.Name, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Apply the changes to the subscribers that the hooks returned.
+	res := make(map[string]renderHookSubscriber, len(d.Subscribers))
+	for _, s := range d.Subscribers {
+		res[s.UUID] = s
+	}
+
+	out := make([]models.Subscriber, 0, len(subs))
+	for _, s := range subs {
+		r, ok := res[s.UUID]
+		if ok && r.Skip {
+			app.log.Printf("skipped message (%s) (%s): skipped by hook", c.Name, s.Email)
+			continue
+		}
+		if ok {
+			s.Name = r.Name
+			s.Attribs = r.Attribs
+		}
+		out = append(out, s)
+	}
+
+	return out, nil
+}
+
+// runSubscribeHooks runs the subscriber.subscribe hooks before a subscriber
+// is inserted and applies their changes to the request.
+func runSubscribeHooks(req *subimporter.SubReq, app *App) error {
+	if !app.hooks.Has(hooks.EventSubscribe) {
+		return nil
+	}
+
+	d := subscribeHookData{
+		Email:     req.Email,
+		Name:      req.Name,
+		Attribs:   req.Attribs,
+		Lists:     req.Lists,
+		ListUUIDs: req.ListUUIDs,
+	}
+	if err := app.hooks.Run(hooks.EventSubscribe, &d); err != nil {
+		return hookHTTPError(err, http.StatusBadRequest, app)
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(d.Email))
+	req.Name = d.Name
+	req.Attribs = d.Attribs
+	req.Lists = pq.Int64Array(d.Lists)
+	req.ListUUIDs = pq.StringArray(d.ListUUIDs)
+
+	if err := subimporter.ValidateFields(*req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// hookHTTPError returns the HTTP error of an action that's vetoed by a hook,
+// with the given code, or that failed as a hook failed.
+func hookHTTPError(err error, code int, app *App) error {
+	v, ok := err.(*hooks.VetoError)
+	if !ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.T("globals.messages.hookFailed"))
+	}
+
+	if v.Reason != "" {
+		return echo.NewHTTPError(code, v.Reason)
+	}
+	return echo.NewHTTPError(code, app.i18n.T("globals.messages.hookVetoed"))
+}
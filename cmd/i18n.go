@@ -3,14 +3,27 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo"
 )
 
+const (
+	// Subscriber attribute that holds the code of the language that public
+	// pages and e-mails are rendered in for the subscriber.
+	subLangAttrib = "lang"
+
+	// Context key of the language that the public pages of a request are rendered in.
+	ctxLang = "lang"
+)
+
 type i18nLang struct {
 	Code string `json:"code"`
 	Name string `json:"name"`
@@ -21,6 +34,22 @@ type i18nLangRaw struct {
 	Name string `json:"_.name"`
 }
 
+// langCache holds the languages other than the app's language that are
+// loaded on demand for subscribers and the e-mail notification templates
+// compiled with them.
+type langCache struct {
+	langs     map[string]*i18n.I18n
+	notifTpls map[string]*template.Template
+	sync.RWMutex
+}
+
+func newLangCache() *langCache {
+	return &langCache{
+		langs:     make(map[string]*i18n.I18n),
+		notifTpls: make(map[string]*template.Template),
+	}
+}
+
 // handleGetI18nLang returns the JSON language pack given the language code.
 func handleGetI18nLang(c echo.Context) error {
 	app := c.Get("app").(*App)
@@ -98,3 +127,92 @@ func getI18nLang(lang string, fs stuffbin.FileSystem) (*i18n.I18n, bool, error)
 
 	return i, true, nil
 }
+
+// isLangAvailable checks whether there's a language pack with a code.
+func isLangAvailable(code string, app *App) bool {
+	langs, err := getI18nLangList("", app)
+	if err != nil {
+		app.log.Printf("error fetching languages: %v", err)
+		return false
+	}
+	for _, l := range langs {
+		if l.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// getLang returns the language with the given code loaded over the default
+// language. The app's language is returned for empty, invalid or unknown codes.
+func (app *App) getLang(code string) *i18n.I18n {
+	code = strings.TrimSpace(code)
+	if code == "" || code == app.i18n.Code() || !reLangTag.MatchString(code) {
+		return app.i18n
+	}
+
+	app.langs.RLock()
+	l, ok := app.langs.langs[code]
+	app.langs.RUnlock()
+	if ok {
+		return l
+	}
+
+	l, _, err := getI18nLang(code, app.fs)
+	if err != nil {
+		return app.i18n
+	}
+
+	app.langs.Lock()
+	app.langs.langs[code] = l
+	app.langs.Unlock()
+	return l
+}
+
+// getNotifTemplates returns the e-mail notification templates compiled with
+// a language.
+func (app *App) getNotifTemplates(l *i18n.I18n) (*template.Template, error) {
+	if l == app.i18n {
+		return app.notifTpls, nil
+	}
+
+	app.langs.RLock()
+	tpl, ok := app.langs.notifTpls[l.Code()]
+	app.langs.RUnlock()
+	if ok {
+		return tpl, nil
+	}
+
+	tpl, err := parseNotifTemplates("/email-templates/*.html", app.fs, l, app.constants, app.manager)
+	if err != nil {
+		return nil, err
+	}
+
+	app.langs.Lock()
+	app.langs.notifTpls[l.Code()] = tpl
+	app.langs.Unlock()
+	return tpl, nil
+}
+
+// subscriberLang returns the language of a subscriber (attribs.lang).
+func subscriberLang(sub models.Subscriber, app *App) *i18n.I18n {
+	code, _ := sub.Attribs[subLangAttrib].(string)
+	return app.getLang(code)
+}
+
+// setPublicLang sets the language that the public pages of a request are
+// rendered in if it's a language other than the app's.
+func setPublicLang(c echo.Context, code string, app *App) {
+	if l := app.getLang(code); l != app.i18n {
+		c.Set(ctxLang, l)
+	}
+}
+
+// publicLang returns the language that the public pages of a request are
+// rendered in.
+func publicLang(c echo.Context, app *App) *i18n.I18n {
+	if l, ok := c.Get(ctxLang).(*i18n.I18n); ok {
+		return l
+	}
+	return app.i18n
+}
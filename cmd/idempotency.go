@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	headerReplayed       = "Idempotent-Replayed"
+
+	// Duration for which the response of a request with a key is kept
+	// and returned to retries.
+	idempotencyKeyTTL = time.Hour * 24
+
+	idempotencyKeyMaxLen = 255
+)
+
+// idempotencyKey is a stored request and its response.
+type idempotencyKey struct {
+	Key         string        `db:"key"`
+	Username    string        `db:"username"`
+	RequestHash string        `db:"request_hash"`
+	Status      sql.NullInt64 `db:"status"`
+	ContentType string        `db:"content_type"`
+	Response    []byte        `db:"response"`
+	CreatedAt   time.Time     `db:"created_at"`
+}
+
+// bodyRecorder is a ResponseWriter that records the body it writes.
+type bodyRecorder struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent middleware makes a write API endpoint safe to retry. The
+// successful response of a request with an Idempotency-Key header is stored
+// and returned as is to requests with the same key from the same user for
+// idempotencyKeyTTL instead of the request being processed again. A key
+// can't be reused for a different request. Requests without the header
+// are processed normally.
+func idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var (
+			app = c.Get("app").(*App)
+			req = c.Request()
+			key = req.Header.Get(headerIdempotencyKey)
+		)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > idempotencyKeyMaxLen {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", headerIdempotencyKey))
+		}
+
+		// Hash the request and restore its body for the handler.
+		h := sha256.New()
+		h.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+		if req.Body != nil {
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(b))
+			h.Write(b)
+		}
+
+		var (
+			username = getUser(c).Username
+			hash     = hex.EncodeToString(h.Sum(nil))
+		)
+
+		// Claim the key. If it's taken, the request is a retry.
+		var claimed []string
+		if err := app.queries.InsertIdempotencyKey.Select(&claimed, key, username, hash,
+			time.Now().Add(-idempotencyKeyTTL)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorCreating",
+					"name", headerIdempotencyKey, "error", pqErrMsg(err)))
+		}
+		if len(claimed) == 0 {
+			return replayIdempotentRequest(c, key, username, hash, app)
+		}
+
+		// Record the response.
+		var (
+			resp = c.Response()
+			rec  = &bodyRecorder{ResponseWriter: resp.Writer}
+			done = false
+		)
+		resp.Writer = rec
+		defer func() {
+			resp.Writer = rec.ResponseWriter
+
+			// Release the key of a failed request so that it can be retried.
+			if !done {
+				if _, err := app.queries.DeleteIdempotencyKey.Exec(key, username); err != nil {
+					app.log.Printf("error deleting idempotency key: %v", err)
+				}
+			}
+		}()
+
+		if err := next(c); err != nil {
+			return err
+		}
+		if resp.Status < http.StatusOK || resp.Status >= http.StatusMultipleChoices {
+			return nil
+		}
+
+		if _, err := app.queries.UpdateIdempotencyKey.Exec(key, username, resp.Status,
+			resp.Header().Get(echo.HeaderContentType), rec.buf.Bytes()); err != nil {
+			app.log.Printf("error saving idempotency key: %v", err)
+			return nil
+		}
+		done = true
+
+		return nil
+	}
+}
+
+// replayIdempotentRequest returns the stored response of a request with
+// a key that's already been used.
+func replayIdempotentRequest(c echo.Context, key, username, hash string, app *App) error {
+	var k idempotencyKey
+	if err := app.queries.GetIdempotencyKey.Get(&k, key, username); err != nil {
+		if err == sql.ErrNoRows {
+			// The key was released by a failed request in the meantime.
+			return echo.NewHTTPError(http.StatusConflict, app.i18n.T("globals.messages.idempotencyKeyInUse"))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", headerIdempotencyKey, "error", pqErrMsg(err)))
+	}
+
+	if k.RequestHash != hash {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity,
+			app.i18n.T("globals.messages.idempotencyKeyReused"))
+	}
+
+	// The original request is still being processed.
+	if !k.Status.Valid {
+		return echo.NewHTTPError(http.StatusConflict, app.i18n.T("globals.messages.idempotencyKeyInUse"))
+	}
+
+	c.Response().Header().Set(headerReplayed, "true")
+	return c.Blob(int(k.Status.Int64), k.ContentType, k.Response)
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"syscall"
 	"time"
@@ -21,6 +25,11 @@ import (
 	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
+	"github.com/knadh/listmonk/internal/buflog"
+	"github.com/knadh/listmonk/internal/captcha"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/geoip"
+	"github.com/knadh/listmonk/internal/hooks"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
@@ -28,11 +37,16 @@ import (
 	"github.com/knadh/listmonk/internal/media/providers/s3"
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/messenger/email"
-	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/webpush"
+	"github.com/knadh/listmonk/internal/oidc"
+	"github.com/knadh/listmonk/internal/ratelimit"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
@@ -47,15 +61,60 @@ type constants struct {
 	FromEmail           string   `koanf:"from_email"`
 	NotifyEmails        []string `koanf:"notify_emails"`
 	EnablePublicSubPage bool     `koanf:"enable_public_subscription_page"`
+	EnablePublicArchive bool     `koanf:"enable_public_archive"`
 	Lang                string   `koanf:"lang"`
 	DBBatchSize         int      `koanf:"batch_size"`
+	TxMaxAttachmentSize int      `koanf:"tx_max_attachment_size"`
+	TxLogEnabled        bool     `koanf:"tx_log_enabled"`
+	MetricsEnabled      bool     `koanf:"metrics_enabled"`
+	MetricsToken        string   `koanf:"metrics_token"`
 	Privacy             struct {
 		IndividualTracking bool            `koanf:"individual_tracking"`
 		AllowBlocklist     bool            `koanf:"allow_blocklist"`
 		AllowExport        bool            `koanf:"allow_export"`
 		AllowWipe          bool            `koanf:"allow_wipe"`
+		UnsubSurvey        bool            `koanf:"unsubscribe_survey"`
+		UnsubReasons       []string        `koanf:"unsubscribe_reasons"`
+		GeoIPDB            string          `koanf:"geoip_db"`
 		Exportable         map[string]bool `koanf:"-"`
 	} `koanf:"privacy"`
+	Security struct {
+		OIDCEnabled       bool   `koanf:"oidc_enabled"`
+		OIDCProviderURL   string `koanf:"oidc_provider_url"`
+		OIDCClientID      string `koanf:"oidc_client_id"`
+		OIDCClientSecret  string `koanf:"oidc_client_secret"`
+		OIDCUsernameClaim string `koanf:"oidc_username_claim"`
+		OIDCRoleClaim     string `koanf:"oidc_role_claim"`
+		OIDCDefaultRole   string `koanf:"oidc_default_role"`
+
+		// Claim value => user role.
+		OIDCRoleMap map[string]string `koanf:"-"`
+
+		RateLimitEnabled           bool   `koanf:"rate_limit_enabled"`
+		RateLimitStore             string `koanf:"rate_limit_store"`
+		RateLimitRedisURL          string `koanf:"rate_limit_redis_url"`
+		RateLimitTrustProxy        bool   `koanf:"rate_limit_trust_proxy"`
+		RateLimitSubscriptionRate  int    `koanf:"rate_limit_subscription_rate"`
+		RateLimitSubscriptionBurst int    `koanf:"rate_limit_subscription_burst"`
+		RateLimitTrackingRate      int    `koanf:"rate_limit_tracking_rate"`
+		RateLimitTrackingBurst     int    `koanf:"rate_limit_tracking_burst"`
+
+		CaptchaProvider   string `koanf:"captcha_provider"`
+		CaptchaSiteKey    string `koanf:"captcha_site_key"`
+		CaptchaSecret     string `koanf:"captcha_secret"`
+		FormMinSubmitTime int    `koanf:"form_min_submit_time"`
+
+		// Origins that are allowed to call the public JSON API from browsers.
+		CORSOrigins []string `koanf:"cors_origins"`
+
+		// Key for signing the load time of public forms. It's generated
+		// on install and isn't exposed by the settings API.
+		FormKey string `koanf:"form_key"`
+
+		// Key for signing the tokens of the hosted message pages of
+		// subscribers ({{ MessageURL }}). It's generated like FormKey.
+		MessageKey string `koanf:"message_key"`
+	} `koanf:"security"`
 	AdminUsername []byte `koanf:"admin_username"`
 	AdminPassword []byte `koanf:"admin_password"`
 
@@ -65,6 +124,13 @@ type constants struct {
 	OptinURL      string
 	MessageURL    string
 	MediaProvider string
+
+	// Width of thumbnails and the resized variants generated from uploaded images.
+	MediaThumbWidth int
+	MediaVariants   []mediaVariant
+
+	WebPushEnabled   bool
+	WebPushPublicKey string
 }
 
 func initFlags() {
@@ -85,6 +151,18 @@ func initFlags() {
 	f.String("static-dir", "", "(optional) path to directory with static files")
 	f.String("i18n-dir", "", "(optional) path to directory with i18n language files")
 	f.Bool("yes", false, "assume 'yes' to prompts, eg: during --install")
+	f.String("export-settings", "", "export the settings to a .toml or .json file and exit")
+	f.String("import-settings", "", "import the settings from a .toml or .json file and exit")
+	f.Bool("with-secrets", false, "include passwords and other secrets in --export-settings")
+	f.Bool("backup", false, "back up the DB, settings and media to the backup directory or S3 bucket and exit")
+	f.String("set-admin", "", "create an admin user or reset a user's password and 2FA and exit. The password is read from stdin or generated")
+	f.String("import-subscribers", "", "import subscribers from a CSV file into --lists and exit")
+	f.IntSlice("lists", []int{}, "IDs of the lists to import subscribers into with --import-subscribers")
+	f.String("import-mode", subimporter.ModeSubscribe, "mode of --import-subscribers: subscribe or blocklist")
+	f.Bool("overwrite", false, "overwrite the names and attributes of existing subscribers with --import-subscribers")
+	f.Int("start-campaign", 0, "start the draft or paused campaign with the given ID and exit")
+	f.Bool("maintenance", false, "create partitions, prune old analytics and tx logs, vacuum the DB and exit")
+	f.Bool("worker", false, "run as a sending worker that only processes campaigns alongside the main instance")
 	if err := f.Parse(os.Args[1:]); err != nil {
 		lo.Fatalf("error loading flags: %v", err)
 	}
@@ -222,6 +300,54 @@ func initDB() *sqlx.DB {
 	return db
 }
 
+// initReadReplica connects to the optional read replica of the DB. Its
+// config is merged on top of the primary DB's config so that only the fields
+// that differ, eg: host, need to be set. nil is returned if there's no replica.
+func initReadReplica() *sqlx.DB {
+	if ko.String("db.read_replica.host") == "" {
+		return nil
+	}
+
+	var dbCfg dbConf
+	if err := ko.Unmarshal("db", &dbCfg); err != nil {
+		lo.Fatalf("error loading db config: %v", err)
+	}
+	if err := ko.Unmarshal("db.read_replica", &dbCfg); err != nil {
+		lo.Fatalf("error loading db read replica config: %v", err)
+	}
+
+	lo.Printf("connecting to db read replica: %s:%d/%s", dbCfg.Host, dbCfg.Port, dbCfg.DBName)
+	db, err := connectDB(dbCfg)
+	if err != nil {
+		lo.Fatalf("error connecting to DB read replica: %v", err)
+	}
+	return db
+}
+
+// prepareReplicaQueries prepares the queries in replicaQueries on the read
+// replica in place of the ones prepared on the primary DB.
+func prepareReplicaQueries(q *Queries, qMap goyesql.Queries, db *sqlx.DB) {
+	var (
+		v = reflect.ValueOf(q).Elem()
+		t = v.Type()
+	)
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("query")
+		if !inArray(name, replicaQueries) {
+			continue
+		}
+		if _, ok := v.Field(i).Interface().(*sqlx.Stmt); !ok {
+			continue
+		}
+
+		stmt, err := db.Unsafe().Preparex(qMap[name].Query)
+		if err != nil {
+			lo.Fatalf("error preparing SQL query %s on the read replica: %v", name, err)
+		}
+		v.Field(i).Set(reflect.ValueOf(stmt))
+	}
+}
+
 // initQueries loads named SQL queries from the queries file and optionally
 // prepares them.
 func initQueries(sqlFile string, db *sqlx.DB, fs stuffbin.FileSystem, prepareQueries bool) (goyesql.Queries, *Queries) {
@@ -266,6 +392,20 @@ func initSettings(q *sqlx.Stmt) {
 	}
 }
 
+// initSecretKeys generates the random secret keys in the settings that
+// aren't set, which is the case on new installs.
+func initSecretKeys(q *Queries) {
+	for _, k := range []string{"security.form_key", "security.message_key"} {
+		v, err := generateRandomString(64)
+		if err != nil {
+			lo.Fatalf("error generating secret key %s: %v", k, err)
+		}
+		if _, err := q.InitSecretSetting.Exec(k, v); err != nil {
+			lo.Fatalf("error initializing secret key %s: %v", k, err)
+		}
+	}
+}
+
 func initConstants() *constants {
 	// Read constants.
 	var c constants
@@ -275,11 +415,24 @@ func initConstants() *constants {
 	if err := ko.Unmarshal("privacy", &c.Privacy); err != nil {
 		lo.Fatalf("error loading app config: %v", err)
 	}
+	if err := ko.Unmarshal("security", &c.Security); err != nil {
+		lo.Fatalf("error loading app config: %v", err)
+	}
+	c.Security.OIDCRoleMap = make(map[string]string)
+	for _, r := range ko.Slices("security.oidc_role_map") {
+		c.Security.OIDCRoleMap[r.String("value")] = r.String("role")
+	}
 
 	c.RootURL = strings.TrimRight(c.RootURL, "/")
 	c.Lang = ko.String("app.lang")
 	c.Privacy.Exportable = maps.StringSliceToLookupMap(ko.Strings("privacy.exportable"))
 	c.MediaProvider = ko.String("upload.provider")
+	c.MediaThumbWidth = ko.Int("upload.thumbnail_width")
+	for _, v := range ko.Slices("upload.image_variants") {
+		c.MediaVariants = append(c.MediaVariants, mediaVariant{Name: v.String("name"), Width: v.Int("width")})
+	}
+	c.WebPushEnabled = ko.Bool("webpush.enabled")
+	c.WebPushPublicKey = ko.String("webpush.vapid_public_key")
 
 	// Static URLS.
 	// url.com/subscription/{campaign_uuid}/{subscriber_uuid}
@@ -291,7 +444,7 @@ func initConstants() *constants {
 	// url.com/link/{campaign_uuid}/{subscriber_uuid}/{link_uuid}
 	c.LinkTrackURL = fmt.Sprintf("%s/link/%%s/%%s/%%s", c.RootURL)
 
-	// url.com/link/{campaign_uuid}/{subscriber_uuid}
+	// url.com/campaign/{campaign_uuid}/{subscriber_uuid}
 	c.MessageURL = fmt.Sprintf("%s/campaign/%%s/%%s", c.RootURL)
 
 	// url.com/campaign/{campaign_uuid}/{subscriber_uuid}/px.png
@@ -318,9 +471,33 @@ func initI18n(lang string, fs stuffbin.FileSystem) *i18n.I18n {
 // initCampaignManager initializes the campaign manager.
 func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 	campNotifCB := func(subject string, data interface{}) error {
+		// Campaigns are paused with a reason on errors.
+		if d, ok := data.(map[string]interface{}); ok && d["Reason"] != "" {
+			app.sendAlert(alertCampaignError, subject, fmt.Sprintf("%v", d["Reason"]))
+		}
 		return app.sendNotification(cs.NotifyEmails, subject, notifTplCampaign, data)
 	}
 
+	// Publish campaign sends to the event firehose.
+	var sentCB func(*models.Campaign, models.Subscriber)
+	if app.events != nil {
+		sentCB = func(c *models.Campaign, s models.Subscriber) {
+			app.events.Publish(events.TypeCampaignSent, campaignSentEvent{
+				CampaignID:     c.ID,
+				CampaignUUID:   c.UUID,
+				SubscriberUUID: s.UUID,
+			})
+		}
+	}
+
+	// Run the message render hooks.
+	var renderCB func(*models.Campaign, []models.Subscriber) ([]models.Subscriber, error)
+	if app.hooks.Has(hooks.EventMessageRender) {
+		renderCB = func(c *models.Campaign, subs []models.Subscriber) ([]models.Subscriber, error) {
+			return runRenderHooks(c, subs, app)
+		}
+	}
+
 	if ko.Int("app.concurrency") < 1 {
 		lo.Fatal("app.concurrency should be at least 1")
 	}
@@ -328,24 +505,58 @@ func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 		lo.Fatal("app.message_rate should be at least 1")
 	}
 
+	// Messenger -> fallback messenger.
+	failover := make(map[string]string)
+	for _, f := range ko.Slices("app.failover_messengers") {
+		failover[f.String("messenger")] = f.String("fallback")
+	}
+
+	var routes []manager.DomainRoute
+	for _, r := range ko.Slices("app.domain_routes") {
+		routes = append(routes, manager.DomainRoute{
+			Domain:    strings.ToLower(r.String("domain")),
+			Messenger: r.String("messenger"),
+		})
+	}
+
 	return manager.New(manager.Config{
-		BatchSize:             ko.Int("app.batch_size"),
-		Concurrency:           ko.Int("app.concurrency"),
-		MessageRate:           ko.Int("app.message_rate"),
-		MaxSendErrors:         ko.Int("app.max_send_errors"),
-		FromEmail:             cs.FromEmail,
-		IndividualTracking:    ko.Bool("privacy.individual_tracking"),
-		UnsubURL:              cs.UnsubURL,
-		OptinURL:              cs.OptinURL,
-		LinkTrackURL:          cs.LinkTrackURL,
-		ViewTrackURL:          cs.ViewTrackURL,
-		MessageURL:            cs.MessageURL,
-		UnsubHeader:           ko.Bool("privacy.unsubscribe_header"),
-		SlidingWindow:         ko.Bool("app.message_sliding_window"),
-		SlidingWindowDuration: ko.Duration("app.message_sliding_window_duration"),
-		SlidingWindowRate:     ko.Int("app.message_sliding_window_rate"),
-	}, newManagerDB(q), campNotifCB, app.i18n, lo)
+		BatchSize:          ko.Int("app.batch_size"),
+		Concurrency:        ko.Int("app.concurrency"),
+		MessageRate:        ko.Int("app.message_rate"),
+		MaxSendErrors:      ko.Int("app.max_send_errors"),
+		FromEmail:          cs.FromEmail,
+		IndividualTracking: ko.Bool("privacy.individual_tracking"),
+		UnsubURL:           cs.UnsubURL,
+		OptinURL:           cs.OptinURL,
+		LinkTrackURL:       cs.LinkTrackURL,
+		ViewTrackURL:       cs.ViewTrackURL,
+		MessageURL:         cs.MessageURL,
+		UnsubHeader:        ko.Bool("privacy.unsubscribe_header"),
+		RateLimits:         initRateLimits(),
+		Failover:           failover,
+		FailoverMaxErrors:  ko.Int("app.failover_max_errors"),
+		FailoverErrorRate:  ko.Int("app.failover_error_rate"),
+		FailoverCooldown:   ko.Duration("app.failover_cooldown"),
+		DomainRoutes:       routes,
+		Worker:             ko.Bool("worker"),
+		SentCB:             sentCB,
+		RenderCB:           renderCB,
+		LangCB:             app.getLang,
+		MessageTokenCB: func(campUUID, subUUID string) string {
+			return messageToken(campUUID, subUUID, cs.Security.MessageKey)
+		},
+	}, newManagerDB(q, db, app.instanceID), campNotifCB, app.i18n, lo)
+
+}
+
+// initRateLimits returns the send rate limits of messengers from the settings.
+func initRateLimits() map[string]manager.RateLimit {
+	var limits []rateLimit
+	if err := ko.UnmarshalWithConf("app.rate_limits", &limits, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		lo.Fatalf("error reading rate limits: %v", err)
+	}
 
+	return makeRateLimits(limits)
 }
 
 // initImporter initializes the bulk subscriber importer.
@@ -356,25 +567,31 @@ func initImporter(q *Queries, db *sqlx.DB, app *App) *subimporter.Importer {
 			BlocklistStmt:      q.UpsertBlocklistSubscriber.Stmt,
 			UpdateListDateStmt: q.UpdateListsDate.Stmt,
 			NotifCB: func(subject string, data interface{}) error {
+				if s := app.importer.GetStats(); s.Status == subimporter.StatusFailed {
+					app.sendAlert(alertImportFailed, subject,
+						fmt.Sprintf("Imported %d of %d records from %s.", s.Imported, s.Total, s.Name))
+				}
 				app.sendNotification(app.constants.NotifyEmails, subject, notifTplImport, data)
 				return nil
 			},
 		}, db.DB)
 }
 
-// initSMTPMessenger initializes the SMTP messenger.
-func initSMTPMessenger(m *manager.Manager) messenger.Messenger {
-	var (
-		mapKeys = ko.MapKeys("smtp")
-		servers = make([]email.Server, 0, len(mapKeys))
-	)
-
+// initSMTPMessengers initializes the SMTP messengers. SMTP servers are grouped
+// into pools by their `pool` name and each pool is a messenger of the same name
+// that rotates messages across its servers. Servers without a pool make up the
+// default `email` messenger.
+func initSMTPMessengers(m *manager.Manager) []messenger.Messenger {
 	items := ko.Slices("smtp")
 	if len(items) == 0 {
 		lo.Fatalf("no SMTP servers found in config")
 	}
 
-	// Load the config for multipme SMTP servers.
+	// Load the config for multiple SMTP servers.
+	var (
+		pools = make(map[string][]email.Server)
+		names []string
+	)
 	for _, item := range items {
 		if !item.Bool("enabled") {
 			continue
@@ -386,59 +603,68 @@ func initSMTPMessenger(m *manager.Manager) messenger.Messenger {
 			lo.Fatalf("error reading SMTP config: %v", err)
 		}
 
-		servers = append(servers, s)
-		lo.Printf("loaded email (SMTP) messenger: %s@%s",
-			item.String("username"), item.String("host"))
-	}
-	if len(servers) == 0 {
-		lo.Fatalf("no SMTP servers enabled in settings")
-	}
+		name := item.String("pool")
+		if name == "" {
+			name = emailMsgr
+		}
+		if _, ok := pools[name]; !ok {
+			names = append(names, name)
+		}
+		pools[name] = append(pools[name], s)
 
-	// Initialize the e-mail messenger with multiple SMTP servers.
-	msgr, err := email.New(servers...)
-	if err != nil {
-		lo.Fatalf("error loading e-mail messenger: %v", err)
+		lo.Printf("loaded email (SMTP) messenger: %s@%s (%s)",
+			item.String("username"), item.String("host"), name)
 	}
-
-	return msgr
-}
-
-// initPostbackMessengers initializes and returns all the enabled
-// HTTP postback messenger backends.
-func initPostbackMessengers(m *manager.Manager) []messenger.Messenger {
-	items := ko.Slices("messengers")
-	if len(items) == 0 {
-		return nil
+	if _, ok := pools[emailMsgr]; !ok {
+		lo.Fatalf("no SMTP servers enabled in settings")
 	}
 
-	var out []messenger.Messenger
-	for _, item := range items {
+	// DKIM keys for signing messages from sending domains.
+	var keys []email.DKIMKey
+	for _, item := range ko.Slices("dkim") {
 		if !item.Bool("enabled") {
 			continue
 		}
 
-		// Read the Postback server config.
-		var (
-			name = item.String("name")
-			o    postback.Options
-		)
-		if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-			lo.Fatalf("error reading Postback config: %v", err)
+		var k email.DKIMKey
+		if err := item.UnmarshalWithConf("", &k, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading DKIM config: %v", err)
 		}
+		keys = append(keys, k)
+
+		lo.Printf("loaded DKIM key: %s._domainkey.%s", k.Selector, k.Domain)
+	}
 
-		// Initialize the Messenger.
-		p, err := postback.New(o)
+	// Initialize an e-mail messenger for every pool of SMTP servers.
+	out := make([]messenger.Messenger, 0, len(names))
+	for _, name := range names {
+		msgr, err := email.New(name, keys, pools[name]...)
 		if err != nil {
-			lo.Fatalf("error initializing Postback messenger %s: %v", name, err)
+			lo.Fatalf("error loading e-mail messenger: %v", err)
 		}
-		out = append(out, p)
-
-		lo.Printf("loaded Postback messenger: %s", name)
+		out = append(out, msgr)
 	}
 
 	return out
 }
 
+// initWebPushMessenger initializes and returns the web push messenger.
+func initWebPushMessenger(q *Queries, cs *constants) messenger.Messenger {
+	var o webpush.Options
+	if err := ko.UnmarshalWithConf("webpush", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		lo.Fatalf("error reading web push config: %v", err)
+	}
+	o.RootURL = cs.RootURL
+
+	w, err := webpush.New(o, &pushStore{q: q})
+	if err != nil {
+		lo.Fatalf("error initializing web push messenger: %v", err)
+	}
+	lo.Println("loaded web push messenger")
+
+	return w
+}
+
 // initMediaStore initializes Upload manager with a custom backend.
 func initMediaStore() media.Store {
 	switch provider := ko.String("upload.provider"); provider {
@@ -472,9 +698,167 @@ func initMediaStore() media.Store {
 	return nil
 }
 
+// initEvents initializes the event bus that publishes tracking, sending and
+// subscription events to the configured firehose sink.
+func initEvents() *events.Bus {
+	var (
+		sink    events.Sink
+		timeout = time.Second * 10
+	)
+
+	switch s := ko.String("events.sink"); s {
+	case "webhook":
+		sink = events.NewWebhook(ko.String("events.url"), timeout)
+	case "nats":
+		n, err := events.NewNATS(ko.String("events.url"), ko.String("events.nats_subject"), timeout)
+		if err != nil {
+			lo.Fatalf("error initializing NATS event sink: %v", err)
+		}
+		sink = n
+	default:
+		lo.Fatalf("unknown event sink: %s", s)
+	}
+
+	lo.Printf("publishing events to: %s", sink.Name())
+	return events.New(sink, events.Opts{
+		BatchSize:     ko.Int("events.batch_size"),
+		FlushInterval: time.Second,
+	}, lo)
+}
+
+// initAlerts loads the enabled admin alert channels from the settings. It
+// returns nil if there are none.
+func initAlerts() *alerter {
+	var chans []alertChannel
+	for _, item := range ko.Slices("alerts") {
+		if !item.Bool("enabled") {
+			continue
+		}
+
+		var ch alertChannel
+		if err := item.UnmarshalWithConf("", &ch, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading alert channel config: %v", err)
+		}
+		chans = append(chans, ch)
+	}
+	if len(chans) == 0 {
+		return nil
+	}
+
+	lo.Printf("loaded %d alert channels", len(chans))
+	return &alerter{channels: chans, sent: make(map[string]time.Time)}
+}
+
+// initLogs sets up the optional log file and the JSON log format. The
+// buffered log for the UI always has text lines.
+func initLogs() {
+	var out io.Writer = os.Stdout
+	if p := ko.String("log.file"); p != "" {
+		f, err := buflog.NewFile(p, ko.Int64("log.max_size")*1024*1024, ko.Int("log.max_backups"))
+		if err != nil {
+			lo.Fatalf("error opening log file: %v", err)
+		}
+		logFile = f
+		out = io.MultiWriter(os.Stdout, f)
+	}
+
+	switch f := ko.String("log.format"); f {
+	case "", "text":
+	case "json":
+		out = buflog.NewJSONWriter(out)
+	default:
+		lo.Fatalf("unknown log format: %s", f)
+	}
+
+	lo.SetOutput(io.MultiWriter(out, bufLog))
+}
+
+// initHooks loads the external command hooks from the config.
+func initHooks() *hooks.Hooks {
+	var list []hooks.Hook
+	for _, h := range ko.Slices("hooks") {
+		list = append(list, hooks.Hook{
+			Event:   h.String("event"),
+			Command: h.String("command"),
+			Args:    h.Strings("args"),
+			Timeout: h.Duration("timeout"),
+			OnError: h.String("on_error"),
+		})
+	}
+
+	h, err := hooks.New(list, lo)
+	if err != nil {
+		lo.Fatalf("error loading hooks: %v", err)
+	}
+	lo.Printf("loaded %d hooks", len(list))
+	return h
+}
+
+// initGeoIP loads a MaxMind (GeoLite2 Country or City) DB for looking up the
+// location of campaign views and link clicks. A DB that fails to load only
+// disables the lookups.
+func initGeoIP(path string) *geoip.DB {
+	g, err := geoip.Open(path)
+	if err != nil {
+		lo.Printf("error loading GeoIP DB: %v", err)
+		return nil
+	}
+	lo.Printf("loaded GeoIP DB: %s", path)
+	return g
+}
+
+// initOIDC initializes the OIDC provider for single sign-on.
+func initOIDC(cs *constants) *oidc.Provider {
+	p, err := oidc.New(oidc.Config{
+		ProviderURL:  cs.Security.OIDCProviderURL,
+		ClientID:     cs.Security.OIDCClientID,
+		ClientSecret: cs.Security.OIDCClientSecret,
+		RedirectURL:  cs.RootURL + "/auth/oidc/callback",
+	})
+	if err != nil {
+		lo.Fatalf("error initializing OIDC: %v", err)
+	}
+	return p
+}
+
+// initCaptcha initializes the CAPTCHA provider of public forms.
+func initCaptcha(cs *constants) *captcha.Captcha {
+	c, err := captcha.New(cs.Security.CaptchaProvider, cs.Security.CaptchaSiteKey,
+		cs.Security.CaptchaSecret, time.Second*5)
+	if err != nil {
+		lo.Fatalf("error initializing CAPTCHA: %v", err)
+	}
+	return c
+}
+
+// initRateLimiter initializes the per IP rate limiter of public endpoints.
+func initRateLimiter(cs *constants) *ratelimit.Limiter {
+	var store ratelimit.Store = ratelimit.NewMemory()
+	if cs.Security.RateLimitStore == "redis" {
+		r, err := ratelimit.NewRedis(cs.Security.RateLimitRedisURL, time.Second*2)
+		if err != nil {
+			lo.Printf("error initializing Redis rate limit store. Using memory: %v", err)
+		} else {
+			store = r
+		}
+	}
+
+	lo.Printf("rate limiting public endpoints (store: %s)", store.Name())
+	return ratelimit.New(store, lo)
+}
+
 // initNotifTemplates compiles and returns e-mail notification templates that are
 // used for sending ad-hoc notifications to admins and subscribers.
-func initNotifTemplates(path string, fs stuffbin.FileSystem, i *i18n.I18n, cs *constants) *template.Template {
+func initNotifTemplates(path string, fs stuffbin.FileSystem, i *i18n.I18n, cs *constants, m *manager.Manager) *template.Template {
+	tpl, err := parseNotifTemplates(path, fs, i, cs, m)
+	if err != nil {
+		lo.Fatalf("error parsing e-mail notif templates: %v", err)
+	}
+	return tpl
+}
+
+// parseNotifTemplates compiles the e-mail notification templates with a language.
+func parseNotifTemplates(path string, fs stuffbin.FileSystem, i *i18n.I18n, cs *constants, m *manager.Manager) (*template.Template, error) {
 	// Register utility functions that the e-mail templates can use.
 	funcs := template.FuncMap{
 		"RootURL": func() string {
@@ -487,12 +871,9 @@ func initNotifTemplates(path string, fs stuffbin.FileSystem, i *i18n.I18n, cs *c
 			return i
 		},
 	}
+	funcs["Partial"] = m.PartialFunc(funcs)
 
-	tpl, err := stuffbin.ParseTemplatesGlob(funcs, fs, "/static/email-templates/*.html")
-	if err != nil {
-		lo.Fatalf("error parsing e-mail notif templates: %v", err)
-	}
-	return tpl
+	return stuffbin.ParseTemplatesGlob(funcs, fs, "/static/email-templates/*.html")
 }
 
 // initHTTPServer sets up and runs the app's main HTTP server and blocks forever.
@@ -501,6 +882,9 @@ func initHTTPServer(app *App) *echo.Echo {
 	var srv = echo.New()
 	srv.HideBanner = true
 
+	// Serve versioned API paths.
+	srv.Pre(versionAPI)
+
 	// Register app (*App) to be injected into all HTTP handlers.
 	srv.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -509,6 +893,11 @@ func initHTTPServer(app *App) *echo.Echo {
 		}
 	})
 
+	// Record HTTP request metrics.
+	if app.metrics != nil {
+		srv.Use(app.metrics.middleware)
+	}
+
 	// Parse and load user facing templates.
 	tpl, err := stuffbin.ParseTemplatesGlob(template.FuncMap{
 		"L": func() *i18n.I18n {
@@ -517,11 +906,17 @@ func initHTTPServer(app *App) *echo.Echo {
 	if err != nil {
 		lo.Fatalf("error parsing public templates: %v", err)
 	}
+	base, err := tpl.Clone()
+	if err != nil {
+		lo.Fatalf("error parsing public templates: %v", err)
+	}
 	srv.Renderer = &tplRenderer{
 		templates:  tpl,
 		RootURL:    app.constants.RootURL,
 		LogoURL:    app.constants.LogoURL,
-		FaviconURL: app.constants.FaviconURL}
+		FaviconURL: app.constants.FaviconURL,
+		base:       base,
+		pageTpls:   make(map[pageTplKey]*template.Template)}
 
 	// Initialize the static file server.
 	fSrv := app.fs.FileServer()
@@ -532,12 +927,22 @@ func initHTTPServer(app *App) *echo.Echo {
 			ko.String("upload.filesystem.upload_path"))
 	}
 
-	// Register all HTTP handlers.
+	// Register all HTTP handlers. API routes without docs would be missing
+	// from the published spec.
 	registerHTTPHandlers(srv, app)
+	if r := checkAPIDocs(srv); len(r) > 0 {
+		lo.Fatalf("API routes missing in apiDocs: %s", strings.Join(r, ", "))
+	}
 
 	// Start the server.
 	go func() {
-		if err := srv.Start(ko.String("app.address")); err != nil {
+		var err error
+		if ko.Bool("tls.enabled") {
+			err = startAutoTLS(srv)
+		} else {
+			err = srv.Start(ko.String("app.address"))
+		}
+		if err != nil {
 			if strings.Contains(err.Error(), "Server closed") {
 				lo.Println("HTTP server shut down")
 			} else {
@@ -549,6 +954,46 @@ func initHTTPServer(app *App) *echo.Echo {
 	return srv
 }
 
+// startAutoTLS starts the HTTPS server on the app address with certificates
+// for the configured domains that are provisioned and renewed automatically
+// from an ACME CA (Let's Encrypt by default). Certificates are validated with
+// TLS-ALPN-01 on the HTTPS address and, if there's an HTTP address, HTTP-01
+// on it, where other requests are redirected to HTTPS.
+func startAutoTLS(srv *echo.Echo) error {
+	domains := ko.Strings("tls.domains")
+	if len(domains) == 0 {
+		return errors.New("tls.domains should have at least one domain")
+	}
+
+	dir := ko.String("tls.cache_dir")
+	if dir == "" {
+		dir = "certs"
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(dir),
+		Email:      ko.String("tls.email"),
+	}
+	if u := ko.String("tls.directory_url"); u != "" {
+		m.Client = &acme.Client{DirectoryURL: u}
+	}
+
+	if addr := ko.String("tls.http_address"); addr != "" {
+		go func() {
+			if err := http.ListenAndServe(addr, m.HTTPHandler(nil)); err != nil {
+				lo.Printf("error starting ACME HTTP server: %v", err)
+			}
+		}()
+	}
+
+	lo.Printf("automatic TLS enabled for %s", strings.Join(domains, ", "))
+	srv.TLSServer.Addr = ko.String("app.address")
+	srv.TLSServer.TLSConfig = m.TLSConfig()
+	return srv.StartServer(srv.TLSServer)
+}
+
 func awaitReload(sigChan chan os.Signal, closerWait chan bool, closer func()) chan bool {
 	// The blocking signal handler that main() waits on.
 	out := make(chan bool)
@@ -561,19 +1006,26 @@ func awaitReload(sigChan chan os.Signal, closerWait chan bool, closer func()) ch
 		os.Exit(0)
 	}
 
-	// Listen for reload signal.
+	// Listen for reload signal. Other signals shut the app down after
+	// the closer.
 	go func() {
-		for range sigChan {
-			lo.Println("reloading on signal ...")
+		for sig := range sigChan {
+			next := respawn
+			if sig == syscall.SIGHUP {
+				lo.Println("reloading on signal ...")
+			} else {
+				lo.Println("shutting down on signal ...")
+				next = func() { os.Exit(0) }
+			}
 
 			go closer()
 			select {
 			case <-closerWait:
 				// Wait for the closer to finish.
-				respawn()
+				next()
 			case <-time.After(time.Second * 3):
 				// Or timeout and force close.
-				respawn()
+				next()
 			}
 		}
 	}()
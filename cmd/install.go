@@ -61,6 +61,10 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		models.ListTypePrivate,
 		models.ListOptinSingle,
 		pq.StringArray{"test"},
+		nil,
+		"",
+		"",
+		"",
 	); err != nil {
 		lo.Fatalf("Error creating list: %v", err)
 	}
@@ -70,6 +74,10 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		models.ListTypePublic,
 		models.ListOptinDouble,
 		pq.StringArray{"test"},
+		nil,
+		"",
+		"",
+		"",
 	); err != nil {
 		lo.Fatalf("Error creating list: %v", err)
 	}
@@ -106,6 +114,10 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 	if err := q.CreateTemplate.Get(&tplID,
 		"Default template",
 		string(tplBody.ReadBytes()),
+		"",
+		models.TemplateTypeCampaign,
+		"",
+		nil,
 	); err != nil {
 		lo.Fatalf("error creating default template: %v", err)
 	}
@@ -113,6 +125,22 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		lo.Fatalf("error setting default template: %v", err)
 	}
 
+	// Sample transactional template.
+	txBody, err := fs.Get("/static/email-templates/sample-tx.tpl")
+	if err != nil {
+		lo.Fatalf("error reading sample transactional template: %v", err)
+	}
+	if err := q.CreateTemplate.Get(&tplID,
+		"Sample transactional template",
+		string(txBody.ReadBytes()),
+		"",
+		models.TemplateTypeTx,
+		"Welcome {{ .Subscriber.Name }}",
+		models.TemplateData{"order_id": "1234", "shipping_date": "2021-04-01"},
+	); err != nil {
+		lo.Fatalf("error creating sample transactional template: %v", err)
+	}
+
 	// Sample campaign.
 	if _, err := q.CreateCampaign.Exec(uuid.Must(uuid.NewV4()),
 		models.CampaignTypeRegular,
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/knadh/listmonk/models"
@@ -30,11 +31,12 @@ func handleGetLists(c echo.Context) error {
 		app = c.Get("app").(*App)
 		out listsWrap
 
-		pg        = getPagination(c.QueryParams(), 20)
-		orderBy   = c.FormValue("order_by")
-		order     = c.FormValue("order")
-		listID, _ = strconv.Atoi(c.Param("id"))
-		single    = false
+		pg          = getPagination(c.QueryParams(), 20)
+		orderBy     = c.FormValue("order_by")
+		order       = c.FormValue("order")
+		listID, _   = strconv.Atoi(c.Param("id"))
+		folderID, _ = strconv.Atoi(c.FormValue("folder_id"))
+		single      = false
 	)
 
 	// Fetch one list.
@@ -50,7 +52,17 @@ func handleGetLists(c echo.Context) error {
 		order = sortAsc
 	}
 
-	if err := db.Select(&out.Results, fmt.Sprintf(app.queries.QueryLists, orderBy, order), listID, pg.Offset, pg.Limit); err != nil {
+	// Limit the lists to a particular folder?
+	folderListIDs, err := getFolderListIDs(folderID, app)
+	if err != nil {
+		return err
+	}
+
+	// List-restricted editors only see their lists.
+	folderListIDs = filterListIDs(getUser(c), folderListIDs)
+
+	if err := db.Select(&out.Results, fmt.Sprintf(app.queries.QueryLists, orderBy, order),
+		listID, pg.Offset, pg.Limit, folderListIDs); err != nil {
 		app.log.Printf("error fetching lists: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -97,6 +109,12 @@ func handleCreateList(c echo.Context) error {
 	if !strHasLen(o.Name, 1, stdInputMaxLen) {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
 	}
+	if err := validateListSender(&o, app); err != nil {
+		return err
+	}
+	if err := validateDynamicList(&o, app); err != nil {
+		return err
+	}
 
 	uu, err := uuid.NewV4()
 	if err != nil {
@@ -113,13 +131,24 @@ func handleCreateList(c echo.Context) error {
 		o.Name,
 		o.Type,
 		o.Optin,
-		pq.StringArray(normalizeTags(o.Tags))); err != nil {
+		pq.StringArray(normalizeTags(o.Tags)),
+		o.FolderID,
+		o.Query,
+		o.FromEmail,
+		o.ReplyTo,
+		o.PageTemplateID,
+		o.UnsubHeader,
+		o.UnsubHeaderVal); err != nil {
 		app.log.Printf("error creating list: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorCreating",
 				"name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
 
+	if err := syncListIfDynamic(newID, app); err != nil {
+		return err
+	}
+
 	// Hand over to the GET handler to return the last insertion.
 	return handleGetLists(copyEchoCtx(c, map[string]string{
 		"id": fmt.Sprintf("%d", newID),
@@ -143,8 +172,39 @@ func handleUpdateList(c echo.Context) error {
 		return err
 	}
 
+	// A request without a type (eg: a rename) keeps the list's type and
+	// a dynamic list's saved query.
+	if o.Type == "" || o.Query == "" {
+		var cur []models.List
+		if err := app.queries.GetListsByOptin.Select(&cur, "", pq.Int64Array{int64(id)}, nil); err != nil {
+			app.log.Printf("error fetching list: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.list}", "error", pqErrMsg(err)))
+		}
+		if len(cur) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
+		}
+
+		if o.Type == "" {
+			o.Type = cur[0].Type
+		}
+		if o.Type == models.ListTypeDynamic && o.Query == "" {
+			o.Query = cur[0].Query
+		}
+	}
+
+	if err := validateListSender(&o, app); err != nil {
+		return err
+	}
+	if err := validateDynamicList(&o, app); err != nil {
+		return err
+	}
+
 	res, err := app.queries.UpdateList.Exec(id,
-		o.Name, o.Type, o.Optin, pq.StringArray(normalizeTags(o.Tags)))
+		o.Name, o.Type, o.Optin, pq.StringArray(normalizeTags(o.Tags)), o.FolderID, o.Query,
+		o.FromEmail, o.ReplyTo, o.PageTemplateID, o.UnsubHeader, o.UnsubHeaderVal)
 	if err != nil {
 		app.log.Printf("error updating list: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -157,6 +217,10 @@ func handleUpdateList(c echo.Context) error {
 			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
 	}
 
+	if err := syncListIfDynamic(id, app); err != nil {
+		return err
+	}
+
 	return handleGetLists(c)
 }
 
@@ -186,3 +250,240 @@ func handleDeleteLists(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
+
+// handleGetListFolders handles retrieval of list folders.
+func handleGetListFolders(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.ListFolder
+
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if err := app.queries.GetListFolders.Select(&out, id); err != nil {
+		app.log.Printf("error fetching list folders: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.folders}", "error", pqErrMsg(err)))
+	}
+	if id > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.folder}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateListFolder handles list folder creation.
+func handleCreateListFolder(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   = models.ListFolder{}
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidFolderName"))
+	}
+
+	var newID int
+	if err := app.queries.CreateListFolder.Get(&newID, o.Name, o.ParentID); err != nil {
+		app.log.Printf("error creating list folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetListFolders(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateListFolder handles list folder modification.
+func handleUpdateListFolder(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o models.ListFolder
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+	if o.Name != "" && !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidFolderName"))
+	}
+
+	// Check that the folder exists so that a failed update can only mean
+	// an invalid parent.
+	var cur []models.ListFolder
+	if err := app.queries.GetListFolders.Select(&cur, id); err != nil {
+		app.log.Printf("error fetching list folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+	if len(cur) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.folder}"))
+	}
+
+	res, err := app.queries.UpdateListFolder.Exec(id, o.Name, o.ParentID)
+	if err != nil {
+		app.log.Printf("error updating list folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+
+	// The folder can't be moved under itself or its own sub-folders.
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidFolderParent"))
+	}
+
+	return handleGetListFolders(c)
+}
+
+// handleDeleteListFolder handles list folder deletion. Lists and sub-folders
+// in the folder are moved to the root.
+func handleDeleteListFolder(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeleteListFolder.Exec(id); err != nil {
+		app.log.Printf("error deleting list folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// getFolderListIDs returns the IDs of all lists in a folder and its sub-folders
+// for filtering lists, campaigns, and subscribers by folder. If there's no
+// folder, a nil slice is returned, which disables the filter in the queries.
+func getFolderListIDs(folderID int, app *App) (pq.Int64Array, error) {
+	if folderID < 1 {
+		return nil, nil
+	}
+
+	var out pq.Int64Array
+	if err := app.queries.GetListFolderListIDs.Get(&out, folderID); err != nil {
+		app.log.Printf("error fetching folder lists: %v", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+
+	// An empty, non-nil slice matches nothing.
+	if out == nil {
+		out = pq.Int64Array{}
+	}
+	return out, nil
+}
+
+// validateListSender validates the optional default sender, reply-to and
+// List-Unsubscribe header of a list that campaigns sent to the list inherit.
+func validateListSender(o *models.List, app *App) error {
+	if o.FromEmail != "" && !isFromAddress(o.FromEmail) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidFromEmail"))
+	}
+	if o.ReplyTo != "" && !isFromAddress(o.ReplyTo) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidReplyTo"))
+	}
+
+	v, err := validateUnsubHeader(o.UnsubHeader, o.UnsubHeaderVal, app)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	o.UnsubHeaderVal = v
+
+	return nil
+}
+
+// validateDynamicList validates the saved subscriber query of a dynamic list
+// by dry running it. The query is discarded for other list types.
+func validateDynamicList(o *models.List, app *App) error {
+	if o.Type != models.ListTypeDynamic {
+		o.Query = ""
+		return nil
+	}
+
+	o.Query = sanitizeSQLExp(o.Query)
+	if o.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidQuery"))
+	}
+	if _, err := app.queries.compileSubscriberQueryTpl(o.Query, app.db); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+
+	// Membership is decided by the query and not by opt-in.
+	o.Optin = models.ListOptinSingle
+	return nil
+}
+
+// syncListIfDynamic syncs the subscriptions of a list with its saved
+// query if it's a dynamic list.
+func syncListIfDynamic(id int, app *App) error {
+	var lists []models.List
+	if err := app.queries.GetDynamicLists.Select(&lists, id); err != nil {
+		app.log.Printf("error fetching dynamic lists: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.list}", "error", pqErrMsg(err)))
+	}
+
+	for _, l := range lists {
+		if err := app.queries.syncDynamicList(l, app.db); err != nil {
+			app.log.Printf("error syncing dynamic list: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("lists.errorSyncing", "error", pqErrMsg(err)))
+		}
+	}
+
+	return nil
+}
+
+// syncDynamicLists is a blocking function that periodically syncs the
+// subscriptions of all dynamic lists with their saved queries so that
+// their subscriber counts stay current.
+func syncDynamicLists(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var lists []models.List
+		if err := app.queries.GetDynamicLists.Select(&lists, 0); err != nil {
+			app.log.Printf("error fetching dynamic lists: %v", err)
+			continue
+		}
+
+		for _, l := range lists {
+			if err := app.queries.syncDynamicList(l, app.db); err != nil {
+				app.log.Printf("error syncing dynamic list %d: %v", l.ID, err)
+			}
+		}
+	}
+}
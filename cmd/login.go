@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/qrcode"
+	"github.com/knadh/listmonk/internal/totp"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	tplLogin = "login"
+
+	// Number of one-time recovery codes generated when 2FA is enabled.
+	totpRecoveryCodes = 10
+
+	// Number of failed logins after which a username is locked out on an IP
+	// and the duration of the lockout.
+	loginMaxFails = 10
+	loginLockout  = time.Minute * 15
+)
+
+// loginGuard counts the failed logins of usernames per client IP and locks
+// them out after loginMaxFails failures so that passwords and 2FA codes can't
+// be guessed. It's always on, irrespective of the per IP rate limits. Lockouts
+// are per IP so that nobody can lock a user, including the superuser in the
+// config, out everywhere by failing logins with their username.
+type loginGuard struct {
+	fails map[string]loginFails
+	sync.Mutex
+}
+
+type loginFails struct {
+	count int
+	last  time.Time
+}
+
+type loginTpl struct {
+	publicTpl
+	Username   string
+	Error      string
+	SSOEnabled bool
+}
+
+type totpReq struct {
+	Code string `json:"code"`
+}
+
+// handleLoginPage renders the admin login page and logs users in with their
+// password and, if they've enabled it, a two-factor (TOTP) or recovery code.
+func handleLoginPage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = loginTpl{SSOEnabled: app.oidc != nil}
+	)
+	out.Title = app.i18n.T("users.login")
+
+	if c.Request().Method != http.MethodPost {
+		return c.Render(http.StatusOK, tplLogin, out)
+	}
+
+	var (
+		username = strings.TrimSpace(c.FormValue("username"))
+		password = c.FormValue("password")
+		code     = c.FormValue("code")
+	)
+	out.Username = username
+
+	ip := clientIP(c, app)
+	if app.loginGuard.locked(username, ip) {
+		out.Error = app.i18n.T("users.loginLocked")
+		return c.Render(http.StatusTooManyRequests, tplLogin, out)
+	}
+
+	u, ok := loginUser(username, password, code, app)
+	if !ok {
+		app.loginGuard.fail(username, ip)
+		out.Error = app.i18n.T("users.invalidLogin")
+		return c.Render(http.StatusUnauthorized, tplLogin, out)
+	}
+	app.loginGuard.reset(username, ip)
+
+	if err := startSession(c, u, app); err != nil {
+		out.Error = app.i18n.T("public.errorProcessingRequest")
+		return c.Render(http.StatusInternalServerError, tplLogin, out)
+	}
+
+	return c.Redirect(http.StatusFound, app.constants.RootURL+"/")
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{fails: make(map[string]loginFails)}
+}
+
+// locked checks whether a username is locked out on an IP.
+func (g *loginGuard) locked(username, ip string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	f, ok := g.fails[loginKey(username, ip)]
+	return ok && f.count >= loginMaxFails && time.Since(f.last) < loginLockout
+}
+
+// fail records a failed login of a username from an IP.
+func (g *loginGuard) fail(username, ip string) {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+
+	// Drop the failures that have expired to keep the map from growing
+	// with the usernames of a guessing spree.
+	if len(g.fails) > 10000 {
+		for k, f := range g.fails {
+			if now.Sub(f.last) >= loginLockout {
+				delete(g.fails, k)
+			}
+		}
+	}
+
+	k := loginKey(username, ip)
+	f := g.fails[k]
+	if now.Sub(f.last) >= loginLockout {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	g.fails[k] = f
+}
+
+// reset clears the failed logins of a username on an IP after a successful
+// login.
+func (g *loginGuard) reset(username, ip string) {
+	g.Lock()
+	delete(g.fails, loginKey(username, ip))
+	g.Unlock()
+}
+
+// loginKey returns the key of the failed logins of a username on an IP.
+func loginKey(username, ip string) string {
+	return strings.ToLower(username) + "|" + ip
+}
+
+// loginUser authenticates a user logging in on the login page. The superuser
+// in the config has no 2FA.
+func loginUser(username, password, code string, app *App) (models.User, bool) {
+	if len(app.constants.AdminUsername) > 0 && len(app.constants.AdminPassword) > 0 &&
+		subtle.ConstantTimeCompare([]byte(username), app.constants.AdminUsername) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), app.constants.AdminPassword) == 1 {
+		return makeSuperuser(username), true
+	}
+
+	u, ok := authUser(username, password, app)
+	if !ok {
+		return models.User{}, false
+	}
+	if u.TOTPEnabled && !checkTOTP(u, code, app) {
+		return models.User{}, false
+	}
+	return u, true
+}
+
+// handleGetProfile returns the user making the request.
+func handleGetProfile(c echo.Context) error {
+	return c.JSON(http.StatusOK, okResp{getUser(c)})
+}
+
+// handleSetupTOTP generates a new TOTP secret for the user making the request
+// and returns it along with the QR code that authenticator apps enroll from.
+// 2FA is enabled once a code from the app is confirmed.
+func handleSetupTOTP(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	u, err := getProfileUser(c, app)
+	if err != nil {
+		return err
+	}
+	if u.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.totpAlreadyEnabled"))
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	var (
+		uri = totp.URI("listmonk", u.Username, secret)
+		qr  = ""
+	)
+	if q, err := qrcode.Encode([]byte(uri)); err == nil {
+		if b, err := q.PNG(4); err == nil {
+			qr = "data:image/png;base64," + base64.StdEncoding.EncodeToString(b)
+		}
+	}
+
+	if _, err := app.queries.UpdateUserTOTP.Exec(u.ID, secret, false, pq.StringArray{}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		QR     string `json:"qr"`
+	}{secret, uri, qr}})
+}
+
+// handleEnableTOTP confirms a code from the authenticator app, enables 2FA
+// for the user making the request and returns the one-time recovery codes.
+func handleEnableTOTP(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req totpReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	u, err := getProfileUser(c, app)
+	if err != nil {
+		return err
+	}
+	if u.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.totpAlreadyEnabled"))
+	}
+	if u.TOTPSecret == "" || !checkTOTPCode(u, req.Code, app) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.invalidTotpCode"))
+	}
+
+	var (
+		codes  = make([]string, totpRecoveryCodes)
+		hashes = make(pq.StringArray, totpRecoveryCodes)
+	)
+	for i := range codes {
+		s, err := generateRandomString(10)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		codes[i] = s
+		hashes[i] = hashToken(s)
+	}
+
+	if _, err := app.queries.UpdateUserTOTP.Exec(u.ID, u.TOTPSecret, true, hashes); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+	app.userAuth.clear()
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes}})
+}
+
+// handleDisableTOTP disables 2FA for the user making the request with
+// a valid code.
+func handleDisableTOTP(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req totpReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	u, err := getProfileUser(c, app)
+	if err != nil {
+		return err
+	}
+	if u.TOTPEnabled && !checkTOTP(u, req.Code, app) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.invalidTotpCode"))
+	}
+
+	return resetTOTP(c, u.ID, app)
+}
+
+// handleResetUserTOTP disables 2FA for a user, eg: one who has lost their
+// authenticator and recovery codes.
+func handleResetUserTOTP(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	return resetTOTP(c, id, app)
+}
+
+// resetTOTP disables 2FA for a user and clears their secret.
+func resetTOTP(c echo.Context, id int, app *App) error {
+	if _, err := app.queries.UpdateUserTOTP.Exec(id, "", false, pq.StringArray{}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+	app.userAuth.clear()
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// getProfileUser returns the user making the request from the DB along with
+// their TOTP secret. The superuser in the config and the unnamed admin when
+// auth is disabled have no profile.
+func getProfileUser(c echo.Context, app *App) (models.User, error) {
+	cu := getUser(c)
+	if cu.ID == 0 {
+		return models.User{}, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("users.noProfile"))
+	}
+
+	var u models.User
+	if err := app.queries.GetUserByUsername.Get(&u, cu.Username); err != nil {
+		if err == sql.ErrNoRows {
+			return u, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.user}"))
+		}
+		return u, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.user}", "error", pqErrMsg(err)))
+	}
+
+	return u, nil
+}
+
+// checkTOTP checks a user's TOTP code or one of their one-time recovery
+// codes, which is used up.
+func checkTOTP(u models.User, code string, app *App) bool {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false
+	}
+	if checkTOTPCode(u, code, app) {
+		return true
+	}
+
+	res, err := app.queries.UseTOTPRecoveryCode.Exec(u.ID, hashToken(code))
+	if err != nil {
+		app.log.Printf("error checking recovery code: %v", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// checkTOTPCode checks a user's TOTP code and records its time step. A code
+// whose step has already been used is rejected.
+func checkTOTPCode(u models.User, code string, app *App) bool {
+	step, ok := totp.Validate(u.TOTPSecret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	res, err := app.queries.UseTOTPStep.Exec(u.ID, step)
+	if err != nil {
+		app.log.Printf("error recording TOTP step: %v", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
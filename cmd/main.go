@@ -14,16 +14,25 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/listmonk/internal/buflog"
+	"github.com/knadh/listmonk/internal/captcha"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/geoip"
+	"github.com/knadh/listmonk/internal/hooks"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/oidc"
+	"github.com/knadh/listmonk/internal/ratelimit"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/stuffbin"
+	"github.com/labstack/echo"
 )
 
 const (
@@ -33,18 +42,45 @@ const (
 // App contains the "global" components that are
 // passed around, especially through HTTP handlers.
 type App struct {
-	fs         stuffbin.FileSystem
-	db         *sqlx.DB
-	queries    *Queries
+	fs      stuffbin.FileSystem
+	db      *sqlx.DB
+	queries *Queries
+
+	// readDB is the read replica that subscriber searches and exports run on.
+	// It's the primary DB if there's no replica.
+	readDB *sqlx.DB
+
 	constants  *constants
 	manager    *manager.Manager
 	importer   *subimporter.Importer
 	messengers map[string]messenger.Messenger
 	media      media.Store
+	geoip      *geoip.DB
+	oidc       *oidc.Provider
+	limiter    *ratelimit.Limiter
+	captcha    *captcha.Captcha
+	events     *events.Bus
+	tracker    *trackWriter
+	hooks      *hooks.Hooks
+	alerts     *alerter
+	metrics    *metrics
+	userAuth   *userAuthCache
+	loginGuard *loginGuard
 	i18n       *i18n.I18n
+	langs      *langCache
 	notifTpls  *template.Template
 	log        *log.Logger
 	bufLog     *buflog.BufLog
+	logFile    *buflog.File
+
+	// 1 if the admin is open without auth, which is only the case on
+	// legacy installs without a superuser in the config, SSO or users.
+	// It's unset when the first user is created.
+	noAuth int32
+
+	// Random ID of the instance among the main instance and any sending
+	// workers.
+	instanceID string
 
 	// Channel for passing reload signals.
 	sigChan chan os.Signal
@@ -55,6 +91,13 @@ type App struct {
 
 	// Global state that stores data on an available remote update.
 	update *AppUpdate
+
+	// Results of the last periodic health check of the SMTP servers
+	// by messenger (pool) name.
+	smtpHealth map[string][]email.CheckResult
+
+	// Last result of the readiness probe.
+	readiness readinessCache
 	sync.Mutex
 }
 
@@ -64,6 +107,9 @@ var (
 	lo     = log.New(io.MultiWriter(os.Stdout, bufLog), "",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
+	// Optional log file that's set up from the config.
+	logFile *buflog.File
+
 	ko      = koanf.New(".")
 	fs      stuffbin.FileSystem
 	db      *sqlx.DB
@@ -113,6 +159,9 @@ func init() {
 		lo.Fatalf("error loading config from env: %v", err)
 	}
 
+	// Set up the log file and format.
+	initLogs()
+
 	// Connect to the database, load the filesystem to read SQL queries.
 	db = initDB()
 	fs = initFS(appDir, frontendDir, ko.String("static-dir"), ko.String("i18n-dir"))
@@ -143,7 +192,8 @@ func init() {
 	// Load the SQL queries from the filesystem.
 	_, queries := initQueries(queryFilePath, db, fs, true)
 
-	// Load settings from DB.
+	// Generate the secret keys that aren't set and load settings from DB.
+	initSecretKeys(queries)
 	initSettings(queries.GetSettings)
 }
 
@@ -158,21 +208,127 @@ func main() {
 		messengers: make(map[string]messenger.Messenger),
 		log:        lo,
 		bufLog:     bufLog,
+		logFile:    logFile,
+		userAuth:   newUserAuthCache(),
+		loginGuard: newLoginGuard(),
+		langs:      newLangCache(),
+		instanceID: uuid.Must(uuid.NewV4()).String(),
+	}
+
+	if app.constants.MetricsEnabled {
+		app.metrics = newMetrics()
 	}
 
 	// Load i18n language map.
 	app.i18n = initI18n(app.constants.Lang, fs)
 
-	_, app.queries = initQueries(queryFilePath, db, fs, true)
+	qMap, queries := initQueries(queryFilePath, db, fs, true)
+	app.queries = queries
+
+	// Run the heavy read queries on the read replica if there's one.
+	app.readDB = db
+	if rdb := initReadReplica(); rdb != nil {
+		app.readDB = rdb
+		prepareReplicaQueries(app.queries, qMap, rdb)
+	}
+
+	// Export or import the settings and exit.
+	if p := ko.String("export-settings"); p != "" {
+		if err := exportSettingsFile(p, ko.Bool("with-secrets"), app); err != nil {
+			lo.Fatalf("error exporting settings: %v", err)
+		}
+		lo.Printf("exported settings to %s", p)
+		os.Exit(0)
+	}
+	if p := ko.String("import-settings"); p != "" {
+		changed, err := importSettingsFile(p, app)
+		if err != nil {
+			lo.Fatalf("error importing settings: %v", err)
+		}
+		lo.Printf("imported settings from %s. %d changed: %s", p, len(changed), strings.Join(changed, ", "))
+		os.Exit(0)
+	}
+
+	// Back up and exit.
+	if ko.Bool("backup") {
+		name, err := createBackup(app)
+		if err != nil {
+			lo.Fatalf("error creating backup: %v", err)
+		}
+		lo.Printf("created backup %s", name)
+		os.Exit(0)
+	}
+
+	// Run an administrative command and exit.
+	if ok, err := runAdminCommand(app); ok {
+		if err != nil {
+			lo.Fatalf("error: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// Initialize the optional event firehose before the components that publish to it.
+	if ko.Bool("events.enabled") {
+		app.events = initEvents()
+		go app.events.Run()
+	}
+
+	// Write campaign views and link clicks in batches.
+	if n := ko.Int("app.tracking_batch_size"); n > 1 {
+		app.tracker = newTrackWriter(n, queries, db, lo)
+		go app.tracker.Run()
+	}
+
+	// Load the admin alert channels.
+	app.alerts = initAlerts()
+
+	// Load the external command hooks before the components that run them.
+	if len(ko.Slices("hooks")) > 0 {
+		app.hooks = initHooks()
+	}
+
 	app.manager = initCampaignManager(app.queries, app.constants, app)
 	app.importer = initImporter(app.queries, db, app)
-	app.notifTpls = initNotifTemplates("/email-templates/*.html", fs, app.i18n, app.constants)
+	app.notifTpls = initNotifTemplates("/email-templates/*.html", fs, app.i18n, app.constants, app.manager)
+
+	// Load the optional GeoIP DB for view and click analytics.
+	if app.constants.Privacy.GeoIPDB != "" {
+		app.geoip = initGeoIP(app.constants.Privacy.GeoIPDB)
+	}
+
+	// Single sign-on to the admin with an OIDC provider.
+	if app.constants.Security.OIDCEnabled {
+		app.oidc = initOIDC(app.constants)
+	}
+	if isAuthOpen(app) {
+		app.noAuth = 1
+		lo.Println("no admin credentials or users are set, the admin is open without auth")
+	}
+
+	// Per IP rate limits on the public endpoints.
+	if app.constants.Security.RateLimitEnabled {
+		app.limiter = initRateLimiter(app.constants)
+	}
+
+	// CAPTCHA on public subscription forms.
+	if app.constants.Security.CaptchaProvider != "" {
+		app.captcha = initCaptcha(app.constants)
+	}
 
-	// Initialize the default SMTP (`email`) messenger.
-	app.messengers[emailMsgr] = initSMTPMessenger(app.manager)
+	// Load the partial templates that templates can include.
+	reloadPartials(app)
 
-	// Initialize any additional postback messengers.
-	for _, m := range initPostbackMessengers(app.manager) {
+	// Initialize the default SMTP (`email`) messenger and any additional SMTP pools.
+	for _, m := range initSMTPMessengers(app.manager) {
+		app.messengers[m.Name()] = m
+	}
+
+	// Initialize any additional postback and API based messengers.
+	msgrs := initMessengers()
+	if app.constants.WebPushEnabled {
+		msgrs = append(msgrs, initWebPushMessenger(app.queries, app.constants))
+	}
+	for _, m := range msgrs {
 		app.messengers[m.Name()] = m
 	}
 
@@ -181,43 +337,111 @@ func main() {
 		app.manager.AddMessenger(m)
 	}
 
+	// Record the instance so that the send rates are shared with the other
+	// instances that are sending campaigns.
+	go pingInstances(app.instanceID, app)
+
 	// Start the campaign workers. The campaign batches (fetch from DB, push out
 	// messages) get processed at the specified interval.
-	go app.manager.Run(time.Second * 5)
-
-	// Start the app server.
-	srv := initHTTPServer(app)
-
-	// Star the update checker.
-	if ko.Bool("app.check_updates") {
-		go checkUpdates(versionString, time.Hour*24, app)
+	go app.manager.Run(campScanInterval)
+
+	// Start the app server and the periodic jobs. Sending workers only
+	// process campaigns alongside the main instance.
+	var srv *echo.Echo
+	if ko.Bool("worker") {
+		lo.Println("running as a sending worker")
+	} else {
+		srv = initHTTPServer(app)
+		startJobs(app)
 	}
 
 	// Wait for the reload signal with a callback to gracefully shut down resources.
 	// The `wait` channel is passed to awaitReload to wait for the callback to finish
 	// within N seconds, or do a force reload.
 	app.sigChan = make(chan os.Signal)
-	signal.Notify(app.sigChan, syscall.SIGHUP)
+	signal.Notify(app.sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 	closerWait := make(chan bool)
 	<-awaitReload(app.sigChan, closerWait, func() {
 		// Stop the HTTP server.
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		srv.Shutdown(ctx)
+		if srv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		}
 
 		// Close the campaign manager.
 		app.manager.Close()
+		if _, err := app.queries.DeleteInstance.Exec(app.instanceID); err != nil {
+			lo.Printf("error removing instance: %v", err)
+		}
 
-		// Close the DB pool.
+		// Write the queued views and clicks and publish the queued events.
+		if app.tracker != nil {
+			app.tracker.Close()
+		}
+		app.events.Close()
+
+		// Close the DB pools.
 		app.db.DB.Close()
+		if app.readDB != app.db {
+			app.readDB.DB.Close()
+		}
 
 		// Close the messenger pool.
 		for _, m := range app.messengers {
-			m.Close()
+			if err := m.Close(); err != nil {
+				lo.Printf("error closing messenger %s: %v", m.Name(), err)
+			}
 		}
 
 		// Signal the close.
 		closerWait <- true
 	})
 }
+
+// startJobs starts the periodic background jobs of the main instance.
+func startJobs(app *App) {
+	// Start the periodic sync of dynamic lists.
+	if d := ko.Duration("app.dynamic_list_sync_interval"); d > 0 {
+		go syncDynamicLists(d, app)
+	}
+
+	// Start the preparation of campaigns that are starting to be sent.
+	go prepareCampaigns(campScanInterval, app)
+
+	// Start the sending of scheduled transactional messages.
+	go sendScheduledTx(time.Second*10, app)
+
+	// Start the creation of the monthly partitions of views and clicks.
+	go maintainTrackingPartitions(time.Hour*24, app)
+
+	// Start the scheduled backups.
+	if d := ko.Duration("backup.interval"); d > 0 {
+		go createBackupsPeriodically(d, app)
+	}
+
+	// Start the periodic pruning of old views and clicks.
+	if days := ko.Int("privacy.analytics_retention_days"); days > 0 {
+		go pruneAnalyticsPeriodically(days, time.Hour*24, app)
+	}
+
+	// Start the periodic pruning of the transactional message log.
+	if days := ko.Int("app.tx_log_retention_days"); days > 0 {
+		go pruneTxLog(days, time.Hour, app)
+	}
+	go pruneTxCallbacks(txCallbackRetentionDays, time.Hour, app)
+
+	// Start the bounce rate alerts.
+	if r := ko.Float64("app.alert_bounce_rate"); r > 0 && app.alerts != nil {
+		go checkBounceRate(r, time.Minute*15, app)
+	}
+
+	// Start the periodic health check of the SMTP servers.
+	go checkSMTPHealth(time.Minute*5, app)
+
+	// Star the update checker.
+	if ko.Bool("app.check_updates") {
+		go checkUpdates(versionString, time.Hour*24, app)
+	}
+}
@@ -1,24 +1,45 @@
 package main
 
 import (
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
 )
 
+// Namespace ('lm') of the advisory locks that the main instance and any
+// sending workers take to lease campaigns and subscriber batches.
+const campLockNamespace = 0x6c6d
+
+const (
+	// Interval at which instances record that they're alive.
+	instancePingInterval = time.Second * 15
+
+	// Time after which an instance that hasn't recorded that it's alive
+	// is no longer counted towards the instances sharing the send rates.
+	instanceTimeout = time.Minute
+)
+
 // runnerDB implements runner.DataSource over the primary
 // database.
 type runnerDB struct {
-	queries *Queries
+	queries    *Queries
+	db         *sqlx.DB
+	instanceID string
 }
 
-func newManagerDB(q *Queries) *runnerDB {
+func newManagerDB(q *Queries, db *sqlx.DB, instanceID string) *runnerDB {
 	return &runnerDB{
-		queries: q,
+		queries:    q,
+		db:         db,
+		instanceID: instanceID,
 	}
 }
 
-// NextCampaigns retrieves active campaigns ready to be processed.
+// NextCampaigns retrieves active campaigns ready to be processed, which
+// are the running campaigns that have been prepared by prepareCampaigns.
 func (r *runnerDB) NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error) {
 	var out []*models.Campaign
 	err := r.queries.NextCampaigns.Select(&out, pq.Int64Array(excludeIDs))
@@ -28,11 +49,30 @@ func (r *runnerDB) NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error)
 // NextSubscribers retrieves a subset of subscribers of a given campaign.
 // Since batches are processed sequentially, the retrieval is ordered by ID,
 // and every batch takes the last ID of the last batch and fetches the next
-// batch above that.
+// batch above that. The campaign is locked while a batch is fetched so that
+// instances sending the same campaign lease distinct batches. The lease is
+// recorded until the instance fetches its next batch so that the campaign
+// isn't finished while the batch is being sent.
 func (r *runnerDB) NextSubscribers(campID, limit int) ([]models.Subscriber, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(r.queries.LockCampaigns).Exec(campLockNamespace, campID); err != nil {
+		return nil, err
+	}
+
 	var out []models.Subscriber
-	err := r.queries.NextCampaignSubscribers.Select(&out, campID, limit)
-	return out, err
+	if err := tx.Stmtx(r.queries.NextCampaignSubscribers).Select(&out, campID, limit); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Stmtx(r.queries.LeaseCampaign).Exec(campID, r.instanceID, len(out) > 0); err != nil {
+		return nil, err
+	}
+
+	return out, tx.Commit()
 }
 
 // GetCampaign fetches a campaign from the database.
@@ -48,6 +88,19 @@ func (r *runnerDB) UpdateCampaignStatus(campID int, status string) error {
 	return err
 }
 
+// FinishCampaign marks a running campaign as finished. It returns false if
+// the campaign is no longer running, eg: another instance has finished it,
+// or if another instance is still sending a batch of it.
+func (r *runnerDB) FinishCampaign(campID int) (bool, error) {
+	res, err := r.queries.FinishCampaign.Exec(campID)
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
 // CreateLink registers a URL with a UUID for tracking clicks and returns the UUID.
 func (r *runnerDB) CreateLink(url string) (string, error) {
 	// Create a new UUID for the URL. If the URL already exists in the DB
@@ -64,3 +117,59 @@ func (r *runnerDB) CreateLink(url string) (string, error) {
 
 	return out, nil
 }
+
+// pingInstances records that the instance is sending campaigns at regular
+// intervals and sets the number of live instances (the main instance and
+// any sending workers) on the campaign manager, which divides the send
+// rates between them.
+func pingInstances(id string, app *App) {
+	ticker := time.NewTicker(instancePingInterval)
+	defer ticker.Stop()
+
+	for {
+		var n int
+		if err := app.queries.PingInstance.Get(&n, id, instanceTimeout.Seconds()); err != nil {
+			app.log.Printf("error recording instance: %v", err)
+		} else {
+			app.manager.SetInstances(n)
+		}
+
+		<-ticker.C
+	}
+}
+
+// prepareCampaigns prepares the campaigns that are starting to be sent at
+// regular intervals. The dynamic lists of a campaign are synced and its
+// subscribers are counted once when it starts, outside of the campaign
+// manager's scans, so that slow list queries don't hold them up.
+func prepareCampaigns(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var camps []models.Campaign
+		if err := app.queries.GetCampaignsToPrepare.Select(&camps); err != nil {
+			app.log.Printf("error fetching campaigns to prepare: %v", err)
+			continue
+		}
+
+		for _, c := range camps {
+			var lists []models.List
+			if err := app.queries.GetCampaignDynamicLists.Select(&lists, c.ID); err != nil {
+				app.log.Printf("error fetching dynamic lists of campaign (%s): %v", c.Name, err)
+				continue
+			}
+			for _, l := range lists {
+				// A failed sync shouldn't hold up sending. The list's existing
+				// subscriptions are used instead.
+				if err := app.queries.syncDynamicList(l, app.db); err != nil {
+					app.log.Printf("error syncing dynamic list %d: %v", l.ID, err)
+				}
+			}
+
+			if _, err := app.queries.PrepareCampaign.Exec(c.ID); err != nil {
+				app.log.Printf("error preparing campaign (%s): %v", c.Name, err)
+			}
+		}
+	}
+}
@@ -2,26 +2,65 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/gofrs/uuid"
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 const (
 	thumbPrefix   = "thumb_"
 	thumbnailSize = 90
+
+	// Maximum width of the resized variants of images.
+	maxImageWidth = 4000
+
+	// Media uploaded more recently than this aren't considered unused.
+	orphanMediaMinAge = time.Hour * 24
 )
 
+// mediaVariant is a resized variant of uploaded images, eg: one that fits
+// the width of e-mails.
+type mediaVariant struct {
+	Name  string
+	Width int
+}
+
+type mediaWrap struct {
+	Results []media.Media `json:"results"`
+
+	Query   string `json:"query"`
+	Total   int    `json:"total"`
+	PerPage int    `json:"per_page"`
+	Page    int    `json:"page"`
+}
+
+// mediaReq is the organization of a media file that can be updated.
+type mediaReq struct {
+	FolderID null.Int       `json:"folder_id"`
+	Tags     pq.StringArray `json:"tags"`
+}
+
 // validMimes is the list of image types allowed to be uploaded.
 var (
 	validMimes = []string{"image/jpg", "image/jpeg", "image/png", "image/gif"}
 	validExts  = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+	reVariantName = regexp.MustCompile(`[^a-z0-9]`)
 )
 
 // handleUploadMedia handles media file uploads.
@@ -50,6 +89,12 @@ func handleUploadMedia(c echo.Context) error {
 			app.i18n.Ts("media.unsupportedFileType", "type", typ))
 	}
 
+	// Folder and tags to organize the file in.
+	var (
+		folderID, _ = strconv.Atoi(c.FormValue("folder_id"))
+		tags        = normalizeTags(c.Request().PostForm["tags"])
+	)
+
 	// Generate filename
 	fName := makeFilename(file.Filename)
 
@@ -70,17 +115,32 @@ func handleUploadMedia(c echo.Context) error {
 			app.i18n.Ts("media.errorUploading", "error", err.Error()))
 	}
 
+	// Files uploaded for the image.
+	files := []string{fName}
 	defer func() {
 		// If any of the subroutines in this function fail,
-		// the uploaded image should be removed.
+		// the uploaded image and its variants should be removed.
 		if cleanUp {
-			app.media.Delete(fName)
-			app.media.Delete(thumbPrefix + fName)
+			for _, f := range files {
+				app.media.Delete(f)
+			}
 		}
 	}()
 
+	img, err := decodeImage(file)
+	if err != nil {
+		cleanUp = true
+		app.log.Printf("error resizing image: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("media.errorResizing", "error", err.Error()))
+	}
+
 	// Create thumbnail from file.
-	thumbFile, err := createThumbnail(file)
+	thumbWidth := app.constants.MediaThumbWidth
+	if thumbWidth < 1 {
+		thumbWidth = thumbnailSize
+	}
+	thumbFile, err := resizeImage(img, thumbWidth, imaging.PNG)
 	if err != nil {
 		cleanUp = true
 		app.log.Printf("error resizing image: %v", err)
@@ -96,6 +156,38 @@ func handleUploadMedia(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("media.errorSavingThumbnail", "error", err.Error()))
 	}
+	files = append(files, thumbfName)
+
+	// Create and upload the resized variants of images that are wider than them
+	// in the original format. Animated GIFs lose their frames when resized
+	// and are left as is.
+	variants := map[string]string{}
+	if format, err := imaging.FormatFromFilename(fName); err == nil && format != imaging.GIF {
+		for _, v := range app.constants.MediaVariants {
+			if img.Bounds().Dx() <= v.Width {
+				continue
+			}
+
+			b, err := resizeImage(img, v.Width, format)
+			if err != nil {
+				cleanUp = true
+				app.log.Printf("error resizing image: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError,
+					app.i18n.Ts("media.errorResizing", "error", err.Error()))
+			}
+
+			name, err := app.media.Put(v.Name+"_"+fName, typ, b)
+			if err != nil {
+				cleanUp = true
+				app.log.Printf("error saving image variant: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError,
+					app.i18n.Ts("media.errorUploading", "error", err.Error()))
+			}
+			files = append(files, name)
+			variants[v.Name] = name
+		}
+	}
+	variantsJSON, _ := json.Marshal(variants)
 
 	uu, err := uuid.NewV4()
 	if err != nil {
@@ -105,7 +197,8 @@ func handleUploadMedia(c echo.Context) error {
 	}
 
 	// Write to the DB.
-	if _, err := app.queries.InsertMedia.Exec(uu, fName, thumbfName, app.constants.MediaProvider); err != nil {
+	if _, err := app.queries.InsertMedia.Exec(uu, fName, thumbfName, variantsJSON, app.constants.MediaProvider,
+		null.NewInt(folderID, folderID > 0), pq.StringArray(tags)); err != nil {
 		cleanUp = true
 		app.log.Printf("error inserting uploaded file to db: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -115,22 +208,126 @@ func handleUploadMedia(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
-// handleGetMedia handles retrieval of uploaded media.
+// handleGetMedia handles retrieval and search of uploaded media by filename,
+// folder, tags and upload date.
 func handleGetMedia(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
-		out = []media.Media{}
+		pg  = getPagination(c.QueryParams(), 50)
+		out mediaWrap
+
+		query       = strings.TrimSpace(c.QueryParam("query"))
+		folderID, _ = strconv.Atoi(c.QueryParam("folder_id"))
+		tags        = normalizeTags(c.QueryParams()["tag"])
 	)
 
-	if err := app.queries.GetMedia.Select(&out, app.constants.MediaProvider); err != nil {
+	from, err := parseDateFilter(c.QueryParam("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+	to, err := parseDateFilter(c.QueryParam("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	search := ""
+	if query != "" {
+		search = "%" + query + "%"
+	}
+
+	if err := app.queries.QueryMedia.Select(&out.Results, app.constants.MediaProvider, search,
+		folderID, pq.StringArray(tags), from, to, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching media: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
 	}
+	if len(out.Results) == 0 {
+		out.Results = []media.Media{}
+	} else {
+		out.Total = out.Results[0].Total
+	}
 
-	for i := 0; i < len(out); i++ {
-		out[i].URL = app.media.Get(out[i].Filename)
-		out[i].ThumbURL = app.media.Get(out[i].Thumb)
+	for i := 0; i < len(out.Results); i++ {
+		setMediaURLs(&out.Results[i], app)
+	}
+
+	out.Query = query
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetMediaItem handles retrieval of a media file.
+func handleGetMediaItem(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var m media.Media
+	if err := app.queries.GetMediaItem.Get(&m, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.media}"))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+	setMediaURLs(&m, app)
+
+	return c.JSON(http.StatusOK, okResp{m})
+}
+
+// handleUpdateMedia handles moving a media file to a folder and tagging it.
+func handleUpdateMedia(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		o     mediaReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+	if o.FolderID.Int < 1 {
+		o.FolderID = null.Int{}
+	}
+
+	res, err := app.queries.UpdateMedia.Exec(id, o.FolderID, pq.StringArray(normalizeTags(o.Tags)))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.media}"))
+	}
+
+	return handleGetMediaItem(c)
+}
+
+// handleGetMediaTags handles retrieval of all the tags of media files.
+func handleGetMediaTags(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out pq.StringArray
+	)
+
+	if err := app.queries.GetMediaTags.Get(&out, app.constants.MediaProvider); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.tags}", "error", pqErrMsg(err)))
 	}
 
 	return c.JSON(http.StatusOK, okResp{out})
@@ -147,37 +344,247 @@ func handleDeleteMedia(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	var m media.Media
-	if err := app.queries.DeleteMedia.Get(&m, id); err != nil {
+	if err := deleteMedia(id, app); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorDeleting",
 				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
 	}
 
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetOrphanMedia returns the media files that aren't used in any
+// campaign, template or setting and can be deleted to reclaim storage.
+func handleGetOrphanMedia(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := getOrphanMedia(nil, app)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteOrphanMedia deletes the given unused media files that were
+// confirmed for deletion. Files that have been used since are skipped.
+// The number of deleted files is returned.
+func handleDeleteOrphanMedia(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	IDs, err := parseStringIDs(c.Request().URL.Query()["id"])
+	if err != nil || len(IDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	orphans, err := getOrphanMedia(IDs, app)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	n := 0
+	for _, m := range orphans {
+		if err := deleteMedia(m.ID, app); err != nil {
+			app.log.Printf("error deleting orphan media %s: %v", m.Filename, err)
+			continue
+		}
+		n++
+	}
+	app.log.Printf("deleted %d unused media file(s)", n)
+
+	return c.JSON(http.StatusOK, okResp{n})
+}
+
+// getOrphanMedia returns the media files older than orphanMediaMinAge that
+// aren't referenced anywhere, optionally from among the given IDs. Recent
+// uploads are excluded as they may be in drafts that are yet to be saved.
+func getOrphanMedia(IDs []int64, app *App) ([]media.Media, error) {
+	out := []media.Media{}
+	if err := app.queries.GetOrphanMedia.Select(&out, app.constants.MediaProvider,
+		time.Now().Add(-orphanMediaMinAge), pq.Int64Array(IDs)); err != nil {
+		app.log.Printf("error fetching orphan media: %v", err)
+		return nil, err
+	}
+
+	for i := range out {
+		setMediaURLs(&out[i], app)
+	}
+	return out, nil
+}
+
+// deleteMedia deletes a media item and its files from the store.
+func deleteMedia(id int, app *App) error {
+	var m media.Media
+	if err := app.queries.DeleteMedia.Get(&m, id); err != nil {
+		return err
+	}
+
 	app.media.Delete(m.Filename)
 	app.media.Delete(thumbPrefix + m.Filename)
+	for _, f := range getMediaVariants(m) {
+		app.media.Delete(f)
+	}
+	return nil
+}
+
+// handleGetMediaFolders handles retrieval of media folders.
+func handleGetMediaFolders(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []media.Folder
+
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if err := app.queries.GetMediaFolders.Select(&out, id); err != nil {
+		app.log.Printf("error fetching media folders: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.folders}", "error", pqErrMsg(err)))
+	}
+	if id > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.folder}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateMediaFolder handles media folder creation.
+func handleCreateMediaFolder(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   = media.Folder{}
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidFolderName"))
+	}
+
+	var newID int
+	if err := app.queries.CreateMediaFolder.Get(&newID, o.Name); err != nil {
+		app.log.Printf("error creating media folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetMediaFolders(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateMediaFolder handles renaming of media folders.
+func handleUpdateMediaFolder(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o media.Folder
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidFolderName"))
+	}
+
+	res, err := app.queries.UpdateMediaFolder.Exec(id, o.Name)
+	if err != nil {
+		app.log.Printf("error updating media folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.folder}"))
+	}
+
+	return handleGetMediaFolders(c)
+}
+
+// handleDeleteMediaFolder handles media folder deletion. The media in it
+// are moved to the root.
+func handleDeleteMediaFolder(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeleteMediaFolder.Exec(id); err != nil {
+		app.log.Printf("error deleting media folder: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.folder}", "error", pqErrMsg(err)))
+	}
+
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
-// createThumbnail reads the file object and returns a smaller image
-func createThumbnail(file *multipart.FileHeader) (*bytes.Reader, error) {
+// setMediaURLs sets the URLs of a media file, its thumbnail and variants.
+func setMediaURLs(m *media.Media, app *App) {
+	m.URL = app.media.Get(m.Filename)
+	m.ThumbURL = app.media.Get(m.Thumb)
+
+	m.VariantURLs = map[string]string{}
+	for name, f := range getMediaVariants(*m) {
+		m.VariantURLs[name] = app.media.Get(f)
+	}
+}
+
+// getMediaVariants returns the filenames of the resized variants of
+// a media item by their names.
+func getMediaVariants(m media.Media) map[string]string {
+	out := map[string]string{}
+	if len(m.Variants) > 0 {
+		_ = m.Variants.Unmarshal(&out)
+	}
+	return out
+}
+
+// decodeImage reads the file object and decodes the image in it.
+func decodeImage(file *multipart.FileHeader) (image.Image, error) {
 	src, err := file.Open()
 	if err != nil {
 		return nil, err
 	}
 	defer src.Close()
 
-	img, err := imaging.Decode(src)
-	if err != nil {
-		return nil, err
-	}
+	return imaging.Decode(src)
+}
 
-	// Encode the image into a byte slice as PNG.
+// resizeImage resizes an image to a width keeping its aspect ratio and
+// encodes it in a format.
+func resizeImage(img image.Image, width int, format imaging.Format) (*bytes.Reader, error) {
 	var (
-		thumb = imaging.Resize(img, thumbnailSize, 0, imaging.Lanczos)
-		out   bytes.Buffer
+		resized = imaging.Resize(img, width, 0, imaging.Lanczos)
+		out     bytes.Buffer
 	)
-	if err := imaging.Encode(&out, thumb, imaging.PNG); err != nil {
+	if err := imaging.Encode(&out, resized, format); err != nil {
 		return nil, err
 	}
 	return bytes.NewReader(out.Bytes()), nil
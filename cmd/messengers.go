@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/knadh/koanf"
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/mailgun"
+	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/sendgrid"
+	"github.com/knadh/listmonk/internal/messenger/ses"
+	"github.com/knadh/listmonk/internal/messenger/sms"
+	"github.com/knadh/listmonk/internal/messenger/telegram"
+)
+
+// msgrKindEmail is the kind of messengers that deliver e-mail.
+const msgrKindEmail = "email"
+
+// msgrProvider is a messenger provider whose messengers are configured as
+// an array of settings blocks under a key (eg: "sendgrid"). Adding a
+// provider only requires an entry in msgrProviders.
+type msgrProvider struct {
+	// Settings key of the array of messenger blocks.
+	key string
+
+	// Name of the provider in logs.
+	label string
+
+	// Whether the provider's messengers deliver e-mail. E-mail messengers
+	// can only fail over to other e-mail messengers and only they can be
+	// domain route targets.
+	email bool
+
+	// fields returns pointers to the fields of the provider's blocks in
+	// the settings that are validated the same way for all providers.
+	fields func(s *settings) []msgrFields
+
+	// init initializes a messenger from its settings block.
+	init func(item *koanf.Koanf) (messenger.Messenger, error)
+}
+
+// msgrFields are the fields of a messenger's settings block that all
+// providers have. Secrets (passwords, API keys) are never sent to the
+// frontend and are retained by UUID when they aren't changed.
+type msgrFields struct {
+	UUID    *string
+	Name    *string
+	Secrets []*string
+}
+
+// msgrProviders is the registry of the messenger providers that are
+// configured with settings blocks. SMTP and web push are configured
+// differently and are initialized separately.
+var msgrProviders = []msgrProvider{
+	{
+		key:   "messengers",
+		label: "Postback",
+		fields: func(s *settings) []msgrFields {
+			out := make([]msgrFields, len(s.Messengers))
+			for i := range s.Messengers {
+				m := &s.Messengers[i]
+				out[i] = msgrFields{&m.UUID, &m.Name, []*string{&m.Password, &m.SigningSecret}}
+			}
+			return out
+		},
+		init: func(item *koanf.Koanf) (messenger.Messenger, error) {
+			var o postback.Options
+			if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+				return nil, err
+			}
+			return postback.New(o)
+		},
+	},
+	{
+		key:   "ses",
+		label: "SES",
+		email: true,
+		fields: func(s *settings) []msgrFields {
+			out := make([]msgrFields, len(s.SES))
+			for i := range s.SES {
+				m := &s.SES[i]
+				out[i] = msgrFields{&m.UUID, &m.Name, []*string{&m.SecretKey}}
+			}
+			return out
+		},
+		init: func(item *koanf.Koanf) (messenger.Messenger, error) {
+			var o ses.Options
+			if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+				return nil, err
+			}
+			return ses.New(o)
+		},
+	},
+	{
+		key:   "sendgrid",
+		label: "SendGrid",
+		email: true,
+		fields: func(s *settings) []msgrFields {
+			out := make([]msgrFields, len(s.SendGrid))
+			for i := range s.SendGrid {
+				m := &s.SendGrid[i]
+				out[i] = msgrFields{&m.UUID, &m.Name, []*string{&m.APIKey}}
+			}
+			return out
+		},
+		init: func(item *koanf.Koanf) (messenger.Messenger, error) {
+			var o sendgrid.Options
+			if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+				return nil, err
+			}
+			return sendgrid.New(o)
+		},
+	},
+	{
+		key:   "mailgun",
+		label: "Mailgun",
+		email: true,
+		fields: func(s *settings) []msgrFields {
+			out := make([]msgrFields, len(s.Mailgun))
+			for i := range s.Mailgun {
+				m := &s.Mailgun[i]
+				out[i] = msgrFields{&m.UUID, &m.Name, []*string{&m.APIKey}}
+			}
+			return out
+		},
+		init: func(item *koanf.Koanf) (messenger.Messenger, error) {
+			var o mailgun.Options
+			if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+				return nil, err
+			}
+			return mailgun.New(o)
+		},
+	},
+	{
+		key:   "sms",
+		label: "SMS",
+		fields: func(s *settings) []msgrFields {
+			out := make([]msgrFields, len(s.SMS))
+			for i := range s.SMS {
+				m := &s.SMS[i]
+				out[i] = msgrFields{&m.UUID, &m.Name, []*string{&m.AuthToken}}
+			}
+			return out
+		},
+		init: func(item *koanf.Koanf) (messenger.Messenger, error) {
+			var o sms.Options
+			if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+				return nil, err
+			}
+			return sms.New(o)
+		},
+	},
+	{
+		key:   "telegram",
+		label: "Telegram",
+		fields: func(s *settings) []msgrFields {
+			out := make([]msgrFields, len(s.Telegram))
+			for i := range s.Telegram {
+				m := &s.Telegram[i]
+				out[i] = msgrFields{&m.UUID, &m.Name, []*string{&m.BotToken}}
+			}
+			return out
+		},
+		init: func(item *koanf.Koanf) (messenger.Messenger, error) {
+			var o telegram.Options
+			if err := item.UnmarshalWithConf("", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+				return nil, err
+			}
+			return telegram.New(o)
+		},
+	},
+}
+
+// initMessengers initializes and returns all the enabled messengers of the
+// providers in msgrProviders.
+func initMessengers() []messenger.Messenger {
+	var out []messenger.Messenger
+	for _, p := range msgrProviders {
+		for _, item := range ko.Slices(p.key) {
+			if !item.Bool("enabled") {
+				continue
+			}
+
+			name := item.String("name")
+			m, err := p.init(item)
+			if err != nil {
+				lo.Fatalf("error initializing %s messenger %s: %v", p.label, name, err)
+			}
+			out = append(out, m)
+
+			lo.Printf("loaded %s messenger: %s", p.label, name)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Upper bounds (seconds) of the HTTP request latency histogram buckets.
+var httpLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpRoute is an HTTP route (registered path pattern) and method.
+type httpRoute struct {
+	method string
+	path   string
+}
+
+// httpLatency is a histogram of the latencies of an HTTP route.
+type httpLatency struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// metrics holds the counters that are collected in-process for the
+// Prometheus /metrics endpoint. Everything else is read from the
+// components (campaign manager, DB pool) when the metrics are scraped.
+type metrics struct {
+	latencies map[httpRoute]*httpLatency
+	responses map[httpRoute]map[int]uint64
+	txStatus  map[string]uint64
+
+	sync.Mutex
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		latencies: make(map[httpRoute]*httpLatency),
+		responses: make(map[httpRoute]map[int]uint64),
+		txStatus:  make(map[string]uint64),
+	}
+}
+
+// middleware is an echo middleware that records the latencies and response
+// codes of HTTP requests by route.
+func (m *metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		code := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+		}
+
+		// Unmatched routes are grouped together to keep the label cardinality bounded.
+		r := httpRoute{method: c.Request().Method, path: c.Path()}
+		if code == http.StatusNotFound || r.path == "" {
+			r.path = "unmatched"
+		}
+		m.observe(r, code, time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// observe records the response code and latency of a request.
+func (m *metrics) observe(r httpRoute, code int, secs float64) {
+	m.Lock()
+	defer m.Unlock()
+
+	l, ok := m.latencies[r]
+	if !ok {
+		l = &httpLatency{buckets: make([]uint64, len(httpLatencyBuckets))}
+		m.latencies[r] = l
+		m.responses[r] = make(map[int]uint64)
+	}
+	for i, b := range httpLatencyBuckets {
+		if secs <= b {
+			l.buckets[i]++
+		}
+	}
+	l.sum += secs
+	l.count++
+	m.responses[r][code]++
+}
+
+// countTxStatus counts a delivery status event (bounce, complaint) of a
+// transactional message. It's a no-op if metrics are disabled.
+func (m *metrics) countTxStatus(status string) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	m.txStatus[status]++
+	m.Unlock()
+}
+
+// handleGetMetrics returns the app's operational metrics in the
+// Prometheus text exposition format.
+func handleGetMetrics(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		w   = bufio.NewWriter(c.Response())
+	)
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+	c.Response().WriteHeader(http.StatusOK)
+
+	// Campaign manager.
+	st := app.manager.Stats()
+	names := make([]string, 0, len(st.Messengers))
+	for n := range st.Messengers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	writeMetricHeader(w, "listmonk_messages_sent_total", "counter", "Messages sent by messenger.")
+	for _, n := range names {
+		writeMetric(w, "listmonk_messages_sent_total", st.Messengers[n].Sent, "messenger", n)
+	}
+	writeMetricHeader(w, "listmonk_messages_errors_total", "counter", "Messages that errored by messenger.")
+	for _, n := range names {
+		writeMetric(w, "listmonk_messages_errors_total", st.Messengers[n].Errors, "messenger", n)
+	}
+
+	writeMetricHeader(w, "listmonk_queue_depth", "gauge", "Messages waiting in the send queues.")
+	writeMetric(w, "listmonk_queue_depth", st.CampaignQueue, "queue", "campaign")
+	writeMetric(w, "listmonk_queue_depth", st.MessageQueue, "queue", "message")
+
+	writeMetricHeader(w, "listmonk_campaigns_running", "gauge", "Campaigns that are being processed.")
+	writeMetric(w, "listmonk_campaigns_running", len(st.Campaigns))
+	writeMetricHeader(w, "listmonk_campaign_send_rate", "gauge", "Messages sent a second by running campaigns over the last minute.")
+	for _, cp := range st.Campaigns {
+		writeMetric(w, "listmonk_campaign_send_rate", cp.Rate,
+			"campaign_id", strconv.Itoa(cp.ID), "campaign_name", cp.Name)
+	}
+
+	// DB connection pool.
+	db := app.db.Stats()
+	writeMetricHeader(w, "listmonk_db_connections_max", "gauge", "Max. open DB connections.")
+	writeMetric(w, "listmonk_db_connections_max", db.MaxOpenConnections)
+	writeMetricHeader(w, "listmonk_db_connections", "gauge", "Open DB connections by state.")
+	writeMetric(w, "listmonk_db_connections", db.InUse, "state", "in_use")
+	writeMetric(w, "listmonk_db_connections", db.Idle, "state", "idle")
+	writeMetricHeader(w, "listmonk_db_wait_total", "counter", "DB connections waited for.")
+	writeMetric(w, "listmonk_db_wait_total", db.WaitCount)
+	writeMetricHeader(w, "listmonk_db_wait_seconds_total", "counter", "Time spent waiting for DB connections.")
+	writeMetric(w, "listmonk_db_wait_seconds_total", db.WaitDuration.Seconds())
+
+	// In-process counters.
+	m := app.metrics
+	m.Lock()
+	defer m.Unlock()
+
+	writeMetricHeader(w, "listmonk_tx_status_events_total", "counter", "Delivery status events (bounces, complaints) of transactional messages.")
+	for _, s := range sortedKeys(m.txStatus) {
+		writeMetric(w, "listmonk_tx_status_events_total", m.txStatus[s], "status", s)
+	}
+
+	routes := make([]httpRoute, 0, len(m.latencies))
+	for r := range m.latencies {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].path == routes[j].path {
+			return routes[i].method < routes[j].method
+		}
+		return routes[i].path < routes[j].path
+	})
+
+	writeMetricHeader(w, "listmonk_http_requests_total", "counter", "HTTP requests by route and response code.")
+	for _, r := range routes {
+		codes := make([]int, 0, len(m.responses[r]))
+		for code := range m.responses[r] {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			writeMetric(w, "listmonk_http_requests_total", m.responses[r][code],
+				"method", r.method, "path", r.path, "code", strconv.Itoa(code))
+		}
+	}
+
+	writeMetricHeader(w, "listmonk_http_request_duration_seconds", "histogram", "HTTP request latencies by route.")
+	for _, r := range routes {
+		l := m.latencies[r]
+		for i, b := range httpLatencyBuckets {
+			writeMetric(w, "listmonk_http_request_duration_seconds_bucket", l.buckets[i],
+				"method", r.method, "path", r.path, "le", strconv.FormatFloat(b, 'g', -1, 64))
+		}
+		writeMetric(w, "listmonk_http_request_duration_seconds_bucket", l.count,
+			"method", r.method, "path", r.path, "le", "+Inf")
+		writeMetric(w, "listmonk_http_request_duration_seconds_sum", l.sum, "method", r.method, "path", r.path)
+		writeMetric(w, "listmonk_http_request_duration_seconds_count", l.count, "method", r.method, "path", r.path)
+	}
+
+	return w.Flush()
+}
+
+// metricsAuth is a middleware that checks the bearer token of requests
+// to the /metrics endpoint.
+func metricsAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			t := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+			return next(c)
+		}
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric.
+func writeMetricHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeMetric writes a sample of a metric with label name-value pairs.
+func writeMetric(w *bufio.Writer, name string, val interface{}, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, labels[i], metricLabelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %v\n", val)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sortedKeys returns the sorted keys of a map of counters.
+func sortedKeys(m map[string]uint64) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 
+	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/manager"
 )
 
@@ -22,8 +23,20 @@ type notifData struct {
 
 // sendNotification sends out an e-mail notification to admins.
 func (app *App) sendNotification(toEmails []string, subject, tplName string, data interface{}) error {
+	return app.sendLangNotification(toEmails, subject, tplName, data, app.i18n)
+}
+
+// sendLangNotification sends out an e-mail notification rendered in a
+// language, eg: the language of the subscriber it's sent to.
+func (app *App) sendLangNotification(toEmails []string, subject, tplName string, data interface{}, l *i18n.I18n) error {
+	tpls, err := app.getNotifTemplates(l)
+	if err != nil {
+		app.log.Printf("error compiling notification templates (%s): %v", l.Code(), err)
+		return err
+	}
+
 	var b bytes.Buffer
-	if err := app.notifTpls.ExecuteTemplate(&b, tplName, data); err != nil {
+	if err := tpls.ExecuteTemplate(&b, tplName, data); err != nil {
 		app.log.Printf("error compiling notification template '%s': %v", tplName, err)
 		return err
 	}
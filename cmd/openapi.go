@@ -0,0 +1,330 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/buflog"
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/openapi"
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+// apiVersion is the current version of the API that's served at /api/{version}/.
+const apiVersion = "v1"
+
+// apiDeprecationPolicy is published in the spec.
+const apiDeprecationPolicy = `The API is versioned with a path prefix, eg: /api/v1/lists. ` +
+	`Changes within a version are backwards compatible. A version that's superseded by a new one is ` +
+	`deprecated and is served for at least one more major release, during which its responses carry ` +
+	`the Deprecation and Sunset headers, before it's removed. Unversioned /api/ paths are aliases of the ` +
+	`current version that are used by the admin frontend and may change with it.`
+
+// apiVersions are the served versions of the API. A deprecated version has
+// the date after which it'll be removed.
+var apiVersions = map[string]apiVersionInfo{
+	"v1": {},
+}
+
+type apiVersionInfo struct {
+	Sunset time.Time
+}
+
+// apiDoc describes the request and response of an API route in the spec.
+type apiDoc struct {
+	summary string
+	query   []string
+	req     interface{}
+	resp    interface{}
+}
+
+type errResp struct {
+	Message string `json:"message"`
+}
+
+var (
+	pageParams    = []string{"page", "per_page"}
+	pageAndSearch = []string{"query", "order_by", "order", "page", "per_page"}
+)
+
+// apiDocs are the docs of API routes keyed by "METHOD path". Every /api route
+// must have an entry, which is checked on startup by checkAPIDocs. Routes
+// without req or resp are published with generic bodies.
+var apiDocs = map[string]apiDoc{
+	"GET /api/health":                   {summary: "Health check", resp: true},
+	"GET /api/config":                   {summary: "Get the server config"},
+	"GET /api/spec":                     {summary: "Get the OpenAPI spec of the API"},
+	"GET /api/dashboard/counts":         {summary: "Get dashboard counts"},
+	"GET /api/dashboard/charts":         {summary: "Get dashboard charts"},
+	"GET /api/dashboard/stats":          {summary: "Get dashboard stats for a period", query: []string{"from", "to", "compare_from", "compare_to"}},
+	"GET /api/dashboard/geo":            {summary: "Get views and clicks by country and region", query: []string{"days"}, resp: geoAnalytics{}},
+	"GET /api/dashboard/deliverability": {summary: "Get bounce and complaint rates"},
+	"GET /api/dashboard/smtp-health":    {summary: "Get the results of the last SMTP server health checks"},
+	"GET /api/lang/:lang":               {summary: "Get a language pack"},
+	"GET /api/settings":                 {summary: "Get settings", resp: settings{}},
+	"PUT /api/settings":                 {summary: "Update settings", req: settings{}, resp: true},
+	"PUT /api/settings/rate-limits":     {summary: "Update the send rate limits of messengers", req: []rateLimit{}, resp: []rateLimit{}},
+	"GET /api/settings/smtp/stats":      {summary: "Get the stats of the SMTP servers"},
+	"POST /api/settings/smtp/:index/test": {summary: "Test an SMTP server", req: struct {
+		Email string `json:"email"`
+	}{}, resp: email.CheckResult{}},
+	"GET /api/settings/messengers/stats": {summary: "Get the stats of the postback messengers", resp: []postback.Stats{}},
+	"GET /api/settings/dkim":             {summary: "Get the DNS records of the DKIM keys", resp: []dkimRecord{}},
+	"POST /api/settings/dkim/generate":   {summary: "Generate a DKIM key", req: dkimRecord{}, resp: dkimRecord{}},
+	"GET /api/settings/export":           {summary: "Export the settings as a JSON or TOML file", query: []string{"format", "secrets"}},
+	"POST /api/settings/import": {summary: "Import a JSON or TOML settings file", query: []string{"format", "dry_run"}, resp: struct {
+		Changed      []string `json:"changed"`
+		NeedsRestart bool     `json:"needs_restart"`
+	}{}},
+	"POST /api/admin/reload":                        {summary: "Restart the app", resp: true},
+	"GET /api/logs":                                 {summary: "Get the app logs", query: append([]string{"level", "component", "query", "from", "to"}, pageParams...), resp: logsWrap{}},
+	"GET /api/logs/files":                           {summary: "Get the log files", resp: []buflog.FileInfo{}},
+	"GET /api/logs/files/:name":                     {summary: "Download a gzipped log file"},
+	"DELETE /api/maintenance/analytics":             {summary: "Prune old views and clicks", query: []string{"days"}, resp: analyticsPruneResult{}},
+	"POST /api/maintenance/backup":                  {summary: "Start a backup of the DB, settings and media"},
+	"GET /api/users":                                {summary: "Get users", resp: []models.User{}},
+	"GET /api/users/:id":                            {summary: "Get a user", resp: models.User{}},
+	"POST /api/users":                               {summary: "Create a user", req: userReq{}, resp: models.User{}},
+	"PUT /api/users/:id":                            {summary: "Update a user", req: userReq{}, resp: models.User{}},
+	"DELETE /api/users/:id":                         {summary: "Delete a user", resp: true},
+	"DELETE /api/users/:id/totp":                    {summary: "Disable 2FA of a user", resp: true},
+	"GET /api/profile":                              {summary: "Get the logged in user", resp: models.User{}},
+	"POST /api/profile/totp":                        {summary: "Start 2FA setup and get the secret and its QR code"},
+	"PUT /api/profile/totp":                         {summary: "Enable 2FA", req: totpReq{}},
+	"DELETE /api/profile/totp":                      {summary: "Disable 2FA", req: totpReq{}, resp: true},
+	"GET /api/subscribers":                          {summary: "Query subscribers", query: append(pageAndSearch, "list_id"), resp: subsWrap{}},
+	"GET /api/subscribers/:id":                      {summary: "Get a subscriber", resp: models.Subscriber{}},
+	"POST /api/subscribers":                         {summary: "Create a subscriber", req: subimporter.SubReq{}, resp: models.Subscriber{}},
+	"PUT /api/subscribers/:id":                      {summary: "Update a subscriber", req: subUpdateReq{}, resp: models.Subscriber{}},
+	"DELETE /api/subscribers/:id":                   {summary: "Delete a subscriber", resp: true},
+	"DELETE /api/subscribers":                       {summary: "Delete subscribers", query: []string{"id"}, resp: true},
+	"GET /api/subscribers/export":                   {summary: "Export subscribers as CSV", query: []string{"list_id", "folder_id", "query", "id"}},
+	"GET /api/subscribers/:id/export":               {summary: "Export the data of a subscriber"},
+	"POST /api/subscribers/:id/optin":               {summary: "Send an opt-in confirmation to a subscriber", resp: true},
+	"PUT /api/subscribers/:id/blocklist":            {summary: "Blocklist a subscriber", resp: true},
+	"PUT /api/subscribers/lists/:id":                {summary: "Add, remove or unsubscribe a subscriber from lists", req: subQueryReq{}, resp: true},
+	"PUT /api/subscribers/lists":                    {summary: "Add, remove or unsubscribe subscribers from lists", req: subQueryReq{}, resp: true},
+	"PUT /api/subscribers/blocklist":                {summary: "Blocklist subscribers", req: subQueryReq{}, resp: true},
+	"POST /api/subscribers/query/delete":            {summary: "Delete subscribers by an SQL expression", req: subQueryReq{}, resp: true},
+	"PUT /api/subscribers/query/blocklist":          {summary: "Blocklist subscribers by an SQL expression", req: subQueryReq{}, resp: true},
+	"PUT /api/subscribers/query/lists":              {summary: "Manage the lists of subscribers by an SQL expression", req: subQueryReq{}, resp: true},
+	"GET /api/import/subscribers":                   {summary: "Get the status of the subscriber import", resp: subimporter.Status{}},
+	"GET /api/import/subscribers/logs":              {summary: "Get the logs of the subscriber import", resp: ""},
+	"POST /api/import/subscribers":                  {summary: "Import subscribers from a CSV or ZIP file (multipart params and file)", resp: subimporter.Status{}},
+	"DELETE /api/import/subscribers":                {summary: "Stop the subscriber import", resp: subimporter.Status{}},
+	"GET /api/lists":                                {summary: "Get lists", query: pageAndSearch, resp: listsWrap{}},
+	"GET /api/lists/:id":                            {summary: "Get a list", resp: models.List{}},
+	"POST /api/lists":                               {summary: "Create a list", req: models.List{}, resp: models.List{}},
+	"PUT /api/lists/:id":                            {summary: "Update a list", req: models.List{}, resp: models.List{}},
+	"DELETE /api/lists/:id":                         {summary: "Delete a list", resp: true},
+	"GET /api/lists/:id/webhooks":                   {summary: "Get the webhooks of a list", resp: []models.ListWebhook{}},
+	"POST /api/lists/:id/webhooks":                  {summary: "Create a list webhook", req: models.ListWebhook{}, resp: models.ListWebhook{}},
+	"GET /api/lists/:id/webhooks/:webhookID":        {summary: "Get a list webhook", resp: models.ListWebhook{}},
+	"PUT /api/lists/:id/webhooks/:webhookID":        {summary: "Update a list webhook", req: models.ListWebhook{}, resp: models.ListWebhook{}},
+	"DELETE /api/lists/:id/webhooks/:webhookID":     {summary: "Delete a list webhook", resp: true},
+	"GET /api/list-folders":                         {summary: "Get list folders", resp: []models.ListFolder{}},
+	"GET /api/list-folders/:id":                     {summary: "Get a list folder", resp: models.ListFolder{}},
+	"POST /api/list-folders":                        {summary: "Create a list folder", req: models.ListFolder{}, resp: models.ListFolder{}},
+	"PUT /api/list-folders/:id":                     {summary: "Update a list folder", req: models.ListFolder{}, resp: models.ListFolder{}},
+	"DELETE /api/list-folders/:id":                  {summary: "Delete a list folder", resp: true},
+	"GET /api/forms":                                {summary: "Get subscription forms", resp: []models.SubForm{}},
+	"POST /api/forms":                               {summary: "Create a subscription form", req: models.SubForm{}, resp: models.SubForm{}},
+	"GET /api/forms/:id":                            {summary: "Get a subscription form", resp: models.SubForm{}},
+	"GET /api/forms/:id/html":                       {summary: "Get the embeddable HTML of a subscription form", resp: ""},
+	"PUT /api/forms/:id":                            {summary: "Update a subscription form", req: models.SubForm{}, resp: models.SubForm{}},
+	"DELETE /api/forms/:id":                         {summary: "Delete a subscription form", resp: true},
+	"GET /api/page-templates":                       {summary: "Get public page template sets", resp: []models.PageTemplate{}},
+	"GET /api/page-templates/:id":                   {summary: "Get a public page template set", resp: models.PageTemplate{}},
+	"POST /api/page-templates":                      {summary: "Create a public page template set", req: models.PageTemplate{}, resp: models.PageTemplate{}},
+	"PUT /api/page-templates/:id":                   {summary: "Update a public page template set", req: models.PageTemplate{}, resp: models.PageTemplate{}},
+	"DELETE /api/page-templates/:id":                {summary: "Delete a public page template set", resp: true},
+	"GET /api/campaigns":                            {summary: "Query campaigns", query: append(pageAndSearch, "status", "no_body"), resp: campsWrap{}},
+	"GET /api/campaigns/:id":                        {summary: "Get a campaign", resp: models.Campaign{}},
+	"POST /api/campaigns":                           {summary: "Create a campaign", req: campaignReq{}, resp: models.Campaign{}},
+	"PUT /api/campaigns/:id":                        {summary: "Update a campaign", req: campaignReq{}, resp: models.Campaign{}},
+	"PUT /api/campaigns/:id/status":                 {summary: "Change the status of a campaign", req: campaignReq{}, resp: models.Campaign{}},
+	"PUT /api/campaigns/:id/archive":                {summary: "Publish a campaign on the public archive or remove it", resp: models.Campaign{}},
+	"POST /api/campaigns/:id/content":               {summary: "Convert the content type of a campaign", req: campaignContentReq{}, resp: ""},
+	"POST /api/campaigns/:id/test":                  {summary: "Send a test campaign", req: campaignReq{}, resp: true},
+	"DELETE /api/campaigns/:id":                     {summary: "Delete a campaign", resp: true},
+	"GET /api/campaigns/:id/preview":                {summary: "Render the HTML preview of a campaign"},
+	"POST /api/campaigns/:id/preview":               {summary: "Render the HTML preview of a campaign with an unsaved body (form params content_type, body)"},
+	"POST /api/campaigns/:id/text":                  {summary: "Render the plain text preview of a campaign (form params content_type, body)"},
+	"GET /api/campaigns/:id/links":                  {summary: "Get the clicks of the links of a campaign", resp: []linkClicks{}},
+	"GET /api/campaigns/:id/analytics/devices":      {summary: "Get the views of a campaign by device and client"},
+	"GET /api/campaigns/:id/analytics/geo":          {summary: "Get the views and clicks of a campaign by country and region", resp: geoAnalytics{}},
+	"GET /api/campaigns/:id/analytics/unsubscribes": {summary: "Get the unsubscriptions of a campaign by source", resp: []analyticsCount{}},
+	"GET /api/campaigns/events/export":              {summary: "Export views or clicks as CSV or JSON", query: []string{"type", "format", "campaign_id", "from", "to"}},
+	"GET /api/campaigns/running/stats":              {summary: "Get the stats of running campaigns", resp: []campaignStats{}},
+	"GET /api/campaigns/running/stream":             {summary: "Stream the stats of running campaigns as server-sent events", resp: campStreamEvent{}},
+	"GET /api/media": {summary: "Query media",
+		query: append([]string{"query", "folder_id", "tag", "from", "to"}, pageParams...), resp: mediaWrap{}},
+	"GET /api/media/:id":                                {summary: "Get a media file", resp: media.Media{}},
+	"PUT /api/media/:id":                                {summary: "Move a media file to a folder and tag it", req: mediaReq{}, resp: media.Media{}},
+	"DELETE /api/media/:id":                             {summary: "Delete a media file", resp: true},
+	"GET /api/media/orphans":                            {summary: "Get media files that aren't used anywhere", resp: []media.Media{}},
+	"DELETE /api/media/orphans":                         {summary: "Delete unused media files", query: []string{"id"}, resp: 0},
+	"GET /api/media/tags":                               {summary: "Get the tags of media files", resp: []string{}},
+	"GET /api/media-folders":                            {summary: "Get media folders", resp: []media.Folder{}},
+	"GET /api/media-folders/:id":                        {summary: "Get a media folder", resp: media.Folder{}},
+	"POST /api/media-folders":                           {summary: "Create a media folder", req: media.Folder{}, resp: media.Folder{}},
+	"POST /api/media":                                   {summary: "Upload a media file (multipart file, folder_id)", resp: true},
+	"PUT /api/media-folders/:id":                        {summary: "Rename a media folder", req: media.Folder{}, resp: media.Folder{}},
+	"DELETE /api/media-folders/:id":                     {summary: "Delete a media folder", resp: true},
+	"GET /api/templates":                                {summary: "Get templates", resp: []models.Template{}},
+	"GET /api/templates/:id":                            {summary: "Get a template", resp: models.Template{}},
+	"POST /api/templates":                               {summary: "Create a template", req: models.Template{}, resp: models.Template{}},
+	"PUT /api/templates/:id":                            {summary: "Update a template", req: models.Template{}, resp: models.Template{}},
+	"DELETE /api/templates/:id":                         {summary: "Delete a template", resp: true},
+	"GET /api/templates/:id/versions":                   {summary: "Get the versions of a template", resp: []models.TemplateVersion{}},
+	"GET /api/templates/:id/versions/:version":          {summary: "Get a version of a template", query: []string{"no_body"}, resp: models.TemplateVersion{}},
+	"GET /api/templates/:id/versions/:version/diff":     {summary: "Diff a version of a template against another", query: []string{"against"}},
+	"PUT /api/templates/:id/versions/:version/rollback": {summary: "Roll back a template to a version", resp: models.Template{}},
+	"PUT /api/templates/:id/default":                    {summary: "Set the default template", resp: models.Template{}},
+	"GET /api/templates/:id/preview":                    {summary: "Render the HTML preview of a template"},
+	"POST /api/templates/preview":                       {summary: "Render the HTML preview of an unsaved template (form params body, type, subject, sample_data)"},
+	"POST /api/templates/validate":                      {summary: "Check a template for errors", req: models.Template{}, resp: tplLint{}},
+	"POST /api/templates/:id/render":                    {summary: "Render a transactional template with data"},
+	"POST /api/tx": {summary: "Send a transactional message", req: models.TxMessage{}, resp: struct {
+		MessageID string `json:"message_id"`
+	}{}},
+	"POST /api/tx/batch":           {summary: "Send a batch of transactional messages", req: models.TxBatch{}, resp: []txBatchResult{}},
+	"GET /api/tx/scheduled":        {summary: "Get scheduled transactional messages", query: pageParams, resp: txScheduledWrap{}},
+	"DELETE /api/tx/scheduled/:id": {summary: "Cancel a scheduled transactional message", resp: true},
+	"POST /api/tx/events":          {summary: "Record a bounce or complaint of a transactional message", resp: true},
+	"GET /api/tx/log/export":       {summary: "Export the transactional message log as CSV or JSON", query: []string{"format", "query", "status", "template_id", "subscriber_id", "from", "to"}},
+	"GET /api/tx/log": {summary: "Query the transactional message log",
+		query: append([]string{"query", "status", "template_id", "subscriber_id", "from", "to"}, pageParams...), resp: txLogWrap{}},
+	"GET /api/unsubscribes": {summary: "Query the unsubscribe survey responses",
+		query: append([]string{"campaign_id", "from", "to"}, pageParams...), resp: unsubFeedbackWrap{}},
+	"GET /api/unsubscribes/summary": {summary: "Get the number of unsubscribe survey responses by reason",
+		query: []string{"campaign_id", "from", "to"}, resp: []unsubFeedbackSummary{}},
+	"GET /api/audit": {summary: "Query the audit log",
+		query: append([]string{"username", "resource", "resource_id", "method", "from", "to"}, pageParams...), resp: auditLogWrap{}},
+	"GET /api/audit/export": {summary: "Export the audit log as CSV or JSON",
+		query: []string{"format", "username", "resource", "resource_id", "method", "from", "to"}},
+	"GET /api/public/lists":           {summary: "Get the public lists", resp: []publicList{}},
+	"POST /api/public/subscription":   {summary: "Subscribe to public lists", req: publicSubReq{}},
+	"POST /api/public/optin/:subUUID": {summary: "Confirm the subscriptions of a subscriber", req: publicOptinReq{}, resp: []publicList{}},
+	"OPTIONS /api/public/*":           {summary: "CORS preflight of the public API"},
+}
+
+// checkAPIDocs returns the /api routes that have no entry in apiDocs.
+func checkAPIDocs(e *echo.Echo) []string {
+	var out []string
+	for _, r := range e.Routes() {
+		if !strings.HasPrefix(r.Path, "/api/") {
+			continue
+		}
+		if _, ok := apiDocs[r.Method+" "+r.Path]; !ok {
+			out = append(out, r.Method+" "+r.Path)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// versionAPI middleware serves versioned API paths (/api/v1/...) by
+// rewriting them to the routes of the version, which are the unversioned
+// routes. The version of the API is returned in the API-Version header and
+// deprecated versions announce their removal in the Deprecation and
+// Sunset headers.
+func versionAPI(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var (
+			req = c.Request()
+			p   = req.URL.Path
+		)
+		if !strings.HasPrefix(p, "/api/") {
+			return next(c)
+		}
+
+		ver := apiVersion
+		if seg := strings.SplitN(p[len("/api/"):], "/", 2); len(seg) == 2 {
+			if v, ok := apiVersions[seg[0]]; ok {
+				ver = seg[0]
+				req.URL.Path = "/api/" + seg[1]
+				if req.URL.RawPath != "" {
+					req.URL.RawPath = strings.Replace(req.URL.RawPath, "/api/"+ver+"/", "/api/", 1)
+				}
+
+				if !v.Sunset.IsZero() {
+					h := c.Response().Header()
+					h.Set("Deprecation", "true")
+					h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+				}
+			}
+		}
+		c.Response().Header().Set("API-Version", ver)
+
+		return next(c)
+	}
+}
+
+// handleGetAPISpec returns the OpenAPI spec of the current version of the
+// API generated from the registered routes.
+func handleGetAPISpec(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	b := openapi.New(openapi.Info{
+		Title:       "listmonk",
+		Description: apiDeprecationPolicy,
+		Version:     apiVersion,
+	}, openapi.Server{URL: app.constants.RootURL + "/api/" + apiVersion})
+
+	b.AddSecurity("basicAuth", openapi.SecurityScheme{Type: "http", Scheme: "basic"})
+	b.AddSecurity("session", openapi.SecurityScheme{Type: "apiKey", In: "cookie", Name: sessionCookie})
+
+	routes := c.Echo().Routes()
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path == routes[j].Path {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Path < routes[j].Path
+	})
+
+	errBody := openapi.Response{Description: "Error", Content: b.JSON(errResp{})}
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Path, "/api/") {
+			continue
+		}
+
+		var (
+			d  = apiDocs[r.Method+" "+r.Path]
+			op = openapi.Operation{
+				OperationID: openapi.OperationID(r.Method, r.Path),
+				Summary:     d.summary,
+				Tags:        []string{getPathResource(r.Path)},
+				Responses: map[string]openapi.Response{
+					"200":     {Description: "OK", Content: map[string]openapi.MediaType{"application/json": {Schema: okSchema(b, d.resp)}}},
+					"default": errBody,
+				},
+			}
+		)
+		for _, q := range d.query {
+			op.Parameters = append(op.Parameters, openapi.Parameter{
+				Name: q, In: "query", Schema: &openapi.Schema{Type: "string"}})
+		}
+		if d.req != nil {
+			op.RequestBody = &openapi.RequestBody{Required: true, Content: b.JSON(d.req)}
+		}
+
+		b.Add(r.Method, strings.TrimPrefix(r.Path, "/api"), op)
+	}
+
+	return c.JSON(http.StatusOK, b.Spec())
+}
+
+// okSchema returns the schema of an okResp with data of the type of v.
+func okSchema(b *openapi.Builder, v interface{}) *openapi.Schema {
+	return &openapi.Schema{
+		Type:       "object",
+		Properties: map[string]*openapi.Schema{"data": b.Schema(v)},
+	}
+}
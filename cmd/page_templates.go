@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+// Context key of the page template set that the public pages of a request
+// are rendered with.
+const ctxPageTemplate = "page_template"
+
+// handleGetPageTemplates handles retrieval of page template sets.
+func handleGetPageTemplates(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.PageTemplate
+
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if err := app.queries.GetPageTemplates.Select(&out, id); err != nil {
+		app.log.Printf("error fetching page templates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.pageTemplates}", "error", pqErrMsg(err)))
+	}
+	if id > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.pageTemplate}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreatePageTemplate handles page template set creation.
+func handleCreatePageTemplate(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.PageTemplate
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validatePageTemplate(o, c, app); err != nil {
+		return err
+	}
+
+	var newID int
+	if err := app.queries.CreatePageTemplate.Get(&newID, o.Name, o.Body); err != nil {
+		app.log.Printf("error creating page template: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.pageTemplate}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetPageTemplates(copyEchoCtx(c, map[string]string{
+		"id": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdatePageTemplate handles page template set modification.
+func handleUpdatePageTemplate(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o models.PageTemplate
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validatePageTemplate(o, c, app); err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdatePageTemplate.Exec(id, o.Name, o.Body)
+	if err != nil {
+		app.log.Printf("error updating page template: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.pageTemplate}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.pageTemplate}"))
+	}
+
+	c.Echo().Renderer.(*tplRenderer).clearPageTemplate(id)
+	return handleGetPageTemplates(c)
+}
+
+// handleDeletePageTemplate handles page template set deletion. Lists that
+// use the set fall back to the default templates.
+func handleDeletePageTemplate(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeletePageTemplate.Exec(id); err != nil {
+		app.log.Printf("error deleting page template: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.pageTemplate}", "error", pqErrMsg(err)))
+	}
+
+	c.Echo().Renderer.(*tplRenderer).clearPageTemplate(id)
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validatePageTemplate validates the name of a page template set and
+// parses its body over the default public templates.
+func validatePageTemplate(o models.PageTemplate, c echo.Context, app *App) error {
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("templates.fieldInvalidName"))
+	}
+	if o.Body == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("templates.invalidPageTemplateBody"))
+	}
+
+	if _, err := c.Echo().Renderer.(*tplRenderer).parsePageTemplate(o.Body, nil); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+	}
+
+	return nil
+}
+
+// getPageTemplate returns the public templates with a page template set
+// (0 for none) parsed over them in a language (nil for the app's language).
+// Parsed sets are cached until they're updated or deleted.
+func (t *tplRenderer) getPageTemplate(id int, lang *i18n.I18n, app *App) (*template.Template, error) {
+	key := pageTplKey{id: id}
+	if lang != nil {
+		key.lang = lang.Code()
+	}
+
+	t.pageTplMut.RLock()
+	tpl, ok := t.pageTpls[key]
+	t.pageTplMut.RUnlock()
+	if ok {
+		return tpl, nil
+	}
+
+	var body string
+	if id > 0 {
+		var out []models.PageTemplate
+		if err := app.queries.GetPageTemplates.Select(&out, id); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("page template %d not found", id)
+		}
+		body = out[0].Body
+	}
+
+	tpl, err := t.parsePageTemplate(body, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	t.pageTplMut.Lock()
+	t.pageTpls[key] = tpl
+	t.pageTplMut.Unlock()
+
+	return tpl, nil
+}
+
+// parsePageTemplate parses a page template set's template definitions
+// over a copy of the default public templates that's rendered in a
+// language (nil for the app's language).
+func (t *tplRenderer) parsePageTemplate(body string, lang *i18n.I18n) (*template.Template, error) {
+	tpl, err := t.base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if lang != nil {
+		tpl.Funcs(template.FuncMap{
+			"L": func() *i18n.I18n {
+				return lang
+			},
+		})
+	}
+	if body == "" {
+		return tpl, nil
+	}
+	return tpl.Parse(body)
+}
+
+// clearPageTemplate removes a parsed page template set in all languages
+// from the cache.
+func (t *tplRenderer) clearPageTemplate(id int) {
+	t.pageTplMut.Lock()
+	for k := range t.pageTpls {
+		if k.id == id {
+			delete(t.pageTpls, k)
+		}
+	}
+	t.pageTplMut.Unlock()
+}
+
+// setPageTemplate sets the page template set of the first of the lists that
+// has one to render the public pages of a request with.
+func setPageTemplate(c echo.Context, lists []models.List) {
+	for _, l := range lists {
+		if l.PageTemplateID.Valid {
+			c.Set(ctxPageTemplate, l.PageTemplateID.Int)
+			return
+		}
+	}
+}
+
+// setListsPageTemplate sets the page template set of the first of the lists,
+// given by IDs or UUIDs, that has one to render the public pages of a request with.
+func setListsPageTemplate(c echo.Context, ids []int64, uuids []string, app *App) {
+	for _, u := range uuids {
+		if !reUUID.MatchString(u) {
+			return
+		}
+	}
+
+	var lists []models.List
+	if err := app.queries.GetListsByOptin.Select(&lists, "", pq.Int64Array(ids), pq.StringArray(uuids)); err != nil {
+		app.log.Printf("error fetching lists for page template: %v", err)
+		return
+	}
+	setPageTemplate(c, lists)
+}
+
+// setCampaignPageTemplate sets the page template set of the first of a
+// campaign's lists that has one to render the public pages of a request with.
+func setCampaignPageTemplate(c echo.Context, campUUID string, app *App) {
+	var id int
+	if err := app.queries.GetCampaignPageTemplate.Get(&id, campUUID); err != nil {
+		app.log.Printf("error fetching campaign page template: %v", err)
+		return
+	}
+	if id > 0 {
+		c.Set(ctxPageTemplate, id)
+	}
+}
@@ -2,19 +2,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"image"
 	"image/png"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/geoip"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/useragent"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 	"github.com/lib/pq"
@@ -30,6 +40,21 @@ type tplRenderer struct {
 	RootURL    string
 	LogoURL    string
 	FaviconURL string
+
+	// Unexecuted copy of the templates that page template sets are
+	// parsed over, as executed templates can't be cloned.
+	base *template.Template
+
+	// Parsed page template sets and languages.
+	pageTpls   map[pageTplKey]*template.Template
+	pageTplMut sync.RWMutex
+}
+
+// pageTplKey is the key of a parsed template set, which is a page template
+// set (0 for the default templates) in a language ("" for the app's language).
+type pageTplKey struct {
+	id   int
+	lang string
 }
 
 // tplData is the data container that is injected
@@ -71,6 +96,7 @@ type msgTpl struct {
 type subFormTpl struct {
 	publicTpl
 	Lists []models.List
+	Guard formGuardTpl
 }
 
 type subForm struct {
@@ -82,26 +108,57 @@ var (
 	pixelPNG = drawTransparentImage(3, 14)
 )
 
-// Render executes and renders a template for echo.
+// Render executes and renders a template for echo. If a page template set
+// or a language is set on the request, the template is rendered from the
+// set in the language.
 func (t *tplRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.templates.ExecuteTemplate(w, name, tplData{
+	var (
+		app = c.Get("app").(*App)
+		tpl = t.templates
+		L   = app.i18n
+	)
+
+	id, _ := c.Get(ctxPageTemplate).(int)
+	lang, _ := c.Get(ctxLang).(*i18n.I18n)
+	if id > 0 || lang != nil {
+		if p, err := t.getPageTemplate(id, lang, app); err != nil {
+			app.log.Printf("error loading page template %d: %v", id, err)
+		} else {
+			tpl = p
+			if lang != nil {
+				L = lang
+			}
+		}
+	}
+
+	return tpl.ExecuteTemplate(w, name, tplData{
 		RootURL:    t.RootURL,
 		LogoURL:    t.LogoURL,
 		FaviconURL: t.FaviconURL,
 		Data:       data,
-		L:          c.Get("app").(*App).i18n,
+		L:          L,
 	})
 }
 
 // handleViewCampaignMessage renders the HTML view of a campaign message.
 // This is the view the {{ MessageURL }} template tag links to in e-mail campaigns.
+// With a valid token (?t=), the message is rendered exactly as it was for the
+// subscriber. Without one (links in messages sent before tokens), the generic
+// copy that isn't personalized is rendered.
 func handleViewCampaignMessage(c echo.Context) error {
 	var (
 		app      = c.Get("app").(*App)
 		campUUID = c.Param("campUUID")
 		subUUID  = c.Param("subUUID")
+		token    = c.QueryParam("t")
 	)
 
+	if token != "" && !hmac.Equal([]byte(token), []byte(messageToken(campUUID, subUUID, app.constants.Security.MessageKey))) {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl(app.i18n.T("public.notFoundTitle"), "",
+				app.i18n.T("public.campaignNotFound")))
+	}
+
 	// Get the campaign.
 	var camp models.Campaign
 	if err := app.queries.GetCampaign.Get(&camp, 0, campUUID); err != nil {
@@ -118,17 +175,21 @@ func handleViewCampaignMessage(c echo.Context) error {
 	}
 
 	// Get the subscriber.
-	sub, err := getSubscriber(0, subUUID, "", app)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.Render(http.StatusNotFound, tplMessage,
-				makeMsgTpl(app.i18n.T("public.notFoundTitle"), "",
-					app.i18n.T("public.errorFetchingEmail")))
-		}
+	sub := models.Subscriber{UUID: archiveSubUUID, Attribs: models.SubscriberAttribs{}}
+	if token != "" {
+		s, err := getSubscriber(0, subUUID, "", app)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.Render(http.StatusNotFound, tplMessage,
+					makeMsgTpl(app.i18n.T("public.notFoundTitle"), "",
+						app.i18n.T("public.errorFetchingEmail")))
+			}
 
-		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorFetchingCampaign")))
+			return c.Render(http.StatusInternalServerError, tplMessage,
+				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+					app.i18n.Ts("public.errorFetchingCampaign")))
+		}
+		sub = s
 	}
 
 	// Compile the template.
@@ -151,12 +212,21 @@ func handleViewCampaignMessage(c echo.Context) error {
 	return c.HTML(http.StatusOK, string(msg.Body()))
 }
 
+// messageToken returns the token that authorizes the hosted message page of
+// a subscriber in a campaign.
+func messageToken(campUUID, subUUID, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(campUUID + "." + subUUID))
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
 // handleSubscriptionPage renders the subscription management page and
 // handles unsubscriptions. This is the view that {{ UnsubscribeURL }} in
 // campaigns link to.
 func handleSubscriptionPage(c echo.Context) error {
 	var (
 		app          = c.Get("app").(*App)
+		L            = publicLang(c, app)
 		campUUID     = c.Param("campUUID")
 		subUUID      = c.Param("subUUID")
 		unsub        = c.Request().Method == http.MethodPost
@@ -164,10 +234,11 @@ func handleSubscriptionPage(c echo.Context) error {
 		out          = unsubTpl{}
 	)
 	out.SubUUID = subUUID
-	out.Title = app.i18n.T("public.unsubscribeTitle")
+	out.Title = L.T("public.unsubscribeTitle")
 	out.AllowBlocklist = app.constants.Privacy.AllowBlocklist
 	out.AllowExport = app.constants.Privacy.AllowExport
 	out.AllowWipe = app.constants.Privacy.AllowWipe
+	setCampaignPageTemplate(c, campUUID, app)
 
 	// Unsubscribe.
 	if unsub {
@@ -176,16 +247,41 @@ func handleSubscriptionPage(c echo.Context) error {
 			blocklist = false
 		}
 
-		if _, err := app.queries.Unsubscribe.Exec(campUUID, subUUID, blocklist); err != nil {
+		var listIDs pq.Int64Array
+		if err := app.queries.Unsubscribe.Select(&listIDs, campUUID, subUUID, blocklist); err != nil {
 			app.log.Printf("error unsubscribing: %v", err)
 			return c.Render(http.StatusInternalServerError, tplMessage,
-				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-					app.i18n.Ts("public.errorProcessingRequest")))
+				makeMsgTpl(L.T("public.errorTitle"), "",
+					L.Ts("public.errorProcessingRequest")))
+		}
+
+		// One-click (RFC 8058) unsubscriptions are POSTed by e-mail clients
+		// from the List-Unsubscribe-Post header.
+		oneClick := c.FormValue("List-Unsubscribe") == "One-Click"
+
+		if len(listIDs) > 0 {
+			if sub, err := getSubscriber(0, subUUID, "", app); err == nil {
+				go fireListWebhooks(models.ListWebhookEventUnsubscribe,
+					[]int64{int64(sub.ID)}, listIDs, app)
+			}
+
+			source := models.UnsubSourcePage
+			if oneClick {
+				source = models.UnsubSourceOneClick
+			}
+			if _, err := app.queries.RegisterCampaignUnsubscribe.Exec(campUUID, subUUID, source); err != nil {
+				app.log.Printf("error recording unsubscription: %v", err)
+			}
+		}
+
+		// Ask for a reason unless the request is a one-click unsubscription.
+		if app.constants.Privacy.UnsubSurvey && !oneClick {
+			return renderUnsubSurvey(c, campUUID, subUUID, app)
 		}
 
 		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.unsubbedTitle"), "",
-				app.i18n.T("public.unsubbedInfo")))
+			makeMsgTpl(L.T("public.unsubbedTitle"), "",
+				L.T("public.unsubbedInfo")))
 	}
 
 	return c.Render(http.StatusOK, "subscription", out)
@@ -197,12 +293,13 @@ func handleSubscriptionPage(c echo.Context) error {
 func handleOptinPage(c echo.Context) error {
 	var (
 		app        = c.Get("app").(*App)
+		L          = publicLang(c, app)
 		subUUID    = c.Param("subUUID")
 		confirm, _ = strconv.ParseBool(c.FormValue("confirm"))
 		out        = optinTpl{}
 	)
 	out.SubUUID = subUUID
-	out.Title = app.i18n.T("public.confirmOptinSubTitle")
+	out.Title = L.T("public.confirmOptinSubTitle")
 	out.SubUUID = subUUID
 
 	// Get and validate fields.
@@ -215,8 +312,8 @@ func handleOptinPage(c echo.Context) error {
 		for _, l := range out.ListUUIDs {
 			if !reUUID.MatchString(l) {
 				return c.Render(http.StatusBadRequest, tplMessage,
-					makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-						app.i18n.T("globals.messages.invalidUUID")))
+					makeMsgTpl(L.T("public.errorTitle"), "",
+						L.T("globals.messages.invalidUUID")))
 			}
 		}
 	}
@@ -227,15 +324,17 @@ func handleOptinPage(c echo.Context) error {
 		app.log.Printf("error fetching lists for opt-in: %s", pqErrMsg(err))
 
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorFetchingLists")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorFetchingLists")))
 	}
 
+	setPageTemplate(c, out.Lists)
+
 	// There are no lists to confirm.
 	if len(out.Lists) == 0 {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.noSubTitle"), "",
-				app.i18n.Ts("public.noSubInfo")))
+			makeMsgTpl(L.T("public.noSubTitle"), "",
+				L.Ts("public.noSubInfo")))
 	}
 
 	// Confirm.
@@ -243,13 +342,13 @@ func handleOptinPage(c echo.Context) error {
 		if _, err := app.queries.ConfirmSubscriptionOptin.Exec(subUUID, pq.StringArray(out.ListUUIDs)); err != nil {
 			app.log.Printf("error unsubscribing: %v", err)
 			return c.Render(http.StatusInternalServerError, tplMessage,
-				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-					app.i18n.Ts("public.errorProcessingRequest")))
+				makeMsgTpl(L.T("public.errorTitle"), "",
+					L.Ts("public.errorProcessingRequest")))
 		}
 
 		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.subConfirmedTitle"), "",
-				app.i18n.Ts("public.subConfirmed")))
+			makeMsgTpl(L.T("public.subConfirmedTitle"), "",
+				L.Ts("public.subConfirmed")))
 	}
 
 	return c.Render(http.StatusOK, "optin", out)
@@ -262,10 +361,15 @@ func handleSubscriptionFormPage(c echo.Context) error {
 		app = c.Get("app").(*App)
 	)
 
+	// Render the page in the requested language (?lang=), if any. The form
+	// posts to the same URL and subscribers are saved with the language.
+	setPublicLang(c, c.QueryParam("lang"), app)
+	L := publicLang(c, app)
+
 	if !app.constants.EnablePublicSubPage {
 		return c.Render(http.StatusNotFound, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.invalidFeature")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.invalidFeature")))
 	}
 
 	// Get all public lists.
@@ -273,19 +377,33 @@ func handleSubscriptionFormPage(c echo.Context) error {
 	if err := app.queries.GetLists.Select(&lists, models.ListTypePublic); err != nil {
 		app.log.Printf("error fetching public lists for form: %s", pqErrMsg(err))
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorFetchingLists")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorFetchingLists")))
+	}
+
+	// Optionally, only show the given lists (?l=uuid) and render the page
+	// with their page template.
+	if uuids := c.QueryParams()["l"]; len(uuids) > 0 {
+		filtered := make([]models.List, 0, len(lists))
+		for _, l := range lists {
+			if inArray(l.UUID, uuids) {
+				filtered = append(filtered, l)
+			}
+		}
+		lists = filtered
+		setPageTemplate(c, lists)
 	}
 
 	if len(lists) == 0 {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.noListsAvailable")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.noListsAvailable")))
 	}
 
 	out := subFormTpl{}
-	out.Title = app.i18n.T("public.sub")
+	out.Title = L.T("public.sub")
 	out.Lists = lists
+	out.Guard = makeFormGuard(app)
 
 	return c.Render(http.StatusOK, "subscription-form", out)
 }
@@ -303,18 +421,20 @@ func handleSubscriptionForm(c echo.Context) error {
 		return err
 	}
 
-	// If there's a nonce value, a bot could've filled the form.
-	if c.FormValue("nonce") != "" {
-		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.T("public.invalidFeature")))
+	setListsPageTemplate(c, nil, req.SubListUUIDs, app)
+	setPublicLang(c, c.FormValue("lang"), app)
+	L := publicLang(c, app)
 
+	// Check for bots (honeypot, submit time, CAPTCHA).
+	if err := checkFormGuard(c, "", true, app); err != nil {
+		return c.Render(http.StatusBadRequest, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "", err.Error()))
 	}
 
 	if len(req.SubListUUIDs) == 0 {
 		return c.Render(http.StatusBadRequest, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.T("public.noListsSelected")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.T("public.noListsSelected")))
 	}
 
 	// If there's no name, use the name bit from the e-mail.
@@ -326,24 +446,172 @@ func handleSubscriptionForm(c echo.Context) error {
 	// Validate fields.
 	if err := subimporter.ValidateFields(req.SubReq); err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", err.Error()))
+			makeMsgTpl(L.T("public.errorTitle"), "", err.Error()))
 	}
 
-	// Insert the subscriber into the DB.
+	// Insert the subscriber into the DB with the language they subscribed in.
 	req.Status = models.SubscriberStatusEnabled
 	req.ListUUIDs = pq.StringArray(req.SubListUUIDs)
+	if L != app.i18n {
+		req.Attribs = models.SubscriberAttribs{subLangAttrib: L.Code()}
+	}
 	_, _, hasOptin, err := insertSubscriber(req.SubReq, app)
 	if err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", fmt.Sprintf("%s", err.(*echo.HTTPError).Message)))
+			makeMsgTpl(L.T("public.errorTitle"), "", fmt.Sprintf("%s", err.(*echo.HTTPError).Message)))
+	}
+
+	msg := "public.subConfirmed"
+	if hasOptin {
+		msg = "public.subOptinPending"
+	}
+
+	return c.Render(http.StatusOK, tplMessage, makeMsgTpl(L.T("public.subTitle"), "", L.Ts(msg)))
+}
+
+// handleSubFormPage renders the hosted page of a subscription form.
+func handleSubFormPage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+	)
+
+	// Render the page in the requested language (?lang=), if any, which is
+	// posted with the form.
+	setPublicLang(c, c.QueryParam("lang"), app)
+	L := publicLang(c, app)
+
+	form, err := getSubFormByUUID(c.Param("formUUID"), app)
+	if err != nil {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "", err.Error()))
+	}
+
+	setListsPageTemplate(c, []int64{int64(form.ListID)}, nil, app)
+
+	out := subFormTplData{Form: form, Guard: makeFormGuard(app)}
+	out.Title = form.Name
+	if L != app.i18n {
+		out.Lang = L.Code()
+	}
+	return c.Render(http.StatusOK, tplSubForm, out)
+}
+
+// handleSubFormSubmit handles subscriptions coming from subscription forms,
+// either as HTML form posts from the hosted page and embedded snippets,
+// or as JSON requests. Custom fields are validated against the form's fields
+// and stored as subscriber attributes.
+func handleSubFormSubmit(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		isJSON = strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+	)
+
+	// Respond with JSON or an HTML message page depending on the request.
+	sendErr := func(code int, msg string) error {
+		if isJSON {
+			return echo.NewHTTPError(code, msg)
+		}
+		return c.Render(code, tplMessage, makeMsgTpl(publicLang(c, app).T("public.errorTitle"), "", msg))
+	}
+
+	form, err := getSubFormByUUID(c.Param("formUUID"), app)
+	if err != nil {
+		return sendErr(http.StatusNotFound, err.Error())
+	}
+	if !isJSON {
+		setListsPageTemplate(c, []int64{int64(form.ListID)}, nil, app)
+	}
+
+	// Read the fixed and custom fields.
+	var req struct {
+		Email   string                 `json:"email"`
+		Name    string                 `json:"name"`
+		Lang    string                 `json:"lang"`
+		Fields  map[string]interface{} `json:"fields"`
+		Captcha string                 `json:"captcha"`
+	}
+	if isJSON {
+		if err := c.Bind(&req); err != nil {
+			return sendErr(http.StatusBadRequest, app.i18n.T("public.errorProcessingRequest"))
+		}
+	} else {
+		params, err := c.FormParams()
+		if err != nil {
+			return sendErr(http.StatusBadRequest, app.i18n.T("public.errorProcessingRequest"))
+		}
+
+		req.Email = params.Get("email")
+		req.Name = params.Get("name")
+		req.Lang = params.Get("lang")
+		req.Fields = make(map[string]interface{}, len(form.Fields))
+		for _, f := range form.Fields {
+			if v, ok := params[f.Name]; ok && len(v) > 0 {
+				req.Fields[f.Name] = v[0]
+			}
+		}
+	}
+
+	setPublicLang(c, req.Lang, app)
+	L := publicLang(c, app)
+
+	// Check for bots (honeypot, submit time, CAPTCHA).
+	if err := checkFormGuard(c, req.Captcha, !isJSON, app); err != nil {
+		return sendErr(http.StatusBadRequest, err.Error())
+	}
+
+	attribs, err := makeSubFormAttribs(form.Fields, req.Fields, app)
+	if err != nil {
+		return sendErr(http.StatusBadRequest, err.Error())
+	}
+	if L != app.i18n {
+		attribs[subLangAttrib] = L.Code()
+	}
+
+	// If there's no name, use the name bit from the e-mail.
+	sub := subimporter.SubReq{}
+	sub.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	sub.Name = strings.TrimSpace(req.Name)
+	if sub.Name == "" {
+		sub.Name = strings.Split(sub.Email, "@")[0]
+	}
+	if err := subimporter.ValidateFields(sub); err != nil {
+		return sendErr(http.StatusBadRequest, err.Error())
+	}
+
+	// Insert the subscriber into the DB.
+	sub.Status = models.SubscriberStatusEnabled
+	sub.Attribs = attribs
+	sub.Lists = pq.Int64Array{int64(form.ListID)}
+	_, _, hasOptin, err := insertSubscriber(sub, app)
+	if err != nil {
+		return sendErr(http.StatusInternalServerError, fmt.Sprintf("%s", err.(*echo.HTTPError).Message))
+	}
+
+	if isJSON {
+		return c.JSON(http.StatusOK, okResp{struct {
+			HasOptin bool `json:"has_optin"`
+		}{hasOptin}})
 	}
 
 	msg := "public.subConfirmed"
 	if hasOptin {
 		msg = "public.subOptinPending"
 	}
+	return c.Render(http.StatusOK, tplMessage, makeMsgTpl(L.T("public.subTitle"), "", L.Ts(msg)))
+}
+
+// getSubFormByUUID fetches a subscription form by its UUID.
+func getSubFormByUUID(formUUID string, app *App) (models.SubForm, error) {
+	var out []models.SubForm
+	if err := app.queries.GetSubForms.Select(&out, 0, formUUID); err != nil {
+		app.log.Printf("error fetching form: %v", err)
+		return models.SubForm{}, errors.New(app.i18n.T("public.errorProcessingRequest"))
+	}
+	if len(out) == 0 {
+		return models.SubForm{}, errors.New(app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.form}"))
+	}
 
-	return c.Render(http.StatusOK, tplMessage, makeMsgTpl(app.i18n.T("public.subTitle"), "", app.i18n.Ts(msg)))
+	return out[0], nil
 }
 
 // handleLinkRedirect redirects a link UUID to its original underlying link
@@ -362,9 +630,34 @@ func handleLinkRedirect(c echo.Context) error {
 		subUUID = ""
 	}
 
-	var url string
-	if err := app.queries.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID); err != nil {
-		if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "link_id" {
+	var (
+		url     = ""
+		loc     = geoLocate(c, app)
+		limited = c.Get(ctxRateLimited) != nil
+		err     error
+	)
+	switch {
+	case app.tracker != nil:
+		// Redirect right away and queue the click to be written in a batch.
+		url, err = app.tracker.GetLinkURL(linkUUID)
+		if err == nil && !limited {
+			app.tracker.AddClick(trackClick{
+				LinkUUID:  linkUUID,
+				CampUUID:  campUUID,
+				SubUUID:   subUUID,
+				Country:   loc.Country,
+				Region:    loc.Region,
+				CreatedAt: time.Now(),
+			})
+		}
+	case limited:
+		// Redirect without recording the click.
+		err = app.queries.GetLinkURL.Get(&url, linkUUID)
+	default:
+		err = app.queries.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID, loc.Country, loc.Region)
+	}
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); (ok && pqErr.Column == "link_id") || err == sql.ErrNoRows {
 			return c.Render(http.StatusNotFound, tplMessage,
 				makeMsgTpl(app.i18n.T("public.errorTitle"), "",
 					app.i18n.Ts("public.invalidLink")))
@@ -376,6 +669,16 @@ func handleLinkRedirect(c echo.Context) error {
 				app.i18n.Ts("public.errorProcessingRequest")))
 	}
 
+	if !limited {
+		app.events.Publish(events.TypeCampaignClick, campaignTrackEvent{
+			CampaignUUID:   campUUID,
+			SubscriberUUID: subUUID,
+			URL:            url,
+			Country:        loc.Country,
+			Region:         loc.Region,
+		})
+	}
+
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
@@ -395,10 +698,39 @@ func handleRegisterCampaignView(c echo.Context) error {
 		subUUID = ""
 	}
 
-	// Exclude dummy hits from template previews.
-	if campUUID != dummyUUID && subUUID != dummyUUID {
-		if _, err := app.queries.RegisterCampaignView.Exec(campUUID, subUUID); err != nil {
+	// Exclude dummy hits from template previews and views over the rate limit.
+	if campUUID != dummyUUID && subUUID != dummyUUID && c.Get(ctxRateLimited) == nil {
+		var (
+			ua  = useragent.Parse(c.Request().UserAgent())
+			loc = geoLocate(c, app)
+		)
+		var err error
+		if app.tracker != nil {
+			// Queue the view to be written in a batch.
+			app.tracker.AddView(trackView{
+				CampUUID:  campUUID,
+				SubUUID:   subUUID,
+				Device:    ua.Device,
+				Client:    ua.Client,
+				Country:   loc.Country,
+				Region:    loc.Region,
+				CreatedAt: time.Now(),
+			})
+		} else {
+			_, err = app.queries.RegisterCampaignView.Exec(campUUID, subUUID, ua.Device, ua.Client, loc.Country, loc.Region)
+		}
+
+		if err != nil {
 			app.log.Printf("error registering campaign view: %s", err)
+		} else {
+			app.events.Publish(events.TypeCampaignView, campaignTrackEvent{
+				CampaignUUID:   campUUID,
+				SubscriberUUID: subUUID,
+				Device:         ua.Device,
+				Client:         ua.Client,
+				Country:        loc.Country,
+				Region:         loc.Region,
+			})
 		}
 	}
 
@@ -406,6 +738,25 @@ func handleRegisterCampaignView(c echo.Context) error {
 	return c.Blob(http.StatusOK, "image/png", pixelPNG)
 }
 
+// geoLocate looks up the location of a tracking request's IP in the
+// optional GeoIP DB. Only the location is recorded and never the IP.
+func geoLocate(c echo.Context, app *App) geoip.Location {
+	if app.geoip == nil {
+		return geoip.Location{}
+	}
+
+	ip := net.ParseIP(c.RealIP())
+	if ip == nil {
+		return geoip.Location{}
+	}
+
+	loc, err := app.geoip.Lookup(ip)
+	if err != nil {
+		app.log.Printf("error looking up GeoIP location: %v", err)
+	}
+	return loc
+}
+
 // handleSelfExportSubscriberData pulls the subscriber's profile, list subscriptions,
 // campaign views and clicks and produces a JSON report that is then e-mailed
 // to the subscriber. This is a privacy feature and the data that's exported
@@ -413,13 +764,14 @@ func handleRegisterCampaignView(c echo.Context) error {
 func handleSelfExportSubscriberData(c echo.Context) error {
 	var (
 		app     = c.Get("app").(*App)
+		L       = publicLang(c, app)
 		subUUID = c.Param("subUUID")
 	)
 	// Is export allowed?
 	if !app.constants.Privacy.AllowExport {
 		return c.Render(http.StatusBadRequest, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.invalidFeature")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.invalidFeature")))
 	}
 
 	// Get the subscriber's data. A single query that gets the profile,
@@ -429,17 +781,25 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 	if err != nil {
 		app.log.Printf("error exporting subscriber data: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorProcessingRequest")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorProcessingRequest")))
+	}
+
+	// Prepare the attachment e-mail in the subscriber's language.
+	tpls, err := app.getNotifTemplates(L)
+	if err != nil {
+		app.log.Printf("error compiling notification templates (%s): %v", L.Code(), err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorProcessingRequest")))
 	}
 
-	// Prepare the attachment e-mail.
 	var msg bytes.Buffer
-	if err := app.notifTpls.ExecuteTemplate(&msg, notifSubscriberData, data); err != nil {
+	if err := tpls.ExecuteTemplate(&msg, notifSubscriberData, data); err != nil {
 		app.log.Printf("error compiling notification template '%s': %v", notifSubscriberData, err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorProcessingRequest")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorProcessingRequest")))
 	}
 
 	// Send the data as a JSON attachment to the subscriber.
@@ -459,13 +819,13 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 	}); err != nil {
 		app.log.Printf("error e-mailing subscriber profile: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorProcessingRequest")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorProcessingRequest")))
 	}
 
 	return c.Render(http.StatusOK, tplMessage,
-		makeMsgTpl(app.i18n.T("public.dataSentTitle"), "",
-			app.i18n.T("public.dataSent")))
+		makeMsgTpl(L.T("public.dataSentTitle"), "",
+			L.T("public.dataSent")))
 }
 
 // handleWipeSubscriberData allows a subscriber to delete their data. The
@@ -474,26 +834,27 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 func handleWipeSubscriberData(c echo.Context) error {
 	var (
 		app     = c.Get("app").(*App)
+		L       = publicLang(c, app)
 		subUUID = c.Param("subUUID")
 	)
 
 	// Is wiping allowed?
 	if !app.constants.Privacy.AllowWipe {
 		return c.Render(http.StatusBadRequest, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.invalidFeature")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.invalidFeature")))
 	}
 
 	if _, err := app.queries.DeleteSubscribers.Exec(nil, pq.StringArray{subUUID}); err != nil {
 		app.log.Printf("error wiping subscriber data: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
-				app.i18n.Ts("public.errorProcessingRequest")))
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorProcessingRequest")))
 	}
 
 	return c.Render(http.StatusOK, tplMessage,
-		makeMsgTpl(app.i18n.T("public.dataRemovedTitle"), "",
-			app.i18n.T("public.dataRemoved")))
+		makeMsgTpl(L.T("public.dataRemovedTitle"), "",
+			L.T("public.dataRemoved")))
 }
 
 // drawTransparentImage draws a transparent PNG of given dimensions
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+// Path prefix of the public JSON API that headless sites and SPAs use to
+// subscribe without the hosted HTML pages.
+const publicAPIPrefix = "/api/public/"
+
+// Machine-readable error codes of the public API.
+const (
+	pubErrDisabled       = "disabled"
+	pubErrInvalidRequest = "invalid_request"
+	pubErrInvalidEmail   = "invalid_email"
+	pubErrInvalidName    = "invalid_name"
+	pubErrInvalidLists   = "invalid_lists"
+	pubErrCaptcha        = "captcha_failed"
+	pubErrNotFound       = "not_found"
+	pubErrRateLimited    = "rate_limited"
+	pubErrServer         = "server_error"
+)
+
+// publicAPIError is the JSON body of public API errors.
+type publicAPIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// publicList is a public list that can be subscribed to.
+type publicList struct {
+	UUID  string `db:"uuid" json:"uuid"`
+	Name  string `db:"name" json:"name"`
+	Optin string `db:"optin" json:"optin"`
+}
+
+type publicSubReq struct {
+	Email     string   `json:"email"`
+	Name      string   `json:"name"`
+	ListUUIDs []string `json:"list_uuids"`
+	Lang      string   `json:"lang"`
+	Captcha   string   `json:"captcha"`
+}
+
+type publicOptinReq struct {
+	ListUUIDs []string `json:"list_uuids"`
+}
+
+// newPublicAPIError returns an HTTP error whose body is a publicAPIError.
+func newPublicAPIError(status int, code, msg string) error {
+	return echo.NewHTTPError(status, publicAPIError{Code: code, Message: msg})
+}
+
+// handleGetPublicLists returns the public lists that can be subscribed to.
+func handleGetPublicLists(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if !app.constants.EnablePublicSubPage {
+		return newPublicAPIError(http.StatusNotFound, pubErrDisabled, app.i18n.T("public.invalidFeature"))
+	}
+
+	var lists []models.List
+	if err := app.queries.GetLists.Select(&lists, models.ListTypePublic); err != nil {
+		app.log.Printf("error fetching public lists: %s", pqErrMsg(err))
+		return newPublicAPIError(http.StatusInternalServerError, pubErrServer, app.i18n.T("public.errorFetchingLists"))
+	}
+
+	out := make([]publicList, 0, len(lists))
+	for _, l := range lists {
+		out = append(out, publicList{UUID: l.UUID, Name: l.Name, Optin: l.Optin})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handlePublicSubscription subscribes an e-mail to public lists from a JSON
+// request. Whether the subscriber already existed isn't disclosed.
+func handlePublicSubscription(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req publicSubReq
+	)
+
+	if !app.constants.EnablePublicSubPage {
+		return newPublicAPIError(http.StatusNotFound, pubErrDisabled, app.i18n.T("public.invalidFeature"))
+	}
+	if err := c.Bind(&req); err != nil {
+		return newPublicAPIError(http.StatusBadRequest, pubErrInvalidRequest, app.i18n.T("public.errorProcessingRequest"))
+	}
+
+	setPublicLang(c, req.Lang, app)
+	L := publicLang(c, app)
+
+	if err := checkFormGuard(c, req.Captcha, false, app); err != nil {
+		return newPublicAPIError(http.StatusBadRequest, pubErrCaptcha, err.Error())
+	}
+
+	// If there's no name, use the name bit from the e-mail.
+	sub := subimporter.SubReq{}
+	sub.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	sub.Name = strings.TrimSpace(req.Name)
+	if len(sub.Email) > 1000 || !subimporter.IsEmail(sub.Email) {
+		return newPublicAPIError(http.StatusBadRequest, pubErrInvalidEmail, L.T("subscribers.invalidEmail"))
+	}
+	if sub.Name == "" {
+		sub.Name = strings.Split(sub.Email, "@")[0]
+	}
+	if !strHasLen(sub.Name, 1, stdInputMaxLen) {
+		return newPublicAPIError(http.StatusBadRequest, pubErrInvalidName, L.T("subscribers.invalidName"))
+	}
+
+	// Only public lists can be subscribed to.
+	req.ListUUIDs = uniqueStrings(req.ListUUIDs)
+	lists, err := getPublicAPILists(req.ListUUIDs, app)
+	if err != nil {
+		return err
+	}
+	if len(lists) == 0 || len(lists) != len(req.ListUUIDs) {
+		return newPublicAPIError(http.StatusBadRequest, pubErrInvalidLists, L.T("public.noListsSelected"))
+	}
+	for _, l := range lists {
+		if l.Type != models.ListTypePublic {
+			return newPublicAPIError(http.StatusBadRequest, pubErrInvalidLists, L.T("public.noListsSelected"))
+		}
+	}
+
+	// Insert the subscriber into the DB with the language they subscribed in.
+	sub.Status = models.SubscriberStatusEnabled
+	sub.ListUUIDs = pq.StringArray(req.ListUUIDs)
+	if L != app.i18n {
+		sub.Attribs = models.SubscriberAttribs{subLangAttrib: L.Code()}
+	}
+	_, _, hasOptin, err := insertSubscriber(sub, app)
+	if err != nil {
+		var (
+			status = http.StatusInternalServerError
+			code   = pubErrServer
+			msg    = L.T("public.errorProcessingRequest")
+		)
+		if e, ok := err.(*echo.HTTPError); ok {
+			status = e.Code
+			if m, ok := e.Message.(string); ok {
+				msg = m
+			}
+		}
+		if status < http.StatusInternalServerError {
+			code = pubErrInvalidRequest
+		}
+		return newPublicAPIError(status, code, msg)
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		HasOptin bool `json:"has_optin"`
+	}{hasOptin}})
+}
+
+// handlePublicOptin confirms the double opt-in subscriptions of a subscriber
+// to the given lists, or all of their unconfirmed lists, and returns the
+// confirmed lists.
+func handlePublicOptin(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		subUUID = c.Param("subUUID")
+		req     publicOptinReq
+	)
+
+	if !reUUID.MatchString(subUUID) {
+		return newPublicAPIError(http.StatusBadRequest, pubErrInvalidRequest, app.i18n.T("globals.messages.invalidUUID"))
+	}
+	if err := c.Bind(&req); err != nil {
+		return newPublicAPIError(http.StatusBadRequest, pubErrInvalidRequest, app.i18n.T("public.errorProcessingRequest"))
+	}
+	for _, u := range req.ListUUIDs {
+		if !reUUID.MatchString(u) {
+			return newPublicAPIError(http.StatusBadRequest, pubErrInvalidLists, app.i18n.T("globals.messages.invalidUUID"))
+		}
+	}
+
+	var lang string
+	if err := app.queries.GetSubscriberLang.Get(&lang, subUUID); err != nil {
+		return newPublicAPIError(http.StatusNotFound, pubErrNotFound, app.i18n.T("public.subNotFound"))
+	}
+	setPublicLang(c, lang, app)
+	L := publicLang(c, app)
+
+	// Get the subscription lists where the subscriber hasn't confirmed.
+	var lists []models.List
+	if err := app.queries.GetSubscriberLists.Select(&lists, 0, subUUID,
+		nil, pq.StringArray(req.ListUUIDs), models.SubscriptionStatusUnconfirmed, nil); err != nil {
+		app.log.Printf("error fetching lists for opt-in: %s", pqErrMsg(err))
+		return newPublicAPIError(http.StatusInternalServerError, pubErrServer, L.Ts("public.errorFetchingLists"))
+	}
+	if len(lists) == 0 {
+		return newPublicAPIError(http.StatusNotFound, pubErrNotFound, L.Ts("public.noSubInfo"))
+	}
+
+	var (
+		uuids = make([]string, 0, len(lists))
+		out   = make([]publicList, 0, len(lists))
+	)
+	for _, l := range lists {
+		uuids = append(uuids, l.UUID)
+		out = append(out, publicList{UUID: l.UUID, Name: l.Name, Optin: l.Optin})
+	}
+	if _, err := app.queries.ConfirmSubscriptionOptin.Exec(subUUID, pq.StringArray(uuids)); err != nil {
+		app.log.Printf("error confirming opt-in: %v", err)
+		return newPublicAPIError(http.StatusInternalServerError, pubErrServer, L.Ts("public.errorProcessingRequest"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handlePublicPreflight responds to CORS preflight requests of the public API.
+func handlePublicPreflight(c echo.Context) error {
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getPublicAPILists fetches the lists with the given UUIDs.
+func getPublicAPILists(uuids []string, app *App) ([]models.List, error) {
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+	for _, u := range uuids {
+		if !reUUID.MatchString(u) {
+			return nil, newPublicAPIError(http.StatusBadRequest, pubErrInvalidLists, app.i18n.T("globals.messages.invalidUUID"))
+		}
+	}
+
+	var lists []models.List
+	if err := app.queries.GetListsByOptin.Select(&lists, "", nil, pq.StringArray(uuids)); err != nil {
+		app.log.Printf("error fetching lists: %s", pqErrMsg(err))
+		return nil, newPublicAPIError(http.StatusInternalServerError, pubErrServer, app.i18n.T("public.errorFetchingLists"))
+	}
+	return lists, nil
+}
+
+// publicCORS middleware sets the CORS headers on public API responses for
+// the allowed origins (security.cors_origins).
+func publicCORS(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var (
+			app    = c.Get("app").(*App)
+			origin = c.Request().Header.Get(echo.HeaderOrigin)
+			h      = c.Response().Header()
+		)
+
+		h.Add(echo.HeaderVary, echo.HeaderOrigin)
+		if origin == "" || !isCORSOriginAllowed(origin, app.constants.Security.CORSOrigins) {
+			return next(c)
+		}
+
+		h.Set(echo.HeaderAccessControlAllowOrigin, origin)
+		if c.Request().Method == http.MethodOptions {
+			h.Set(echo.HeaderAccessControlAllowMethods, "GET, POST")
+			h.Set(echo.HeaderAccessControlAllowHeaders, echo.HeaderContentType)
+			h.Set(echo.HeaderAccessControlMaxAge, "86400")
+		}
+		return next(c)
+	}
+}
+
+// isCORSOriginAllowed checks whether an origin is one of the allowed
+// origins or if all origins (*) are allowed.
+func isCORSOriginAllowed(origin string, allowed []string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/knadh/listmonk/internal/messenger/webpush"
+	"github.com/knadh/listmonk/internal/safehttp"
+	"github.com/labstack/echo"
+)
+
+// Maximum length of a push subscription endpoint URL.
+const maxPushEndpointLen = 1000
+
+// pushSubReq is the PushSubscription JSON that browsers serialize.
+type pushSubReq struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// pushStore implements webpush.Store with the DB queries.
+type pushStore struct {
+	q *Queries
+}
+
+// GetSubscriptions returns the push subscriptions of a subscriber.
+func (p *pushStore) GetSubscriptions(subscriberID int) ([]webpush.Subscription, error) {
+	var out []webpush.Subscription
+	if err := p.q.GetPushSubscriptions.Select(&out, subscriberID); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteSubscription deletes an expired push subscription.
+func (p *pushStore) DeleteSubscription(endpoint string) error {
+	_, err := p.q.DeletePushSubscription.Exec(endpoint, "")
+	return err
+}
+
+// handleGetPushKey returns the VAPID public key that browsers need to
+// create push subscriptions.
+func handleGetPushKey(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if !app.constants.WebPushEnabled {
+		return echo.NewHTTPError(http.StatusNotFound, app.i18n.T("public.invalidFeature"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		PublicKey string `json:"public_key"`
+	}{app.constants.WebPushPublicKey}})
+}
+
+// handleAddPushSubscription registers a browser's push subscription
+// against a subscriber.
+func handleAddPushSubscription(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		subUUID = c.Param("subUUID")
+		req     pushSubReq
+	)
+
+	if !app.constants.WebPushEnabled {
+		return echo.NewHTTPError(http.StatusNotFound, app.i18n.T("public.invalidFeature"))
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	// Push services are only ever reached over HTTPS and on public addresses.
+	if u, err := url.Parse(req.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" ||
+		len(req.Endpoint) > maxPushEndpointLen || req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+	if err := safehttp.CheckURL(req.Endpoint); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+
+	// An endpoint that's registered to another subscriber isn't updated.
+	res, err := app.queries.UpsertPushSubscription.Exec(subUUID, req.Endpoint, req.Keys.P256dh, req.Keys.Auth)
+	if err != nil {
+		app.log.Printf("error registering push subscription: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.T("public.errorProcessingRequest"))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleDeletePushSubscription deletes a subscriber's push subscription.
+func handleDeletePushSubscription(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		subUUID = c.Param("subUUID")
+		req     pushSubReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Endpoint == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+
+	if _, err := app.queries.DeletePushSubscription.Exec(req.Endpoint, subUUID); err != nil {
+		app.log.Printf("error deleting push subscription: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.T("public.errorProcessingRequest"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
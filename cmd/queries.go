@@ -7,22 +7,28 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
 )
 
 // Queries contains all prepared SQL queries.
 type Queries struct {
 	GetDashboardCharts *sqlx.Stmt `query:"get-dashboard-charts"`
+	GetDashboardStats  *sqlx.Stmt `query:"get-dashboard-stats"`
+	GetDeliverability  *sqlx.Stmt `query:"get-deliverability"`
+	GetBounceRate      *sqlx.Stmt `query:"get-bounce-rate"`
 	GetDashboardCounts *sqlx.Stmt `query:"get-dashboard-counts"`
 
 	InsertSubscriber                *sqlx.Stmt `query:"insert-subscriber"`
 	UpsertSubscriber                *sqlx.Stmt `query:"upsert-subscriber"`
 	UpsertBlocklistSubscriber       *sqlx.Stmt `query:"upsert-blocklist-subscriber"`
 	GetSubscriber                   *sqlx.Stmt `query:"get-subscriber"`
+	GetSubscribersByIDs             *sqlx.Stmt `query:"get-subscribers-by-ids"`
 	GetSubscribersByEmails          *sqlx.Stmt `query:"get-subscribers-by-emails"`
 	GetSubscriberLists              *sqlx.Stmt `query:"get-subscriber-lists"`
 	GetSubscriberListsLazy          *sqlx.Stmt `query:"get-subscriber-lists-lazy"`
 	SubscriberExists                *sqlx.Stmt `query:"subscriber-exists"`
+	GetSubscriberLang               *sqlx.Stmt `query:"get-subscriber-lang"`
 	UpdateSubscriber                *sqlx.Stmt `query:"update-subscriber"`
 	BlocklistSubscribers            *sqlx.Stmt `query:"blocklist-subscribers"`
 	AddSubscribersToLists           *sqlx.Stmt `query:"add-subscribers-to-lists"`
@@ -33,6 +39,12 @@ type Queries struct {
 	Unsubscribe                     *sqlx.Stmt `query:"unsubscribe"`
 	ExportSubscriberData            *sqlx.Stmt `query:"export-subscriber-data"`
 
+	InsertUnsubscribeFeedback     *sqlx.Stmt `query:"insert-unsubscribe-feedback"`
+	QueryUnsubscribeFeedback      *sqlx.Stmt `query:"query-unsubscribe-feedback"`
+	GetUnsubscribeFeedbackSummary *sqlx.Stmt `query:"get-unsubscribe-feedback-summary"`
+	RegisterCampaignUnsubscribe   *sqlx.Stmt `query:"register-campaign-unsubscribe"`
+	GetCampaignUnsubscribeSources *sqlx.Stmt `query:"get-campaign-unsubscribe-sources"`
+
 	// Non-prepared arbitrary subscriber queries.
 	QuerySubscribers                       string `query:"query-subscribers"`
 	QuerySubscribersForExport              string `query:"query-subscribers-for-export"`
@@ -49,26 +61,82 @@ type Queries struct {
 	GetListsByOptin *sqlx.Stmt `query:"get-lists-by-optin"`
 	UpdateList      *sqlx.Stmt `query:"update-list"`
 	UpdateListsDate *sqlx.Stmt `query:"update-lists-date"`
+	GetListSender   *sqlx.Stmt `query:"get-list-sender"`
 	DeleteLists     *sqlx.Stmt `query:"delete-lists"`
 
+	GetListFolders       *sqlx.Stmt `query:"get-list-folders"`
+	GetListFolderListIDs *sqlx.Stmt `query:"get-list-folder-list-ids"`
+	CreateListFolder     *sqlx.Stmt `query:"create-list-folder"`
+	UpdateListFolder     *sqlx.Stmt `query:"update-list-folder"`
+	DeleteListFolder     *sqlx.Stmt `query:"delete-list-folder"`
+
+	GetListWebhooks      *sqlx.Stmt `query:"get-list-webhooks"`
+	GetEventListWebhooks *sqlx.Stmt `query:"get-event-list-webhooks"`
+	CreateListWebhook    *sqlx.Stmt `query:"create-list-webhook"`
+	UpdateListWebhook    *sqlx.Stmt `query:"update-list-webhook"`
+	DeleteListWebhook    *sqlx.Stmt `query:"delete-list-webhook"`
+
+	GetPushSubscriptions   *sqlx.Stmt `query:"get-push-subscriptions"`
+	UpsertPushSubscription *sqlx.Stmt `query:"upsert-push-subscription"`
+	DeletePushSubscription *sqlx.Stmt `query:"delete-push-subscription"`
+
+	GetSubForms   *sqlx.Stmt `query:"get-sub-forms"`
+	CreateSubForm *sqlx.Stmt `query:"create-sub-form"`
+	UpdateSubForm *sqlx.Stmt `query:"update-sub-form"`
+	DeleteSubForm *sqlx.Stmt `query:"delete-sub-form"`
+
+	GetPageTemplates        *sqlx.Stmt `query:"get-page-templates"`
+	CreatePageTemplate      *sqlx.Stmt `query:"create-page-template"`
+	UpdatePageTemplate      *sqlx.Stmt `query:"update-page-template"`
+	DeletePageTemplate      *sqlx.Stmt `query:"delete-page-template"`
+	GetCampaignPageTemplate *sqlx.Stmt `query:"get-campaign-page-template"`
+
+	GetDynamicLists         *sqlx.Stmt `query:"get-dynamic-lists"`
+	GetCampaignDynamicLists *sqlx.Stmt `query:"get-campaign-dynamic-lists"`
+	SyncDynamicList         string     `query:"sync-dynamic-list"`
+
 	CreateCampaign           *sqlx.Stmt `query:"create-campaign"`
 	QueryCampaigns           string     `query:"query-campaigns"`
 	GetCampaign              *sqlx.Stmt `query:"get-campaign"`
 	GetCampaignForPreview    *sqlx.Stmt `query:"get-campaign-for-preview"`
 	GetCampaignStats         *sqlx.Stmt `query:"get-campaign-stats"`
 	GetCampaignStatus        *sqlx.Stmt `query:"get-campaign-status"`
+	GetCampaignsToPrepare    *sqlx.Stmt `query:"get-campaigns-to-prepare"`
+	PrepareCampaign          *sqlx.Stmt `query:"prepare-campaign"`
 	NextCampaigns            *sqlx.Stmt `query:"next-campaigns"`
 	NextCampaignSubscribers  *sqlx.Stmt `query:"next-campaign-subscribers"`
 	GetOneCampaignSubscriber *sqlx.Stmt `query:"get-one-campaign-subscriber"`
 	UpdateCampaign           *sqlx.Stmt `query:"update-campaign"`
 	UpdateCampaignStatus     *sqlx.Stmt `query:"update-campaign-status"`
+	FinishCampaign           *sqlx.Stmt `query:"finish-campaign"`
+	LockCampaigns            *sqlx.Stmt `query:"lock-campaigns"`
+	LeaseCampaign            *sqlx.Stmt `query:"lease-campaign"`
+	PingInstance             *sqlx.Stmt `query:"ping-instance"`
+	DeleteInstance           *sqlx.Stmt `query:"delete-instance"`
 	UpdateCampaignCounts     *sqlx.Stmt `query:"update-campaign-counts"`
 	RegisterCampaignView     *sqlx.Stmt `query:"register-campaign-view"`
+	RegisterCampaignViews    *sqlx.Stmt `query:"register-campaign-views"`
+	GetCampaignViewDevices   *sqlx.Stmt `query:"get-campaign-view-devices"`
+	GetCampaignGeo           *sqlx.Stmt `query:"get-campaign-geo"`
+	GetCampaignLinkClicks    *sqlx.Stmt `query:"get-campaign-link-clicks"`
+	ExportTrackingEvents     *sqlx.Stmt `query:"export-tracking-events"`
 	DeleteCampaign           *sqlx.Stmt `query:"delete-campaign"`
+	UpdateCampaignArchive    *sqlx.Stmt `query:"update-campaign-archive"`
+	QueryArchivedCampaigns   *sqlx.Stmt `query:"query-archived-campaigns"`
+	GetArchiveTags           *sqlx.Stmt `query:"get-archive-tags"`
 
-	InsertMedia *sqlx.Stmt `query:"insert-media"`
-	GetMedia    *sqlx.Stmt `query:"get-media"`
-	DeleteMedia *sqlx.Stmt `query:"delete-media"`
+	InsertMedia       *sqlx.Stmt `query:"insert-media"`
+	QueryMedia        *sqlx.Stmt `query:"query-media"`
+	GetMediaItem      *sqlx.Stmt `query:"get-media-item"`
+	UpdateMedia       *sqlx.Stmt `query:"update-media"`
+	GetMediaTags      *sqlx.Stmt `query:"get-media-tags"`
+	GetMediaByUUIDs   *sqlx.Stmt `query:"get-media-by-uuids"`
+	DeleteMedia       *sqlx.Stmt `query:"delete-media"`
+	GetOrphanMedia    *sqlx.Stmt `query:"get-orphan-media"`
+	GetMediaFolders   *sqlx.Stmt `query:"get-media-folders"`
+	CreateMediaFolder *sqlx.Stmt `query:"create-media-folder"`
+	UpdateMediaFolder *sqlx.Stmt `query:"update-media-folder"`
+	DeleteMediaFolder *sqlx.Stmt `query:"delete-media-folder"`
 
 	CreateTemplate     *sqlx.Stmt `query:"create-template"`
 	GetTemplates       *sqlx.Stmt `query:"get-templates"`
@@ -76,15 +144,80 @@ type Queries struct {
 	SetDefaultTemplate *sqlx.Stmt `query:"set-default-template"`
 	DeleteTemplate     *sqlx.Stmt `query:"delete-template"`
 
-	CreateLink        *sqlx.Stmt `query:"create-link"`
-	RegisterLinkClick *sqlx.Stmt `query:"register-link-click"`
+	GetTemplateVersions *sqlx.Stmt `query:"get-template-versions"`
+	RollbackTemplate    *sqlx.Stmt `query:"rollback-template"`
+
+	GetUsers                     *sqlx.Stmt `query:"get-users"`
+	GetUserByUsername            *sqlx.Stmt `query:"get-user-by-username"`
+	CreateUser                   *sqlx.Stmt `query:"create-user"`
+	UpdateUser                   *sqlx.Stmt `query:"update-user"`
+	DeleteUser                   *sqlx.Stmt `query:"delete-user"`
+	CountUsers                   *sqlx.Stmt `query:"count-users"`
+	UpsertSSOUser                *sqlx.Stmt `query:"upsert-sso-user"`
+	UpsertAdminUser              *sqlx.Stmt `query:"upsert-admin-user"`
+	UpdateUserTOTP               *sqlx.Stmt `query:"update-user-totp"`
+	UseTOTPStep                  *sqlx.Stmt `query:"use-totp-step"`
+	UseTOTPRecoveryCode          *sqlx.Stmt `query:"use-totp-recovery-code"`
+	CreateSession                *sqlx.Stmt `query:"create-session"`
+	GetSessionUser               *sqlx.Stmt `query:"get-session-user"`
+	GetSuperuserSession          *sqlx.Stmt `query:"get-superuser-session"`
+	DeleteSession                *sqlx.Stmt `query:"delete-session"`
+	CountSubscribersOutsideLists *sqlx.Stmt `query:"count-subscribers-outside-lists"`
+
+	InsertIdempotencyKey *sqlx.Stmt `query:"insert-idempotency-key"`
+	GetIdempotencyKey    *sqlx.Stmt `query:"get-idempotency-key"`
+	UpdateIdempotencyKey *sqlx.Stmt `query:"update-idempotency-key"`
+	DeleteIdempotencyKey *sqlx.Stmt `query:"delete-idempotency-key"`
 
-	GetSettings    *sqlx.Stmt `query:"get-settings"`
-	UpdateSettings *sqlx.Stmt `query:"update-settings"`
+	InsertAuditLog *sqlx.Stmt `query:"insert-audit-log"`
+	QueryAuditLog  *sqlx.Stmt `query:"query-audit-log"`
+
+	InsertTxLog       *sqlx.Stmt `query:"insert-tx-log"`
+	UpdateTxLogStatus *sqlx.Stmt `query:"update-tx-log-status"`
+	QueryTxLog        *sqlx.Stmt `query:"query-tx-log"`
+	DeleteTxLog       *sqlx.Stmt `query:"delete-tx-log"`
+	InsertTxScheduled *sqlx.Stmt `query:"insert-tx-scheduled"`
+	QueryTxScheduled  *sqlx.Stmt `query:"query-tx-scheduled"`
+	GetDueTxScheduled *sqlx.Stmt `query:"get-due-tx-scheduled"`
+	DeleteTxScheduled *sqlx.Stmt `query:"delete-tx-scheduled"`
+	InsertTxCallback  *sqlx.Stmt `query:"insert-tx-callback"`
+	GetTxCallback     *sqlx.Stmt `query:"get-tx-callback"`
+	DeleteTxCallbacks *sqlx.Stmt `query:"delete-tx-callbacks"`
+
+	CreateLink         *sqlx.Stmt `query:"create-link"`
+	RegisterLinkClick  *sqlx.Stmt `query:"register-link-click"`
+	RegisterLinkClicks *sqlx.Stmt `query:"register-link-clicks"`
+	GetLinkURL         *sqlx.Stmt `query:"get-link-url"`
+
+	GetSettings       *sqlx.Stmt `query:"get-settings"`
+	UpdateSettings    *sqlx.Stmt `query:"update-settings"`
+	InitSecretSetting *sqlx.Stmt `query:"init-secret-setting"`
+
+	PartitionExists *sqlx.Stmt `query:"partition-exists"`
+	GetPartitions   *sqlx.Stmt `query:"get-partitions"`
+	CreatePartition string     `query:"create-partition"`
+	DropPartition   string     `query:"drop-partition"`
+	RollupTracking  *sqlx.Stmt `query:"rollup-tracking"`
+	DeleteTracking  *sqlx.Stmt `query:"delete-tracking"`
+	VacuumDB        string     `query:"vacuum-db"`
 
 	// GetStats *sqlx.Stmt `query:"get-stats"`
 }
 
+// replicaQueries are the heavy read queries of analytics and exports that
+// are run on the read replica of the DB if there's one. They should tolerate
+// the replication lag.
+var replicaQueries = []string{
+	"get-dashboard-charts",
+	"get-dashboard-stats",
+	"get-dashboard-counts",
+	"get-deliverability",
+	"get-campaign-view-devices",
+	"get-campaign-geo",
+	"get-campaign-link-clicks",
+	"export-tracking-events",
+}
+
 // dbConf contains database config required for connecting to a DB.
 type dbConf struct {
 	Host        string        `koanf:"host"`
@@ -126,7 +259,7 @@ func (q *Queries) compileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 
 	// Perform the dry run.
 	if exp != "" {
-		exp = " AND " + exp
+		exp = " AND (" + exp + ")"
 	}
 	stmt := fmt.Sprintf(q.QuerySubscribersTpl, exp)
 	if _, err := tx.Exec(stmt, true, pq.Int64Array{}); err != nil {
@@ -157,3 +290,9 @@ func (q *Queries) execSubscriberQueryTpl(exp, tpl string, listIDs []int64, db *s
 
 	return nil
 }
+
+// syncDynamicList evaluates the saved query of a dynamic list and syncs
+// the list's subscriptions with the matching subscribers.
+func (q *Queries) syncDynamicList(l models.List, db *sqlx.DB) error {
+	return q.execSubscriberQueryTpl(sanitizeSQLExp(l.Query), q.SyncDynamicList, nil, db, l.ID)
+}
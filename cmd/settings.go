@@ -1,15 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/koanf/maps"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/listmonk/internal/buflog"
+	"github.com/knadh/listmonk/internal/captcha"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/geoip"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/webpush"
+	"github.com/knadh/listmonk/internal/oidc"
+	"github.com/knadh/listmonk/internal/ratelimit"
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/knadh/smtppool"
 	"github.com/labstack/echo"
 )
 
@@ -20,6 +47,7 @@ type settings struct {
 	AppFromEmail        string   `json:"app.from_email"`
 	AppNotifyEmails     []string `json:"app.notify_emails"`
 	EnablePublicSubPage bool     `json:"app.enable_public_subscription_page"`
+	EnablePublicArchive bool     `json:"app.enable_public_archive"`
 	CheckUpdates        bool     `json:"app.check_updates"`
 	AppLang             string   `json:"app.lang"`
 
@@ -28,16 +56,70 @@ type settings struct {
 	AppMaxSendErrors int `json:"app.max_send_errors"`
 	AppMessageRate   int `json:"app.message_rate"`
 
-	AppMessageSlidingWindow         bool   `json:"app.message_sliding_window"`
-	AppMessageSlidingWindowDuration string `json:"app.message_sliding_window_duration"`
-	AppMessageSlidingWindowRate     int    `json:"app.message_sliding_window_rate"`
+	AppTrackingBatchSize int `json:"app.tracking_batch_size"`
+
+	AppRateLimits []rateLimit `json:"app.rate_limits"`
+
+	AppDynamicListSyncInterval string `json:"app.dynamic_list_sync_interval"`
+	AppTxMaxAttachmentSize     int    `json:"app.tx_max_attachment_size"`
+	AppTxLogEnabled            bool   `json:"app.tx_log_enabled"`
+	AppTxLogRetentionDays      int    `json:"app.tx_log_retention_days"`
+	AppMetricsEnabled          bool   `json:"app.metrics_enabled"`
+	AppMetricsToken            string `json:"app.metrics_token,omitempty"`
+
+	AppAlertBounceRate float64 `json:"app.alert_bounce_rate"`
+
+	AppFailoverMessengers []struct {
+		Messenger string `json:"messenger"`
+		Fallback  string `json:"fallback"`
+	} `json:"app.failover_messengers"`
+	AppFailoverMaxErrors int    `json:"app.failover_max_errors"`
+	AppFailoverErrorRate int    `json:"app.failover_error_rate"`
+	AppFailoverCooldown  string `json:"app.failover_cooldown"`
+
+	AppDomainRoutes []struct {
+		Domain    string `json:"domain"`
+		Messenger string `json:"messenger"`
+	} `json:"app.domain_routes"`
 
 	PrivacyIndividualTracking bool     `json:"privacy.individual_tracking"`
 	PrivacyUnsubHeader        bool     `json:"privacy.unsubscribe_header"`
+	PrivacyUnsubSurvey        bool     `json:"privacy.unsubscribe_survey"`
+	PrivacyUnsubReasons       []string `json:"privacy.unsubscribe_reasons"`
 	PrivacyAllowBlocklist     bool     `json:"privacy.allow_blocklist"`
 	PrivacyAllowExport        bool     `json:"privacy.allow_export"`
 	PrivacyAllowWipe          bool     `json:"privacy.allow_wipe"`
 	PrivacyExportable         []string `json:"privacy.exportable"`
+	PrivacyGeoIPDB            string   `json:"privacy.geoip_db"`
+	PrivacyAnalyticsRetention int      `json:"privacy.analytics_retention_days"`
+
+	SecurityOIDCEnabled       bool   `json:"security.oidc_enabled"`
+	SecurityOIDCProviderURL   string `json:"security.oidc_provider_url"`
+	SecurityOIDCClientID      string `json:"security.oidc_client_id"`
+	SecurityOIDCClientSecret  string `json:"security.oidc_client_secret,omitempty"`
+	SecurityOIDCUsernameClaim string `json:"security.oidc_username_claim"`
+	SecurityOIDCRoleClaim     string `json:"security.oidc_role_claim"`
+	SecurityOIDCRoleMap       []struct {
+		Value string `json:"value"`
+		Role  string `json:"role"`
+	} `json:"security.oidc_role_map"`
+	SecurityOIDCDefaultRole string `json:"security.oidc_default_role"`
+
+	SecurityRateLimitEnabled           bool   `json:"security.rate_limit_enabled"`
+	SecurityRateLimitStore             string `json:"security.rate_limit_store"`
+	SecurityRateLimitRedisURL          string `json:"security.rate_limit_redis_url"`
+	SecurityRateLimitTrustProxy        bool   `json:"security.rate_limit_trust_proxy"`
+	SecurityRateLimitSubscriptionRate  int    `json:"security.rate_limit_subscription_rate"`
+	SecurityRateLimitSubscriptionBurst int    `json:"security.rate_limit_subscription_burst"`
+	SecurityRateLimitTrackingRate      int    `json:"security.rate_limit_tracking_rate"`
+	SecurityRateLimitTrackingBurst     int    `json:"security.rate_limit_tracking_burst"`
+
+	SecurityCaptchaProvider   string `json:"security.captcha_provider"`
+	SecurityCaptchaSiteKey    string `json:"security.captcha_site_key"`
+	SecurityCaptchaSecret     string `json:"security.captcha_secret,omitempty"`
+	SecurityFormMinSubmitTime int    `json:"security.form_min_submit_time"`
+
+	SecurityCORSOrigins []string `json:"security.cors_origins"`
 
 	UploadProvider             string `json:"upload.provider"`
 	UploadFilesystemUploadPath string `json:"upload.filesystem.upload_path"`
@@ -50,6 +132,23 @@ type settings struct {
 	UploadS3BucketPath         string `json:"upload.s3.bucket_path"`
 	UploadS3BucketType         string `json:"upload.s3.bucket_type"`
 	UploadS3Expiry             string `json:"upload.s3.expiry"`
+	UploadThumbnailWidth       int    `json:"upload.thumbnail_width"`
+	UploadImageVariants        []struct {
+		Name  string `json:"name"`
+		Width int    `json:"width"`
+	} `json:"upload.image_variants"`
+
+	WebPushEnabled         bool   `json:"webpush.enabled"`
+	WebPushVAPIDPublicKey  string `json:"webpush.vapid_public_key"`
+	WebPushVAPIDPrivateKey string `json:"webpush.vapid_private_key,omitempty"`
+	WebPushSubject         string `json:"webpush.subject"`
+	WebPushTTL             int    `json:"webpush.ttl"`
+
+	EventsEnabled     bool   `json:"events.enabled"`
+	EventsSink        string `json:"events.sink"`
+	EventsURL         string `json:"events.url"`
+	EventsNATSSubject string `json:"events.nats_subject"`
+	EventsBatchSize   int    `json:"events.batch_size"`
 
 	SMTP []struct {
 		UUID          string              `json:"uuid"`
@@ -67,8 +166,18 @@ type settings struct {
 		WaitTimeout   string              `json:"wait_timeout"`
 		TLSEnabled    bool                `json:"tls_enabled"`
 		TLSSkipVerify bool                `json:"tls_skip_verify"`
+		Pool          string              `json:"pool"`
+		Weight        int                 `json:"weight"`
 	} `json:"smtp"`
 
+	DKIM []struct {
+		UUID       string `json:"uuid"`
+		Enabled    bool   `json:"enabled"`
+		Domain     string `json:"domain"`
+		Selector   string `json:"selector"`
+		PrivateKey string `json:"private_key,omitempty"`
+	} `json:"dkim"`
+
 	Messengers []struct {
 		UUID          string `json:"uuid"`
 		Enabled       bool   `json:"enabled"`
@@ -79,13 +188,117 @@ type settings struct {
 		MaxConns      int    `json:"max_conns"`
 		Timeout       string `json:"timeout"`
 		MaxMsgRetries int    `json:"max_msg_retries"`
+		SigningSecret string `json:"signing_secret,omitempty"`
+		BatchSize     int    `json:"batch_size"`
 	} `json:"messengers"`
+
+	SES []struct {
+		UUID             string            `json:"uuid"`
+		Enabled          bool              `json:"enabled"`
+		Name             string            `json:"name"`
+		Region           string            `json:"region"`
+		AccessKey        string            `json:"access_key"`
+		SecretKey        string            `json:"secret_key,omitempty"`
+		ConfigurationSet string            `json:"configuration_set"`
+		Tags             map[string]string `json:"tags"`
+		MaxConns         int               `json:"max_conns"`
+		Timeout          string            `json:"timeout"`
+		MaxMsgRetries    int               `json:"max_msg_retries"`
+	} `json:"ses"`
+
+	SendGrid []struct {
+		UUID           string `json:"uuid"`
+		Enabled        bool   `json:"enabled"`
+		Name           string `json:"name"`
+		APIKey         string `json:"api_key,omitempty"`
+		IPPool         string `json:"ip_pool"`
+		SandboxMode    bool   `json:"sandbox_mode"`
+		BatchCampaigns bool   `json:"batch_campaigns"`
+		MaxConns       int    `json:"max_conns"`
+		Timeout        string `json:"timeout"`
+		MaxMsgRetries  int    `json:"max_msg_retries"`
+	} `json:"sendgrid"`
+
+	Mailgun []struct {
+		UUID          string   `json:"uuid"`
+		Enabled       bool     `json:"enabled"`
+		Name          string   `json:"name"`
+		Domain        string   `json:"domain"`
+		Region        string   `json:"region"`
+		APIKey        string   `json:"api_key,omitempty"`
+		Tags          []string `json:"tags"`
+		TestMode      bool     `json:"test_mode"`
+		MaxConns      int      `json:"max_conns"`
+		Timeout       string   `json:"timeout"`
+		MaxMsgRetries int      `json:"max_msg_retries"`
+	} `json:"mailgun"`
+
+	SMS []struct {
+		UUID          string `json:"uuid"`
+		Enabled       bool   `json:"enabled"`
+		Name          string `json:"name"`
+		Provider      string `json:"provider"`
+		AccountSID    string `json:"account_sid"`
+		AuthToken     string `json:"auth_token,omitempty"`
+		From          string `json:"from"`
+		URL           string `json:"url"`
+		PhoneAttrib   string `json:"phone_attrib"`
+		MaxConns      int    `json:"max_conns"`
+		Timeout       string `json:"timeout"`
+		MaxMsgRetries int    `json:"max_msg_retries"`
+	} `json:"sms"`
+
+	Telegram []struct {
+		UUID           string `json:"uuid"`
+		Enabled        bool   `json:"enabled"`
+		Name           string `json:"name"`
+		BotToken       string `json:"bot_token,omitempty"`
+		ChatIDAttrib   string `json:"chat_id_attrib"`
+		DisablePreview bool   `json:"disable_preview"`
+		MaxConns       int    `json:"max_conns"`
+		Timeout        string `json:"timeout"`
+		MaxMsgRetries  int    `json:"max_msg_retries"`
+	} `json:"telegram"`
+
+	Alerts []struct {
+		UUID    string   `json:"uuid"`
+		Enabled bool     `json:"enabled"`
+		Type    string   `json:"type"`
+		URL     string   `json:"url,omitempty"`
+		Emails  []string `json:"emails"`
+		Events  []string `json:"events"`
+	} `json:"alerts"`
 }
 
 var (
 	reAlphaNum = regexp.MustCompile(`[^a-z0-9\-]`)
+
+	// DKIM selectors and domains are DNS labels.
+	reDKIMName = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-_.]*[a-z0-9])?$`)
+
+	// Environment variable references in imported settings, eg: ${SMTP_PASSWORD}.
+	reEnvRef = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
 )
 
+// Maximum size of an imported settings file.
+const settingsImportMaxSize = 1 << 20
+
+// Log levels in increasing order of severity. An empty level is the lowest.
+var logLevels = map[string]int{
+	"":                0,
+	buflog.LevelInfo:  0,
+	buflog.LevelWarn:  1,
+	buflog.LevelError: 2,
+}
+
+type logsWrap struct {
+	Results []buflog.Entry `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
 // handleGetSettings returns settings from the DB.
 func handleGetSettings(c echo.Context) error {
 	app := c.Get("app").(*App)
@@ -95,16 +308,7 @@ func handleGetSettings(c echo.Context) error {
 		return err
 	}
 
-	// Empty out passwords.
-	for i := 0; i < len(s.SMTP); i++ {
-		s.SMTP[i].Password = ""
-	}
-	for i := 0; i < len(s.Messengers); i++ {
-		s.Messengers[i].Password = ""
-	}
-	s.UploadS3AwsSecretAccessKey = ""
-
-	return c.JSON(http.StatusOK, okResp{s})
+	return c.JSON(http.StatusOK, okResp{redactSettings(s)})
 }
 
 // handleUpdateSettings returns settings from the DB.
@@ -125,11 +329,65 @@ func handleUpdateSettings(c echo.Context) error {
 		return err
 	}
 
-	// There should be at least one SMTP block that's enabled.
-	has := false
+	set, err = prepareSettings(set, cur, app)
+	if err != nil {
+		return err
+	}
+
+	// Marshal settings.
+	b, err := json.Marshal(set)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+
+	// Record the keys of the changed settings in the audit log instead of
+	// the settings blob that has secrets.
+	setAuditData(c, map[string]interface{}{"changed": getChangedSettings(cur, b)})
+
+	needsRestart, err := saveSettings(b, app)
+	if err != nil {
+		return err
+	}
+
+	// If there are any active campaigns, the app isn't reloaded. Warn the
+	// user on the frontend.
+	if needsRestart {
+		return c.JSON(http.StatusOK, okResp{struct {
+			NeedsRestart bool `json:"needs_restart"`
+		}{true}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// prepareSettings validates and sanitizes incoming settings. Secrets that
+// are empty in the incoming settings retain their current values from cur.
+// Blocks such as SMTP servers are matched with the current ones by UUID.
+func prepareSettings(set, cur settings, app *App) (settings, error) {
+	// There should be at least one SMTP block that's enabled in the default pool.
+	// Pool names share the messenger namespace with postback messengers.
+	var (
+		has   = false
+		pools = make(map[string]bool)
+	)
 	for i, s := range set.SMTP {
+		pool := reAlphaNum.ReplaceAllString(strings.ToLower(s.Pool), "")
+		if pool == emailMsgr {
+			pool = ""
+		}
+		set.SMTP[i].Pool = pool
+
+		if s.Weight < 1 {
+			set.SMTP[i].Weight = 1
+		}
+
 		if s.Enabled {
-			has = true
+			if pool == "" {
+				has = true
+			} else {
+				pools[pool] = true
+			}
 		}
 
 		// Assign a UUID. The frontend only sends a password when the user explictly
@@ -151,38 +409,216 @@ func handleUpdateSettings(c echo.Context) error {
 		}
 	}
 	if !has {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.errorNoSMTP"))
+		return settings{}, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.errorNoSMTP"))
 	}
 
-	// Validate and sanitize postback Messenger names. Duplicates are disallowed
-	// and "email" is a reserved name.
-	names := map[string]bool{emailMsgr: true}
-
-	for i, m := range set.Messengers {
-		// UUID to keep track of password changes similar to the SMTP logic above.
-		if m.UUID == "" {
-			set.Messengers[i].UUID = uuid.Must(uuid.NewV4()).String()
+	// DKIM keys. Private keys are retained by UUID like SMTP passwords.
+	for i, k := range set.DKIM {
+		if k.UUID == "" {
+			set.DKIM[i].UUID = uuid.Must(uuid.NewV4()).String()
 		}
-
-		if m.Password == "" {
-			for _, c := range cur.Messengers {
-				if m.UUID == c.UUID {
-					set.Messengers[i].Password = c.Password
+		if k.PrivateKey == "" {
+			for _, c := range cur.DKIM {
+				if k.UUID == c.UUID {
+					set.DKIM[i].PrivateKey = c.PrivateKey
 				}
 			}
 		}
 
-		name := reAlphaNum.ReplaceAllString(strings.ToLower(m.Name), "")
+		set.DKIM[i].Domain = strings.ToLower(strings.TrimSpace(k.Domain))
+		set.DKIM[i].Selector = strings.ToLower(strings.TrimSpace(k.Selector))
+		if !reDKIMName.MatchString(set.DKIM[i].Domain) || !reDKIMName.MatchString(set.DKIM[i].Selector) {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.dkim.invalid", "name", k.Domain, "error", "domain / selector"))
+		}
+		if _, _, err := email.DKIMRecord(k.Domain, k.Selector, set.DKIM[i].PrivateKey); err != nil {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.dkim.invalid", "name", k.Domain, "error", err.Error()))
+		}
+	}
+
+	// Validate and sanitize postback Messenger names. Duplicates are disallowed
+	// and "email" is a reserved name.
+	names := map[string]bool{emailMsgr: true, webpush.Name: true}
+	for p := range pools {
+		names[p] = true
+	}
+
+	// The kind of every messenger: msgrKindEmail for e-mail messengers and
+	// the provider for others. Failover only falls back within a kind.
+	kinds := map[string]string{emailMsgr: msgrKindEmail, webpush.Name: webpush.Name}
+	for p := range pools {
+		kinds[p] = msgrKindEmail
+	}
+
+	// checkName sanitizes a messenger name and ensures that it's unique.
+	checkName := func(n string) (string, error) {
+		name := reAlphaNum.ReplaceAllString(strings.ToLower(n), "")
 		if _, ok := names[name]; ok {
-			return echo.NewHTTPError(http.StatusBadRequest,
+			return "", echo.NewHTTPError(http.StatusBadRequest,
 				app.i18n.Ts("settings.duplicateMessengerName", "name", name))
 		}
 		if len(name) == 0 {
-			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.invalidMessengerName"))
+			return "", echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.invalidMessengerName"))
 		}
 
-		set.Messengers[i].Name = name
 		names[name] = true
+		return name, nil
+	}
+
+	// Postback and API based messengers share the same namespace. Secrets
+	// that aren't sent from the frontend are copied from the existing
+	// messenger with the same UUID like SMTP passwords.
+	for _, p := range msgrProviders {
+		curFields := p.fields(&cur)
+		for _, f := range p.fields(&set) {
+			if *f.UUID == "" {
+				*f.UUID = uuid.Must(uuid.NewV4()).String()
+			}
+
+			for _, c := range curFields {
+				if *c.UUID != *f.UUID {
+					continue
+				}
+				for n, sec := range f.Secrets {
+					if *sec == "" {
+						*sec = *c.Secrets[n]
+					}
+				}
+			}
+
+			name, err := checkName(*f.Name)
+			if err != nil {
+				return settings{}, err
+			}
+			*f.Name = name
+
+			kinds[name] = p.key
+			if p.email {
+				kinds[name] = msgrKindEmail
+			}
+		}
+	}
+
+	// Alert channels. Webhook URLs are retained by UUID like passwords.
+	for i, a := range set.Alerts {
+		if a.UUID == "" {
+			set.Alerts[i].UUID = uuid.Must(uuid.NewV4()).String()
+		}
+
+		if a.URL == "" {
+			for _, c := range cur.Alerts {
+				if a.UUID == c.UUID {
+					set.Alerts[i].URL = c.URL
+				}
+			}
+		}
+
+		switch a.Type {
+		case alertChannelSlack, alertChannelWebhook:
+			if a.Enabled && !strHasLen(set.Alerts[i].URL, 1, 2000) {
+				return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidField", "name", "alerts.url"))
+			}
+		case alertChannelEmail:
+		default:
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "alerts.type"))
+		}
+
+		for _, e := range a.Events {
+			if !isAlertEvent(e) {
+				return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidField", "name", "alerts.events"))
+			}
+		}
+		if a.Events == nil {
+			set.Alerts[i].Events = []string{}
+		}
+		if a.Emails == nil {
+			set.Alerts[i].Emails = []string{}
+		}
+	}
+	if set.AppAlertBounceRate < 0 || set.AppAlertBounceRate > 100 {
+		set.AppAlertBounceRate = 0
+	}
+
+	// Image variant names are used in filenames and should be unique.
+	// "thumb" is reserved for thumbnails.
+	if set.UploadThumbnailWidth < 1 {
+		set.UploadThumbnailWidth = thumbnailSize
+	}
+	variants := map[string]bool{"thumb": true}
+	for i, v := range set.UploadImageVariants {
+		name := reVariantName.ReplaceAllString(strings.ToLower(v.Name), "")
+		if name == "" || variants[name] || v.Width < 1 || v.Width > maxImageWidth {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.media.invalidVariant", "name", v.Name))
+		}
+		variants[name] = true
+		set.UploadImageVariants[i].Name = name
+	}
+
+	// Failover rules should map known messengers to other messengers of the
+	// same kind (eg: e-mail to e-mail), and a messenger can only have one fallback.
+	failover := map[string]bool{}
+	for _, f := range set.AppFailoverMessengers {
+		if !names[f.Messenger] || !names[f.Fallback] || f.Messenger == f.Fallback || failover[f.Messenger] ||
+			kinds[f.Messenger] != kinds[f.Fallback] {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.failover.invalidRule", "name", f.Messenger))
+		}
+		failover[f.Messenger] = true
+	}
+	if set.AppFailoverErrorRate < 0 || set.AppFailoverErrorRate > 100 {
+		return settings{}, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.failover.invalidErrorRate"))
+	}
+
+	if set.AppTxLogRetentionDays < 0 {
+		set.AppTxLogRetentionDays = 0
+	}
+	if set.PrivacyAnalyticsRetention < 0 {
+		set.PrivacyAnalyticsRetention = 0
+	}
+
+	// Unsubscribe reasons are shown as options on the survey and should be
+	// unique. "Other" with a comment is always available.
+	reasons := make([]string, 0, len(set.PrivacyUnsubReasons))
+	for _, r := range set.PrivacyUnsubReasons {
+		r = strings.TrimSpace(r)
+		if r == "" || inArray(r, reasons) {
+			continue
+		}
+		if !strHasLen(r, 1, stdInputMaxLen) {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "privacy.unsubscribe_reasons"))
+		}
+		reasons = append(reasons, r)
+	}
+	set.PrivacyUnsubReasons = reasons
+
+	// The GeoIP DB should be loadable.
+	set.PrivacyGeoIPDB = strings.TrimSpace(set.PrivacyGeoIPDB)
+	if set.PrivacyGeoIPDB != "" {
+		if _, err := geoip.Open(set.PrivacyGeoIPDB); err != nil {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.privacy.invalidGeoIPDB", "error", err.Error()))
+		}
+	}
+
+	// Domain routes should have valid domain patterns and route to known
+	// e-mail messengers as they apply to e-mail recipients.
+	for i, r := range set.AppDomainRoutes {
+		d := strings.ToLower(strings.TrimSpace(r.Domain))
+		if _, err := path.Match(d, ""); err != nil || d == "" || !names[r.Messenger] || kinds[r.Messenger] != msgrKindEmail {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.domainRoutes.invalidRoute", "name", r.Domain))
+		}
+		set.AppDomainRoutes[i].Domain = d
+	}
+
+	if err := validateRateLimits(set.AppRateLimits, app); err != nil {
+		return settings{}, err
 	}
 
 	// S3 password?
@@ -190,30 +626,149 @@ func handleUpdateSettings(c echo.Context) error {
 		set.UploadS3AwsSecretAccessKey = cur.UploadS3AwsSecretAccessKey
 	}
 
-	// Marshal settings.
-	b, err := json.Marshal(set)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError,
-			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	// Web push. The VAPID private key is never sent to the frontend. Generate
+	// a key pair the first time web push is enabled.
+	if set.WebPushVAPIDPrivateKey == "" {
+		set.WebPushVAPIDPrivateKey = cur.WebPushVAPIDPrivateKey
+	}
+	if set.WebPushEnabled && (set.WebPushVAPIDPublicKey == "" || set.WebPushVAPIDPrivateKey == "") {
+		pub, priv, err := webpush.GenerateKeys()
+		if err != nil {
+			return settings{}, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		set.WebPushVAPIDPublicKey, set.WebPushVAPIDPrivateKey = pub, priv
+	}
+
+	// Metrics token. An empty token retains the existing one and "-" removes it.
+	switch set.AppMetricsToken {
+	case "":
+		set.AppMetricsToken = cur.AppMetricsToken
+	case "-":
+		set.AppMetricsToken = ""
 	}
 
-	// Update the settings in the DB.
+	// Single sign-on.
+	if set.SecurityOIDCClientSecret == "" {
+		set.SecurityOIDCClientSecret = cur.SecurityOIDCClientSecret
+	}
+	if set.SecurityOIDCEnabled {
+		if _, err := oidc.New(oidc.Config{
+			ProviderURL: set.SecurityOIDCProviderURL,
+			ClientID:    set.SecurityOIDCClientID,
+		}); err != nil {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.security.invalidOIDC", "error", err.Error()))
+		}
+		if set.SecurityOIDCUsernameClaim == "" {
+			set.SecurityOIDCUsernameClaim = "email"
+		}
+	}
+	for _, r := range set.SecurityOIDCRoleMap {
+		if r.Value == "" || !isUserRole(r.Role) {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "role: "+r.Value))
+		}
+	}
+	if set.SecurityOIDCDefaultRole != "" && !isUserRole(set.SecurityOIDCDefaultRole) {
+		return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "role"))
+	}
+
+	// Rate limits on public endpoints.
+	if set.SecurityRateLimitEnabled {
+		switch set.SecurityRateLimitStore {
+		case "memory":
+		case "redis":
+			if _, err := ratelimit.NewRedis(set.SecurityRateLimitRedisURL, time.Second); err != nil {
+				return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidField", "name", "Redis URL"))
+			}
+		default:
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "store"))
+		}
+		if set.SecurityRateLimitSubscriptionRate < 1 || set.SecurityRateLimitSubscriptionBurst < 1 ||
+			set.SecurityRateLimitTrackingRate < 1 || set.SecurityRateLimitTrackingBurst < 1 {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "rate limit"))
+		}
+	}
+
+	// CAPTCHA and bot checks on public forms.
+	if set.SecurityCaptchaSecret == "" {
+		set.SecurityCaptchaSecret = cur.SecurityCaptchaSecret
+	}
+	if set.SecurityCaptchaProvider != "" {
+		if _, err := captcha.New(set.SecurityCaptchaProvider, set.SecurityCaptchaSiteKey,
+			set.SecurityCaptchaSecret, time.Second); err != nil {
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.security.invalidCaptcha", "error", err.Error()))
+		}
+	}
+	if set.SecurityFormMinSubmitTime < 0 {
+		set.SecurityFormMinSubmitTime = 0
+	}
+
+	// CORS origins of the public API should be * or scheme://host[:port].
+	origins := make([]string, 0, len(set.SecurityCORSOrigins))
+	for _, o := range set.SecurityCORSOrigins {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+				return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("settings.security.invalidCORSOrigin", "name", o))
+			}
+		}
+		origins = append(origins, o)
+	}
+	set.SecurityCORSOrigins = origins
+
+	// Event firehose.
+	if set.EventsEnabled {
+		switch set.EventsSink {
+		case "webhook":
+			u, err := url.Parse(set.EventsURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return settings{}, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidWebhookURL"))
+			}
+		case "nats":
+			if _, err := events.NewNATS(set.EventsURL, set.EventsNATSSubject, 0); err != nil {
+				return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("settings.events.invalidNATS", "error", err.Error()))
+			}
+		default:
+			return settings{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidField", "name", "sink"))
+		}
+	}
+	if set.EventsBatchSize < 1 {
+		set.EventsBatchSize = 100
+	}
+	if set.AppTrackingBatchSize < 1 {
+		set.AppTrackingBatchSize = 1
+	}
+
+	return set, nil
+}
+
+// saveSettings saves a settings blob to the DB and reloads the app. If
+// there are any active campaigns, the app isn't reloaded and true is returned.
+func saveSettings(b []byte, app *App) (bool, error) {
 	if _, err := app.queries.UpdateSettings.Exec(b); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError,
+		return false, echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorUpdating",
 				"name", "{globals.terms.settings}", "error", pqErrMsg(err)))
 	}
 
-	// If there are any active campaigns, don't do an auto reload and
-	// warn the user on the frontend.
 	if app.manager.HasRunningCampaigns() {
 		app.Lock()
 		app.needsRestart = true
 		app.Unlock()
-
-		return c.JSON(http.StatusOK, okResp{struct {
-			NeedsRestart bool `json:"needs_restart"`
-		}{true}})
+		return true, nil
 	}
 
 	// No running campaigns. Reload the app.
@@ -222,13 +777,678 @@ func handleUpdateSettings(c echo.Context) error {
 		app.sigChan <- syscall.SIGHUP
 	}()
 
-	return c.JSON(http.StatusOK, okResp{true})
+	return false, nil
 }
 
-// handleGetLogs returns the log entries stored in the log buffer.
+// handleGetLogs returns the log entries stored in the log buffer filtered by
+// ?level, ?component, ?query and the ?from and ?to dates. ?level is the
+// minimum level and ?query matches the message. Pages are counted from the
+// latest entries and entries are in the order they were logged.
 func handleGetLogs(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		q     = c.Request().URL.Query()
+		pg    = getPagination(q, 100)
+		comp  = q.Get("component")
+		query = strings.ToLower(q.Get("query"))
+	)
+
+	minLevel, ok := logLevels[q.Get("level")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "level"))
+	}
+	from, err := parseDateFilter(q.Get("from"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+	to, err := parseDateFilter(q.Get("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	out := logsWrap{Results: []buflog.Entry{}}
+	for _, l := range app.bufLog.Lines() {
+		e := buflog.Parse(l)
+		if logLevels[e.Level] < minLevel ||
+			(comp != "" && e.Component != comp) ||
+			(query != "" && !strings.Contains(strings.ToLower(e.Message), query)) ||
+			(from != nil && e.Time.Before(from.(time.Time))) ||
+			(to != nil && e.Time.After(to.(time.Time))) {
+			continue
+		}
+		out.Results = append(out.Results, e)
+	}
+
+	// Slice the page from the end.
+	out.Total = len(out.Results)
+	if pg.Limit > 0 {
+		end := out.Total - pg.Offset
+		if end < 0 {
+			end = 0
+		}
+		start := end - pg.Limit
+		if start < 0 {
+			start = 0
+		}
+		out.Results = out.Results[start:end]
+	}
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetLogFiles returns the log file and its rotated files.
+func handleGetLogFiles(c echo.Context) error {
 	app := c.Get("app").(*App)
-	return c.JSON(http.StatusOK, okResp{app.bufLog.Lines()})
+	if app.logFile == nil {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	out, err := app.logFile.Files()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching", "name", "{logs.title}", "error", err.Error()))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDownloadLogFile sends a log file gzipped. Rotated files are already
+// gzipped and the current file is gzipped as it's sent.
+func handleDownloadLogFile(c echo.Context) error {
+	var (
+		app  = c.Get("app").(*App)
+		name = c.Param("name")
+	)
+	if app.logFile == nil {
+		return echo.NewHTTPError(http.StatusNotFound,
+			app.i18n.Ts("globals.messages.notFound", "name", name))
+	}
+
+	f, gzipped, err := app.logFile.Open(name)
+	if err != nil {
+		if err == buflog.ErrFileNotFound {
+			return echo.NewHTTPError(http.StatusNotFound,
+				app.i18n.Ts("globals.messages.notFound", "name", name))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching", "name", name, "error", err.Error()))
+	}
+	defer f.Close()
+
+	if !gzipped {
+		name += ".gz"
+	}
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if gzipped {
+		return c.Stream(http.StatusOK, "application/gzip", f)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+	c.Response().WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(c.Response())
+	if _, err := io.Copy(gz, f); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// handleGetSMTPStats returns the per-server message counters of the
+// SMTP messengers (pools).
+func handleGetSMTPStats(c echo.Context) error {
+	type pool struct {
+		Name    string              `json:"name"`
+		Servers []email.ServerStats `json:"servers"`
+	}
+
+	var (
+		app = c.Get("app").(*App)
+		out = []pool{}
+	)
+	for _, m := range app.messengers {
+		if e, ok := m.(*email.Emailer); ok {
+			out = append(out, pool{Name: e.Name(), Servers: e.Stats()})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleTestSMTP checks the connectivity of a configured SMTP server by
+// going through the connection, HELLO, STARTTLS and AUTH steps. If an
+// e-mail address is given, a test message is sent to it.
+func handleTestSMTP(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		idx, _ = strconv.Atoi(c.Param("index"))
+		req    struct {
+			Email string `json:"email"`
+		}
+	)
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Email != "" && !subimporter.IsEmail(req.Email) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidEmail"))
+	}
+
+	set, err := getSettings(app)
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(set.SMTP) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "SMTP"))
+	}
+
+	cfg := set.SMTP[idx]
+	srv := email.Server{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		AuthProtocol:  cfg.AuthProtocol,
+		TLSEnabled:    cfg.TLSEnabled,
+		TLSSkipVerify: cfg.TLSSkipVerify,
+	}
+	srv.Host = cfg.Host
+	srv.Port = cfg.Port
+	srv.HelloHostname = cfg.HelloHostname
+
+	var em *smtppool.Email
+	if req.Email != "" {
+		em = &smtppool.Email{
+			From:    app.constants.FromEmail,
+			To:      []string{req.Email},
+			Subject: app.i18n.T("settings.smtp.testSubject"),
+			Text:    []byte(app.i18n.Ts("settings.smtp.testBody", "host", cfg.Host)),
+		}
+	}
+
+	return c.JSON(http.StatusOK, okResp{email.Check(srv, em)})
+}
+
+// handleGetPostbackStats returns the request and failure counters of
+// the HTTP postback messengers.
+func handleGetPostbackStats(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = []postback.Stats{}
+	)
+	for _, m := range app.messengers {
+		if p, ok := m.(*postback.Postback); ok {
+			out = append(out, p.Stats())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// rateLimit represents the send rate limit of a messenger.
+type rateLimit struct {
+	Messenger string `json:"messenger"`
+	PerSecond int    `json:"per_second"`
+	PerHour   int    `json:"per_hour"`
+}
+
+// handleUpdateRateLimits updates the messenger rate limits in the settings
+// and applies them to the running campaigns without a restart.
+func handleUpdateRateLimits(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		limits []rateLimit
+	)
+	if err := c.Bind(&limits); err != nil {
+		return err
+	}
+
+	if err := validateRateLimits(limits, app); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"app.rate_limits": limits})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+	if _, err := app.queries.UpdateSettings.Exec(b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.settings}", "error", pqErrMsg(err)))
+	}
+
+	app.manager.SetRateLimits(makeRateLimits(limits))
+	return c.JSON(http.StatusOK, okResp{limits})
+}
+
+// validateRateLimits checks that rate limits are non-negative and that
+// a messenger has only one limit.
+func validateRateLimits(limits []rateLimit, app *App) error {
+	seen := make(map[string]bool, len(limits))
+	for _, l := range limits {
+		if l.Messenger == "" || seen[l.Messenger] || l.PerSecond < 0 || l.PerHour < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.rateLimits.invalid", "name", l.Messenger))
+		}
+		seen[l.Messenger] = true
+	}
+	return nil
+}
+
+// makeRateLimits returns the manager's rate limits keyed by messenger.
+func makeRateLimits(limits []rateLimit) map[string]manager.RateLimit {
+	out := make(map[string]manager.RateLimit, len(limits))
+	for _, l := range limits {
+		out[l.Messenger] = manager.RateLimit{PerSecond: l.PerSecond, PerHour: l.PerHour}
+	}
+	return out
+}
+
+// dkimRecord represents the DNS record that publishes a DKIM public key.
+type dkimRecord struct {
+	UUID     string `json:"uuid,omitempty"`
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	DNSName  string `json:"dns_name"`
+	DNSValue string `json:"dns_value"`
+}
+
+// handleGetDKIMRecords returns the DNS TXT records of the DKIM keys in
+// the settings that have to be published on the sending domains.
+func handleGetDKIMRecords(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	s, err := getSettings(app)
+	if err != nil {
+		return err
+	}
+
+	out := make([]dkimRecord, 0, len(s.DKIM))
+	for _, k := range s.DKIM {
+		name, val, err := email.DKIMRecord(k.Domain, k.Selector, k.PrivateKey)
+		if err != nil {
+			app.log.Printf("error reading DKIM key for %s: %v", k.Domain, err)
+			continue
+		}
+		out = append(out, dkimRecord{UUID: k.UUID, Domain: k.Domain, Selector: k.Selector,
+			DNSName: name, DNSValue: val})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGenerateDKIMKey generates a new DKIM private key for a domain and
+// returns it along with its DNS record.
+func handleGenerateDKIMKey(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req dkimRecord
+	)
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Domain = strings.ToLower(strings.TrimSpace(req.Domain))
+	req.Selector = strings.ToLower(strings.TrimSpace(req.Selector))
+	if !reDKIMName.MatchString(req.Domain) || !reDKIMName.MatchString(req.Selector) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("settings.dkim.invalid", "name", req.Domain, "error", "domain / selector"))
+	}
+
+	key, err := email.GenerateDKIMKey()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	name, val, err := email.DKIMRecord(req.Domain, req.Selector, key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		dkimRecord
+		PrivateKey string `json:"private_key"`
+	}{dkimRecord{Domain: req.Domain, Selector: req.Selector, DNSName: name, DNSValue: val}, key}})
+}
+
+// handleExportSettings exports the settings as a JSON or TOML file that can
+// be imported into another install. Secrets are left out unless they're
+// explicitly requested by an admin.
+func handleExportSettings(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		format  = c.QueryParam("format")
+		secrets = c.QueryParam("secrets") == "true"
+	)
+
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "toml" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "format"))
+	}
+	if secrets && getUser(c).Role != models.UserRoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, app.i18n.T("users.permissionDenied"))
+	}
+
+	s, err := getSettings(app)
+	if err != nil {
+		return err
+	}
+	if !secrets {
+		s = redactSettings(s)
+	}
+
+	b, err := exportSettings(s, format)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentDisposition, "attachment; filename="+"settings."+format)
+	h.Set("Cache-Control", "no-cache")
+	if format == "toml" {
+		return c.Blob(http.StatusOK, "application/toml", b)
+	}
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, b)
+}
+
+// handleImportSettings applies settings exported from an install. The
+// settings in the file replace the current ones and the ones that aren't
+// in it are retained. Secrets that are empty or missing retain their current
+// values, and string values of the form ${NAME} are read from the
+// environment variable NAME so that secrets can be kept out of the file.
+// Importing the same file again changes nothing. With dry_run=true, the
+// changed settings are returned without being applied.
+func handleImportSettings(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		format = c.QueryParam("format")
+		dryRun = c.QueryParam("dry_run") == "true"
+	)
+
+	if format == "" {
+		format = "json"
+		if strings.Contains(c.Request().Header.Get(echo.HeaderContentType), "toml") {
+			format = "toml"
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, settingsImportMaxSize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	cur, err := getSettings(app)
+	if err != nil {
+		return err
+	}
+
+	b, changed, err := importSettings(body, format, cur, app)
+	if err != nil {
+		return err
+	}
+	setAuditData(c, map[string]interface{}{"changed": changed})
+
+	out := struct {
+		Changed      []string `json:"changed"`
+		NeedsRestart bool     `json:"needs_restart"`
+	}{Changed: changed}
+	if dryRun || len(changed) == 0 {
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	out.NeedsRestart, err = saveSettings(b, app)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// exportSettings encodes settings as JSON with the flat keys of the settings
+// blob, eg: "app.root_url", or as TOML with the keys nested in tables, eg:
+// [app] root_url.
+func exportSettings(s settings, format string) ([]byte, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	if format == "toml" {
+		return toml.Parser().Marshal(maps.Unflatten(tomlValue(m).(map[string]interface{}), "."))
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// importSettings decodes a JSON or TOML settings file and merges it into the
+// current settings, which are then validated. The resultant settings blob
+// and the keys of the settings that change are returned.
+func importSettings(body []byte, format string, cur settings, app *App) ([]byte, []string, error) {
+	var (
+		in  map[string]interface{}
+		err error
+	)
+	switch format {
+	case "json":
+		err = json.Unmarshal(body, &in)
+	case "toml":
+		in, err = toml.Parser().Unmarshal(body)
+	default:
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidField", "name", "format"))
+	}
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("settings.errorImporting", "error", err.Error()))
+	}
+
+	// Decode the current settings into a flat map of keys and merge the
+	// incoming settings into it.
+	cb, err := json.Marshal(cur)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(cb, &m); err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+	if err := mergeSettings(m, in, ""); err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("settings.errorImporting", "error", err.Error()))
+	}
+
+	// Decode the merged map into settings afresh so that no values of the
+	// current blocks, eg: SMTP servers, leak into the incoming ones.
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("settings.errorImporting", "error", err.Error()))
+	}
+	var set settings
+	if err := json.Unmarshal(mb, &set); err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("settings.errorImporting", "error", err.Error()))
+	}
+
+	set, err = prepareSettings(set, cur, app)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := json.Marshal(set)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+
+	return b, getChangedSettings(cur, b), nil
+}
+
+// mergeSettings merges incoming settings, with flat keys or keys nested in
+// maps as in TOML tables, into a flat map of the known settings. Unknown
+// keys are rejected to catch typos in hand written files.
+func mergeSettings(m, in map[string]interface{}, prefix string) error {
+	for k, v := range in {
+		key := prefix + k
+		if _, ok := m[key]; ok {
+			m[key] = importValue(v)
+			continue
+		}
+
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("unknown setting: %s", key)
+		}
+		if err := mergeSettings(m, sub, key+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importValue prepares a value decoded from an imported file. Strings of
+// the form ${NAME} are replaced with the value of the environment variable
+// NAME and empty TOML arrays, which are decoded as nil, are made empty.
+func importValue(v interface{}) interface{} {
+	switch o := v.(type) {
+	case string:
+		if sm := reEnvRef.FindStringSubmatch(o); sm != nil {
+			return os.Getenv(sm[1])
+		}
+	case map[string]interface{}:
+		for k, val := range o {
+			o[k] = importValue(val)
+		}
+	case []interface{}:
+		if o == nil {
+			return []interface{}{}
+		}
+		for i, val := range o {
+			o[i] = importValue(val)
+		}
+	}
+	return v
+}
+
+// tomlValue prepares a value decoded from JSON to be encoded as TOML, which
+// has no nulls and distinguishes integers from floats.
+func tomlValue(v interface{}) interface{} {
+	switch o := v.(type) {
+	case float64:
+		if o == math.Trunc(o) {
+			return int64(o)
+		}
+	case map[string]interface{}:
+		for k, val := range o {
+			if val == nil {
+				delete(o, k)
+				continue
+			}
+			o[k] = tomlValue(val)
+		}
+	case []interface{}:
+		for i, val := range o {
+			o[i] = tomlValue(val)
+		}
+	}
+	return v
+}
+
+// exportSettingsFile writes the settings to a JSON or TOML file as per its
+// extension (TOML by default) for the --export-settings flag.
+func exportSettingsFile(path string, secrets bool, app *App) error {
+	s, err := getSettings(app)
+	if err != nil {
+		return fmt.Errorf("%v", err.(*echo.HTTPError).Message)
+	}
+	if !secrets {
+		s = redactSettings(s)
+	}
+
+	b, err := exportSettings(s, settingsFileFormat(path))
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// importSettingsFile applies a JSON or TOML settings file for the
+// --import-settings flag and returns the keys of the changed settings.
+// A running instance picks up the settings when it's restarted.
+func importSettingsFile(path string, app *App) ([]string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := getSettings(app)
+	if err != nil {
+		return nil, fmt.Errorf("%v", err.(*echo.HTTPError).Message)
+	}
+
+	b, changed, err := importSettings(body, settingsFileFormat(path), cur, app)
+	if err != nil {
+		return nil, fmt.Errorf("%v", err.(*echo.HTTPError).Message)
+	}
+	if len(changed) == 0 {
+		return changed, nil
+	}
+
+	if _, err := app.queries.UpdateSettings.Exec(b); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// settingsFileFormat returns the format of a settings file by its extension.
+func settingsFileFormat(path string) string {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return "json"
+	}
+	return "toml"
+}
+
+// redactSettings empties out the passwords and other secrets in settings.
+func redactSettings(s settings) settings {
+	for i := 0; i < len(s.SMTP); i++ {
+		s.SMTP[i].Password = ""
+	}
+	for _, p := range msgrProviders {
+		for _, f := range p.fields(&s) {
+			for _, sec := range f.Secrets {
+				*sec = ""
+			}
+		}
+	}
+	for i := 0; i < len(s.Alerts); i++ {
+		s.Alerts[i].URL = ""
+	}
+	for i := 0; i < len(s.DKIM); i++ {
+		s.DKIM[i].PrivateKey = ""
+	}
+	s.UploadS3AwsSecretAccessKey = ""
+	s.WebPushVAPIDPrivateKey = ""
+	s.AppMetricsToken = ""
+	s.SecurityOIDCClientSecret = ""
+	s.SecurityCaptchaSecret = ""
+
+	return s
 }
 
 func getSettings(app *App) (settings, error) {
@@ -251,3 +1471,24 @@ func getSettings(app *App) (settings, error) {
 
 	return out, nil
 }
+
+// getChangedSettings returns the keys of the settings in the JSON blob b
+// whose values differ from the current settings.
+func getChangedSettings(cur settings, b []byte) []string {
+	var (
+		a, n = map[string]json.RawMessage{}, map[string]json.RawMessage{}
+		out  = []string{}
+	)
+	if cb, err := json.Marshal(cur); err == nil {
+		json.Unmarshal(cb, &a)
+	}
+	json.Unmarshal(b, &n)
+
+	for k, v := range n {
+		if !bytes.Equal(a[k], v) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+const (
+	sessionCookie = "listmonk_session"
+	sessionTTL    = time.Hour * 12
+
+	// oidcCookie holds the state and nonce of an OIDC login between the
+	// redirect to the provider and the callback.
+	oidcCookie    = "listmonk_oidc"
+	oidcCookieTTL = time.Minute * 10
+)
+
+// userRoles are the user roles in the order of their precedence when
+// several of them are mapped from a user's SSO claims.
+var userRoles = []string{
+	models.UserRoleAdmin,
+	models.UserRoleManager,
+	models.UserRoleAnalyst,
+	models.UserRoleEditor,
+}
+
+// handleOIDCLogin redirects to the OIDC provider to start a login.
+func handleOIDCLogin(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if app.oidc == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	state, err := generateRandomString(32)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	nonce, err := generateRandomString(32)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	u, err := app.oidc.AuthURL(state, nonce)
+	if err != nil {
+		app.log.Printf("error starting OIDC login: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
+				app.i18n.Ts("users.ssoError", "error", err.Error())))
+	}
+
+	setCookie(c, oidcCookie, state+"."+nonce, time.Now().Add(oidcCookieTTL), app)
+	return c.Redirect(http.StatusFound, u)
+}
+
+// handleOIDCCallback handles the redirect back from the OIDC provider. It
+// verifies the login, provisions or updates the user with the role mapped
+// from their claims and starts a session.
+func handleOIDCCallback(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if app.oidc == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	fail := func(msg string) error {
+		return c.Render(http.StatusUnauthorized, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("users.ssoError", "error", msg)))
+	}
+
+	// The state should match the one set before the redirect.
+	ck, err := c.Cookie(oidcCookie)
+	if err != nil {
+		return fail("missing login state")
+	}
+	setCookie(c, oidcCookie, "", time.Unix(0, 0), app)
+
+	parts := strings.SplitN(ck.Value, ".", 2)
+	if len(parts) != 2 || parts[0] != c.QueryParam("state") {
+		return fail("invalid login state")
+	}
+	if e := c.QueryParam("error"); e != "" {
+		return fail(e + " " + c.QueryParam("error_description"))
+	}
+
+	claims, err := app.oidc.Exchange(c.QueryParam("code"), parts[1])
+	if err != nil {
+		app.log.Printf("error verifying OIDC login: %v", err)
+		return fail(err.Error())
+	}
+
+	var (
+		cs       = app.constants.Security
+		username = strings.TrimSpace(claims.String(cs.OIDCUsernameClaim))
+		name     = strings.TrimSpace(claims.String("name"))
+	)
+	if username == "" {
+		return fail("missing claim: " + cs.OIDCUsernameClaim)
+	}
+
+	// An unverified e-mail could be anyone's.
+	if cs.OIDCUsernameClaim == "email" && !claims.Bool("email_verified") {
+		return fail("e-mail is not verified")
+	}
+	if name == "" {
+		name = username
+	}
+
+	role := mapOIDCRole(claims.Strings(cs.OIDCRoleClaim), cs.OIDCRoleMap, cs.OIDCDefaultRole)
+	if role == "" {
+		app.log.Printf("OIDC login denied to %s: no role mapped from claims", username)
+		return c.Render(http.StatusForbidden, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("users.permissionDenied")))
+	}
+
+	// Provision (just-in-time) or update the user.
+	var u models.User
+	if err := app.queries.UpsertSSOUser.Get(&u, username, name, role); err != nil {
+		if err == sql.ErrNoRows {
+			app.log.Printf("SSO login denied to %s: not a single sign-on user", username)
+			return c.Render(http.StatusForbidden, tplMessage,
+				makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("users.permissionDenied")))
+		}
+		app.log.Printf("error provisioning SSO user: %v", err)
+		return fail(pqErrMsg(err))
+	}
+	if u.Status != models.UserStatusEnabled {
+		return c.Render(http.StatusForbidden, tplMessage,
+			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("users.permissionDenied")))
+	}
+
+	if err := startSession(c, u, app); err != nil {
+		return fail(err.Error())
+	}
+
+	return c.Redirect(http.StatusFound, app.constants.RootURL+"/")
+}
+
+// handleLogout ends a user's session.
+func handleLogout(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if ck, err := c.Cookie(sessionCookie); err == nil && ck.Value != "" {
+		if _, err := app.queries.DeleteSession.Exec(hashToken(ck.Value)); err != nil {
+			app.log.Printf("error deleting session: %v", err)
+		}
+	}
+	setCookie(c, sessionCookie, "", time.Unix(0, 0), app)
+
+	return c.Render(http.StatusOK, tplMessage,
+		makeMsgTpl(app.i18n.T("users.loggedOut"), "", app.i18n.T("users.loggedOutMessage")))
+}
+
+// authenticate is the auth middleware for admin handlers. A valid session
+// cookie (from the login page or a single sign-on) authenticates a user,
+// failing which BasicAuth credentials are checked. Browsers requesting admin
+// pages without credentials are sent to the identity provider if SSO is
+// enabled or to the login page. ?login=basic skips SSO, eg: for the superuser.
+func authenticate(app *App) echo.MiddlewareFunc {
+	basic := middleware.BasicAuth(basicAuth)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withBasic := basic(next)
+
+		return func(c echo.Context) error {
+			if atomic.LoadInt32(&app.noAuth) == 1 {
+				return next(c)
+			}
+
+			if u, ok := getSessionUser(c, app); ok {
+				c.Set("user", u)
+				return next(c)
+			}
+
+			req := c.Request()
+			if req.Method == http.MethodGet && req.Header.Get(echo.HeaderAuthorization) == "" &&
+				!strings.HasPrefix(req.URL.Path, "/api/") {
+				if app.oidc != nil && c.QueryParam("login") != "basic" {
+					return c.Redirect(http.StatusFound, app.constants.RootURL+"/auth/oidc")
+				}
+				return c.Redirect(http.StatusFound, app.constants.RootURL+"/auth/login")
+			}
+
+			return withBasic(c)
+		}
+	}
+}
+
+// getSessionUser returns the user of the session in the request's cookie.
+func getSessionUser(c echo.Context, app *App) (models.User, bool) {
+	ck, err := c.Cookie(sessionCookie)
+	if err != nil || ck.Value == "" {
+		return models.User{}, false
+	}
+
+	var out []models.User
+	if err := app.queries.GetSessionUser.Select(&out, hashToken(ck.Value)); err != nil {
+		app.log.Printf("error fetching session: %v", err)
+		return models.User{}, false
+	}
+	if len(out) == 0 {
+		return getSuperuserSession(ck.Value, app)
+	}
+
+	u := out[0]
+	u.Password = ""
+	return u, true
+}
+
+// getSuperuserSession returns the superuser in the config if a session is
+// theirs and they're still in the config.
+func getSuperuserSession(id string, app *App) (models.User, bool) {
+	if len(app.constants.AdminUsername) == 0 || len(app.constants.AdminPassword) == 0 {
+		return models.User{}, false
+	}
+
+	var n int
+	if err := app.queries.GetSuperuserSession.Get(&n, hashToken(id)); err != nil {
+		app.log.Printf("error fetching session: %v", err)
+		return models.User{}, false
+	}
+	if n == 0 {
+		return models.User{}, false
+	}
+	return makeSuperuser(string(app.constants.AdminUsername)), true
+}
+
+// startSession creates a session for a user, sets its cookie and records the
+// login in the audit log. The superuser's session has no user ID.
+func startSession(c echo.Context, u models.User, app *App) error {
+	id, err := generateRandomString(48)
+	if err != nil {
+		return err
+	}
+
+	var userID interface{}
+	if u.ID > 0 {
+		userID = u.ID
+	}
+
+	exp := time.Now().Add(sessionTTL)
+	if _, err := app.queries.CreateSession.Exec(hashToken(id), userID, exp); err != nil {
+		app.log.Printf("error creating session: %v", err)
+		return err
+	}
+
+	setCookie(c, sessionCookie, id, exp, app)
+	auditLogin(c, u, app)
+	return nil
+}
+
+// mapOIDCRole returns the most privileged role mapped from a user's claim
+// values, or the default role if none of them is mapped.
+func mapOIDCRole(vals []string, roleMap map[string]string, defRole string) string {
+	mapped := map[string]bool{}
+	for _, v := range vals {
+		if r, ok := roleMap[v]; ok {
+			mapped[r] = true
+		}
+	}
+
+	for _, r := range userRoles {
+		if mapped[r] {
+			return r
+		}
+	}
+	return defRole
+}
+
+// hashToken returns the hash of a secret token (a session ID or a 2FA
+// recovery code) that's stored in the DB so that the DB doesn't have
+// usable tokens.
+func hashToken(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+// setCookie sets an HTTP only cookie that's secure if the app is on HTTPS.
+// SameSite=Lax keeps session cookies off cross-site API (non-GET) requests.
+func setCookie(c echo.Context, name, val string, exp time.Time, app *App) {
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    val,
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.constants.RootURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
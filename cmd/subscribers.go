@@ -104,8 +104,9 @@ func handleQuerySubscribers(c echo.Context) error {
 		app = c.Get("app").(*App)
 		pg  = getPagination(c.QueryParams(), 30)
 
-		// Limit the subscribers to a particular list?
-		listID, _ = strconv.Atoi(c.FormValue("list_id"))
+		// Limit the subscribers to a particular list or list folder?
+		listID, _   = strconv.Atoi(c.FormValue("list_id"))
+		folderID, _ = strconv.Atoi(c.FormValue("folder_id"))
 
 		// The "WHERE ?" bit.
 		query   = sanitizeSQLExp(c.FormValue("query"))
@@ -124,7 +125,7 @@ func handleQuerySubscribers(c echo.Context) error {
 	// There's an arbitrary query condition.
 	cond := ""
 	if query != "" {
-		cond = " AND " + query
+		cond = " AND (" + query + ")"
 	}
 
 	// Sort params.
@@ -135,10 +136,15 @@ func handleQuerySubscribers(c echo.Context) error {
 		order = sortAsc
 	}
 
+	folderListIDs, err := getFolderListIDs(folderID, app)
+	if err != nil {
+		return err
+	}
+
 	stmt := fmt.Sprintf(app.queries.QuerySubscribers, cond, orderBy, order)
 
 	// Create a readonly transaction to prevent mutations.
-	tx, err := app.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	tx, err := app.readDB.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		app.log.Printf("error preparing subscriber query: %v", err)
 		return echo.NewHTTPError(http.StatusBadRequest,
@@ -147,7 +153,7 @@ func handleQuerySubscribers(c echo.Context) error {
 	defer tx.Rollback()
 
 	// Run the query. stmt is the raw SQL query.
-	if err := tx.Select(&out.Results, stmt, listIDs, pg.Offset, pg.Limit); err != nil {
+	if err := tx.Select(&out.Results, stmt, listIDs, pg.Offset, pg.Limit, folderListIDs); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
@@ -180,8 +186,9 @@ func handleExportSubscribers(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
 
-		// Limit the subscribers to a particular list?
-		listID, _ = strconv.Atoi(c.FormValue("list_id"))
+		// Limit the subscribers to a particular list or list folder?
+		listID, _   = strconv.Atoi(c.FormValue("list_id"))
+		folderID, _ = strconv.Atoi(c.FormValue("folder_id"))
 
 		// The "WHERE ?" bit.
 		query = sanitizeSQLExp(c.FormValue("query"))
@@ -197,14 +204,19 @@ func handleExportSubscribers(c echo.Context) error {
 	// There's an arbitrary query condition.
 	cond := ""
 	if query != "" {
-		cond = " AND " + query
+		cond = " AND (" + query + ")"
+	}
+
+	folderListIDs, err := getFolderListIDs(folderID, app)
+	if err != nil {
+		return err
 	}
 
 	stmt := fmt.Sprintf(app.queries.QuerySubscribersForExport, cond)
 
 	// Verify that the arbitrary SQL search expression is read only.
 	if cond != "" {
-		tx, err := app.db.Unsafe().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+		tx, err := app.readDB.Unsafe().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 		if err != nil {
 			app.log.Printf("error preparing subscriber query: %v", err)
 			return echo.NewHTTPError(http.StatusBadRequest,
@@ -212,14 +224,14 @@ func handleExportSubscribers(c echo.Context) error {
 		}
 		defer tx.Rollback()
 
-		if _, err := tx.Query(stmt, nil, 0, 1); err != nil {
+		if _, err := tx.Query(stmt, nil, 0, 1, nil); err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest,
 				app.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
 		}
 	}
 
 	// Prepare the actual query statement.
-	tx, err := db.Preparex(stmt)
+	tx, err := app.readDB.Preparex(stmt)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			app.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
@@ -243,7 +255,7 @@ func handleExportSubscribers(c echo.Context) error {
 loop:
 	for {
 		var out []models.SubscriberExport
-		if err := tx.Select(&out, listIDs, id, app.constants.DBBatchSize); err != nil {
+		if err := tx.Select(&out, listIDs, id, app.constants.DBBatchSize, folderListIDs); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("globals.messages.errorFetching",
 					"name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
@@ -327,6 +339,20 @@ func handleUpdateSubscriber(c echo.Context) error {
 		}
 	}
 
+	// Subscriptions to lists that aren't assigned to a list-restricted editor
+	// are retained as the update replaces the subscriber's subscriptions.
+	if u := getUser(c); u.Role == models.UserRoleEditor {
+		cur, err := getSubscriber(int(id), "", "", app)
+		if err != nil {
+			return err
+		}
+		for _, l := range getSubscriberListIDs(cur) {
+			if !hasListIDs(u.ListIDs, []int64{l}) {
+				req.Lists = append(req.Lists, l)
+			}
+		}
+	}
+
 	_, err := app.queries.UpdateSubscriber.Exec(id,
 		strings.ToLower(strings.TrimSpace(req.Email)),
 		strings.TrimSpace(req.Name),
@@ -471,6 +497,13 @@ func handleManageSubscriberLists(c echo.Context) error {
 				"name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
 
+	switch req.Action {
+	case "add":
+		go fireListWebhooks(models.ListWebhookEventSubscribe, IDs, req.TargetListIDs, app)
+	case "unsubscribe":
+		go fireListWebhooks(models.ListWebhookEventUnsubscribe, IDs, req.TargetListIDs, app)
+	}
+
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
@@ -637,6 +670,10 @@ func handleExportSubscriberData(c echo.Context) error {
 // insertSubscriber inserts a subscriber and returns the ID. The first bool indicates if
 // it was a new subscriber, and the second bool indicates if the subscriber was sent an optin confirmation.
 func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, bool, bool, error) {
+	if err := runSubscribeHooks(&req, app); err != nil {
+		return req.Subscriber, false, false, err
+	}
+
 	uu, err := uuid.NewV4()
 	if err != nil {
 		return req.Subscriber, false, false, err
@@ -678,6 +715,11 @@ func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, bool
 		return sub, false, false, err
 	}
 
+	if isNew {
+		go fireListWebhooks(models.ListWebhookEventSubscribe,
+			[]int64{int64(sub.ID)}, getSubscriberListIDs(sub), app)
+	}
+
 	hasOptin := false
 	if !req.PreconfirmSubs {
 		// Send a confirmation e-mail (if there are any double opt-in lists).
@@ -785,9 +827,10 @@ func sendOptinConfirmation(sub models.Subscriber, listIDs []int64, app *App) (in
 	}
 	out.OptinURL = fmt.Sprintf(app.constants.OptinURL, sub.UUID, qListIDs.Encode())
 
-	// Send the e-mail.
-	if err := app.sendNotification([]string{sub.Email},
-		app.i18n.T("subscribers.optinSubject"), notifSubscriberOptin, out); err != nil {
+	// Send the e-mail in the subscriber's language.
+	l := subscriberLang(sub, app)
+	if err := app.sendLangNotification([]string{sub.Email},
+		l.T("subscribers.optinSubject"), notifSubscriberOptin, out, l); err != nil {
 		app.log.Printf("error sending opt-in e-mail: %s", err)
 		return 0, err
 	}
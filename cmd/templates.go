@@ -1,12 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"text/template/parse"
 
+	"github.com/knadh/listmonk/internal/diff"
+	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 )
@@ -28,6 +36,9 @@ const (
 
 var (
 	regexpTplTag = regexp.MustCompile(`{{(\s+)?template\s+?"content"(\s+)?\.(\s+)?}}`)
+
+	// Partials are included by name, eg: {{ Partial "social-bar" }}.
+	regexpPartialName = regexp.MustCompile(`^[a-z0-9_\-]+$`)
 )
 
 // handleGetTemplates handles retrieval of templates.
@@ -39,6 +50,7 @@ func handleGetTemplates(c echo.Context) error {
 		id, _     = strconv.Atoi(c.Param("id"))
 		single    = false
 		noBody, _ = strconv.ParseBool(c.QueryParam("no_body"))
+		typ       = c.QueryParam("type")
 	)
 
 	// Fetch one list.
@@ -46,7 +58,11 @@ func handleGetTemplates(c echo.Context) error {
 		single = true
 	}
 
-	err := app.queries.GetTemplates.Select(&out, id, noBody)
+	if typ != "" && !isTemplateType(typ) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("templates.invalidType"))
+	}
+
+	err := app.queries.GetTemplates.Select(&out, id, noBody, typ)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorFetching",
@@ -72,21 +88,33 @@ func handlePreviewTemplate(c echo.Context) error {
 		app   = c.Get("app").(*App)
 		id, _ = strconv.Atoi(c.Param("id"))
 		body  = c.FormValue("body")
+		typ   = c.FormValue("type")
+		subj  = c.FormValue("subject")
 
 		tpls []models.Template
+		data models.TemplateData
 	)
 
 	if body != "" {
-		if !regexpTplTag.MatchString(body) {
+		// Partials and transactional templates are previewed on their own
+		// and don't embed campaign content.
+		if typ != models.TemplateTypePartial && typ != models.TemplateTypeTx && !regexpTplTag.MatchString(body) {
 			return echo.NewHTTPError(http.StatusBadRequest,
 				app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag))
 		}
+
+		if s := c.FormValue("sample_data"); typ == models.TemplateTypeTx && s != "" {
+			if err := json.Unmarshal([]byte(s), &data); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("templates.invalidSampleData", "error", err.Error()))
+			}
+		}
 	} else {
 		if id < 1 {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 		}
 
-		err := app.queries.GetTemplates.Select(&tpls, id, false)
+		err := app.queries.GetTemplates.Select(&tpls, id, false, "")
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("globals.messages.errorFetching",
@@ -98,6 +126,13 @@ func handlePreviewTemplate(c echo.Context) error {
 				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
 		}
 		body = tpls[0].Body
+		typ = tpls[0].Type
+		subj = tpls[0].Subject
+		data = tpls[0].SampleData
+	}
+
+	if typ == models.TemplateTypeTx {
+		return previewTxTemplate(c, models.Template{Type: typ, Subject: subj, Body: body, SampleData: data}, app)
 	}
 
 	// Compile the template.
@@ -115,8 +150,13 @@ func handlePreviewTemplate(c echo.Context) error {
 			app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
 	}
 
+	sub, err := getPreviewSubscriber(c, app)
+	if err != nil {
+		return err
+	}
+
 	// Render the message body.
-	msg, err := app.manager.NewCampaignMessage(&camp, dummySubscriber)
+	msg, err := app.manager.NewCampaignMessage(&camp, sub)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
@@ -125,6 +165,99 @@ func handlePreviewTemplate(c echo.Context) error {
 	return c.HTML(http.StatusOK, string(msg.Body()))
 }
 
+// previewTxTemplate renders the HTML preview of a transactional template
+// with the preview subscriber and the template's sample data.
+func previewTxTemplate(c echo.Context, tpl models.Template, app *App) error {
+	sub, err := getPreviewSubscriber(c, app)
+	if err != nil {
+		return err
+	}
+
+	m, err := renderTxTemplate(tpl, sub, tpl.SampleData, app)
+	if err != nil {
+		return err
+	}
+
+	return c.HTML(http.StatusOK, string(m.Body))
+}
+
+// handleRenderTxTemplate renders the subject and body of a saved transactional
+// template for a subscriber (or a dummy subscriber) with the given data,
+// or the template's sample data if there's none.
+func handleRenderTxTemplate(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   struct {
+			SubscriberID    int                 `json:"subscriber_id"`
+			SubscriberEmail string              `json:"subscriber_email"`
+			Data            models.TemplateData `json:"data"`
+		}
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, id, false, models.TemplateTypeTx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
+	}
+	if len(tpls) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+	}
+
+	sub := dummySubscriber
+	if req.SubscriberID > 0 || req.SubscriberEmail != "" {
+		s, err := getSubscriber(req.SubscriberID, "", req.SubscriberEmail, app)
+		if err != nil {
+			return err
+		}
+		sub = s
+	}
+
+	data := req.Data
+	if data == nil {
+		data = tpls[0].SampleData
+	}
+
+	m, err := renderTxTemplate(tpls[0], sub, data, app)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}{m.Subject, string(m.Body)}})
+}
+
+// renderTxTemplate compiles a transactional template and renders it for
+// a subscriber with the given data.
+func renderTxTemplate(tpl models.Template, sub models.Subscriber, data models.TemplateData, app *App) (models.TxMessage, error) {
+	if err := tpl.Compile(app.manager.TxTemplateFuncs()); err != nil {
+		return models.TxMessage{}, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+	}
+
+	m := models.TxMessage{TemplateID: tpl.ID, Data: data}
+	if m.Data == nil {
+		m.Data = map[string]interface{}{}
+	}
+	if err := m.Render(sub, &tpl); err != nil {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+	}
+
+	return m, nil
+}
+
 // handleCreateTemplate handles template creation.
 func handleCreateTemplate(c echo.Context) error {
 	var (
@@ -136,6 +269,9 @@ func handleCreateTemplate(c echo.Context) error {
 		return err
 	}
 
+	if o.Type == "" {
+		o.Type = models.TemplateTypeCampaign
+	}
 	if err := validateTemplate(o, app); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
@@ -144,11 +280,16 @@ func handleCreateTemplate(c echo.Context) error {
 	var newID int
 	if err := app.queries.CreateTemplate.Get(&newID,
 		o.Name,
-		o.Body); err != nil {
+		o.Body,
+		getAuthUser(c),
+		o.Type,
+		o.Subject,
+		o.SampleData); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorCreating",
 				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
 	}
+	reloadPartials(app)
 
 	// Hand over to the GET handler to return the last insertion.
 	return handleGetTemplates(copyEchoCtx(c, map[string]string{
@@ -172,11 +313,24 @@ func handleUpdateTemplate(c echo.Context) error {
 		return err
 	}
 
+	// The type of a template can't be changed.
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, id, true, ""); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
+	}
+	if len(tpls) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+	}
+	o.Type = tpls[0].Type
+
 	if err := validateTemplate(o, app); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	res, err := app.queries.UpdateTemplate.Exec(id, o.Name, o.Body)
+	res, err := app.queries.UpdateTemplate.Exec(id, o.Name, o.Body, getAuthUser(c), o.Subject, o.SampleData)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorUpdating",
@@ -187,6 +341,7 @@ func handleUpdateTemplate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
 	}
+	reloadPartials(app)
 
 	return handleGetTemplates(c)
 }
@@ -234,20 +389,439 @@ func handleDeleteTemplate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			app.i18n.T("templates.cantDeleteDefault"))
 	}
+	reloadPartials(app)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetTemplateVersions handles retrieval of the version history of a template.
+func handleGetTemplateVersions(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.TemplateVersion
+
+		id, _      = strconv.Atoi(c.Param("id"))
+		version, _ = strconv.Atoi(c.Param("version"))
+		noBody, _  = strconv.ParseBool(c.QueryParam("no_body"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.queries.GetTemplateVersions.Select(&out, id, version, noBody); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{templates.versions}", "error", pqErrMsg(err)))
+	}
+	if version > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{templates.version}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDiffTemplateVersions returns the unified diff of a template's body
+// between a past version and either another version (?against=) or the
+// template's current body.
+func handleDiffTemplateVersions(c echo.Context) error {
+	var (
+		app        = c.Get("app").(*App)
+		id, _      = strconv.Atoi(c.Param("id"))
+		version, _ = strconv.Atoi(c.Param("version"))
+		against, _ = strconv.Atoi(c.QueryParam("against"))
+	)
+
+	if id < 1 || version < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	from, err := getTemplateVersion(id, version, app)
+	if err != nil {
+		return err
+	}
+
+	// Diff against the current template if there's no version to compare with.
+	var (
+		toName = app.i18n.T("templates.current")
+		toBody string
+	)
+	if against > 0 {
+		to, err := getTemplateVersion(id, against, app)
+		if err != nil {
+			return err
+		}
+		toName = fmt.Sprintf("v%d", to.Version)
+		toBody = to.Body
+	} else {
+		var tpls []models.Template
+		if err := app.queries.GetTemplates.Select(&tpls, id, false, ""); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.template}", "error", pqErrMsg(err)))
+		}
+		if len(tpls) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+		}
+		toBody = tpls[0].Body
+	}
+
+	fromName := fmt.Sprintf("v%d", from.Version)
+	return c.JSON(http.StatusOK, okResp{struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Diff string `json:"diff"`
+	}{fromName, toName, diff.Unified(from.Body, toBody, fromName, toName)}})
+}
+
+// handleRollbackTemplate restores a template to a past version. The rollback
+// itself is recorded as a new version so that no history is lost.
+func handleRollbackTemplate(c echo.Context) error {
+	var (
+		app        = c.Get("app").(*App)
+		id, _      = strconv.Atoi(c.Param("id"))
+		version, _ = strconv.Atoi(c.Param("version"))
+	)
+
+	if id < 1 || version < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	res, err := app.queries.RollbackTemplate.Exec(id, version, getAuthUser(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{templates.version}"))
+	}
+	reloadPartials(app)
+
+	return handleGetTemplates(c)
+}
+
+// getTemplateVersion fetches a single version of a template.
+func getTemplateVersion(id, version int, app *App) (models.TemplateVersion, error) {
+	var out []models.TemplateVersion
+	if err := app.queries.GetTemplateVersions.Select(&out, id, version, false); err != nil {
+		return models.TemplateVersion{}, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{templates.version}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return models.TemplateVersion{}, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{templates.version}"))
+	}
+
+	return out[0], nil
+}
+
 // validateTemplate validates template fields.
 func validateTemplate(o models.Template, app *App) error {
 	if !strHasLen(o.Name, 1, stdInputMaxLen) {
 		return errors.New(app.i18n.T("campaigns.fieldInvalidName"))
 	}
 
-	if !regexpTplTag.MatchString(o.Body) {
-		return echo.NewHTTPError(http.StatusBadRequest,
-			app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag))
+	switch o.Type {
+	case models.TemplateTypeCampaign:
+		if !regexpTplTag.MatchString(o.Body) {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag))
+		}
+	case models.TemplateTypePartial:
+		if !regexpPartialName.MatchString(o.Name) {
+			return errors.New(app.i18n.T("templates.invalidPartialName"))
+		}
+		if o.Body == "" {
+			return errors.New(app.i18n.T("templates.invalidPartialBody"))
+		}
+	case models.TemplateTypeTx:
+		if !strHasLen(o.Subject, 1, stdInputMaxLen) {
+			return errors.New(app.i18n.T("campaigns.fieldInvalidSubject"))
+		}
+		if o.Body == "" {
+			return errors.New(app.i18n.T("templates.invalidTxBody"))
+		}
+	default:
+		return errors.New(app.i18n.T("templates.invalidType"))
+	}
+
+	return nil
+}
+
+// handleValidateTemplate parses a template body without saving it and reports
+// syntax errors, unknown template fields, and missing placeholders along with
+// their line numbers.
+func handleValidateTemplate(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.Template
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if o.Type == "" {
+		o.Type = models.TemplateTypeCampaign
+	}
+	if !isTemplateType(o.Type) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("templates.invalidType"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{lintTemplate(o, app)})
+}
+
+// tplLintMsg is an error or a warning in a template body.
+type tplLintMsg struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// tplLint is the result of linting a template body.
+type tplLint struct {
+	Valid    bool         `json:"valid"`
+	Errors   []tplLintMsg `json:"errors"`
+	Warnings []tplLintMsg `json:"warnings"`
+}
+
+// tplDataType is the type of the data (.) that templates are rendered with.
+var tplDataType = reflect.TypeOf(&manager.CampaignMessage{})
+
+// txTplDataType is the type of the data (.) that transactional templates
+// are rendered with. It mirrors the data in models.TxMessage.Render.
+var txTplDataType = reflect.TypeOf(struct {
+	Subscriber models.Subscriber
+	Tx         *models.TxMessage
+}{})
+
+// regexpTplErr matches the line number in Go template parse errors.
+// eg: template: base:3: function "Foo" not defined
+var regexpTplErr = regexp.MustCompile(`^template: [^:]*:(\d+):(?:\d+:)?\s*(.*)$`)
+
+// lintTemplate parses a template body and walks its parse tree to look for
+// unknown fields, unknown partials, and missing placeholders.
+func lintTemplate(o models.Template, app *App) tplLint {
+	out := tplLint{Errors: []tplLintMsg{}, Warnings: []tplLintMsg{}}
+
+	var (
+		funcs    = app.manager.TemplateFuncs(&models.Campaign{})
+		dataType = tplDataType
+	)
+	if o.Type == models.TemplateTypeTx {
+		funcs = app.manager.TxTemplateFuncs()
+		dataType = txTplDataType
+	}
+
+	// Shorthand function calls (eg: {{ TrackView }}) are valid Go template
+	// syntax, so the body is parsed as-is to preserve node positions.
+	tpl, err := template.New(models.BaseTpl).Funcs(funcs).Parse(o.Body)
+	if err != nil {
+		msg := tplLintMsg{Message: err.Error()}
+		if m := regexpTplErr.FindStringSubmatch(err.Error()); m != nil {
+			msg.Line, _ = strconv.Atoi(m[1])
+			msg.Message = m[2]
+		}
+		out.Errors = append(out.Errors, msg)
+		return out
+	}
+
+	l := &tplLinter{body: o.Body, dataType: dataType, funcs: make(map[string]bool), app: app, out: &out}
+	if tpl.Tree != nil && tpl.Tree.Root != nil {
+		l.walk(tpl.Tree.Root, true)
+	}
+
+	// Placeholders may also be in the included partials.
+	var (
+		partials  []models.Template
+		inPartial = make(map[string]bool)
+	)
+	if err := app.queries.GetTemplates.Select(&partials, 0, false, models.TemplateTypePartial); err != nil {
+		app.log.Printf("error fetching partial templates: %v", err)
+	}
+	for _, p := range partials {
+		if _, ok := l.partials[p.Name]; !ok {
+			continue
+		}
+		delete(l.partials, p.Name)
+		for _, f := range []string{"TrackView", "UnsubscribeURL"} {
+			if strings.Contains(p.Body, f) {
+				inPartial[f] = true
+			}
+		}
+	}
+	for name, pos := range l.partials {
+		out.Errors = append(out.Errors, tplLintMsg{Line: l.line(pos),
+			Message: app.i18n.Ts("templates.lintUnknownPartial", "name", name)})
+	}
+
+	if o.Type == models.TemplateTypeCampaign {
+		if !regexpTplTag.MatchString(o.Body) {
+			out.Errors = append(out.Errors, tplLintMsg{
+				Message: app.i18n.Ts("templates.placeholderHelp", "placeholder", tplTag)})
+		}
+		for _, f := range []string{"TrackView", "UnsubscribeURL"} {
+			if !l.funcs[f] && !inPartial[f] {
+				out.Warnings = append(out.Warnings, tplLintMsg{
+					Message: app.i18n.Ts("templates.lintMissingPlaceholder", "name", fmt.Sprintf("{{ %s }}", f))})
+			}
+		}
+	}
+
+	sort.SliceStable(out.Errors, func(i, j int) bool { return out.Errors[i].Line < out.Errors[j].Line })
+	out.Valid = len(out.Errors) == 0
+	return out
+}
+
+// tplLinter walks a template parse tree and records lint messages.
+type tplLinter struct {
+	body     string
+	dataType reflect.Type
+	app      *App
+	out      *tplLint
+
+	// Functions that are called and partials that are included in the template.
+	funcs    map[string]bool
+	partials map[string]parse.Pos
+}
+
+// walk walks a node. checkDot indicates whether dot (.) is the template's
+// root data, which isn't the case inside {{ range }} and {{ with }} blocks.
+func (l *tplLinter) walk(n parse.Node, checkDot bool) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			l.walk(c, checkDot)
+		}
+	case *parse.ActionNode:
+		l.walk(n.Pipe, checkDot)
+	case *parse.IfNode:
+		l.walkBranch(&n.BranchNode, checkDot, checkDot)
+	case *parse.RangeNode:
+		l.walkBranch(&n.BranchNode, false, checkDot)
+	case *parse.WithNode:
+		l.walkBranch(&n.BranchNode, false, checkDot)
+	case *parse.TemplateNode:
+		l.walk(n.Pipe, checkDot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			l.walk(c, checkDot)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 0 {
+			if id, ok := n.Args[0].(*parse.IdentifierNode); ok {
+				l.funcs[id.Ident] = true
+				if id.Ident == "Partial" && len(n.Args) > 1 {
+					if s, ok := n.Args[1].(*parse.StringNode); ok {
+						if l.partials == nil {
+							l.partials = make(map[string]parse.Pos)
+						}
+						l.partials[s.Text] = s.Position()
+					}
+				}
+			}
+		}
+		for _, a := range n.Args {
+			l.walk(a, checkDot)
+		}
+	case *parse.FieldNode:
+		if checkDot {
+			l.checkFields(n.Ident, n.Position())
+		}
+	case *parse.VariableNode:
+		// $ is always the root data.
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			l.checkFields(n.Ident[1:], n.Position())
+		}
+	case *parse.ChainNode:
+		l.walk(n.Node, checkDot)
+	}
+}
+
+func (l *tplLinter) walkBranch(n *parse.BranchNode, checkDot, checkElseDot bool) {
+	l.walk(n.Pipe, checkElseDot)
+	l.walk(n.List, checkDot)
+	if n.ElseList != nil {
+		l.walk(n.ElseList, checkElseDot)
+	}
+}
+
+// checkFields checks a chain of fields (eg: .Subscriber.Email) against the
+// type of the template data.
+func (l *tplLinter) checkFields(idents []string, pos parse.Pos) {
+	t := l.dataType
+	for i, id := range idents {
+		// Methods can be on the pointer or the value.
+		if _, ok := t.MethodByName(id); ok {
+			return
+		}
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+			if _, ok := t.MethodByName(id); ok {
+				return
+			}
+		}
+
+		// Map keys (eg: .Subscriber.Attribs.city) can't be checked.
+		if t.Kind() == reflect.Map {
+			return
+		}
+
+		f, ok := t.FieldByName(id)
+		if t.Kind() != reflect.Struct || !ok || f.PkgPath != "" {
+			l.out.Errors = append(l.out.Errors, tplLintMsg{Line: l.line(pos),
+				Message: l.app.i18n.Ts("templates.lintUnknownField",
+					"name", "."+strings.Join(idents[:i+1], "."))})
+			return
+		}
+		t = f.Type
+	}
+}
+
+// line returns the line number of a position in the template body.
+func (l *tplLinter) line(pos parse.Pos) int {
+	p := int(pos)
+	if p > len(l.body) {
+		p = len(l.body)
+	}
+	return strings.Count(l.body[:p], "\n") + 1
+}
+
+// isTemplateType checks whether a string is a valid template type.
+func isTemplateType(typ string) bool {
+	switch typ {
+	case models.TemplateTypeCampaign, models.TemplateTypePartial, models.TemplateTypeTx:
+		return true
+	}
+	return false
+}
+
+// reloadPartials loads the partial templates from the DB into the campaign
+// manager, which makes them available to the Partial template function.
+func reloadPartials(app *App) error {
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, 0, false, models.TemplateTypePartial); err != nil {
+		app.log.Printf("error loading partial templates: %v", err)
+		return err
 	}
 
+	app.manager.SetPartials(tpls)
 	return nil
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/lib/pq"
+)
+
+const (
+	// Interval at which queued views and clicks are written if a batch
+	// isn't full.
+	trackFlushInterval = time.Second
+
+	// Max. number of link URLs that are cached for click redirects.
+	trackMaxLinks = 10000
+)
+
+// trackView is a campaign view that's queued to be written.
+type trackView struct {
+	CampUUID  string
+	SubUUID   string
+	Device    string
+	Client    string
+	Country   string
+	Region    string
+	CreatedAt time.Time
+}
+
+// trackClick is a link click that's queued to be written.
+type trackClick struct {
+	LinkUUID  string
+	CampUUID  string
+	SubUUID   string
+	Country   string
+	Region    string
+	CreatedAt time.Time
+}
+
+// Types of the tracking events that are queued on a trackWriter's bus.
+const (
+	trackEventView  = "view"
+	trackEventClick = "click"
+)
+
+// trackWriter queues campaign views and link clicks and writes them to the
+// DB in batches instead of an insert per tracking request, which dominates
+// the DB load on large campaigns. The batches are queued on an events.Bus
+// that the writer is the sink of.
+type trackWriter struct {
+	bus *events.Bus
+	db  *sqlx.DB
+	q   *Queries
+	log *log.Logger
+
+	// Link UUID -> URL for redirecting clicks without a write.
+	links    map[string]string
+	linksMut sync.RWMutex
+}
+
+// newTrackWriter returns a new trackWriter that writes views and clicks in
+// batches of up to batchSize.
+func newTrackWriter(batchSize int, q *Queries, db *sqlx.DB, l *log.Logger) *trackWriter {
+	w := &trackWriter{
+		db:    db,
+		q:     q,
+		log:   l,
+		links: make(map[string]string),
+	}
+	w.bus = events.New(w, events.Opts{
+		BatchSize:     batchSize,
+		FlushInterval: trackFlushInterval,
+		QueueSize:     batchSize * 100,
+	}, l)
+
+	return w
+}
+
+// AddView queues a campaign view. It never blocks and the view is dropped
+// if the queue is full.
+func (w *trackWriter) AddView(v trackView) {
+	w.bus.Publish(trackEventView, v)
+}
+
+// AddClick queues a link click. It never blocks and the click is dropped
+// if the queue is full.
+func (w *trackWriter) AddClick(c trackClick) {
+	w.bus.Publish(trackEventClick, c)
+}
+
+// GetLinkURL returns the URL of a tracked link. It returns sql.ErrNoRows
+// if the link doesn't exist.
+func (w *trackWriter) GetLinkURL(linkUUID string) (string, error) {
+	w.linksMut.RLock()
+	url, ok := w.links[linkUUID]
+	w.linksMut.RUnlock()
+	if ok {
+		return url, nil
+	}
+
+	if err := w.q.GetLinkURL.Get(&url, linkUUID); err != nil {
+		return "", err
+	}
+
+	w.linksMut.Lock()
+	if len(w.links) >= trackMaxLinks {
+		w.links = make(map[string]string)
+	}
+	w.links[linkUUID] = url
+	w.linksMut.Unlock()
+
+	return url, nil
+}
+
+// Run writes the queued views and clicks in batches. It blocks until the
+// writer is closed and is meant to be run in a goroutine.
+func (w *trackWriter) Run() {
+	w.bus.Run()
+}
+
+// Close stops the writer and blocks until the queued views and clicks
+// are written.
+func (w *trackWriter) Close() {
+	w.bus.Close()
+}
+
+// Name returns the name of the writer as an events.Sink.
+func (w *trackWriter) Name() string {
+	return "tracking"
+}
+
+// Publish writes a batch of views and clicks in a transaction so that
+// a failed batch can be retried as a whole.
+func (w *trackWriter) Publish(evs []events.Event) error {
+	var (
+		views  []trackView
+		clicks []trackClick
+	)
+	for _, e := range evs {
+		switch d := e.Data.(type) {
+		case trackView:
+			views = append(views, d)
+		case trackClick:
+			clicks = append(clicks, d)
+		}
+	}
+
+	tx, err := w.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(views) > 0 {
+		if err := w.writeViews(tx, views); err != nil {
+			return fmt.Errorf("error writing %d campaign views: %v", len(views), err)
+		}
+	}
+	if len(clicks) > 0 {
+		if err := w.writeClicks(tx, clicks); err != nil {
+			return fmt.Errorf("error writing %d link clicks: %v", len(clicks), err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// writeViews writes a batch of views in a single insert.
+func (w *trackWriter) writeViews(tx *sqlx.Tx, views []trackView) error {
+	var (
+		n      = len(views)
+		camps  = make(pq.StringArray, n)
+		subs   = make(pq.StringArray, n)
+		devs   = make(pq.StringArray, n)
+		cls    = make(pq.StringArray, n)
+		cnts   = make(pq.StringArray, n)
+		regs   = make(pq.StringArray, n)
+		tstamp = make(pq.StringArray, n)
+	)
+	for i, v := range views {
+		camps[i], subs[i], devs[i], cls[i] = v.CampUUID, v.SubUUID, v.Device, v.Client
+		cnts[i], regs[i] = v.Country, v.Region
+		tstamp[i] = v.CreatedAt.Format(time.RFC3339Nano)
+	}
+
+	_, err := tx.Stmtx(w.q.RegisterCampaignViews).Exec(camps, subs, devs, cls, cnts, regs, tstamp)
+	return err
+}
+
+// writeClicks writes a batch of clicks in a single insert.
+func (w *trackWriter) writeClicks(tx *sqlx.Tx, clicks []trackClick) error {
+	var (
+		n      = len(clicks)
+		links  = make(pq.StringArray, n)
+		camps  = make(pq.StringArray, n)
+		subs   = make(pq.StringArray, n)
+		cnts   = make(pq.StringArray, n)
+		regs   = make(pq.StringArray, n)
+		tstamp = make(pq.StringArray, n)
+	)
+	for i, c := range clicks {
+		links[i], camps[i], subs[i] = c.LinkUUID, c.CampUUID, c.SubUUID
+		cnts[i], regs[i] = c.Country, c.Region
+		tstamp[i] = c.CreatedAt.Format(time.RFC3339Nano)
+	}
+
+	_, err := tx.Stmtx(w.q.RegisterLinkClicks).Exec(links, camps, subs, cnts, regs, tstamp)
+	return err
+}
@@ -0,0 +1,943 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/hooks"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/safehttp"
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	// Max. number of attachments in a transactional message.
+	txMaxAttachments = 20
+
+	// Max. number of messages in a transactional batch and the number
+	// of messages in a batch that are processed concurrently.
+	txMaxBatchSize     = 1000
+	txBatchConcurrency = 10
+
+	// Header that carries the ID of a transactional message so that bounces
+	// and complaints can be traced back to the message.
+	txMessageIDHeader = "X-Listmonk-Tx-ID"
+
+	// Number of days after which the status callbacks of transactional
+	// messages are deleted. Bounces and complaints that arrive later
+	// aren't posted to the status URL.
+	txCallbackRetentionDays = 30
+)
+
+// txStatusClient posts delivery statuses to the status URLs of
+// transactional messages. The URLs come from API callers, so connections
+// to non-public addresses are refused.
+var txStatusClient = &http.Client{
+	Timeout: listWebhookTimeout,
+	Transport: &http.Transport{
+		DialContext: safehttp.Dialer(listWebhookTimeout).DialContext,
+	},
+}
+
+// txStatusEvent is the payload that's posted as JSON to the status URL
+// of a transactional message.
+type txStatusEvent struct {
+	MessageID  string `json:"message_id"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+	Subscriber struct {
+		ID    int    `json:"id,omitempty"`
+		Email string `json:"email"`
+	} `json:"subscriber"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// txBatchResult is the result of a message in a transactional batch.
+type txBatchResult struct {
+	Index           int    `json:"index"`
+	SubscriberEmail string `json:"subscriber_email,omitempty"`
+	SubscriberID    int    `json:"subscriber_id,omitempty"`
+	MessageID       string `json:"message_id,omitempty"`
+	OK              bool   `json:"ok"`
+	Error           string `json:"error,omitempty"`
+}
+
+type txScheduledWrap struct {
+	Results []models.TxScheduled `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+type txLogWrap struct {
+	Results []models.TxLog `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// txLogQuery represents the filters for querying the transactional message log.
+type txLogQuery struct {
+	Query        string
+	Status       string
+	TemplateID   int
+	SubscriberID int
+	From         interface{}
+	To           interface{}
+}
+
+// handleSendTxMessage handles the sending of a transactional message
+// to a subscriber with a transactional template.
+func handleSendTxMessage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		m   models.TxMessage
+	)
+
+	if err := c.Bind(&m); err != nil {
+		return err
+	}
+
+	m, err := validateTxMessage(m, app)
+	if err != nil {
+		return err
+	}
+
+	tpl, err := getTxTemplate(m.TemplateID, app)
+	if err != nil {
+		return err
+	}
+
+	files, err := makeTxAttachments(m.Attachments, app)
+	if err != nil {
+		return err
+	}
+
+	msgID, err := dispatchTxMessage(m, tpl, files, app)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		MessageID string `json:"message_id"`
+	}{msgID}})
+}
+
+// handleSendTxBatch handles the sending of a batch of transactional messages
+// with a shared template. The messages are processed concurrently and the
+// result of each message is reported individually so that a failing
+// recipient doesn't fail the whole batch.
+func handleSendTxBatch(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		b   models.TxBatch
+	)
+
+	if err := c.Bind(&b); err != nil {
+		return err
+	}
+
+	if len(b.Messages) == 0 || len(b.Messages) > txMaxBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("tx.invalidBatchSize", "max", strconv.Itoa(txMaxBatchSize)))
+	}
+
+	opt, err := validateTxOptions(b.TxMessage, app)
+	if err != nil {
+		return err
+	}
+
+	tpl, err := getTxTemplate(opt.TemplateID, app)
+	if err != nil {
+		return err
+	}
+
+	// Attachments are shared by all the messages in the batch.
+	files, err := makeTxAttachments(opt.Attachments, app)
+	if err != nil {
+		return err
+	}
+
+	var (
+		out  = make([]txBatchResult, len(b.Messages))
+		jobs = make(chan int)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < txBatchConcurrency && i < len(b.Messages); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				out[n] = sendTxBatchMessage(n, b.Messages[n], opt, tpl, files, app)
+			}
+		}()
+	}
+	for n := range b.Messages {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// sendTxBatchMessage sends a single message in a transactional batch.
+func sendTxBatchMessage(n int, bm models.TxBatchMessage, opt models.TxMessage,
+	tpl *models.Template, files []messenger.Attachment, app *App) txBatchResult {
+	res := txBatchResult{Index: n, SubscriberEmail: bm.SubscriberEmail, SubscriberID: bm.SubscriberID}
+
+	m := opt
+	m.SubscriberEmail = bm.SubscriberEmail
+	m.SubscriberID = bm.SubscriberID
+	m.Data = bm.Data
+
+	// Merge the recipient's headers into the batch's.
+	if len(bm.Headers) > 0 {
+		m.Headers = make(map[string]string, len(opt.Headers)+len(bm.Headers))
+		for k, v := range opt.Headers {
+			m.Headers[k] = v
+		}
+		for k, v := range bm.Headers {
+			m.Headers[k] = v
+		}
+	}
+
+	err := validateTxRecipient(m, app)
+	if err == nil {
+		res.MessageID, err = dispatchTxMessage(m, tpl, files, app)
+	}
+	if err != nil {
+		if e, ok := err.(*echo.HTTPError); ok {
+			res.Error = fmt.Sprintf("%s", e.Message)
+		} else {
+			res.Error = err.Error()
+		}
+		return res
+	}
+
+	res.OK = true
+	return res
+}
+
+// dispatchTxMessage sends a validated transactional message right away, or
+// schedules it if it has a send_at time in the future. It returns the
+// unique ID assigned to the message.
+func dispatchTxMessage(m models.TxMessage, tpl *models.Template, files []messenger.Attachment, app *App) (string, error) {
+	if m.SendAt.Valid && m.SendAt.Time.After(time.Now()) {
+		return scheduleTxMessage(m, tpl, app)
+	}
+	return sendTxMessage(m, tpl, files, app)
+}
+
+// scheduleTxMessage stores a transactional message in the DB to be sent
+// at its send_at time. The subscriber and the template are checked
+// beforehand so that the errors are reported right away.
+func scheduleTxMessage(m models.TxMessage, tpl *models.Template, app *App) (string, error) {
+	sub, err := getSubscriber(m.SubscriberID, "", m.SubscriberEmail, app)
+	if err != nil {
+		return "", err
+	}
+
+	test := m
+	if err := test.Render(sub, tpl); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return "", echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if _, err := app.queries.InsertTxScheduled.Exec(uu.String(), string(b), m.SendAt); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{tx.message}", "error", pqErrMsg(err)))
+	}
+
+	return uu.String(), nil
+}
+
+// handleGetTxScheduled handles retrieval of the scheduled transactional messages.
+func handleGetTxScheduled(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams(), 50)
+		out txScheduledWrap
+	)
+
+	if err := app.queries.QueryTxScheduled.Select(&out.Results, pg.Offset, pg.Limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{tx.message}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.TxScheduled{}
+	} else {
+		out.Total = out.Results[0].Total
+	}
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteTxScheduled handles the cancellation of a scheduled
+// transactional message by its message ID.
+func handleDeleteTxScheduled(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		msgID = c.Param("id")
+	)
+
+	if !reUUID.MatchString(msgID) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidUUID"))
+	}
+
+	res, err := app.queries.DeleteTxScheduled.Exec(msgID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{tx.message}", "error", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{tx.message}"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// sendScheduledTx periodically sends the scheduled transactional messages
+// that are due. A message is removed from the schedule once it's handed
+// over to the manager or it fails.
+func sendScheduledTx(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var msgs []models.TxScheduled
+		if err := app.queries.GetDueTxScheduled.Select(&msgs, app.constants.DBBatchSize); err != nil {
+			app.log.Printf("error fetching scheduled tx messages: %v", err)
+			continue
+		}
+
+		tpls := make(map[int]*models.Template)
+		for _, s := range msgs {
+			var m models.TxMessage
+			if err := s.Message.Unmarshal(&m); err != nil {
+				app.log.Printf("error reading scheduled tx message %s: %v", s.MessageID, err)
+			} else {
+				m.MessageID = s.MessageID
+				if err := sendScheduledTxMessage(m, tpls, app); err != nil {
+					app.log.Printf("error sending scheduled tx message %s: %v", s.MessageID, err)
+					onTxMessageDone(m, m.TemplateID,
+						models.Subscriber{Base: models.Base{ID: m.SubscriberID}, Email: m.SubscriberEmail},
+						m.Messenger, err, app)
+				}
+			}
+
+			if _, err := app.queries.DeleteTxScheduled.Exec(s.MessageID); err != nil {
+				app.log.Printf("error deleting scheduled tx message %s: %v", s.MessageID, err)
+			}
+		}
+	}
+}
+
+// sendScheduledTxMessage sends a scheduled transactional message. Compiled
+// templates are cached in tpls.
+func sendScheduledTxMessage(m models.TxMessage, tpls map[int]*models.Template, app *App) error {
+	tpl, ok := tpls[m.TemplateID]
+	if !ok {
+		t, err := getTxTemplate(m.TemplateID, app)
+		if err != nil {
+			return err
+		}
+		tpl = t
+		tpls[m.TemplateID] = t
+	}
+
+	files, err := makeTxAttachments(m.Attachments, app)
+	if err != nil {
+		return err
+	}
+
+	_, err = sendTxMessage(m, tpl, files, app)
+	return err
+}
+
+// sendTxMessage renders a validated transactional message for its
+// subscriber and pushes it to the manager. It returns the unique ID
+// assigned to the message.
+func sendTxMessage(m models.TxMessage, tpl *models.Template, files []messenger.Attachment, app *App) (string, error) {
+	sub, err := getSubscriber(m.SubscriberID, "", m.SubscriberEmail, app)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.Render(sub, tpl); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+	}
+
+	// Scheduled messages already have an ID.
+	if m.MessageID == "" {
+		uu, err := uuid.NewV4()
+		if err != nil {
+			app.log.Printf("error generating UUID: %v", err)
+			return "", echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+		}
+		m.MessageID = uu.String()
+	}
+
+	// Record the status URL to post the message's bounces and complaints to.
+	if m.StatusURL != "" {
+		if _, err := app.queries.InsertTxCallback.Exec(m.MessageID, sub.ID, sub.Email, m.StatusURL); err != nil {
+			return "", echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorCreating",
+					"name", "{tx.statusCallback}", "error", pqErrMsg(err)))
+		}
+	}
+
+	msg := makeTxMessage(m, sub, files)
+	msg.Done = func(msgr string, err error) {
+		onTxMessageDone(m, tpl.ID, sub, msgr, err, app)
+	}
+
+	if err := app.manager.PushMessage(msg); err != nil {
+		onTxMessageDone(m, tpl.ID, sub, m.Messenger, err, app)
+		return "", echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return m.MessageID, nil
+}
+
+// onTxMessageDone logs the result of a transactional message send and
+// posts it to the message's status URL.
+func onTxMessageDone(m models.TxMessage, tplID int, sub models.Subscriber, msgr string, err error, app *App) {
+	if app.constants.TxLogEnabled {
+		logTxMessage(m, tplID, sub, msgr, err, app)
+	}
+
+	ev := txEvent{MessageID: m.MessageID, SubscriberID: sub.ID, Email: sub.Email}
+	if err != nil {
+		ev.Reason = err.Error()
+		app.events.Publish(events.TypeTxFailed, ev)
+	} else {
+		app.events.Publish(events.TypeTxSent, ev)
+	}
+
+	if m.StatusURL != "" {
+		status, reason := models.TxStatusSent, ""
+		if err != nil {
+			status, reason = models.TxStatusFailed, err.Error()
+		}
+		go postTxStatus(m.StatusURL, m.MessageID, sub.ID, sub.Email, status, reason, app)
+	}
+}
+
+// handleTxStatusEvent handles a delivery status event (bounce or complaint)
+// of a transactional message that's referenced by its ID, for instance, by
+// an external bounce processor. The status is recorded in the message log
+// and posted to the message's status URL.
+func handleTxStatusEvent(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req struct {
+			MessageID string `json:"message_id"`
+			Status    string `json:"status"`
+			Reason    string `json:"reason"`
+		}
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if !reUUID.MatchString(req.MessageID) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidUUID"))
+	}
+
+	// Run the hooks, which may change the status and the reason, before
+	// the event is recorded.
+	d := bounceHookData{MessageID: req.MessageID, Status: req.Status, Reason: req.Reason}
+	if err := app.hooks.Run(hooks.EventBounce, &d); err != nil {
+		return hookHTTPError(err, http.StatusUnprocessableEntity, app)
+	}
+	req.Status, req.Reason = d.Status, d.Reason
+
+	if req.Status != models.TxStatusBounced && req.Status != models.TxStatusComplained {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("tx.invalidEventStatus"))
+	}
+
+	res, err := app.queries.UpdateTxLogStatus.Exec(req.MessageID, req.Status, req.Reason)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{tx.log}", "error", pqErrMsg(err)))
+	}
+	logged, _ := res.RowsAffected()
+
+	var cbs []models.TxCallback
+	if err := app.queries.GetTxCallback.Select(&cbs, req.MessageID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{tx.statusCallback}", "error", pqErrMsg(err)))
+	}
+
+	if logged == 0 && len(cbs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{tx.message}"))
+	}
+
+	for _, cb := range cbs {
+		go postTxStatus(cb.URL, cb.MessageID, int(cb.SubscriberID.Int), cb.Email, req.Status, req.Reason, app)
+	}
+
+	app.metrics.countTxStatus(req.Status)
+
+	ev := txEvent{MessageID: req.MessageID, Reason: req.Reason}
+	if len(cbs) > 0 {
+		ev.SubscriberID, ev.Email = int(cbs[0].SubscriberID.Int), cbs[0].Email
+	}
+	app.events.Publish("tx."+req.Status, ev)
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// postTxStatus posts a status event of a transactional message to its
+// status URL. It's meant to be run in a goroutine so that slow endpoints
+// don't hold up sending.
+func postTxStatus(u, msgID string, subID int, email, status, reason string, app *App) {
+	ev := txStatusEvent{MessageID: msgID, Status: status, Reason: reason, Timestamp: time.Now()}
+	ev.Subscriber.ID = subID
+	ev.Subscriber.Email = email
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		app.log.Printf("error marshalling tx status event: %v", err)
+		return
+	}
+
+	if err := postWebhook(txStatusClient, u, b); err != nil {
+		app.log.Printf("error posting tx status to %s: %v", u, err)
+	}
+}
+
+// handleGetTxLog handles querying of the transactional message log.
+func handleGetTxLog(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams(), 50)
+		out txLogWrap
+	)
+
+	q, err := getTxLogQuery(c, app)
+	if err != nil {
+		return err
+	}
+
+	if err := app.queries.QueryTxLog.Select(&out.Results, q.Query, q.Status, q.TemplateID,
+		q.SubscriberID, q.From, q.To, 0, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching tx log: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{tx.log}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.TxLog{}
+	} else {
+		out.Total = out.Results[0].Total
+	}
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleExportTxLog handles the export of the transactional message log
+// as a CSV file. It takes the same filters as handleGetTxLog.
+func handleExportTxLog(c echo.Context) error {
+	var app = c.Get("app").(*App)
+
+	q, err := getTxLogQuery(c, app)
+	if err != nil {
+		return err
+	}
+
+	var (
+		h  = c.Response().Header()
+		wr = csv.NewWriter(c.Response())
+	)
+
+	h.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	h.Set("Content-type", "text/csv")
+	h.Set(echo.HeaderContentDisposition, "attachment; filename="+"tx-log.csv")
+	h.Set("Content-Transfer-Encoding", "binary")
+	h.Set("Cache-Control", "no-cache")
+	wr.Write([]string{"id", "message_id", "email", "subscriber_id", "template_id", "template_name",
+		"subject", "messenger", "status", "error", "created_at"})
+
+	// Page through the entries with the ID cursor until they're exhausted.
+	var lastID int64
+loop:
+	for {
+		var out []models.TxLog
+		if err := app.queries.QueryTxLog.Select(&out, q.Query, q.Status, q.TemplateID,
+			q.SubscriberID, q.From, q.To, lastID, 0, app.constants.DBBatchSize); err != nil {
+			app.log.Printf("error fetching tx log: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{tx.log}", "error", pqErrMsg(err)))
+		}
+		if len(out) == 0 {
+			break loop
+		}
+
+		for _, r := range out {
+			if err := wr.Write([]string{strconv.FormatInt(r.ID, 10), r.MessageID.String, r.Email,
+				nullIntStr(r.SubscriberID.Int, r.SubscriberID.Valid),
+				nullIntStr(r.TemplateID.Int, r.TemplateID.Valid),
+				r.TemplateName, r.Subject, r.Messenger, r.Status, r.Error,
+				r.CreatedAt.Time.String()}); err != nil {
+				app.log.Printf("error streaming CSV export: %v", err)
+				break loop
+			}
+		}
+		wr.Flush()
+
+		lastID = out[len(out)-1].ID
+	}
+
+	return nil
+}
+
+// validateTxMessage validates a transactional message and fills in the
+// defaults for the optional fields.
+func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
+	if err := validateTxRecipient(m, app); err != nil {
+		return m, err
+	}
+	return validateTxOptions(m, app)
+}
+
+// validateTxRecipient validates the recipient of a transactional message.
+func validateTxRecipient(m models.TxMessage, app *App) error {
+	if m.SubscriberID < 1 && m.SubscriberEmail == "" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.subscriber}"))
+	}
+	if m.SubscriberEmail != "" && !subimporter.IsEmail(m.SubscriberEmail) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidEmail"))
+	}
+	return nil
+}
+
+// validateTxOptions validates the template and the options of a
+// transactional message and fills in the defaults for the optional fields.
+func validateTxOptions(m models.TxMessage, app *App) (models.TxMessage, error) {
+	if m.TemplateID < 1 {
+		return m, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if m.FromEmail == "" {
+		m.FromEmail = app.constants.FromEmail
+	} else if !isFromAddress(m.FromEmail) {
+		return m, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidFromEmail"))
+	}
+
+	if m.Messenger == "" {
+		m.Messenger = emailMsgr
+	} else if !app.manager.HasMessenger(m.Messenger) {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", m.Messenger))
+	}
+
+	switch m.ContentType {
+	case "":
+		m.ContentType = models.CampaignContentTypeHTML
+	case models.CampaignContentTypeHTML, models.CampaignContentTypePlain:
+	default:
+		return m, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("tx.invalidContentType"))
+	}
+
+	if m.StatusURL != "" {
+		if err := safehttp.CheckURL(m.StatusURL); err != nil {
+			return m, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("tx.invalidStatusURL"))
+		}
+	}
+
+	if len(m.Attachments) > txMaxAttachments {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("tx.tooManyAttachments", "max", strconv.Itoa(txMaxAttachments)))
+	}
+
+	return m, nil
+}
+
+// getTxTemplate fetches a transactional template and compiles it.
+func getTxTemplate(id int, app *App) (*models.Template, error) {
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, id, false, models.TemplateTypeTx); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.template}", "error", pqErrMsg(err)))
+	}
+	if len(tpls) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+	}
+
+	tpl := tpls[0]
+	if err := tpl.Compile(app.manager.TxTemplateFuncs()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+	}
+
+	return &tpl, nil
+}
+
+// makeTxAttachments decodes the base64 attachments of a transactional
+// message and fetches the ones that reference media files. The total size
+// of the attachments is limited by the max. attachment size setting.
+func makeTxAttachments(atts []models.TxAttachment, app *App) ([]messenger.Attachment, error) {
+	if len(atts) == 0 {
+		return nil, nil
+	}
+
+	// Fetch the referenced media files.
+	var uuids []string
+	for _, a := range atts {
+		if a.MediaUUID != "" {
+			if !reUUID.MatchString(a.MediaUUID) {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidUUID"))
+			}
+			uuids = append(uuids, a.MediaUUID)
+		}
+	}
+	files := make(map[string]string, len(uuids))
+	if len(uuids) > 0 {
+		var media []struct {
+			UUID     string `db:"uuid"`
+			Filename string `db:"filename"`
+		}
+		if err := app.queries.GetMediaByUUIDs.Select(&media, pq.StringArray(uuids)); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.media}", "error", pqErrMsg(err)))
+		}
+		for _, m := range media {
+			files[m.UUID] = m.Filename
+		}
+	}
+
+	var (
+		out   = make([]messenger.Attachment, 0, len(atts))
+		max   = app.constants.TxMaxAttachmentSize * 1024 * 1024
+		total = 0
+	)
+	for _, a := range atts {
+		var (
+			name = filepath.Base(a.Name)
+			b    []byte
+		)
+		if a.MediaUUID != "" {
+			fName, ok := files[a.MediaUUID]
+			if !ok {
+				return nil, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.media}"))
+			}
+
+			blob, err := app.media.GetBlob(fName)
+			if err != nil {
+				app.log.Printf("error reading media file %s: %v", fName, err)
+				return nil, echo.NewHTTPError(http.StatusInternalServerError,
+					app.i18n.Ts("media.errorReadingFile", "error", err.Error()))
+			}
+			b = blob
+			if a.Name == "" {
+				name = fName
+			}
+		} else {
+			blob, err := base64.StdEncoding.DecodeString(a.Content)
+			if err != nil || a.Name == "" {
+				return nil, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("tx.invalidAttachment", "name", a.Name))
+			}
+			b = blob
+		}
+
+		total += len(b)
+		if total > max {
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				app.i18n.Ts("tx.attachmentsTooLarge", "max", strconv.Itoa(app.constants.TxMaxAttachmentSize)))
+		}
+
+		out = append(out, messenger.Attachment{
+			Name:    name,
+			Header:  makeAttachmentHeader(name),
+			Content: b,
+		})
+	}
+
+	return out, nil
+}
+
+// makeAttachmentHeader returns the MIME header of a file attachment with
+// the content type guessed from its extension.
+func makeAttachmentHeader(name string) textproto.MIMEHeader {
+	typ := mime.TypeByExtension(filepath.Ext(name))
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+
+	h := messenger.MakeAttachmentHeader(name, "base64")
+	h.Set("Content-Type", typ+"; name=\""+name+"\"")
+	return h
+}
+
+// getTxLogQuery reads and validates the transactional message log filters
+// from the query params. Dates can be either YYYY-MM-DD or RFC3339 timestamps.
+func getTxLogQuery(c echo.Context, app *App) (txLogQuery, error) {
+	var (
+		q = txLogQuery{
+			Query:  strings.TrimSpace(c.QueryParam("query")),
+			Status: c.QueryParam("status"),
+		}
+		err error
+	)
+	if q.Query != "" {
+		q.Query = "%" + q.Query + "%"
+	}
+	q.TemplateID, _ = strconv.Atoi(c.QueryParam("template_id"))
+	q.SubscriberID, _ = strconv.Atoi(c.QueryParam("subscriber_id"))
+
+	switch q.Status {
+	case "", models.TxStatusSent, models.TxStatusFailed, models.TxStatusBounced, models.TxStatusComplained:
+	default:
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("tx.invalidStatus"))
+	}
+
+	if q.From, err = parseDateFilter(c.QueryParam("from")); err != nil {
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+	if q.To, err = parseDateFilter(c.QueryParam("to")); err != nil {
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	return q, nil
+}
+
+// parseDateFilter parses an optional date filter. It returns nil if the
+// date is empty so that the filter is ignored by the query.
+func parseDateFilter(s string) (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// nullIntStr returns the string form of a nullable int.
+func nullIntStr(n int, valid bool) string {
+	if !valid {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// logTxMessage records the result of a transactional message send in the log.
+func logTxMessage(m models.TxMessage, tplID int, sub models.Subscriber, msgr string, sendErr error, app *App) {
+	var (
+		status = models.TxStatusSent
+		errMsg = ""
+	)
+	if sendErr != nil {
+		status = models.TxStatusFailed
+		errMsg = sendErr.Error()
+	}
+
+	if _, err := app.queries.InsertTxLog.Exec(sub.ID, tplID, sub.Email, m.Subject,
+		msgr, status, errMsg, m.MessageID); err != nil {
+		app.log.Printf("error logging tx message: %v", err)
+	}
+}
+
+// pruneTxLog periodically deletes the transactional message log entries
+// that are older than the retention period.
+func pruneTxLog(days int, interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		res, err := app.queries.DeleteTxLog.Exec(days)
+		if err != nil {
+			app.log.Printf("error pruning tx log: %v", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			app.log.Printf("pruned %d tx log entries older than %d days", n, days)
+		}
+	}
+}
+
+// pruneTxCallbacks periodically deletes the status callbacks of
+// transactional messages that are older than the retention period.
+func pruneTxCallbacks(days int, interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := app.queries.DeleteTxCallbacks.Exec(days); err != nil {
+			app.log.Printf("error pruning tx callbacks: %v", err)
+		}
+	}
+}
+
+// makeTxMessage returns the manager message for a rendered transactional message.
+func makeTxMessage(m models.TxMessage, sub models.Subscriber, files []messenger.Attachment) manager.Message {
+	msg := manager.Message{}
+	msg.From = m.FromEmail
+	msg.To = []string{sub.Email}
+	msg.Subject = m.Subject
+	msg.ContentType = m.ContentType
+	msg.Body = m.Body
+	msg.Attachments = files
+	msg.Subscriber = sub
+	msg.Messenger = m.Messenger
+
+	msg.Headers = make(textproto.MIMEHeader, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		msg.Headers.Set(strings.TrimSpace(k), v)
+	}
+	msg.Headers.Set(txMessageIDHeader, m.MessageID)
+
+	return msg
+}
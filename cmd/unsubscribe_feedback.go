@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+const (
+	tplUnsubSurvey = "unsubscribe-survey"
+
+	// Reason that's stored when a subscriber picks "Other" on the survey
+	// with a comment instead of one of the configured reasons.
+	unsubReasonOther = "other"
+
+	unsubCommentMaxLen = 1000
+)
+
+// unsubSurveyTpl is the data that's passed to the unsubscribe survey template.
+type unsubSurveyTpl struct {
+	publicTpl
+	CampUUID string
+	SubUUID  string
+	Reasons  []string
+}
+
+type unsubFeedbackWrap struct {
+	Results []models.UnsubscribeFeedback `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// unsubFeedbackSummary is the number of survey responses with a reason.
+type unsubFeedbackSummary struct {
+	Reason string `db:"reason" json:"reason"`
+	Count  int    `db:"count" json:"count"`
+}
+
+// unsubFeedbackQuery is the set of filters of survey response queries.
+type unsubFeedbackQuery struct {
+	CampaignID int
+	From       interface{}
+	To         interface{}
+}
+
+// renderUnsubSurvey renders the optional reason survey that's shown to
+// subscribers after they unsubscribe from a campaign.
+func renderUnsubSurvey(c echo.Context, campUUID, subUUID string, app *App) error {
+	L := publicLang(c, app)
+
+	out := unsubSurveyTpl{
+		CampUUID: campUUID,
+		SubUUID:  subUUID,
+		Reasons:  app.constants.Privacy.UnsubReasons,
+	}
+	out.Title = L.T("public.unsubbedTitle")
+
+	return c.Render(http.StatusOK, tplUnsubSurvey, out)
+}
+
+// handleUnsubscribeSurvey records the reason a subscriber gave on the
+// unsubscribe survey against the campaign they unsubscribed from.
+func handleUnsubscribeSurvey(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		L        = publicLang(c, app)
+		campUUID = c.Param("campUUID")
+		subUUID  = c.Param("subUUID")
+		reason   = strings.TrimSpace(c.FormValue("reason"))
+		comment  = strings.TrimSpace(c.FormValue("comment"))
+	)
+	setCampaignPageTemplate(c, campUUID, app)
+
+	if !app.constants.Privacy.UnsubSurvey {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.invalidFeature")))
+	}
+
+	// The reason should be one of the configured reasons or "other", in
+	// which case, the comment is the reason.
+	if reason != unsubReasonOther && !inArray(reason, app.constants.Privacy.UnsubReasons) {
+		return c.Render(http.StatusBadRequest, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.T("public.unsubSurveyInvalidReason")))
+	}
+	if reason == unsubReasonOther && comment == "" {
+		return c.Render(http.StatusBadRequest, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.T("public.unsubSurveyInvalidReason")))
+	}
+	if r := []rune(comment); len(r) > unsubCommentMaxLen {
+		comment = string(r[:unsubCommentMaxLen])
+	}
+
+	if _, err := app.queries.InsertUnsubscribeFeedback.Exec(campUUID, subUUID, reason, comment); err != nil {
+		app.log.Printf("error recording unsubscribe feedback: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(L.T("public.errorTitle"), "",
+				L.Ts("public.errorProcessingRequest")))
+	}
+
+	return c.Render(http.StatusOK, tplMessage,
+		makeMsgTpl(L.T("public.unsubbedTitle"), "",
+			L.T("public.unsubSurveyThanks")))
+}
+
+// handleGetUnsubscribeFeedback returns the unsubscribe survey responses,
+// newest first, optionally of a campaign (?campaign_id=).
+func handleGetUnsubscribeFeedback(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams(), 50)
+		out unsubFeedbackWrap
+	)
+
+	q, err := getUnsubFeedbackQuery(c, app)
+	if err != nil {
+		return err
+	}
+
+	if err := app.queries.QueryUnsubscribeFeedback.Select(&out.Results,
+		q.CampaignID, q.From, q.To, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching unsubscribe feedback: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.unsubscribeFeedback}", "error", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.UnsubscribeFeedback{}
+	} else {
+		out.Total = out.Results[0].Total
+	}
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetUnsubscribeFeedbackSummary returns the number of unsubscribe
+// survey responses by reason, optionally of a campaign (?campaign_id=).
+func handleGetUnsubscribeFeedbackSummary(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []unsubFeedbackSummary
+	)
+
+	q, err := getUnsubFeedbackQuery(c, app)
+	if err != nil {
+		return err
+	}
+
+	if err := app.queries.GetUnsubscribeFeedbackSummary.Select(&out, q.CampaignID, q.From, q.To); err != nil {
+		app.log.Printf("error fetching unsubscribe feedback summary: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.unsubscribeFeedback}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// getUnsubFeedbackQuery returns the survey response filters from a request's params.
+func getUnsubFeedbackQuery(c echo.Context, app *App) (unsubFeedbackQuery, error) {
+	var (
+		q   unsubFeedbackQuery
+		err error
+	)
+
+	if s := c.QueryParam("campaign_id"); s != "" {
+		if q.CampaignID, err = strconv.Atoi(s); err != nil || q.CampaignID < 1 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+		}
+	}
+	if q.From, err = parseDateFilter(c.QueryParam("from")); err != nil {
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+	if q.To, err = parseDateFilter(c.QueryParam("to")); err != nil {
+		return q, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidDate"))
+	}
+
+	return q, nil
+}
@@ -129,3 +129,15 @@ func strSliceContains(str string, sl []string) bool {
 
 	return false
 }
+
+// uniqueStrings returns the unique strings of a slice in their order.
+func uniqueStrings(sl []string) []string {
+	out := make([]string, 0, len(sl))
+	for _, s := range sl {
+		if !strSliceContains(s, out) {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const listWebhookTimeout = time.Second * 10
+
+var listWebhookClient = &http.Client{Timeout: listWebhookTimeout}
+
+// listWebhookEvent is the payload that's posted as JSON to list webhooks.
+type listWebhookEvent struct {
+	Event      string                `json:"event"`
+	List       listWebhookList       `json:"list"`
+	Subscriber listWebhookSubscriber `json:"subscriber"`
+	Timestamp  time.Time             `json:"timestamp"`
+}
+
+type listWebhookList struct {
+	ID   int    `json:"id"`
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+type listWebhookSubscriber struct {
+	ID      int                      `json:"id"`
+	UUID    string                   `json:"uuid"`
+	Email   string                   `json:"email"`
+	Name    string                   `json:"name"`
+	Attribs models.SubscriberAttribs `json:"attribs"`
+	Status  string                   `json:"status"`
+}
+
+// handleGetListWebhooks handles retrieval of the webhooks of a list.
+func handleGetListWebhooks(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		out    []models.ListWebhook
+		id, _  = strconv.Atoi(c.Param("id"))
+		hID, _ = strconv.Atoi(c.Param("webhookID"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.queries.GetListWebhooks.Select(&out, id, hID); err != nil {
+		app.log.Printf("error fetching webhooks: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.webhooks}", "error", pqErrMsg(err)))
+	}
+	if hID > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.webhook}"))
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateListWebhook handles webhook creation on a list.
+func handleCreateListWebhook(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		o     models.ListWebhook
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validateListWebhook(o, app); err != nil {
+		return err
+	}
+
+	var newID int
+	if err := app.queries.CreateListWebhook.Get(&newID, id, o.URL, o.Events, o.Enabled); err != nil {
+		app.log.Printf("error creating webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	return handleGetListWebhooks(copyEchoCtx(c, map[string]string{
+		"id":        fmt.Sprintf("%d", id),
+		"webhookID": fmt.Sprintf("%d", newID),
+	}))
+}
+
+// handleUpdateListWebhook handles modification of a list's webhook.
+func handleUpdateListWebhook(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		id, _  = strconv.Atoi(c.Param("id"))
+		hID, _ = strconv.Atoi(c.Param("webhookID"))
+	)
+
+	if id < 1 || hID < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o models.ListWebhook
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validateListWebhook(o, app); err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateListWebhook.Exec(hID, id, o.URL, o.Events, o.Enabled)
+	if err != nil {
+		app.log.Printf("error updating webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.webhook}"))
+	}
+
+	return handleGetListWebhooks(c)
+}
+
+// handleDeleteListWebhook handles deletion of a list's webhook.
+func handleDeleteListWebhook(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		id, _  = strconv.Atoi(c.Param("id"))
+		hID, _ = strconv.Atoi(c.Param("webhookID"))
+	)
+
+	if id < 1 || hID < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeleteListWebhook.Exec(hID, id); err != nil {
+		app.log.Printf("error deleting webhook: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.webhook}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateListWebhook validates the URL and events of a list webhook.
+func validateListWebhook(o models.ListWebhook, app *App) error {
+	u, err := url.Parse(o.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidWebhookURL"))
+	}
+
+	if len(o.Events) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidWebhookEvents"))
+	}
+	for _, e := range o.Events {
+		if e != models.ListWebhookEventSubscribe && e != models.ListWebhookEventUnsubscribe {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidWebhookEvents"))
+		}
+	}
+
+	return nil
+}
+
+// fireListWebhooks posts an event for each of the given subscribers to the
+// enabled webhooks of the given lists that are registered for the event.
+// It's meant to be run in a goroutine so that slow endpoints don't hold up
+// the request that triggered the event.
+func fireListWebhooks(event string, subIDs, listIDs []int64, app *App) {
+	if len(subIDs) == 0 || len(listIDs) == 0 {
+		return
+	}
+
+	app.events.Publish("subscription."+event, subscriptionEvent{SubscriberIDs: subIDs, ListIDs: listIDs})
+
+	var hooks []models.ListWebhook
+	if err := app.queries.GetEventListWebhooks.Select(&hooks, pq.Int64Array(listIDs), event); err != nil {
+		app.log.Printf("error fetching list webhooks: %v", err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	var subs models.Subscribers
+	if err := app.queries.GetSubscribersByIDs.Select(&subs, pq.Int64Array(subIDs)); err != nil {
+		app.log.Printf("error fetching subscribers for list webhooks: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, h := range hooks {
+		for _, s := range subs {
+			b, err := json.Marshal(listWebhookEvent{
+				Event: event,
+				List:  listWebhookList{ID: h.ListID, UUID: h.ListUUID, Name: h.ListName},
+				Subscriber: listWebhookSubscriber{
+					ID:      s.ID,
+					UUID:    s.UUID,
+					Email:   s.Email,
+					Name:    s.Name,
+					Attribs: s.Attribs,
+					Status:  s.Status,
+				},
+				Timestamp: now,
+			})
+			if err != nil {
+				app.log.Printf("error marshalling list webhook event: %v", err)
+				continue
+			}
+
+			if err := postWebhook(listWebhookClient, h.URL, b); err != nil {
+				app.log.Printf("error posting to list webhook %d (%s): %v", h.ID, h.URL, err)
+			}
+		}
+	}
+}
+
+// postWebhook posts a JSON payload to a webhook URL.
+func postWebhook(c *http.Client, u string, b []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return fmt.Errorf("non-OK response from webhook: %d", r.StatusCode)
+	}
+	return nil
+}
+
+// getSubscriberListIDs returns the IDs of the lists in a subscriber's
+// lazy loaded lists.
+func getSubscriberListIDs(sub models.Subscriber) []int64 {
+	var lists []struct {
+		ID int64 `json:"id"`
+	}
+	if err := sub.Lists.Unmarshal(&lists); err != nil {
+		return nil
+	}
+
+	out := make([]int64, 0, len(lists))
+	for _, l := range lists {
+		out = append(out, l.ID)
+	}
+	return out
+}
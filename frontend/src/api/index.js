@@ -90,6 +90,12 @@ export const getDashboardCounts = () => http.get('/api/dashboard/counts',
 export const getDashboardCharts = () => http.get('/api/dashboard/charts',
   { loading: models.dashboard });
 
+export const getDashboardSMTPHealth = () => http.get('/api/dashboard/smtp-health',
+  { loading: models.dashboard });
+
+export const getDashboardGeo = () => http.get('/api/dashboard/geo',
+  { loading: models.dashboard });
+
 // Lists.
 export const getLists = (params) => http.get('/api/lists',
   {
@@ -107,6 +113,64 @@ export const updateList = (data) => http.put(`/api/lists/${data.id}`, data,
 export const deleteList = (id) => http.delete(`/api/lists/${id}`,
   { loading: models.lists });
 
+// List folders.
+export const getListFolders = () => http.get('/api/list-folders',
+  { loading: models.lists });
+
+export const createListFolder = (data) => http.post('/api/list-folders', data,
+  { loading: models.lists });
+
+export const updateListFolder = (data) => http.put(`/api/list-folders/${data.id}`, data,
+  { loading: models.lists });
+
+export const deleteListFolder = (id) => http.delete(`/api/list-folders/${id}`,
+  { loading: models.lists });
+
+// List webhooks.
+export const getListWebhooks = (listID) => http.get(`/api/lists/${listID}/webhooks`,
+  { loading: models.lists });
+
+export const createListWebhook = (listID, data) => http.post(`/api/lists/${listID}/webhooks`, data,
+  { loading: models.lists });
+
+export const updateListWebhook = (listID, data) => http.put(`/api/lists/${listID}/webhooks/${data.id}`,
+  data, { loading: models.lists });
+
+export const deleteListWebhook = (listID, id) => http.delete(`/api/lists/${listID}/webhooks/${id}`,
+  { loading: models.lists });
+
+// Subscription forms.
+export const getSubForms = () => http.get('/api/forms',
+  { loading: models.lists });
+
+export const getSubFormHTML = (id) => http.get(`/api/forms/${id}/html`,
+  { loading: models.lists });
+
+export const createSubForm = (data) => http.post('/api/forms', data,
+  { loading: models.lists });
+
+export const updateSubForm = (data) => http.put(`/api/forms/${data.id}`, data,
+  { loading: models.lists });
+
+export const deleteSubForm = (id) => http.delete(`/api/forms/${id}`,
+  { loading: models.lists });
+
+// Public page template sets.
+export const getPageTemplates = () => http.get('/api/page-templates',
+  { loading: models.lists });
+
+export const getPageTemplate = (id) => http.get(`/api/page-templates/${id}`,
+  { loading: models.lists });
+
+export const createPageTemplate = (data) => http.post('/api/page-templates', data,
+  { loading: models.lists });
+
+export const updatePageTemplate = (data) => http.put(`/api/page-templates/${data.id}`, data,
+  { loading: models.lists });
+
+export const deletePageTemplate = (id) => http.delete(`/api/page-templates/${id}`,
+  { loading: models.lists });
+
 // Subscribers.
 export const getSubscribers = async (params) => http.get('/api/subscribers',
   { params, loading: models.subscribers, store: models.subscribers });
@@ -172,19 +236,45 @@ export const updateCampaign = async (id, data) => http.put(`/api/campaigns/${id}
 export const changeCampaignStatus = async (id, status) => http.put(`/api/campaigns/${id}/status`,
   { status }, { loading: models.campaigns });
 
+export const updateCampaignArchive = async (id, archive) => http.put(`/api/campaigns/${id}/archive`,
+  { archive }, { loading: models.campaigns });
+
 export const deleteCampaign = async (id) => http.delete(`/api/campaigns/${id}`,
   { loading: models.campaigns });
 
 // Media.
-export const getMedia = async () => http.get('/api/media',
-  { loading: models.media, store: models.media });
+export const getMedia = async (params) => http.get('/api/media',
+  { params, loading: models.media, store: models.media });
 
 export const uploadMedia = (data) => http.post('/api/media', data,
   { loading: models.media });
 
+export const updateMedia = (id, data) => http.put(`/api/media/${id}`, data,
+  { loading: models.media });
+
 export const deleteMedia = (id) => http.delete(`/api/media/${id}`,
   { loading: models.media });
 
+export const getMediaTags = () => http.get('/api/media/tags');
+
+export const getOrphanMedia = () => http.get('/api/media/orphans',
+  { loading: models.media });
+
+export const deleteOrphanMedia = (id) => http.delete('/api/media/orphans',
+  { params: { id }, loading: models.media });
+
+export const getMediaFolders = () => http.get('/api/media-folders',
+  { loading: models.media });
+
+export const createMediaFolder = (data) => http.post('/api/media-folders', data,
+  { loading: models.media });
+
+export const updateMediaFolder = (data) => http.put(`/api/media-folders/${data.id}`, data,
+  { loading: models.media });
+
+export const deleteMediaFolder = (id) => http.delete(`/api/media-folders/${id}`,
+  { loading: models.media });
+
 // Templates.
 export const createTemplate = async (data) => http.post('/api/templates', data,
   { loading: models.templates });
@@ -192,15 +282,35 @@ export const createTemplate = async (data) => http.post('/api/templates', data,
 export const getTemplates = async () => http.get('/api/templates',
   { loading: models.templates, store: models.templates });
 
+// The keys in the sample data of transactional templates are user defined,
+// so the template is fetched as-is.
+export const getTemplate = async (id) => http.get(`/api/templates/${id}`,
+  { loading: models.templates, preserveCase: true });
+
 export const updateTemplate = async (data) => http.put(`/api/templates/${data.id}`, data,
   { loading: models.templates });
 
+export const validateTemplate = async (data) => http.post('/api/templates/validate', data,
+  { loading: models.templates });
+
 export const makeTemplateDefault = async (id) => http.put(`/api/templates/${id}/default`, {},
   { loading: models.templates });
 
 export const deleteTemplate = async (id) => http.delete(`/api/templates/${id}`,
   { loading: models.templates });
 
+export const getTemplateVersions = async (id) => http.get(`/api/templates/${id}/versions`,
+  { params: { no_body: true }, loading: models.templates });
+
+export const getTemplateVersion = async (id, version) => http.get(`/api/templates/${id}/versions/${version}`,
+  { loading: models.templates });
+
+export const getTemplateVersionDiff = async (id, version, against) => http.get(`/api/templates/${id}/versions/${version}/diff`,
+  { params: { against }, loading: models.templates, preserveCase: true });
+
+export const rollbackTemplate = async (id, version) => http.put(`/api/templates/${id}/versions/${version}/rollback`, {},
+  { loading: models.templates });
+
 // Settings.
 export const getServerConfig = async () => http.get('/api/config',
   { loading: models.serverConfig, store: models.serverConfig, preserveCase: true });
@@ -211,8 +321,68 @@ export const getSettings = async () => http.get('/api/settings',
 export const updateSettings = async (data) => http.put('/api/settings', data,
   { loading: models.settings });
 
-export const getLogs = async () => http.get('/api/logs',
+// Import a JSON or TOML settings file. With dryRun, the changed
+// settings are returned without being applied.
+export const importSettings = async (data, format, dryRun) => http.post('/api/settings/import', data,
+  {
+    params: { format, dry_run: dryRun },
+    headers: { 'Content-Type': 'text/plain' },
+    loading: models.settings,
+    preserveCase: true,
+  });
+
+export const getSMTPStats = async () => http.get('/api/settings/smtp/stats',
+  { loading: models.settings });
+
+export const getPostbackStats = async () => http.get('/api/settings/messengers/stats',
+  { loading: models.settings });
+
+export const testSMTP = async (index, data) => http.post(`/api/settings/smtp/${index}/test`, data,
+  { loading: models.settings });
+
+export const updateRateLimits = async (data) => http.put('/api/settings/rate-limits', data,
+  { loading: models.settings });
+
+export const getDKIMRecords = async () => http.get('/api/settings/dkim',
+  { loading: models.settings });
+
+export const generateDKIMKey = async (data) => http.post('/api/settings/dkim/generate', data,
+  { loading: models.settings });
+
+export const getLogs = async (params) => http.get('/api/logs',
+  { params, loading: models.logs });
+
+export const getLogFiles = async () => http.get('/api/logs/files',
   { loading: models.logs });
 
+// Users.
+export const getUsers = async () => http.get('/api/users',
+  { loading: models.users, store: models.users });
+
+export const createUser = (data) => http.post('/api/users', data,
+  { loading: models.users });
+
+export const updateUser = (data) => http.put(`/api/users/${data.id}`, data,
+  { loading: models.users });
+
+export const deleteUser = (id) => http.delete(`/api/users/${id}`,
+  { loading: models.users });
+
+export const resetUserTOTP = (id) => http.delete(`/api/users/${id}/totp`,
+  { loading: models.users });
+
+// Profile of the logged in user.
+export const getProfile = async () => http.get('/api/profile',
+  { loading: models.users });
+
+export const setupTOTP = async () => http.post('/api/profile/totp', {},
+  { loading: models.users });
+
+export const enableTOTP = async (code) => http.put('/api/profile/totp', { code },
+  { loading: models.users });
+
+export const disableTOTP = async (code) => http.delete('/api/profile/totp',
+  { loading: models.users, data: { code } });
+
 export const getLang = async (lang) => http.get(`/api/lang/${lang}`,
   { loading: models.lang, preserveCase: true });
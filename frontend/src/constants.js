@@ -9,6 +9,7 @@ export const models = Object.freeze({
   media: 'media',
   settings: 'settings',
   logs: 'logs',
+  users: 'users',
 });
 
 // Ad-hoc URIs that are used outside of vuex requests.
@@ -17,6 +18,9 @@ export const uris = Object.freeze({
   previewTemplate: '/api/templates/:id/preview',
   previewRawTemplate: '/api/templates/preview',
   exportSubscribers: '/api/subscribers/export',
+  exportSettings: '/api/settings/export',
+  logFiles: '/api/logs/files',
+  campaignStatsStream: '/api/campaigns/running/stream',
 });
 
 // Keys used in Vuex store.
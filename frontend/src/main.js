@@ -32,6 +32,11 @@ new Vue({
   methods: {
     loadConfig() {
       api.getServerConfig().then((data) => {
+        // List-restricted editors don't have access to settings.
+        if (!data.user || data.user.role !== 'editor') {
+          api.getSettings();
+        }
+
         api.getLang(data.lang).then((lang) => {
           i18n.locale = data.lang;
           i18n.setLocaleMessage(i18n.locale, lang);
@@ -43,6 +48,5 @@ new Vue({
 
   created() {
     this.loadConfig();
-    api.getSettings();
   },
 }).$mount('#app');
@@ -83,6 +83,18 @@ const routes = [
     meta: { title: 'Logs', group: 'settings' },
     component: () => import(/* webpackChunkName: "main" */ '../views/Logs.vue'),
   },
+  {
+    path: '/settings/users',
+    name: 'users',
+    meta: { title: 'Users', group: 'settings' },
+    component: () => import(/* webpackChunkName: "main" */ '../views/Users.vue'),
+  },
+  {
+    path: '/profile',
+    name: 'profile',
+    meta: { title: 'Profile' },
+    component: () => import(/* webpackChunkName: "main" */ '../views/Profile.vue'),
+  },
 ];
 
 const router = new VueRouter({
@@ -44,6 +44,7 @@ export default new Vuex.Store({
     [models.settings]: (state) => state[models.settings],
     [models.serverConfig]: (state) => state[models.serverConfig],
     [models.logs]: (state) => state[models.logs],
+    [models.users]: (state) => state[models.users],
   },
 
   modules: {
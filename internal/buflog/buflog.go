@@ -2,8 +2,37 @@ package buflog
 
 import (
 	"bytes"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
+)
+
+// Levels of log entries.
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// Format of the timestamp of a std logger with the Ldate|Ltime flags.
+const timeFormat = "2006/01/02 15:04:05"
+
+// Entry is a log line that's parsed into its parts.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Component string    `json:"component"`
+	Message   string    `json:"message"`
+	Line      string    `json:"line"`
+}
+
+var (
+	// eg: 2021/05/01 00:00:00 init.go:99: reading config: config.toml
+	reLine = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) (?:([^\s:]+\.go):\d+: )?`)
+
+	reError = regexp.MustCompile(`(?i)\b(error|fatal|failed|panic)`)
+	reWarn  = regexp.MustCompile(`(?i)\b(warning|warn)\b`)
 )
 
 // BufLog implements a simple log buffer that can be supplied to a std
@@ -48,3 +77,29 @@ func (bu *BufLog) Lines() []string {
 	copy(out[:], bu.lines[:])
 	return out
 }
+
+// Parse parses a line of a std logger with the Ldate|Ltime|Lshortfile flags.
+// The component is the name of the source file of the line, eg: campaigns,
+// and as the std logger doesn't have levels, the level is derived from the
+// message.
+func Parse(line string) Entry {
+	line = strings.TrimSpace(line)
+
+	e := Entry{Message: line, Line: line}
+	if m := reLine.FindStringSubmatch(line); m != nil {
+		e.Time, _ = time.ParseInLocation(timeFormat, m[1], time.Local)
+		e.Component = strings.TrimSuffix(m[2], ".go")
+		e.Message = line[len(m[0]):]
+	}
+
+	switch {
+	case reError.MatchString(e.Message):
+		e.Level = LevelError
+	case reWarn.MatchString(e.Message):
+		e.Level = LevelWarn
+	default:
+		e.Level = LevelInfo
+	}
+
+	return e
+}
@@ -0,0 +1,217 @@
+package buflog
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotateTimeFormat = "2006-01-02T15-04-05"
+
+// ErrFileNotFound is returned when a log file doesn't exist.
+var ErrFileNotFound = errors.New("log file not found")
+
+// File is a log file that's rotated when it reaches a maximum size. Rotated
+// files are gzipped and named after the file and the time of the rotation,
+// eg: listmonk-2021-05-01T00-00-00.log.gz, and only the latest maxBackups
+// are kept.
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+	sync.Mutex
+}
+
+// FileInfo describes a log file.
+type FileInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewFile opens a log file for appending.
+func NewFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	l := &File{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write writes to the log file and rotates it if it'd exceed the maximum size.
+func (l *File) Write(b []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// Files returns the log file and the rotated files, latest first.
+func (l *File) Files() ([]FileInfo, error) {
+	dir, name := filepath.Split(l.path)
+	if dir == "" {
+		dir = "."
+	}
+	prefix, _ := l.rotatedName()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []FileInfo
+	for _, f := range files {
+		n := f.Name()
+		if n != name && !(strings.HasPrefix(n, prefix) && strings.HasSuffix(n, ".gz")) {
+			continue
+		}
+		out = append(out, FileInfo{Name: n, Size: f.Size(), UpdatedAt: f.ModTime()})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].UpdatedAt.After(out[j].UpdatedAt)
+	})
+
+	return out, nil
+}
+
+// Open opens a log file that's listed by Files. The bool indicates
+// whether the file is gzipped.
+func (l *File) Open(name string) (io.ReadCloser, bool, error) {
+	files, err := l.Files()
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, f := range files {
+		if f.Name != name {
+			continue
+		}
+		r, err := os.Open(filepath.Join(filepath.Dir(l.path), name))
+		if err != nil {
+			return nil, false, err
+		}
+		return r, strings.HasSuffix(name, ".gz"), nil
+	}
+
+	return nil, false, ErrFileNotFound
+}
+
+func (l *File) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f, l.size = f, st.Size()
+	return nil
+}
+
+// rotate renames the log file, opens a new one and gzips the old one and
+// removes the old backups in the background.
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	prefix, ext := l.rotatedName()
+	rotated := filepath.Join(filepath.Dir(l.path), prefix+time.Now().Format(rotateTimeFormat)+ext)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := gzipFile(rotated); err != nil {
+			return
+		}
+		l.removeBackups()
+	}()
+	return nil
+}
+
+// rotatedName returns the prefix and the extension of the names of rotated
+// files, eg: listmonk- and .log for listmonk.log.
+func (l *File) rotatedName() (string, string) {
+	name := filepath.Base(l.path)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-", ext
+}
+
+// removeBackups removes the oldest rotated files beyond maxBackups.
+func (l *File) removeBackups() {
+	if l.maxBackups < 1 {
+		return
+	}
+
+	files, err := l.Files()
+	if err != nil {
+		return
+	}
+
+	n := 0
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name, ".gz") {
+			continue
+		}
+		n++
+		if n > l.maxBackups {
+			os.Remove(filepath.Join(filepath.Dir(l.path), f.Name))
+		}
+	}
+}
+
+// gzipFile compresses a file to a .gz file and removes it.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
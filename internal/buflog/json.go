@@ -0,0 +1,48 @@
+package buflog
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// JSONWriter is a writer for a std logger that writes each log line as a
+// JSON object on a line of its own, for shipping logs to aggregators.
+type JSONWriter struct {
+	w io.Writer
+}
+
+type jsonEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component,omitempty"`
+	Message   string `json:"message"`
+}
+
+// NewJSONWriter returns a JSONWriter that writes to w.
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{w: w}
+}
+
+// Write writes a log line to the underlying writer as JSON.
+func (j *JSONWriter) Write(b []byte) (int, error) {
+	e := Parse(string(b))
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	out, err := json.Marshal(jsonEntry{
+		Time:      e.Time.Format(time.RFC3339),
+		Level:     e.Level,
+		Component: e.Component,
+		Message:   e.Message,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := j.w.Write(append(out, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
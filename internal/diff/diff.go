@@ -0,0 +1,184 @@
+// Package diff generates line based unified diffs between two texts.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is the type of a diff line.
+type Op byte
+
+// Diff line types.
+const (
+	OpEqual  Op = ' '
+	OpDelete Op = '-'
+	OpInsert Op = '+'
+)
+
+// Line is a single line in a diff.
+type Line struct {
+	Op   Op
+	Text string
+}
+
+// contextLines is the number of unchanged lines shown around changes
+// in unified diffs.
+const contextLines = 3
+
+// Lines returns the line by line diff between a and b computed
+// from their longest common subsequence.
+func Lines(a, b string) []Line {
+	var (
+		al = splitLines(a)
+		bl = splitLines(b)
+	)
+
+	// Skip the common prefix and suffix to keep the LCS table small
+	// as edits are usually localised.
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre &&
+		al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+
+	var (
+		x = al[pre : len(al)-suf]
+		y = bl[pre : len(bl)-suf]
+	)
+
+	// lcs[i][j] is the length of the LCS of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	out := make([]Line, 0, len(al)+len(bl))
+	for _, l := range al[:pre] {
+		out = append(out, Line{OpEqual, l})
+	}
+
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			out = append(out, Line{OpEqual, x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, Line{OpDelete, x[i]})
+			i++
+		default:
+			out = append(out, Line{OpInsert, y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		out = append(out, Line{OpDelete, x[i]})
+	}
+	for ; j < len(y); j++ {
+		out = append(out, Line{OpInsert, y[j]})
+	}
+
+	for _, l := range al[len(al)-suf:] {
+		out = append(out, Line{OpEqual, l})
+	}
+
+	return out
+}
+
+// Unified returns the unified diff (with @@ hunk headers) between a and b.
+// An empty string is returned if the texts are identical.
+func Unified(a, b, fromName, toName string) string {
+	lines := Lines(a, b)
+
+	// Find the changed lines and group them into hunks along with
+	// their surrounding context.
+	type hunk struct{ start, end int }
+	var hunks []hunk
+	for i, l := range lines {
+		if l.Op == OpEqual {
+			continue
+		}
+
+		start, end := i-contextLines, i+contextLines+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		if n := len(hunks); n > 0 && start <= hunks[n-1].end {
+			hunks[n-1].end = end
+		} else {
+			hunks = append(hunks, hunk{start, end})
+		}
+	}
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// Line numbers in a and b at the current position.
+	aLine, bLine, pos := 1, 1, 0
+	for _, h := range hunks {
+		for ; pos < h.start; pos++ {
+			aLine, bLine = advance(lines[pos].Op, aLine, bLine)
+		}
+
+		var aCount, bCount int
+		for _, l := range lines[h.start:h.end] {
+			if l.Op != OpInsert {
+				aCount++
+			}
+			if l.Op != OpDelete {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aLine, aCount, bLine, bCount)
+
+		for ; pos < h.end; pos++ {
+			sb.WriteByte(byte(lines[pos].Op))
+			sb.WriteString(lines[pos].Text)
+			sb.WriteByte('\n')
+			aLine, bLine = advance(lines[pos].Op, aLine, bLine)
+		}
+	}
+
+	return sb.String()
+}
+
+func advance(op Op, a, b int) (int, int) {
+	switch op {
+	case OpEqual:
+		return a + 1, b + 1
+	case OpDelete:
+		return a + 1, b
+	}
+	return a, b + 1
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
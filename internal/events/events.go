@@ -0,0 +1,182 @@
+// Package events is an in-process bus that publishes tracking, sending and
+// subscription events in batches to an external sink (a webhook or a NATS
+// server) in near real time.
+package events
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Event types.
+const (
+	TypeCampaignSent  = "campaign.sent"
+	TypeCampaignView  = "campaign.view"
+	TypeCampaignClick = "campaign.click"
+	TypeTxSent        = "tx.sent"
+	TypeTxFailed      = "tx.failed"
+	TypeTxBounced     = "tx.bounced"
+	TypeTxComplained  = "tx.complained"
+	TypeSubscribe     = "subscription.subscribe"
+	TypeUnsubscribe   = "subscription.unsubscribe"
+)
+
+// Event is an event that's published to the sink.
+type Event struct {
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// Sink publishes batches of events to an external system.
+type Sink interface {
+	Name() string
+	Publish([]Event) error
+}
+
+// Opts represents the bus options.
+type Opts struct {
+	// Max. number of events to publish in a batch.
+	BatchSize int
+
+	// Interval at which queued events are published if the batch
+	// isn't full.
+	FlushInterval time.Duration
+
+	// Max. number of events to queue. Events are dropped when the
+	// queue is full.
+	QueueSize int
+}
+
+// Bus queues events and publishes them to a sink.
+type Bus struct {
+	sink  Sink
+	opts  Opts
+	queue chan Event
+	log   *log.Logger
+
+	// Closed to stop Run, which closes done once it has published
+	// the queued events.
+	stop chan bool
+	done chan bool
+
+	// Number of events dropped since the last flush.
+	dropped int64
+}
+
+// New returns a new Bus that publishes to the given sink.
+func New(s Sink, o Opts, l *log.Logger) *Bus {
+	if o.BatchSize < 1 {
+		o.BatchSize = 100
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	if o.QueueSize < o.BatchSize {
+		o.QueueSize = o.BatchSize * 100
+	}
+
+	return &Bus{
+		sink:  s,
+		opts:  o,
+		queue: make(chan Event, o.QueueSize),
+		log:   l,
+		stop:  make(chan bool),
+		done:  make(chan bool),
+	}
+}
+
+// Publish queues an event. It never blocks and the event is dropped if the
+// queue is full so that a slow sink doesn't hold up sending or tracking.
+// Publishing on a nil Bus is a no-op.
+func (b *Bus) Publish(typ string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	select {
+	case b.queue <- Event{Type: typ, Data: data, Timestamp: time.Now()}:
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+	}
+}
+
+// Run publishes the queued events to the sink in batches. It blocks
+// until the Bus is closed and is meant to be run in a goroutine.
+func (b *Bus) Run() {
+	var (
+		batch = make([]Event, 0, b.opts.BatchSize)
+		t     = time.NewTicker(b.opts.FlushInterval)
+	)
+	defer t.Stop()
+
+	for {
+		select {
+		case e := <-b.queue:
+			batch = append(batch, e)
+			if len(batch) < b.opts.BatchSize {
+				continue
+			}
+
+		case <-t.C:
+			if len(batch) == 0 {
+				continue
+			}
+
+		case <-b.stop:
+			b.drain(batch)
+			close(b.done)
+			return
+		}
+
+		b.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// Close stops the Bus, whose Run should be running, and blocks until the
+// queued events are published. Events that are published after it are
+// dropped. Closing a nil Bus is a no-op.
+func (b *Bus) Close() {
+	if b == nil {
+		return
+	}
+
+	close(b.stop)
+	<-b.done
+}
+
+// drain publishes a batch and the events that are left in the queue.
+func (b *Bus) drain(batch []Event) {
+	for {
+		select {
+		case e := <-b.queue:
+			if batch = append(batch, e); len(batch) >= b.opts.BatchSize {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+
+		default:
+			if len(batch) > 0 {
+				b.flush(batch)
+			}
+			return
+		}
+	}
+}
+
+// flush publishes a batch of events, retrying once on error.
+func (b *Bus) flush(batch []Event) {
+	if n := atomic.SwapInt64(&b.dropped, 0); n > 0 {
+		b.log.Printf("events: %s queue full, dropped %d events", b.sink.Name(), n)
+	}
+
+	err := b.sink.Publish(batch)
+	if err != nil {
+		err = b.sink.Publish(batch)
+	}
+	if err != nil {
+		b.log.Printf("events: error publishing %d events to %s: %v", len(batch), b.sink.Name(), err)
+	}
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS is a sink that publishes events to a NATS server. Each event is
+// published to the subject <subject>.<event type>, eg:
+// listmonk.events.campaign.view, so that consumers can subscribe to
+// specific events with wildcards.
+type NATS struct {
+	url     string
+	subject string
+	timeout time.Duration
+
+	conn *nats.Conn
+	mu   sync.Mutex
+}
+
+// NewNATS returns a NATS sink for a server URL of the form
+// nats://[user:password@]host[:port] or tls://... for servers that
+// require TLS. The connection is made on the first publish.
+func NewNATS(u, subject string, timeout time.Duration) (*NATS, error) {
+	p, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if (p.Scheme != "nats" && p.Scheme != "tls") || p.Hostname() == "" {
+		return nil, fmt.Errorf("invalid NATS URL: %s", u)
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid NATS subject: %s", subject)
+	}
+
+	return &NATS{url: u, subject: subject, timeout: timeout}, nil
+}
+
+// Name returns the sink's name.
+func (n *NATS) Name() string {
+	return "nats"
+}
+
+// Publish publishes a batch of events and waits for the server to
+// acknowledge them. The client reconnects by itself if the connection
+// drops and events published in the meantime are buffered.
+func (n *NATS) Publish(evs []Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil || n.conn.IsClosed() {
+		c, err := nats.Connect(n.url,
+			nats.Name("listmonk"),
+			nats.Timeout(n.timeout),
+			nats.MaxReconnects(-1))
+		if err != nil {
+			return err
+		}
+		n.conn = c
+	}
+
+	for _, e := range evs {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := n.conn.Publish(n.subject+"."+e.Type, b); err != nil {
+			return err
+		}
+	}
+
+	// Flush round trips to the server, which confirms that it has
+	// processed the messages.
+	return n.conn.FlushTimeout(n.timeout)
+}
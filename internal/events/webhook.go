@@ -0,0 +1,57 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Webhook is a sink that posts batches of events as a JSON array to
+// an HTTP endpoint, for instance, a collector or a Kafka REST proxy.
+type Webhook struct {
+	url string
+	c   *http.Client
+}
+
+// NewWebhook returns a webhook sink.
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{url: url, c: &http.Client{Timeout: timeout}}
+}
+
+// Name returns the sink's name.
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+// Publish posts a batch of events to the webhook.
+func (w *Webhook) Publish(evs []Event) error {
+	b, err := json.Marshal(evs)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := w.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return fmt.Errorf("non-OK response from webhook: %d", r.StatusCode)
+	}
+	return nil
+}
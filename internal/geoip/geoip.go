@@ -0,0 +1,385 @@
+// Package geoip looks up the country and region of IP addresses in
+// MaxMind DB (.mmdb) files such as GeoLite2-Country and GeoLite2-City.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// metaMarker marks the beginning of the metadata section, which is
+// at the end of the file.
+var metaMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Size of the zero filled separator between the search tree and
+// the data section.
+const dataSeparator = 16
+
+// Data section field types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Max. nesting of data structures. It guards against pointer loops in
+// malformed files.
+const maxDepth = 32
+
+// DB is an in-memory MaxMind DB.
+type DB struct {
+	tree []byte
+	data []byte
+
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// Node at which IPv4 lookups start in IPv6 trees.
+	ipv4Start uint
+}
+
+// Location is the location of an IP address. Region is the ISO 3166-2
+// subdivision code without the country prefix (eg: CA for US-CA), and is
+// only available in databases with subdivisions.
+type Location struct {
+	Country string
+	Region  string
+}
+
+// Open loads a MaxMind DB file into memory.
+func Open(path string) (*DB, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(b)
+}
+
+// New returns a DB from the contents of a MaxMind DB file.
+func New(b []byte) (*DB, error) {
+	i := bytes.LastIndex(b, metaMarker)
+	if i < 0 {
+		return nil, errors.New("invalid MaxMind DB: metadata not found")
+	}
+
+	m, _, err := (&decoder{buf: b[i+len(metaMarker):]}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading MaxMind DB metadata: %v", err)
+	}
+	meta, ok := m.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata")
+	}
+
+	db := &DB{
+		nodeCount:  toUint(meta["node_count"]),
+		recordSize: toUint(meta["record_size"]),
+		ipVersion:  toUint(meta["ip_version"]),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size: %d", db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+dataSeparator > uint(i) {
+		return nil, errors.New("invalid MaxMind DB: search tree exceeds the file")
+	}
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+dataSeparator : i]
+
+	// IPv4 addresses are in the ::/96 subnet of IPv6 trees.
+	if db.ipVersion == 6 {
+		n := uint(0)
+		for j := 0; j < 96 && n < db.nodeCount; j++ {
+			n = db.record(n, 0)
+		}
+		db.ipv4Start = n
+	}
+
+	return db, nil
+}
+
+// Lookup returns the location of an IP address. An empty location is
+// returned if the address isn't in the DB.
+func (db *DB) Lookup(ip net.IP) (Location, error) {
+	rec, err := db.lookup(ip)
+	if err != nil || rec == nil {
+		return Location{}, err
+	}
+
+	var out Location
+	if c, ok := rec["country"].(map[string]interface{}); ok {
+		out.Country, _ = c["iso_code"].(string)
+	}
+	if subs, ok := rec["subdivisions"].([]interface{}); ok && len(subs) > 0 {
+		if s, ok := subs[0].(map[string]interface{}); ok {
+			out.Region, _ = s["iso_code"].(string)
+		}
+	}
+
+	return out, nil
+}
+
+// lookup returns the data record of an IP address.
+func (db *DB) lookup(ip net.IP) (map[string]interface{}, error) {
+	var (
+		bits  = ip.To4()
+		node  = uint(0)
+		nbits = 32
+	)
+	if bits != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if db.ipVersion != 6 {
+			return nil, nil
+		}
+		if bits = ip.To16(); bits == nil {
+			return nil, fmt.Errorf("invalid IP: %v", ip)
+		}
+		nbits = 128
+	}
+
+	for i := 0; i < nbits && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+
+	// The address isn't in the DB.
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("invalid MaxMind DB: search tree is too deep")
+	}
+
+	off := node - db.nodeCount - dataSeparator
+	v, _, err := (&decoder{buf: db.data}).decode(off, 0)
+	if err != nil {
+		return nil, err
+	}
+	rec, _ := v.(map[string]interface{})
+	return rec, nil
+}
+
+// record returns the left (bit = 0) or right (bit = 1) record of a node.
+func (db *DB) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := db.tree[node*8+bit*4:]
+		return uint(binary.BigEndian.Uint32(b))
+	}
+}
+
+// decoder decodes the fields of a MaxMind DB data section.
+type decoder struct {
+	buf []byte
+}
+
+var errOverflow = errors.New("invalid MaxMind DB: data exceeds the section")
+
+// decode decodes the field at an offset and returns its value and the
+// offset of the next field.
+func (d *decoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("invalid MaxMind DB: data is nested too deep")
+	}
+
+	typ, size, off, err := d.ctrl(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		ptr, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid MaxMind DB: map key isn't a string")
+			}
+
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d.buf)) {
+		return nil, 0, errOverflow
+	}
+	b := d.buf[off : off+size]
+	next := off + size
+
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes, typeUint128:
+		return b, next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid MaxMind DB: invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid MaxMind DB: invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case typeInt32:
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("invalid MaxMind DB: unknown data type %d", typ)
+}
+
+// ctrl reads the control byte(s) of a field and returns its type, its size
+// and the offset of its payload.
+func (d *decoder) ctrl(off uint) (uint, uint, uint, error) {
+	if off >= uint(len(d.buf)) {
+		return 0, 0, 0, errOverflow
+	}
+	c := d.buf[off]
+	off++
+
+	typ := uint(c >> 5)
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return 0, 0, 0, errOverflow
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+
+	// Pointers carry their size in the remaining bits.
+	if typ == typePointer {
+		return typ, uint(c & 0x1F), off, nil
+	}
+
+	size := uint(c & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d.buf)) {
+			return 0, 0, 0, errOverflow
+		}
+		var v uint
+		for _, b := range d.buf[off : off+n] {
+			v = v<<8 | uint(b)
+		}
+		off += n
+
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	return typ, size, off, nil
+}
+
+// pointer reads a pointer's address in the data section and returns it
+// along with the offset after the pointer.
+func (d *decoder) pointer(bits, off uint) (uint, uint, error) {
+	n := (bits>>3)&0x3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errOverflow
+	}
+
+	var v uint
+	if n < 4 {
+		v = bits & 0x7
+	}
+	for _, b := range d.buf[off : off+n] {
+		v = v<<8 | uint(b)
+	}
+
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+
+	return v, off + n, nil
+}
+
+// toUint converts a decoded unsigned int to uint.
+func toUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
@@ -0,0 +1,227 @@
+// Package hooks runs external commands at defined points in the app so that
+// custom logic can be plugged in without changes to listmonk. A hook is
+// given the event and its payload as JSON on stdin:
+//
+//	{"event": "subscriber.subscribe", "data": {...}}
+//
+// It may print a JSON response on stdout. An empty response lets the action
+// proceed as is. A response with data replaces the payload, so a hook that
+// modifies it should return the whole payload. A response with veto set
+// stops the action:
+//
+//	{"data": {...}}
+//	{"veto": true, "reason": "..."}
+//
+// Hooks of an event run in order with the payload returned by the previous
+// one. Hooks that fail, time out or respond with invalid JSON are logged and,
+// as per their OnError policy, either fail the action or are skipped.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Events that hooks can be run at.
+const (
+	// Campaign messages are about to be rendered for a batch of
+	// subscribers. Vetoing it skips the batch.
+	EventMessageRender = "message.render"
+
+	// A subscriber is about to be added, from the API or a public form.
+	EventSubscribe = "subscriber.subscribe"
+
+	// A bounce or complaint of a message is about to be recorded.
+	EventBounce = "bounce.record"
+)
+
+// Policies for hooks that fail.
+const (
+	// The action fails.
+	OnErrorFail = "fail"
+
+	// The hook is skipped and the action proceeds with the payload as is.
+	OnErrorIgnore = "ignore"
+)
+
+const defaultTimeout = time.Second * 5
+
+var events = []string{EventMessageRender, EventSubscribe, EventBounce}
+
+// Hook is an external command that's run at an event.
+type Hook struct {
+	Event   string
+	Command string
+	Args    []string
+	Timeout time.Duration
+	OnError string
+}
+
+// VetoError is returned when a hook vetoes an action.
+type VetoError struct {
+	Command string
+	Reason  string
+}
+
+func (e *VetoError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("vetoed by %s", e.Command)
+	}
+	return e.Reason
+}
+
+// Hooks runs the hooks of events.
+type Hooks struct {
+	hooks map[string][]Hook
+	log   *log.Logger
+}
+
+type request struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+type response struct {
+	Data   json.RawMessage `json:"data"`
+	Veto   bool            `json:"veto"`
+	Reason string          `json:"reason"`
+}
+
+// New returns a Hooks that runs the given hooks.
+func New(hooks []Hook, l *log.Logger) (*Hooks, error) {
+	h := &Hooks{hooks: make(map[string][]Hook), log: l}
+	for _, hk := range hooks {
+		if !isEvent(hk.Event) {
+			return nil, fmt.Errorf("unknown hook event '%s'. Should be one of: %s",
+				hk.Event, strings.Join(events, ", "))
+		}
+		if hk.Command == "" {
+			return nil, fmt.Errorf("hook for '%s' has no command", hk.Event)
+		}
+		if hk.Timeout <= 0 {
+			hk.Timeout = defaultTimeout
+		}
+		switch hk.OnError {
+		case "":
+			hk.OnError = OnErrorFail
+		case OnErrorFail, OnErrorIgnore:
+		default:
+			return nil, fmt.Errorf("unknown on_error '%s' for hook %s. Should be one of: %s, %s",
+				hk.OnError, hk.Command, OnErrorFail, OnErrorIgnore)
+		}
+		h.hooks[hk.Event] = append(h.hooks[hk.Event], hk)
+	}
+
+	return h, nil
+}
+
+// Has returns true if there are hooks for an event.
+func (h *Hooks) Has(event string) bool {
+	if h == nil {
+		return false
+	}
+	return len(h.hooks[event]) > 0
+}
+
+// Run runs the hooks of an event with the payload that data points to,
+// which is replaced by the payloads that the hooks return. It returns a
+// *VetoError if a hook vetoes the action and an error if a hook with the
+// fail policy fails.
+func (h *Hooks) Run(event string, data interface{}) error {
+	if !h.Has(event) {
+		return nil
+	}
+
+	for _, hk := range h.hooks[event] {
+		res, err := hk.run(event, data)
+		if err != nil {
+			if err := h.fail(event, hk, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if res.Veto {
+			return &VetoError{Command: hk.Command, Reason: res.Reason}
+		}
+		if len(res.Data) == 0 || string(res.Data) == "null" {
+			continue
+		}
+
+		// Replace the payload.
+		v := reflect.New(reflect.TypeOf(data).Elem())
+		if err := json.Unmarshal(res.Data, v.Interface()); err != nil {
+			if err := h.fail(event, hk, fmt.Errorf("invalid data: %v", err)); err != nil {
+				return err
+			}
+			continue
+		}
+		reflect.ValueOf(data).Elem().Set(v.Elem())
+	}
+
+	return nil
+}
+
+// fail logs the error of a hook and returns it if the hook's policy is
+// to fail the action.
+func (h *Hooks) fail(event string, hk Hook, err error) error {
+	if hk.OnError == OnErrorIgnore {
+		h.log.Printf("error running %s hook %s, ignoring: %v", event, hk.Command, err)
+		return nil
+	}
+
+	h.log.Printf("error running %s hook %s: %v", event, hk.Command, err)
+	return fmt.Errorf("%s hook %s: %v", event, hk.Command, err)
+}
+
+// run runs the hook's command with a payload and returns its response.
+func (hk Hook) run(event string, data interface{}) (response, error) {
+	var res response
+
+	b, err := json.Marshal(request{Event: event, Data: data})
+	if err != nil {
+		return res, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hk.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hk.Command, hk.Args...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return res, fmt.Errorf("timed out after %s", hk.Timeout)
+		}
+		return res, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 {
+		return res, nil
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return res, fmt.Errorf("invalid response: %v", err)
+	}
+
+	return res, nil
+}
+
+func isEvent(e string) bool {
+	for _, v := range events {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
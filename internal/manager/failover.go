@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// Number of recent messages a messenger's error rate is computed over.
+const failoverWindow = 100
+
+// msgrHealth tracks the recent delivery errors of a messenger that has
+// a fallback messenger.
+type msgrHealth struct {
+	// Number of consecutive errors.
+	numConsecutive int
+
+	// Ring buffer of the results (true = error) of the last failoverWindow messages.
+	results [failoverWindow]bool
+	pos     int
+	num     int
+	numErr  int
+
+	// Time at which the messenger failed over to its fallback. Zero if
+	// the messenger is healthy.
+	failedAt time.Time
+}
+
+// push pushes a message to the named messenger. If the messenger has a
+// fallback configured and its errors cross the failover thresholds, messages
+// are sent via the fallback messenger until the cooldown period elapses,
+// after which the messenger is tried again. c is the campaign that the
+// message belongs to, if any, for notifying admins.
+func (m *Manager) push(name string, msg messenger.Message, c *models.Campaign) error {
+	fb, ok := m.cfg.Failover[name]
+	if !ok || m.messengers[fb] == nil {
+		return m.pushVia(name, msg)
+	}
+
+	if !m.isFailedOver(name) {
+		err := m.pushVia(name, msg)
+		if !m.recordResult(name, err) {
+			return err
+		}
+
+		// The error crossed the threshold. Send this message and
+		// the ones that follow via the fallback messenger.
+		m.logger.Printf("messenger %s is failing (last error: %v). switching to fallback messenger %s for %s",
+			name, err, fb, m.cfg.FailoverCooldown)
+		if c != nil {
+			go m.sendNotif(c, models.CampaignStatusRunning,
+				fmt.Sprintf("Messenger %s is failing. Switched to %s", name, fb))
+		}
+	}
+
+	return m.pushVia(fb, msg)
+}
+
+// pushVia pushes a message to a messenger within its rate limits.
+func (m *Manager) pushVia(name string, msg messenger.Message) error {
+	m.waitRateLimit(name)
+	err := m.messengers[name].Push(msg)
+	m.msgrCounts.count(name, err)
+	return err
+}
+
+// isFailedOver checks whether a messenger is currently failed over to its
+// fallback. Once the cooldown period elapses, the messenger's error
+// history is reset so that it's tried again.
+func (m *Manager) isFailedOver(name string) bool {
+	m.healthMut.Lock()
+	defer m.healthMut.Unlock()
+
+	h, ok := m.health[name]
+	if !ok || h.failedAt.IsZero() {
+		return false
+	}
+
+	if time.Since(h.failedAt) < m.cfg.FailoverCooldown {
+		return true
+	}
+
+	m.logger.Printf("retrying messenger %s after failover cooldown", name)
+	m.health[name] = &msgrHealth{}
+	return false
+}
+
+// recordResult records the result of a message push to a messenger and
+// returns true if the messenger's errors crossed the failover thresholds.
+func (m *Manager) recordResult(name string, err error) bool {
+	m.healthMut.Lock()
+	defer m.healthMut.Unlock()
+
+	h, ok := m.health[name]
+	if !ok {
+		h = &msgrHealth{}
+		m.health[name] = h
+	}
+	if !h.failedAt.IsZero() {
+		return false
+	}
+
+	isErr := err != nil
+	if isErr {
+		h.numConsecutive++
+	} else {
+		h.numConsecutive = 0
+	}
+
+	// Update the error rate window.
+	if h.num == failoverWindow {
+		if h.results[h.pos] {
+			h.numErr--
+		}
+	} else {
+		h.num++
+	}
+	h.results[h.pos] = isErr
+	if isErr {
+		h.numErr++
+	}
+	h.pos = (h.pos + 1) % failoverWindow
+
+	if !isErr {
+		return false
+	}
+
+	if (m.cfg.FailoverMaxErrors > 0 && h.numConsecutive >= m.cfg.FailoverMaxErrors) ||
+		(m.cfg.FailoverErrorRate > 0 && h.num == failoverWindow &&
+			h.numErr*100/h.num >= m.cfg.FailoverErrorRate) {
+		*h = msgrHealth{failedAt: time.Now()}
+		return true
+	}
+
+	return false
+}
@@ -34,6 +34,7 @@ type DataSource interface {
 	NextSubscribers(campID, limit int) ([]models.Subscriber, error)
 	GetCampaign(campID int) (*models.Campaign, error)
 	UpdateCampaignStatus(campID int, status string) error
+	FinishCampaign(campID int) (bool, error)
 	CreateLink(url string) (string, error)
 }
 
@@ -57,17 +58,39 @@ type Manager struct {
 	links    map[string]string
 	linksMut sync.RWMutex
 
+	// Partial templates that can be included in other templates
+	// with the Partial template function, keyed by name.
+	partials    map[string]models.Template
+	partialsMut sync.RWMutex
+
 	subFetchQueue      chan *models.Campaign
 	campMsgQueue       chan CampaignMessage
 	campMsgErrorQueue  chan msgError
 	campMsgErrorCounts map[int]int
 	msgQueue           chan Message
 
-	// Sliding window keeps track of the total number of messages sent in a period
-	// and on reaching the specified limit, waits until the window is over before
-	// sending further messages.
-	slidingWindowNumMsg int
-	slidingWindowStart  time.Time
+	// Token bucket rate limiters of messengers, keyed by messenger name.
+	// The limits are shared by the instances that are sending campaigns
+	// and each limiter allows its share of them.
+	rateLimits map[string]RateLimit
+	limits     map[string]*limiter
+	instances  int
+	limitsMut  sync.RWMutex
+
+	// Effective send rates of running campaigns.
+	campRates map[int]*rateCounter
+	ratesMut  sync.Mutex
+
+	// Recent errors of messengers that have fallbacks, keyed by messenger name.
+	health    map[string]*msgrHealth
+	healthMut sync.Mutex
+
+	// Messages pushed to messengers, keyed by messenger name.
+	msgrCounts msgrCounters
+
+	// Time of the last scan of the data source for campaigns.
+	lastScan    time.Time
+	lastScanMut sync.RWMutex
 }
 
 // CampaignMessage represents an instance of campaign message to be pushed out,
@@ -91,6 +114,10 @@ type Message struct {
 
 	// Messenger is the messenger backend to use: email|postback.
 	Messenger string
+
+	// Done, if set, is called with the messenger and the result of the
+	// push once the message has been handed over to the messenger.
+	Done func(messenger string, err error)
 }
 
 // Config has parameters for configuring the manager.
@@ -98,21 +125,56 @@ type Config struct {
 	// Number of subscribers to pull from the DB in a single iteration.
 	BatchSize int
 
-	Concurrency           int
-	MessageRate           int
-	MaxSendErrors         int
-	SlidingWindow         bool
-	SlidingWindowDuration time.Duration
-	SlidingWindowRate     int
-	RequeueOnError        bool
-	FromEmail             string
-	IndividualTracking    bool
-	LinkTrackURL          string
-	UnsubURL              string
-	OptinURL              string
-	MessageURL            string
-	ViewTrackURL          string
-	UnsubHeader           bool
+	Concurrency        int
+	MessageRate        int
+	MaxSendErrors      int
+	RequeueOnError     bool
+	FromEmail          string
+	IndividualTracking bool
+	LinkTrackURL       string
+	UnsubURL           string
+	OptinURL           string
+	MessageURL         string
+	ViewTrackURL       string
+	UnsubHeader        bool
+
+	// Failover maps messengers to fallback messengers that messages are
+	// sent via when the messengers cross the failover error thresholds.
+	Failover          map[string]string
+	FailoverMaxErrors int
+	FailoverErrorRate int
+	FailoverCooldown  time.Duration
+
+	// RateLimits are the send rate limits of messengers, keyed by name.
+	RateLimits map[string]RateLimit
+
+	// DomainRoutes route messages to recipients on specific domains
+	// via specific messengers. The first matching route applies.
+	DomainRoutes []DomainRoute
+
+	// Worker indicates that the manager runs on a sending worker alongside
+	// the main instance, which notifies admins of campaigns being paused or
+	// cancelled.
+	Worker bool
+
+	// SentCB is an optional callback that's called after a campaign
+	// message is sent to a subscriber.
+	SentCB func(camp *models.Campaign, sub models.Subscriber)
+
+	// RenderCB is an optional callback that's called before campaign
+	// messages are rendered for a batch of subscribers. It returns the
+	// subscribers, which it may modify or leave out, to send the messages
+	// to. If it returns an error, the batch is skipped and the campaign is
+	// paused.
+	RenderCB func(camp *models.Campaign, subs []models.Subscriber) ([]models.Subscriber, error)
+
+	// LangCB is an optional callback that returns the language of a code
+	// that campaigns with a language (Campaign.Lang) are rendered in.
+	LangCB func(code string) *i18n.I18n
+
+	// MessageTokenCB is an optional callback that returns the token that
+	// authorizes a subscriber's hosted message page ({{ MessageURL }}).
+	MessageTokenCB func(campUUID, subUUID string) string
 }
 
 type msgError struct {
@@ -131,8 +193,11 @@ func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, i *i18n.
 	if cfg.MessageRate < 1 {
 		cfg.MessageRate = 1
 	}
+	if cfg.FailoverCooldown < time.Second {
+		cfg.FailoverCooldown = time.Minute * 10
+	}
 
-	return &Manager{
+	m := &Manager{
 		cfg:                cfg,
 		src:                src,
 		i18n:               i,
@@ -141,13 +206,20 @@ func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, i *i18n.
 		messengers:         make(map[string]messenger.Messenger),
 		camps:              make(map[int]*models.Campaign),
 		links:              make(map[string]string),
+		partials:           make(map[string]models.Template),
 		subFetchQueue:      make(chan *models.Campaign, cfg.Concurrency),
 		campMsgQueue:       make(chan CampaignMessage, cfg.Concurrency*2),
 		msgQueue:           make(chan Message, cfg.Concurrency),
 		campMsgErrorQueue:  make(chan msgError, cfg.MaxSendErrors),
 		campMsgErrorCounts: make(map[int]int),
-		slidingWindowStart: time.Now(),
+		health:             make(map[string]*msgrHealth),
+		campRates:          make(map[int]*rateCounter),
+		instances:          1,
+		msgrCounts:         msgrCounters{counts: make(map[string]*MessengerStats)},
 	}
+	m.SetRateLimits(cfg.RateLimits)
+
+	return m
 }
 
 // NewCampaignMessage creates and returns a CampaignMessage that is made available
@@ -231,6 +303,7 @@ func (m *Manager) HasRunningCampaigns() bool {
 // until all subscribers are exhausted, at which point, a campaign is marked
 // as "finished".
 func (m *Manager) Run(tick time.Duration) {
+	m.setLastScan()
 	go m.scanCampaigns(tick)
 
 	// Spawn N message workers.
@@ -252,16 +325,58 @@ func (m *Manager) Run(tick time.Duration) {
 		} else if m.isCampaignProcessing(c.ID) {
 			// There are no more subscribers. Either the campaign status
 			// has changed or all subscribers have been processed.
-			newC, err := m.exhaustCampaign(c, "")
+			newC, notify, err := m.exhaustCampaign(c, "")
 			if err != nil {
 				m.logger.Printf("error exhausting campaign (%s): %v", c.Name, err)
 				continue
 			}
-			m.sendNotif(newC, newC.Status, "")
+			if notify {
+				m.sendNotif(newC, newC.Status, "")
+			}
 		}
 	}
 }
 
+// setUnsubHeaders sets the List-Unsubscribe headers of a campaign message as
+// per the campaign's header mode. The one-click (RFC 8058) List-Unsubscribe-Post
+// header is only set when there's an HTTP unsubscribe URL in the header.
+func (m *Manager) setUnsubHeaders(h textproto.MIMEHeader, msg CampaignMessage) {
+	mode := msg.Campaign.UnsubHeader
+	if mode == models.UnsubHeaderDefault {
+		if !m.cfg.UnsubHeader {
+			return
+		}
+		mode = models.UnsubHeaderURL
+	}
+
+	var (
+		url    = `<` + msg.unsubURL + `>`
+		mailto = `<mailto:` + msg.Campaign.UnsubHeaderVal + `?subject=unsubscribe%20` + msg.Subscriber.UUID + `>`
+	)
+	switch mode {
+	case models.UnsubHeaderURL:
+		h.Set("List-Unsubscribe", url)
+	case models.UnsubHeaderMailto:
+		h.Set("List-Unsubscribe", mailto)
+		return
+	case models.UnsubHeaderBoth:
+		h.Set("List-Unsubscribe", url+", "+mailto)
+	case models.UnsubHeaderCustom:
+		v := strings.NewReplacer(
+			"{url}", msg.unsubURL,
+			"{campaign_uuid}", msg.Campaign.UUID,
+			"{subscriber_uuid}", msg.Subscriber.UUID).Replace(msg.Campaign.UnsubHeaderVal)
+		h.Set("List-Unsubscribe", v)
+		if !strings.Contains(v, "<http") {
+			return
+		}
+	default:
+		return
+	}
+
+	h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+}
+
 // messageWorker is a blocking function that listens to the message queue
 // and pushes out incoming messages on it to the messenger.
 func (m *Manager) messageWorker() {
@@ -276,7 +391,7 @@ func (m *Manager) messageWorker() {
 			}
 
 			// Pause on hitting the message rate.
-			if numMsg >= m.cfg.MessageRate {
+			if numMsg >= m.messageRate() {
 				time.Sleep(time.Second)
 				numMsg = 0
 			}
@@ -294,15 +409,19 @@ func (m *Manager) messageWorker() {
 				Campaign:    msg.Campaign,
 			}
 
-			// Attach List-Unsubscribe headers?
-			if m.cfg.UnsubHeader {
-				h := textproto.MIMEHeader{}
-				h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-				h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
+			h := textproto.MIMEHeader{}
+
+			// Attach List-Unsubscribe headers.
+			m.setUnsubHeaders(h, msg)
+			if msg.Campaign.ReplyTo != "" {
+				h.Set("Reply-To", msg.Campaign.ReplyTo)
+			}
+			if len(h) > 0 {
 				out.Headers = h
 			}
 
-			if err := m.messengers[msg.Campaign.Messenger].Push(out); err != nil {
+			name := m.routeMessenger(msg.Campaign.Messenger, msg.Subscriber.Email)
+			if err := m.push(name, out, msg.Campaign); err != nil {
 				m.logger.Printf("error sending message in campaign %s: subscriber %s: %v",
 					msg.Campaign.Name, msg.Subscriber.UUID, err)
 
@@ -310,6 +429,11 @@ func (m *Manager) messageWorker() {
 				case m.campMsgErrorQueue <- msgError{camp: msg.Campaign, err: err}:
 				default:
 				}
+			} else {
+				m.countSent(msg.Campaign.ID)
+				if m.cfg.SentCB != nil {
+					m.cfg.SentCB(msg.Campaign, msg.Subscriber)
+				}
 			}
 
 		// Arbitrary message.
@@ -318,19 +442,30 @@ func (m *Manager) messageWorker() {
 				return
 			}
 
-			err := m.messengers[msg.Messenger].Push(messenger.Message{
+			// Messages to multiple recipients are not routed.
+			name := msg.Messenger
+			if len(msg.To) == 1 {
+				name = m.routeMessenger(name, msg.To[0])
+			}
+
+			err := m.push(name, messenger.Message{
 				From:        msg.From,
 				To:          msg.To,
 				Subject:     msg.Subject,
 				ContentType: msg.ContentType,
 				Body:        msg.Body,
 				AltBody:     msg.AltBody,
+				Headers:     msg.Headers,
+				Attachments: msg.Attachments,
 				Subscriber:  msg.Subscriber,
 				Campaign:    msg.Campaign,
-			})
+			}, nil)
 			if err != nil {
 				m.logger.Printf("error sending message '%s': %v", msg.Subject, err)
 			}
+			if msg.Done != nil {
+				msg.Done(name, err)
+			}
 		}
 	}
 }
@@ -365,16 +500,48 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 			return fmt.Sprintf(m.cfg.OptinURL, msg.Subscriber.UUID, "")
 		},
 		"MessageURL": func(msg *CampaignMessage) string {
-			return fmt.Sprintf(m.cfg.MessageURL, c.UUID, msg.Subscriber.UUID)
+			u := fmt.Sprintf(m.cfg.MessageURL, c.UUID, msg.Subscriber.UUID)
+			if m.cfg.MessageTokenCB != nil {
+				u += "?t=" + m.cfg.MessageTokenCB(c.UUID, msg.Subscriber.UUID)
+			}
+			return u
 		},
+	}
+
+	// System strings and dates in the campaign's language.
+	l := m.i18n
+	if c != nil && c.Lang != "" && m.cfg.LangCB != nil {
+		l = m.cfg.LangCB(c.Lang)
+	}
+	for k, v := range m.genericFuncs(l) {
+		f[k] = v
+	}
+	f["Partial"] = m.PartialFunc(f)
+	return f
+}
+
+// TxTemplateFuncs returns the template functions to be applied into
+// compiled transactional templates. Campaign functions such as tracking
+// aren't available to them.
+func (m *Manager) TxTemplateFuncs() template.FuncMap {
+	f := m.genericFuncs(m.i18n)
+	f["Partial"] = m.PartialFunc(f)
+	return f
+}
+
+// genericFuncs returns the template functions that are common to
+// all templates with the system strings in a language.
+func (m *Manager) genericFuncs(l *i18n.I18n) template.FuncMap {
+	f := template.FuncMap{
 		"Date": func(layout string) string {
+			// The default layout is the language's.
 			if layout == "" {
-				layout = time.ANSIC
+				layout = l.T("email.dateLayout")
 			}
 			return time.Now().Format(layout)
 		},
 		"L": func() *i18n.I18n {
-			return m.i18n
+			return l
 		},
 		"Safe": func(safeHTML string) template.HTML {
 			return template.HTML(safeHTML)
@@ -386,6 +553,69 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 	return f
 }
 
+// SetPartials replaces the partial templates that are available
+// to the Partial template function.
+func (m *Manager) SetPartials(tpls []models.Template) {
+	p := make(map[string]models.Template, len(tpls))
+	for _, t := range tpls {
+		p[t.Name] = t
+	}
+
+	m.partialsMut.Lock()
+	m.partials = p
+	m.partialsMut.Unlock()
+}
+
+// PartialFunc returns a template function that renders the named partial
+// template with the given data. Partials are compiled with the given
+// function map (without Partial, so that partials can't include other
+// partials and recurse) and cached until their body changes.
+func (m *Manager) PartialFunc(f template.FuncMap) func(string, interface{}) (template.HTML, error) {
+	type compiled struct {
+		body string
+		tpl  *template.Template
+	}
+
+	var (
+		pf    = make(template.FuncMap, len(f))
+		cache = make(map[string]compiled)
+		mut   sync.Mutex
+	)
+	for k, v := range f {
+		if k != "Partial" {
+			pf[k] = v
+		}
+	}
+
+	return func(name string, data interface{}) (template.HTML, error) {
+		m.partialsMut.RLock()
+		p, ok := m.partials[name]
+		m.partialsMut.RUnlock()
+		if !ok {
+			return "", fmt.Errorf("unknown partial template: %s", name)
+		}
+
+		mut.Lock()
+		c, ok := cache[name]
+		if !ok || c.body != p.Body {
+			tpl, err := p.CompilePartial(pf)
+			if err != nil {
+				mut.Unlock()
+				return "", fmt.Errorf("error compiling partial template %s: %v", name, err)
+			}
+			c = compiled{body: p.Body, tpl: tpl}
+			cache[name] = c
+		}
+		mut.Unlock()
+
+		var b bytes.Buffer
+		if err := c.tpl.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("error rendering partial template %s: %v", name, err)
+		}
+		return template.HTML(b.String()), nil
+	}
+}
+
 // Close closes and exits the campaign manager.
 func (m *Manager) Close() {
 	close(m.subFetchQueue)
@@ -404,6 +634,7 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 		// Periodically scan the data source for campaigns to process.
 		case <-t.C:
 			campaigns, err := m.src.NextCampaigns(m.getPendingCampaignIDs())
+			m.setLastScan()
 			if err != nil {
 				m.logger.Printf("error fetching campaigns: %v", err)
 				continue
@@ -473,6 +704,21 @@ func (m *Manager) addCampaign(c *models.Campaign) error {
 	return nil
 }
 
+// LastScan returns the time the data source was last scanned for campaigns,
+// which stops advancing if the manager gets stuck. It's zero if the manager
+// isn't running.
+func (m *Manager) LastScan() time.Time {
+	m.lastScanMut.RLock()
+	defer m.lastScanMut.RUnlock()
+	return m.lastScan
+}
+
+func (m *Manager) setLastScan() {
+	m.lastScanMut.Lock()
+	m.lastScan = time.Now()
+	m.lastScanMut.Unlock()
+}
+
 // getPendingCampaignIDs returns the IDs of campaigns currently being processed.
 func (m *Manager) getPendingCampaignIDs() []int64 {
 	// Needs to return an empty slice in case there are no campaigns.
@@ -501,10 +747,22 @@ func (m *Manager) nextSubscribers(c *models.Campaign, batchSize int) (bool, erro
 		return false, nil
 	}
 
-	// Is there a sliding window limit configured?
-	hasSliding := m.cfg.SlidingWindow &&
-		m.cfg.SlidingWindowRate > 0 &&
-		m.cfg.SlidingWindowDuration.Seconds() > 1
+	// The batch has already been leased, so it's skipped if the callback
+	// fails. The campaign is paused so that the rest of the subscribers
+	// aren't skipped too.
+	if m.cfg.RenderCB != nil {
+		out, err := m.cfg.RenderCB(c, subs)
+		if err != nil {
+			m.logger.Printf("error running render callback, skipped %d messages (%s) (subscriber IDs %d-%d) and pausing campaign: %v",
+				len(subs), c.Name, subs[0].ID, subs[len(subs)-1].ID, err)
+			if m.isCampaignProcessing(c.ID) {
+				m.exhaustCampaign(c, models.CampaignStatusPaused)
+			}
+			m.sendNotif(c, models.CampaignStatusPaused, "Render hook failed")
+			return false, nil
+		}
+		subs = out
+	}
 
 	// Push messages.
 	for _, s := range subs {
@@ -518,33 +776,6 @@ func (m *Manager) nextSubscribers(c *models.Campaign, batchSize int) (bool, erro
 		// Push the message to the queue while blocking and waiting until
 		// the queue is drained.
 		m.campMsgQueue <- msg
-
-		// Check if the sliding window is active.
-		if hasSliding {
-			diff := time.Now().Sub(m.slidingWindowStart)
-
-			// Window has expired. Reset the clock.
-			if diff >= m.cfg.SlidingWindowDuration {
-				m.slidingWindowStart = time.Now()
-				m.slidingWindowNumMsg = 0
-				continue
-			}
-
-			// Have the messages exceeded the limit?
-			m.slidingWindowNumMsg++
-			if m.slidingWindowNumMsg >= m.cfg.SlidingWindowRate {
-				wait := m.cfg.SlidingWindowDuration - diff
-
-				m.logger.Printf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
-					m.slidingWindowNumMsg,
-					m.cfg.SlidingWindowDuration,
-					m.slidingWindowStart.Format(time.RFC822Z),
-					wait.Round(time.Second)*1)
-
-				m.slidingWindowNumMsg = 0
-				time.Sleep(wait)
-			}
-		}
 	}
 
 	return true, nil
@@ -558,11 +789,19 @@ func (m *Manager) isCampaignProcessing(id int) bool {
 	return ok
 }
 
-func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Campaign, error) {
+// exhaustCampaign stops processing a campaign and returns its up-to-date
+// record along with whether admins should be notified of its status. The
+// campaign may be processed by other instances too, in which case only the
+// one that finishes it notifies.
+func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Campaign, bool, error) {
 	m.campsMut.Lock()
 	delete(m.camps, c.ID)
 	m.campsMut.Unlock()
 
+	m.ratesMut.Lock()
+	delete(m.campRates, c.ID)
+	m.ratesMut.Unlock()
+
 	// A status has been passed. Change the campaign's status
 	// without further checks.
 	if status != "" {
@@ -571,28 +810,37 @@ func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Ca
 		} else {
 			m.logger.Printf("set campaign (%s) to %s", c.Name, status)
 		}
-		return c, nil
+		return c, true, nil
 	}
 
 	// Fetch the up-to-date campaign status from the source.
 	cm, err := m.src.GetCampaign(c.ID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// If a running campaign has exhausted subscribers, it's finished.
 	if cm.Status == models.CampaignStatusRunning {
-		cm.Status = models.CampaignStatusFinished
-		if err := m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusFinished); err != nil {
+		ok, err := m.src.FinishCampaign(c.ID)
+		if err != nil {
 			m.logger.Printf("error finishing campaign (%s): %v", c.Name, err)
-		} else {
-			m.logger.Printf("campaign (%s) finished", c.Name)
+			return cm, false, nil
+		}
+
+		// Another instance finished the campaign in the meantime or is
+		// still sending a batch of it and finishes it.
+		if !ok {
+			m.logger.Printf("stop processing campaign (%s)", c.Name)
+			return cm, false, nil
 		}
-	} else {
-		m.logger.Printf("stop processing campaign (%s)", c.Name)
+
+		cm.Status = models.CampaignStatusFinished
+		m.logger.Printf("campaign (%s) finished", c.Name)
+		return cm, true, nil
 	}
 
-	return cm, nil
+	m.logger.Printf("stop processing campaign (%s)", c.Name)
+	return cm, cm.Status != models.CampaignStatusFinished && !m.cfg.Worker, nil
 }
 
 // trackLink register a URL and return its UUID to be used in message templates
@@ -658,7 +906,8 @@ func (m *CampaignMessage) render() error {
 	m.body = out.Bytes()
 
 	// Is there an alt body?
-	if m.Campaign.ContentType != models.CampaignContentTypePlain && m.Campaign.AltBody.Valid {
+	if m.Campaign.ContentType != models.CampaignContentTypePlain &&
+		m.Campaign.ContentType != models.CampaignContentTypeSMS && m.Campaign.AltBody.Valid {
 		if m.Campaign.AltBodyTpl != nil {
 			b := bytes.Buffer{}
 			if err := m.Campaign.AltBodyTpl.ExecuteTemplate(&b, models.ContentTpl, m); err != nil {
@@ -0,0 +1,231 @@
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// Window over which the effective send rates are computed.
+const rateWindow = 60
+
+// RateLimit is the send rate limit of a messenger. A zero value
+// means no limit.
+type RateLimit struct {
+	PerSecond int
+	PerHour   int
+}
+
+// tokenBucket is a token bucket that refills at rate tokens a second
+// up to burst tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// limiter rate limits messages with per-second and per-hour token buckets.
+type limiter struct {
+	buckets []*tokenBucket
+	mut     sync.Mutex
+}
+
+// rateCounter counts events in one second slots to compute the
+// average rate over the last rateWindow seconds.
+type rateCounter struct {
+	slots [rateWindow]int
+	sec   int64
+	start time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token from the bucket and returns the time to wait
+// before the token is available. The bucket goes into debt when empty
+// so that concurrent reservations are queued up.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// newLimiter returns a limiter for the share of a rate limit of one of
+// n instances. The per-hour bucket allows bursts of up to a minute's worth
+// of messages so that messages are paced through the hour instead of being
+// sent all at once.
+func newLimiter(r RateLimit, n int) *limiter {
+	l := &limiter{}
+	if r.PerSecond > 0 {
+		rate := float64(r.PerSecond) / float64(n)
+		l.buckets = append(l.buckets, newTokenBucket(rate, rate))
+	}
+	if r.PerHour > 0 {
+		rate := float64(r.PerHour) / float64(n)
+		l.buckets = append(l.buckets, newTokenBucket(rate/3600, rate/60))
+	}
+	return l
+}
+
+// wait blocks until a message can be sent within the limits.
+func (l *limiter) wait() {
+	var (
+		now  = time.Now()
+		wait time.Duration
+	)
+
+	l.mut.Lock()
+	for _, b := range l.buckets {
+		if w := b.reserve(now); w > wait {
+			wait = w
+		}
+	}
+	l.mut.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SetRateLimits sets the send rate limits of messengers. It can be
+// called at any time to change the limits of running campaigns.
+func (m *Manager) SetRateLimits(limits map[string]RateLimit) {
+	m.limitsMut.Lock()
+	m.rateLimits = limits
+	m.limits = makeLimiters(limits, m.instances)
+	m.limitsMut.Unlock()
+}
+
+// SetInstances sets the number of instances (the main instance and any
+// sending workers) that are sending campaigns. The message rate and the
+// rate limits of messengers are divided between them.
+func (m *Manager) SetInstances(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	m.limitsMut.Lock()
+	defer m.limitsMut.Unlock()
+
+	if n == m.instances {
+		return
+	}
+	m.instances = n
+	m.limits = makeLimiters(m.rateLimits, n)
+}
+
+// messageRate returns the number of messages a second that a message
+// worker sends, which is the instance's share of the message rate.
+func (m *Manager) messageRate() int {
+	m.limitsMut.RLock()
+	n := m.instances
+	m.limitsMut.RUnlock()
+
+	if r := m.cfg.MessageRate / n; r > 1 {
+		return r
+	}
+	return 1
+}
+
+// makeLimiters returns the limiters of messengers for an instance's share
+// of their rate limits.
+func makeLimiters(limits map[string]RateLimit, instances int) map[string]*limiter {
+	out := make(map[string]*limiter, len(limits))
+	for name, r := range limits {
+		if r.PerSecond > 0 || r.PerHour > 0 {
+			out[name] = newLimiter(r, instances)
+		}
+	}
+	return out
+}
+
+// waitRateLimit blocks until a message can be sent via a messenger
+// within its rate limits.
+func (m *Manager) waitRateLimit(name string) {
+	m.limitsMut.RLock()
+	l, ok := m.limits[name]
+	m.limitsMut.RUnlock()
+
+	if ok {
+		l.wait()
+	}
+}
+
+// CampaignRate returns the effective send rate (messages a second) of
+// a running campaign over the last minute.
+func (m *Manager) CampaignRate(campID int) float64 {
+	m.ratesMut.Lock()
+	defer m.ratesMut.Unlock()
+
+	r, ok := m.campRates[campID]
+	if !ok {
+		return 0
+	}
+	return r.rate(time.Now())
+}
+
+// countSent counts a message sent in a campaign towards its effective rate.
+func (m *Manager) countSent(campID int) {
+	m.ratesMut.Lock()
+	defer m.ratesMut.Unlock()
+
+	r, ok := m.campRates[campID]
+	if !ok {
+		r = &rateCounter{start: time.Now()}
+		m.campRates[campID] = r
+	}
+	r.add(time.Now())
+}
+
+func (r *rateCounter) add(now time.Time) {
+	r.advance(now)
+	r.slots[r.sec%rateWindow]++
+}
+
+// rate returns the average number of events a second over the window,
+// or since the counter started if that's more recent.
+func (r *rateCounter) rate(now time.Time) float64 {
+	r.advance(now)
+
+	total := 0
+	for _, n := range r.slots {
+		total += n
+	}
+
+	secs := now.Sub(r.start).Seconds()
+	if secs > rateWindow {
+		secs = rateWindow
+	}
+	if secs < 1 {
+		secs = 1
+	}
+	return float64(total) / secs
+}
+
+// advance clears the slots of the seconds that have elapsed since the last event.
+func (r *rateCounter) advance(now time.Time) {
+	sec := now.Unix()
+	if r.sec == 0 {
+		r.sec = sec
+		return
+	}
+
+	for s := r.sec + 1; s <= sec && s <= r.sec+rateWindow; s++ {
+		r.slots[s%rateWindow] = 0
+	}
+	if sec > r.sec {
+		r.sec = sec
+	}
+}
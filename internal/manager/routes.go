@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// defaultMessenger is the name of the default e-mail messenger whose
+// messages are subject to domain routing rules.
+const defaultMessenger = "email"
+
+// DomainRoute routes e-mails to recipients on domains matching Domain, a
+// glob pattern (eg: yahoo.com, *.yahoo.com), via the given Messenger.
+type DomainRoute struct {
+	Domain    string
+	Messenger string
+}
+
+// routeMessenger returns the messenger to send a message via. Messages to
+// be sent via the default e-mail messenger are routed via the messenger of
+// the first domain route that matches the recipient's domain. Messages
+// via other messengers are never routed.
+func (m *Manager) routeMessenger(name, to string) string {
+	if name != defaultMessenger || len(m.cfg.DomainRoutes) == 0 {
+		return name
+	}
+
+	// Recipients may be of the form `Name <email>`.
+	if a, err := mail.ParseAddress(to); err == nil {
+		to = a.Address
+	}
+	i := strings.LastIndexByte(to, '@')
+	if i < 0 {
+		return name
+	}
+	domain := strings.ToLower(to[i+1:])
+
+	for _, r := range m.cfg.DomainRoutes {
+		if ok, _ := path.Match(r.Domain, domain); ok {
+			if _, ok := m.messengers[r.Messenger]; ok {
+				return r.Messenger
+			}
+			break
+		}
+	}
+
+	return name
+}
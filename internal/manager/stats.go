@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+)
+
+// MessengerStats is the number of messages pushed to a messenger.
+type MessengerStats struct {
+	Sent   int64 `json:"sent"`
+	Errors int64 `json:"errors"`
+}
+
+// CampaignStats is the throughput of a running campaign.
+type CampaignStats struct {
+	ID   int
+	Name string
+	Rate float64
+}
+
+// Stats is a snapshot of the manager's operational stats.
+type Stats struct {
+	Messengers map[string]MessengerStats
+
+	// Number of messages waiting in the campaign and arbitrary
+	// message queues.
+	CampaignQueue int
+	MessageQueue  int
+
+	Campaigns []CampaignStats
+}
+
+// msgrCounters counts the messages pushed to messengers since the
+// manager started.
+type msgrCounters struct {
+	counts map[string]*MessengerStats
+	sync.Mutex
+}
+
+// count counts a message pushed to a messenger.
+func (c *msgrCounters) count(name string, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, ok := c.counts[name]
+	if !ok {
+		s = &MessengerStats{}
+		c.counts[name] = s
+	}
+	if err != nil {
+		s.Errors++
+	} else {
+		s.Sent++
+	}
+}
+
+// Stats returns a snapshot of the manager's operational stats.
+func (m *Manager) Stats() Stats {
+	out := Stats{
+		Messengers:    make(map[string]MessengerStats),
+		CampaignQueue: len(m.campMsgQueue),
+		MessageQueue:  len(m.msgQueue),
+	}
+
+	m.msgrCounts.Lock()
+	for name, s := range m.msgrCounts.counts {
+		out.Messengers[name] = *s
+	}
+	m.msgrCounts.Unlock()
+
+	m.campsMut.RLock()
+	for id, c := range m.camps {
+		out.Campaigns = append(out.Campaigns, CampaignStats{ID: id, Name: c.Name})
+	}
+	m.campsMut.RUnlock()
+
+	for i, c := range out.Campaigns {
+		out.Campaigns[i].Rate = m.CampaignRate(c.ID)
+	}
+	sort.Slice(out.Campaigns, func(i, j int) bool {
+		return out.Campaigns[i].ID < out.Campaigns[j].ID
+	})
+
+	return out
+}
@@ -3,19 +3,41 @@ package media
 import (
 	"io"
 
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
 	"gopkg.in/volatiletech/null.v6"
 )
 
 // Media represents an uploaded object.
 type Media struct {
-	ID        int       `db:"id" json:"id"`
-	UUID      string    `db:"uuid" json:"uuid"`
-	Filename  string    `db:"filename" json:"filename"`
-	Thumb     string    `db:"thumb" json:"thumb"`
-	CreatedAt null.Time `db:"created_at" json:"created_at"`
-	ThumbURL  string    `json:"thumb_url"`
-	Provider  string    `json:"provider"`
-	URL       string    `json:"url"`
+	ID        int            `db:"id" json:"id"`
+	UUID      string         `db:"uuid" json:"uuid"`
+	Filename  string         `db:"filename" json:"filename"`
+	Thumb     string         `db:"thumb" json:"thumb"`
+	FolderID  null.Int       `db:"folder_id" json:"folder_id"`
+	Tags      pq.StringArray `db:"tags" json:"tags"`
+	CreatedAt null.Time      `db:"created_at" json:"created_at"`
+	ThumbURL  string         `json:"thumb_url"`
+	Provider  string         `json:"provider"`
+	URL       string         `json:"url"`
+
+	// Filenames of the resized variants of an image by their names
+	// and their URLs.
+	Variants    types.JSONText    `db:"variants" json:"-"`
+	VariantURLs map[string]string `json:"variants"`
+
+	// Pseudofield for getting the total number of media files
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+}
+
+// Folder is a folder that organizes media.
+type Folder struct {
+	ID         int       `db:"id" json:"id"`
+	Name       string    `db:"name" json:"name"`
+	MediaCount int       `db:"media_count" json:"media_count"`
+	CreatedAt  null.Time `db:"created_at" json:"created_at"`
+	UpdatedAt  null.Time `db:"updated_at" json:"updated_at"`
 }
 
 // Store represents functions to store and retrieve media (files).
@@ -23,4 +45,5 @@ type Store interface {
 	Put(string, string, io.ReadSeeker) (string, error)
 	Delete(string) error
 	Get(string) string
+	GetBlob(string) ([]byte, error)
 }
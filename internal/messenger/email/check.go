@@ -0,0 +1,153 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+// Steps of an SMTP server check.
+const (
+	StepConnect  = "connect"
+	StepHello    = "hello"
+	StepStartTLS = "starttls"
+	StepAuth     = "auth"
+	StepSend     = "send"
+)
+
+// Time a server check is allowed to take.
+const checkTimeout = time.Second * 15
+
+// CheckResult is the result of an SMTP server connectivity check.
+type CheckResult struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	OK       bool   `json:"ok"`
+
+	// Step at which the check failed and the server's error, if any.
+	Step  string `json:"step,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	Duration  int64     `json:"duration_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Check connects to an SMTP server and goes through the HELLO, STARTTLS and
+// AUTH steps without sending a message. If em is not nil, em is sent as a
+// test message. The result reports the step that failed, if any.
+func Check(s Server, em *smtppool.Email) CheckResult {
+	if err := s.setup(); err != nil {
+		return CheckResult{Host: s.Host, Port: s.Port, Username: s.Username,
+			Step: StepAuth, Error: err.Error(), CheckedAt: time.Now()}
+	}
+	return check(&s, em)
+}
+
+// Check checks the connectivity of all the SMTP servers in the pool.
+func (e *Emailer) Check() []CheckResult {
+	out := make([]CheckResult, 0, len(e.servers))
+	for _, s := range e.servers {
+		out = append(out, check(s, nil))
+	}
+	return out
+}
+
+func check(s *Server, em *smtppool.Email) CheckResult {
+	var (
+		start = time.Now()
+		out   = CheckResult{Host: s.Host, Port: s.Port, Username: s.Username, CheckedAt: start}
+	)
+
+	step, err := checkServer(s, em)
+	if err != nil {
+		out.Step = step
+		out.Error = err.Error()
+	} else {
+		out.OK = true
+	}
+	out.Duration = time.Since(start).Milliseconds()
+
+	return out
+}
+
+// checkServer runs through the steps of an SMTP session and returns the
+// step that failed along with its error.
+func checkServer(s *Server, em *smtppool.Email) (string, error) {
+	nc, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", s.Host, s.Port), checkTimeout)
+	if err != nil {
+		return StepConnect, err
+	}
+	nc.SetDeadline(time.Now().Add(checkTimeout))
+
+	c, err := smtp.NewClient(nc, s.Host)
+	if err != nil {
+		nc.Close()
+		return StepConnect, err
+	}
+	defer c.Close()
+
+	hello := s.HelloHostname
+	if hello == "" {
+		hello = "localhost"
+	}
+	if err := c.Hello(hello); err != nil {
+		return StepHello, err
+	}
+
+	if s.TLSConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return StepStartTLS, errors.New("SMTP STARTTLS extension not found")
+		}
+		if err := c.StartTLS(s.TLSConfig); err != nil {
+			return StepStartTLS, err
+		}
+	}
+
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return StepAuth, errors.New("SMTP AUTH extension not found")
+		}
+		if err := c.Auth(s.Auth); err != nil {
+			return StepAuth, err
+		}
+	}
+
+	if em != nil {
+		if err := sendCheck(c, em); err != nil {
+			return StepSend, err
+		}
+	}
+
+	c.Quit()
+	return "", nil
+}
+
+// sendCheck sends a test message on an SMTP connection.
+func sendCheck(c *smtp.Client, em *smtppool.Email) error {
+	b, err := em.Bytes()
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(em.From)
+	if err != nil {
+		return err
+	}
+	to := make([]string, 0, len(em.To))
+	for _, addr := range em.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		to = append(to, a.Address)
+	}
+
+	_, err = (&rawConn{c: c}).send(from.Address, to, b)
+	return err
+}
@@ -0,0 +1,204 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Headers that are signed, if present in a message.
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// DKIMKey is a DKIM signing key for a sending domain.
+type DKIMKey struct {
+	Domain     string `json:"domain"`
+	Selector   string `json:"selector"`
+	PrivateKey string `json:"private_key"`
+
+	key *rsa.PrivateKey
+}
+
+// GenerateDKIMKey generates a new 2048 bit RSA DKIM key and returns
+// it PEM encoded.
+func GenerateDKIMKey() (string, error) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	return string(b), nil
+}
+
+// DKIMRecord returns the DNS TXT record name and value that publish the
+// public key of a PEM encoded DKIM private key.
+func DKIMRecord(domain, selector, privKey string) (string, string, error) {
+	k, err := parseDKIMKey(privKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return fmt.Sprintf("%s._domainkey.%s", selector, domain),
+		"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// parseDKIMKey parses a PEM encoded PKCS1 or PKCS8 RSA private key.
+func parseDKIMKey(s string) (*rsa.PrivateKey, error) {
+	b, _ := pem.Decode([]byte(strings.TrimSpace(s)))
+	if b == nil {
+		return nil, errors.New("invalid PEM DKIM private key")
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DKIM private key: %v", err)
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("DKIM private key is not an RSA key")
+	}
+	return rk, nil
+}
+
+// dkimSign signs a raw message (RFC 6376) with the rsa-sha256 algorithm and
+// relaxed/relaxed canonicalization and returns the message with the
+// DKIM-Signature header prepended.
+func dkimSign(msg []byte, k *DKIMKey, now time.Time) ([]byte, error) {
+	var hdr, body []byte
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		hdr, body = msg[:i+2], msg[i+4:]
+	} else {
+		hdr = msg
+	}
+
+	bh := sha256.Sum256(relaxedBody(body))
+
+	// Pick the headers to sign. If a header occurs more than once,
+	// its last instance is signed.
+	var (
+		fields = splitHeaders(hdr)
+		names  []string
+		h      = sha256.New()
+	)
+	for _, name := range dkimHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(headerName(fields[i]), name) {
+				h.Write([]byte(relaxedHeader(fields[i])))
+				names = append(names, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	sig := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		k.Domain, k.Selector, now.Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+
+	// The signature header itself (with an empty b=) is signed last,
+	// without the trailing CRLF.
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+sig), "\r\n")))
+
+	b, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(msg)+len(sig)+512)
+	out = append(out, "DKIM-Signature: "+sig+base64.StdEncoding.EncodeToString(b)+"\r\n"...)
+	return append(out, msg...), nil
+}
+
+// splitHeaders splits a raw header block into individual header fields,
+// including their folded continuation lines.
+func splitHeaders(b []byte) []string {
+	var out []string
+	for _, l := range strings.SplitAfter(string(b), "\r\n") {
+		if l == "" {
+			continue
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(out) > 0 {
+			out[len(out)-1] += l
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func headerName(f string) string {
+	if i := strings.IndexByte(f, ':'); i > 0 {
+		return strings.TrimSpace(f[:i])
+	}
+	return ""
+}
+
+// relaxedHeader canonicalizes a header field with the "relaxed" algorithm.
+func relaxedHeader(f string) string {
+	i := strings.IndexByte(f, ':')
+	if i < 0 {
+		return ""
+	}
+
+	v := strings.NewReplacer("\r\n", "").Replace(f[i+1:])
+	return strings.ToLower(strings.TrimSpace(f[:i])) + ":" + strings.TrimSpace(collapseWSP(v)) + "\r\n"
+}
+
+// relaxedBody canonicalizes a message body with the "relaxed" algorithm.
+func relaxedBody(b []byte) []byte {
+	lines := strings.Split(string(b), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(l), " ")
+	}
+
+	// Ignore empty lines at the end of the body.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWSP reduces sequences of spaces and tabs to a single space.
+func collapseWSP(s string) string {
+	var (
+		sb  strings.Builder
+		wsp bool
+	)
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			sb.WriteByte(' ')
+			wsp = false
+		}
+		sb.WriteByte(s[i])
+	}
+	if wsp {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
@@ -3,18 +3,25 @@ package email
 import (
 	"crypto/tls"
 	"fmt"
-	"math/rand"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/smtppool"
 )
 
-const emName = "email"
-
 // Server represents an SMTP server's credentials.
 type Server struct {
+	// Message counters. These are accessed atomically and are kept
+	// at the top of the struct for 64-bit alignment.
+	numSent   uint64
+	numErrors uint64
+
 	Username      string            `json:"username"`
 	Password      string            `json:"password"`
 	AuthProtocol  string            `json:"auth_protocol"`
@@ -22,48 +29,68 @@ type Server struct {
 	TLSSkipVerify bool              `json:"tls_skip_verify"`
 	EmailHeaders  map[string]string `json:"email_headers"`
 
+	// Weight of the server in its pool's rotation. A server with weight 2
+	// gets twice as many messages as a server with weight 1.
+	Weight int `json:"weight"`
+
 	// Rest of the options are embedded directly from the smtppool lib.
 	// The JSON tag is for config unmarshal to work.
 	smtppool.Opt `json:",squash"`
 
 	pool *smtppool.Pool
+
+	// Pool for sending DKIM signed messages.
+	raw *rawPool
+
+	// Current weight in the smooth weighted round-robin rotation.
+	curWeight int
 }
 
-// Emailer is the SMTP e-mail messenger.
+// ServerStats represents the message counters of an SMTP server.
+type ServerStats struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Weight   int    `json:"weight"`
+	Sent     uint64 `json:"sent"`
+	Errors   uint64 `json:"errors"`
+}
+
+// Emailer is the SMTP e-mail messenger. It represents a pool of one or
+// more SMTP servers that messages are rotated across by weight.
 type Emailer struct {
+	name    string
 	servers []*Server
+	mut     sync.Mutex
+
+	// DKIM keys by sending domain.
+	dkim map[string]*DKIMKey
 }
 
-// New returns an SMTP e-mail Messenger backend with a the given SMTP servers.
-func New(servers ...Server) (*Emailer, error) {
+// New returns an SMTP e-mail Messenger backend with the given name
+// and SMTP servers. Messages from domains that have DKIM keys are signed.
+func New(name string, keys []DKIMKey, servers ...Server) (*Emailer, error) {
 	e := &Emailer{
+		name:    name,
 		servers: make([]*Server, 0, len(servers)),
+		dkim:    make(map[string]*DKIMKey, len(keys)),
+	}
+
+	for _, k := range keys {
+		key, err := parseDKIMKey(k.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k.Domain, err)
+		}
+		d := k
+		d.Domain = strings.ToLower(k.Domain)
+		d.key = key
+		e.dkim[d.Domain] = &d
 	}
 
 	for _, srv := range servers {
 		s := srv
-		var auth smtp.Auth
-		switch s.AuthProtocol {
-		case "cram":
-			auth = smtp.CRAMMD5Auth(s.Username, s.Password)
-		case "plain":
-			auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
-		case "login":
-			auth = &smtppool.LoginAuth{Username: s.Username, Password: s.Password}
-		case "", "none":
-		default:
-			return nil, fmt.Errorf("unknown SMTP auth type '%s'", s.AuthProtocol)
-		}
-		s.Opt.Auth = auth
-
-		// TLS config.
-		if s.TLSEnabled {
-			s.TLSConfig = &tls.Config{}
-			if s.TLSSkipVerify {
-				s.TLSConfig.InsecureSkipVerify = s.TLSSkipVerify
-			} else {
-				s.TLSConfig.ServerName = s.Host
-			}
+		if err := s.setup(); err != nil {
+			return nil, err
 		}
 
 		pool, err := smtppool.New(s.Opt)
@@ -72,31 +99,142 @@ func New(servers ...Server) (*Emailer, error) {
 		}
 
 		s.pool = pool
+		if len(e.dkim) > 0 {
+			s.raw = newRawPool(s.Opt)
+		}
 		e.servers = append(e.servers, &s)
 	}
 
 	return e, nil
 }
 
+// setup sets up the auth and TLS options of a server.
+func (s *Server) setup() error {
+	if s.Weight < 1 {
+		s.Weight = 1
+	}
+
+	var auth smtp.Auth
+	switch s.AuthProtocol {
+	case "cram":
+		auth = smtp.CRAMMD5Auth(s.Username, s.Password)
+	case "plain":
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	case "login":
+		auth = &smtppool.LoginAuth{Username: s.Username, Password: s.Password}
+	case "", "none":
+	default:
+		return fmt.Errorf("unknown SMTP auth type '%s'", s.AuthProtocol)
+	}
+	s.Opt.Auth = auth
+
+	// TLS config.
+	if s.TLSEnabled {
+		s.TLSConfig = &tls.Config{}
+		if s.TLSSkipVerify {
+			s.TLSConfig.InsecureSkipVerify = s.TLSSkipVerify
+		} else {
+			s.TLSConfig.ServerName = s.Host
+		}
+	}
+
+	return nil
+}
+
 // Name returns the Server's name.
 func (e *Emailer) Name() string {
-	return emName
+	return e.name
+}
+
+// Stats returns the message counters of the SMTP servers in the pool.
+func (e *Emailer) Stats() []ServerStats {
+	out := make([]ServerStats, 0, len(e.servers))
+	for _, s := range e.servers {
+		out = append(out, ServerStats{
+			Host:     s.Host,
+			Port:     s.Port,
+			Username: s.Username,
+			Weight:   s.Weight,
+			Sent:     atomic.LoadUint64(&s.numSent),
+			Errors:   atomic.LoadUint64(&s.numErrors),
+		})
+	}
+	return out
 }
 
 // Push pushes a message to the server.
 func (e *Emailer) Push(m messenger.Message) error {
-	// If there are more than one SMTP servers, send to a random
-	// one from the list.
-	var (
-		ln  = len(e.servers)
-		srv *Server
-	)
-	if ln > 1 {
-		srv = e.servers[rand.Intn(ln)]
+	srv := e.nextServer()
+
+	em := MakeEmail(m)
+
+	// Attach SMTP level headers.
+	if len(srv.EmailHeaders) > 0 {
+		for k, v := range srv.EmailHeaders {
+			em.Headers.Set(k, v)
+		}
+	}
+
+	var err error
+	if k := e.dkimKey(em.From); k != nil {
+		err = e.sendSigned(srv, em, k)
 	} else {
-		srv = e.servers[0]
+		err = srv.pool.Send(em)
+	}
+	if err != nil {
+		atomic.AddUint64(&srv.numErrors, 1)
+		return err
+	}
+	atomic.AddUint64(&srv.numSent, 1)
+	return nil
+}
+
+// dkimKey returns the DKIM key of the domain of a from address, if any.
+func (e *Emailer) dkimKey(from string) *DKIMKey {
+	if len(e.dkim) == 0 {
+		return nil
+	}
+
+	a, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil
 	}
+	i := strings.LastIndexByte(a.Address, '@')
+	return e.dkim[strings.ToLower(a.Address[i+1:])]
+}
+
+// sendSigned renders an e-mail, signs it with a DKIM key and sends it.
+func (e *Emailer) sendSigned(srv *Server, em smtppool.Email, k *DKIMKey) error {
+	b, err := em.Bytes()
+	if err != nil {
+		return err
+	}
+	b, err = dkimSign(b, k, time.Now())
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(em.From)
+	if err != nil {
+		return err
+	}
+	var to []string
+	for _, l := range [][]string{em.To, em.Cc, em.Bcc} {
+		for _, addr := range l {
+			a, err := mail.ParseAddress(addr)
+			if err != nil {
+				return err
+			}
+			to = append(to, a.Address)
+		}
+	}
+
+	return srv.raw.Send(from.Address, to, b)
+}
 
+// MakeEmail returns the MIME e-mail representation of a message.
+// It's also used by messengers that send raw e-mails over HTTP APIs.
+func MakeEmail(m messenger.Message) smtppool.Email {
 	// Are there attachments?
 	var files []smtppool.Attachment
 	if m.Attachments != nil {
@@ -125,13 +263,6 @@ func (e *Emailer) Push(m messenger.Message) error {
 		em.Headers = m.Headers
 	}
 
-	// Attach SMTP level headers.
-	if len(srv.EmailHeaders) > 0 {
-		for k, v := range srv.EmailHeaders {
-			em.Headers.Set(k, v)
-		}
-	}
-
 	switch m.ContentType {
 	case "plain":
 		em.Text = []byte(m.Body)
@@ -142,7 +273,34 @@ func (e *Emailer) Push(m messenger.Message) error {
 		}
 	}
 
-	return srv.pool.Send(em)
+	return em
+}
+
+// nextServer picks the next server in the pool using smooth weighted
+// round-robin, which spreads messages across servers in proportion to
+// their weights without sending bursts to any one server.
+func (e *Emailer) nextServer() *Server {
+	if len(e.servers) == 1 {
+		return e.servers[0]
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	var (
+		best  *Server
+		total = 0
+	)
+	for _, s := range e.servers {
+		s.curWeight += s.Weight
+		total += s.Weight
+		if best == nil || s.curWeight > best.curWeight {
+			best = s
+		}
+	}
+	best.curWeight -= total
+
+	return best
 }
 
 // Flush flushes the message queue to the server.
@@ -154,6 +312,9 @@ func (e *Emailer) Flush() error {
 func (e *Emailer) Close() error {
 	for _, s := range e.servers {
 		s.pool.Close()
+		if s.raw != nil {
+			s.raw.Close()
+		}
 	}
 	return nil
 }
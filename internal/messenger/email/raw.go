@@ -0,0 +1,228 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+// rawPool is a minimal SMTP connection pool that sends pre-rendered raw
+// messages. smtppool renders messages itself at the time of sending (with
+// new MIME boundaries and Message-Ids), which would invalidate DKIM
+// signatures computed beforehand, so signed messages are sent via this pool.
+type rawPool struct {
+	o     smtppool.Opt
+	conns chan *rawConn
+
+	// Number of connections that are open, idle or busy.
+	numConns int
+	mut      sync.Mutex
+}
+
+type rawConn struct {
+	c            *smtp.Client
+	lastActivity time.Time
+}
+
+func newRawPool(o smtppool.Opt) *rawPool {
+	if o.MaxMessageRetries < 1 {
+		o.MaxMessageRetries = 2
+	}
+	if o.PoolWaitTimeout < time.Second {
+		o.PoolWaitTimeout = time.Second * 2
+	}
+
+	return &rawPool{
+		o:     o,
+		conns: make(chan *rawConn, o.MaxConns),
+	}
+}
+
+// Send sends a raw message. On error, the message is retried on a
+// new connection.
+func (p *rawPool) Send(from string, to []string, msg []byte) error {
+	var lastErr error
+	for i := 0; i < p.o.MaxMessageRetries; i++ {
+		c, err := p.borrow()
+		if err != nil {
+			return err
+		}
+
+		retry, err := c.send(from, to, msg)
+		p.release(c, err)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if !retry {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+// Close closes all idle connections.
+func (p *rawPool) Close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// borrow returns an idle connection from the pool or a new connection if
+// the pool has room for one. Idle connections that have timed out are closed.
+func (p *rawPool) borrow() (*rawConn, error) {
+	for {
+		select {
+		case c := <-p.conns:
+			if p.o.IdleTimeout > 0 && time.Since(c.lastActivity) > p.o.IdleTimeout {
+				p.discard(c)
+				continue
+			}
+			return c, nil
+		default:
+		}
+
+		p.mut.Lock()
+		if p.numConns < p.o.MaxConns {
+			p.numConns++
+			p.mut.Unlock()
+
+			c, err := p.dial()
+			if err != nil {
+				p.mut.Lock()
+				p.numConns--
+				p.mut.Unlock()
+				return nil, err
+			}
+			return c, nil
+		}
+		p.mut.Unlock()
+
+		select {
+		case c := <-p.conns:
+			return c, nil
+		case <-time.After(p.o.PoolWaitTimeout):
+			return nil, errors.New("timed out waiting for free conn in pool")
+		}
+	}
+}
+
+// release returns a connection to the pool. Connections that had non-SMTP
+// (network) errors are closed.
+func (p *rawPool) release(c *rawConn, err error) {
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			p.discard(c)
+			return
+		}
+		// Reset the SMTP transaction after a rejection.
+		if c.c.Reset() != nil {
+			p.discard(c)
+			return
+		}
+	}
+
+	c.lastActivity = time.Now()
+	select {
+	case p.conns <- c:
+	default:
+		p.discard(c)
+	}
+}
+
+func (p *rawPool) discard(c *rawConn) {
+	c.c.Close()
+	p.mut.Lock()
+	p.numConns--
+	p.mut.Unlock()
+}
+
+// dial opens a new SMTP connection.
+func (p *rawPool) dial() (*rawConn, error) {
+	nc, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", p.o.Host, p.o.Port), p.o.PoolWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(nc, p.o.Host)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if err := p.setup(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &rawConn{c: c, lastActivity: time.Now()}, nil
+}
+
+// setup does the HELLO, STARTTLS and AUTH steps on a new connection.
+func (p *rawPool) setup(c *smtp.Client) error {
+	if p.o.HelloHostname != "" {
+		if err := c.Hello(p.o.HelloHostname); err != nil {
+			return err
+		}
+	}
+
+	if p.o.TLSConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP STARTTLS extension not found")
+		}
+		if err := c.StartTLS(p.o.TLSConfig); err != nil {
+			return err
+		}
+	}
+
+	if p.o.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP AUTH extension not found")
+		}
+		if err := c.Auth(p.o.Auth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send sends a message on the connection and returns whether a failed
+// message can be retried.
+func (c *rawConn) send(from string, to []string, msg []byte) (bool, error) {
+	if err := c.c.Mail(from); err != nil {
+		return true, err
+	}
+	for _, r := range to {
+		if err := c.c.Rcpt(r); err != nil {
+			return true, err
+		}
+	}
+
+	w, err := c.c.Data()
+	if err != nil {
+		return true, err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return true, err
+	}
+	if err := w.Close(); err != nil {
+		return true, err
+	}
+
+	return false, nil
+}
@@ -0,0 +1,181 @@
+// Package mailgun is a messenger that sends e-mails via the Mailgun messages API.
+package mailgun
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/email"
+)
+
+// Mailgun allows a maximum of 3 tags per message.
+const maxTags = 3
+
+// API root URLs of the Mailgun regions.
+var regionURLs = map[string]string{
+	"us": "https://api.mailgun.net",
+	"eu": "https://api.eu.mailgun.net",
+}
+
+// Options represents Mailgun messenger options.
+type Options struct {
+	Name     string        `json:"name"`
+	Domain   string        `json:"domain"`
+	Region   string        `json:"region"`
+	APIKey   string        `json:"api_key"`
+	Tags     []string      `json:"tags"`
+	TestMode bool          `json:"test_mode"`
+	MaxConns int           `json:"max_conns"`
+	Retries  int           `json:"max_msg_retries"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// Mailgun represents the Mailgun messenger. Messages are sent as raw MIME
+// to the messages.mime endpoint so that custom headers and attachments are
+// retained. Mailgun's batch sending (recipient-variables) isn't used as it
+// relies on Mailgun's templating whereas listmonk renders every message.
+// Instead, messages are sent concurrently over max_conns connections.
+type Mailgun struct {
+	o   Options
+	url string
+	c   *http.Client
+}
+
+// New returns a new instance of the Mailgun messenger.
+func New(o Options) (*Mailgun, error) {
+	if o.Domain == "" || o.APIKey == "" {
+		return nil, errors.New("Mailgun domain and API key are required")
+	}
+	if o.Region == "" {
+		o.Region = "us"
+	}
+	root, ok := regionURLs[o.Region]
+	if !ok {
+		return nil, fmt.Errorf("unknown Mailgun region: %s", o.Region)
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	return &Mailgun{
+		o:   o,
+		url: fmt.Sprintf("%s/v3/%s/messages.mime", root, o.Domain),
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (g *Mailgun) Name() string {
+	return g.o.Name
+}
+
+// Push pushes a message to Mailgun.
+func (g *Mailgun) Push(m messenger.Message) error {
+	em := email.MakeEmail(m)
+	raw, err := em.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var (
+		body bytes.Buffer
+		w    = multipart.NewWriter(&body)
+	)
+	w.WriteField("to", strings.Join(m.To, ","))
+
+	// Static tags followed by the campaign's tags.
+	tags := g.o.Tags
+	if m.Campaign != nil {
+		tags = append(append([]string{}, tags...), m.Campaign.Tags...)
+		w.WriteField("v:campaign_uuid", m.Campaign.UUID)
+		if m.Subscriber.UUID != "" {
+			w.WriteField("v:subscriber_uuid", m.Subscriber.UUID)
+		}
+	}
+	for i, t := range tags {
+		if i == maxTags {
+			break
+		}
+		w.WriteField("o:tag", t)
+	}
+
+	if g.o.TestMode {
+		w.WriteField("o:testmode", "yes")
+	}
+
+	f, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	f.Write(raw)
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// Retry on throttling and server errors.
+	for n := 0; ; n++ {
+		retry, err := g.send(body.Bytes(), w.FormDataContentType())
+		if err == nil || !retry || n >= g.o.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(n+1) * time.Second)
+	}
+}
+
+// Flush flushes the message queue to the server.
+func (g *Mailgun) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (g *Mailgun) Close() error {
+	g.c.CloseIdleConnections()
+	return nil
+}
+
+// send posts a message and returns whether a failed request can be retried.
+func (g *Mailgun) send(b []byte, contentType string) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, g.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.SetBasicAuth("api", g.o.APIKey)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "listmonk")
+
+	resp, err := g.c.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	// Mailgun returns errors as {"message": "..."}.
+	var e struct {
+		Message string `json:"message"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &e)
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("Mailgun error (%d): %s", resp.StatusCode, e.Message)
+}
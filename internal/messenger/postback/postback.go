@@ -2,11 +2,16 @@ package postback
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/knadh/listmonk/internal/messenger"
@@ -44,8 +49,29 @@ type Options struct {
 	Password string        `json:"password"`
 	RootURL  string        `json:"root_url"`
 	MaxConns int           `json:"max_conns"`
-	Retries  int           `json:"retries"`
+	Retries  int           `json:"max_msg_retries"`
 	Timeout  time.Duration `json:"timeout"`
+
+	// Optional secret with which request bodies are signed (HMAC-SHA256).
+	SigningSecret string `json:"signing_secret"`
+
+	// Number of messages to post per request. If it's more than 1, messages
+	// are queued and posted together as a JSON array when the batch is full
+	// or every batchInterval, whichever is sooner. Push waits for the batch
+	// to be posted and returns its result.
+	BatchSize int `json:"batch_size"`
+}
+
+// Stats represents the request counters of a Postback endpoint.
+type Stats struct {
+	Name        string     `json:"name"`
+	RootURL     string     `json:"root_url"`
+	Requests    uint64     `json:"requests"`
+	Messages    uint64     `json:"messages"`
+	Errors      uint64     `json:"errors"`
+	Retries     uint64     `json:"retries"`
+	LastError   string     `json:"last_error"`
+	LastErrorAt *time.Time `json:"last_error_at"`
 }
 
 // Postback represents an HTTP Message server.
@@ -53,8 +79,30 @@ type Postback struct {
 	authStr string
 	o       Options
 	c       *http.Client
+
+	// Messages queued for the next batch.
+	batch   []batchMsg
+	batchMu sync.Mutex
+	done    chan bool
+
+	stats   Stats
+	statsMu sync.Mutex
+}
+
+// batchMsg is a message queued in a batch. The result of posting the
+// batch is sent on done.
+type batchMsg struct {
+	pb   postback
+	done chan error
 }
 
+// Interval at which incomplete batches are posted. As Push waits for the
+// batch to be posted, this is the max. time a message waits in a batch.
+const batchInterval = time.Millisecond * 200
+
+// Max. wait between retries.
+const maxBackoff = time.Second * 30
+
 // New returns a new instance of the HTTP Postback messenger.
 func New(o Options) (*Postback, error) {
 	authStr := ""
@@ -63,7 +111,7 @@ func New(o Options) (*Postback, error) {
 			[]byte(o.Username+":"+o.Password)))
 	}
 
-	return &Postback{
+	p := &Postback{
 		authStr: authStr,
 		o:       o,
 		c: &http.Client{
@@ -75,7 +123,16 @@ func New(o Options) (*Postback, error) {
 				IdleConnTimeout:       o.Timeout,
 			},
 		},
-	}, nil
+		stats: Stats{Name: o.Name, RootURL: o.RootURL},
+	}
+
+	if o.BatchSize > 1 {
+		p.batch = make([]batchMsg, 0, o.BatchSize)
+		p.done = make(chan bool)
+		go p.flushBatches()
+	}
+
+	return p, nil
 }
 
 // Name returns the messenger's name.
@@ -106,26 +163,163 @@ func (p *Postback) Push(m messenger.Message) error {
 		}
 	}
 
+	if p.o.BatchSize > 1 {
+		return p.queue(pb)
+	}
+
 	b, err := pb.MarshalJSON()
 	if err != nil {
 		return err
 	}
 
-	return p.exec(http.MethodPost, p.o.RootURL, b, nil)
+	return p.post(b, 1)
 }
 
-// Flush flushes the message queue to the server.
+// Flush posts the messages queued in the current batch, if any, and
+// returns the error of posting them.
 func (p *Postback) Flush() error {
-	return nil
+	if p.o.BatchSize < 2 {
+		return nil
+	}
+
+	p.batchMu.Lock()
+	batch := p.batch
+	p.batch = make([]batchMsg, 0, p.o.BatchSize)
+	p.batchMu.Unlock()
+
+	return p.postBatch(batch)
 }
 
-// Close closes idle HTTP connections.
+// Close posts any queued messages and closes idle HTTP connections.
 func (p *Postback) Close() error {
+	var err error
+	if p.done != nil {
+		close(p.done)
+		err = p.Flush()
+	}
 	p.c.CloseIdleConnections()
-	return nil
+	return err
+}
+
+// Stats returns the request counters of the Postback endpoint.
+func (p *Postback) Stats() Stats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	return p.stats
+}
+
+// queue adds a message to the current batch, posts the batch if it's full,
+// and returns the result of posting the batch that the message is in. That
+// way, failed deliveries are reported for every message like unbatched ones.
+func (p *Postback) queue(pb postback) error {
+	m := batchMsg{pb: pb, done: make(chan error, 1)}
+
+	p.batchMu.Lock()
+	p.batch = append(p.batch, m)
+	if len(p.batch) < p.o.BatchSize {
+		p.batchMu.Unlock()
+		return <-m.done
+	}
+
+	batch := p.batch
+	p.batch = make([]batchMsg, 0, p.o.BatchSize)
+	p.batchMu.Unlock()
+
+	p.postBatch(batch)
+	return <-m.done
 }
 
-func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header) error {
+// flushBatches periodically posts incomplete batches so that messages
+// aren't held back when the rate of messages is low.
+func (p *Postback) flushBatches() {
+	t := time.NewTicker(batchInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			// Errors are returned to the Push calls of the messages.
+			p.Flush()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// postBatch posts a batch of messages as a JSON array and sends the result
+// to each message in the batch.
+func (p *Postback) postBatch(batch []batchMsg) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := p.marshalAndPost(batch)
+	for _, m := range batch {
+		m.done <- err
+	}
+	return err
+}
+
+// marshalAndPost posts the messages of a batch as a JSON array.
+func (p *Postback) marshalAndPost(batch []batchMsg) error {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, m := range batch {
+		b, err := m.pb.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte(']')
+
+	return p.post(buf.Bytes(), len(batch))
+}
+
+// post posts a request body with n messages to the server. Requests that
+// fail with network errors or 5xx responses are retried with exponential
+// backoff up to the configured number of retries.
+func (p *Postback) post(b []byte, n int) error {
+	var (
+		wait = time.Second
+		err  error
+	)
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = p.exec(http.MethodPost, p.o.RootURL, b, nil)
+		if err == nil || !retry || i >= p.o.Retries {
+			break
+		}
+
+		p.statsMu.Lock()
+		p.stats.Retries++
+		p.statsMu.Unlock()
+
+		time.Sleep(wait)
+		if wait *= 2; wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+
+	p.statsMu.Lock()
+	p.stats.Requests++
+	p.stats.Messages += uint64(n)
+	if err != nil {
+		now := time.Now()
+		p.stats.Errors++
+		p.stats.LastError = err.Error()
+		p.stats.LastErrorAt = &now
+	}
+	p.statsMu.Unlock()
+
+	return err
+}
+
+// exec makes an HTTP request and returns whether a failed request can be retried.
+func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header) (bool, error) {
 	var (
 		err      error
 		postBody io.Reader
@@ -138,7 +332,7 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 
 	req, err := http.NewRequest(method, rURL, postBody)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if headers != nil {
@@ -153,6 +347,14 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 		req.Header.Set("Authorization", p.authStr)
 	}
 
+	// Optional signature of the timestamp and the body. The timestamp
+	// allows the server to reject replayed requests.
+	if p.o.SigningSecret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Listmonk-Timestamp", ts)
+		req.Header.Set("X-Listmonk-Signature", "sha256="+sign(p.o.SigningSecret, ts, reqBody))
+	}
+
 	// If a content-type isn't set, set the default one.
 	if req.Header.Get("Content-Type") == "" {
 		if method == http.MethodPost || method == http.MethodPut {
@@ -167,7 +369,7 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 
 	r, err := p.c.Do(req)
 	if err != nil {
-		return err
+		return true, err
 	}
 	defer func() {
 		// Drain and close the body to let the Transport reuse the connection
@@ -176,8 +378,18 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 	}()
 
 	if r.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-OK response from Postback server: %d", r.StatusCode)
+		return r.StatusCode >= 500, fmt.Errorf("non-OK response from Postback server: %d", r.StatusCode)
 	}
 
-	return nil
+	return false, nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 signature of a timestamp and
+// a request body joined by a dot.
+func sign(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
 }
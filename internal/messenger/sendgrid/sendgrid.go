@@ -0,0 +1,337 @@
+// Package sendgrid is a messenger that sends e-mails via the SendGrid v3 mail/send API.
+package sendgrid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const (
+	defaultURL = "https://api.sendgrid.com"
+
+	// SendGrid allows a maximum of 10 categories per message.
+	maxCategories = 10
+)
+
+// Headers that SendGrid rejects in the headers object of a message
+// as they're set from the message's fields.
+var reservedHeaders = map[string]bool{
+	"to":                        true,
+	"from":                      true,
+	"subject":                   true,
+	"reply-to":                  true,
+	"cc":                        true,
+	"bcc":                       true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"mime-version":              true,
+	"date":                      true,
+	"dkim-signature":            true,
+	"received":                  true,
+	"x-sg-id":                   true,
+	"x-sg-eid":                  true,
+}
+
+// Options represents SendGrid messenger options.
+type Options struct {
+	Name        string        `json:"name"`
+	APIKey      string        `json:"api_key"`
+	IPPool      string        `json:"ip_pool"`
+	SandboxMode bool          `json:"sandbox_mode"`
+	MaxConns    int           `json:"max_conns"`
+	Retries     int           `json:"max_msg_retries"`
+	Timeout     time.Duration `json:"timeout"`
+
+	// Group all the messages of a campaign under a SendGrid batch ID
+	// so that the campaign's sends can be paused or cancelled on SendGrid.
+	BatchCampaigns bool `json:"batch_campaigns"`
+
+	// Optional API root URL override (eg: the EU region https://api.eu.sendgrid.com).
+	RootURL string `json:"root_url"`
+}
+
+// SendGrid represents the SendGrid messenger.
+type SendGrid struct {
+	o Options
+	c *http.Client
+
+	// Campaign UUID => SendGrid batch ID.
+	batches map[string]string
+	mut     sync.Mutex
+}
+
+// mailReq is the v3 mail/send request.
+type mailReq struct {
+	Personalizations []personalization `json:"personalizations"`
+	From             address           `json:"from"`
+	ReplyTo          *address          `json:"reply_to,omitempty"`
+	Subject          string            `json:"subject"`
+	Content          []content         `json:"content"`
+	Attachments      []attachment      `json:"attachments,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Categories       []string          `json:"categories,omitempty"`
+	CustomArgs       map[string]string `json:"custom_args,omitempty"`
+	BatchID          string            `json:"batch_id,omitempty"`
+	IPPoolName       string            `json:"ip_pool_name,omitempty"`
+	MailSettings     *mailSettings     `json:"mail_settings,omitempty"`
+}
+
+type personalization struct {
+	To []address `json:"to"`
+}
+
+type address struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type content struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type attachment struct {
+	Content     string `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition"`
+}
+
+type mailSettings struct {
+	SandboxMode struct {
+		Enable bool `json:"enable"`
+	} `json:"sandbox_mode"`
+}
+
+// New returns a new instance of the SendGrid messenger.
+func New(o Options) (*SendGrid, error) {
+	if o.APIKey == "" {
+		return nil, errors.New("SendGrid API key is required")
+	}
+	if o.RootURL == "" {
+		o.RootURL = defaultURL
+	}
+	o.RootURL = strings.TrimRight(o.RootURL, "/")
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	return &SendGrid{
+		o: o,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+		batches: make(map[string]string),
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (s *SendGrid) Name() string {
+	return s.o.Name
+}
+
+// Push pushes a message to SendGrid.
+func (s *SendGrid) Push(m messenger.Message) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %v", err)
+	}
+
+	var to []address
+	for _, t := range m.To {
+		a, err := mail.ParseAddress(t)
+		if err != nil {
+			return fmt.Errorf("invalid to address: %v", err)
+		}
+		to = append(to, address{Email: a.Address, Name: a.Name})
+	}
+
+	r := mailReq{
+		Personalizations: []personalization{{To: to}},
+		From:             address{Email: from.Address, Name: from.Name},
+		Subject:          m.Subject,
+		IPPoolName:       s.o.IPPool,
+	}
+
+	// text/plain has to precede text/html.
+	switch m.ContentType {
+	case "plain":
+		r.Content = []content{{Type: "text/plain", Value: string(m.Body)}}
+	default:
+		if len(m.AltBody) > 0 {
+			r.Content = append(r.Content, content{Type: "text/plain", Value: string(m.AltBody)})
+		}
+		r.Content = append(r.Content, content{Type: "text/html", Value: string(m.Body)})
+	}
+
+	for k := range m.Headers {
+		if strings.ToLower(k) == "reply-to" {
+			if a, err := mail.ParseAddress(m.Headers.Get(k)); err == nil {
+				r.ReplyTo = &address{Email: a.Address, Name: a.Name}
+			}
+			continue
+		}
+		if reservedHeaders[strings.ToLower(k)] {
+			continue
+		}
+		if r.Headers == nil {
+			r.Headers = make(map[string]string)
+		}
+		r.Headers[k] = m.Headers.Get(k)
+	}
+
+	for _, a := range m.Attachments {
+		typ := ""
+		if t, _, err := mime.ParseMediaType(a.Header.Get("Content-Type")); err == nil {
+			typ = t
+		}
+		r.Attachments = append(r.Attachments, attachment{
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			Filename:    a.Name,
+			Type:        typ,
+			Disposition: "attachment",
+		})
+	}
+
+	// Campaign and subscriber UUIDs are sent as custom args that are
+	// returned in SendGrid's event webhooks and campaign tags are sent
+	// as categories for SendGrid's stats.
+	if m.Campaign != nil {
+		r.CustomArgs = map[string]string{"campaign_uuid": m.Campaign.UUID}
+		if m.Subscriber.UUID != "" {
+			r.CustomArgs["subscriber_uuid"] = m.Subscriber.UUID
+		}
+
+		for _, t := range m.Campaign.Tags {
+			if len(r.Categories) == maxCategories {
+				break
+			}
+			r.Categories = append(r.Categories, t)
+		}
+
+		if s.o.BatchCampaigns {
+			id, err := s.getBatchID(m.Campaign.UUID)
+			if err != nil {
+				return err
+			}
+			r.BatchID = id
+		}
+	}
+
+	if s.o.SandboxMode {
+		r.MailSettings = &mailSettings{}
+		r.MailSettings.SandboxMode.Enable = true
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	// Retry on throttling and server errors.
+	for n := 0; ; n++ {
+		_, retry, err := s.exec(http.MethodPost, "/v3/mail/send", b)
+		if err == nil || !retry || n >= s.o.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(n+1) * time.Second)
+	}
+}
+
+// Flush flushes the message queue to the server.
+func (s *SendGrid) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (s *SendGrid) Close() error {
+	s.c.CloseIdleConnections()
+	return nil
+}
+
+// getBatchID returns the SendGrid batch ID of a campaign, creating
+// one on the first message of the campaign.
+func (s *SendGrid) getBatchID(campUUID string) (string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if id, ok := s.batches[campUUID]; ok {
+		return id, nil
+	}
+
+	body, _, err := s.exec(http.MethodPost, "/v3/mail/batch", nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating SendGrid batch: %v", err)
+	}
+
+	var out struct {
+		BatchID string `json:"batch_id"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("error reading SendGrid batch: %v", err)
+	}
+
+	s.batches[campUUID] = out.BatchID
+	return out.BatchID, nil
+}
+
+// exec makes an API request and returns the response body and whether
+// a failed request can be retried.
+func (s *SendGrid) exec(method, path string, b []byte) ([]byte, bool, error) {
+	req, err := http.NewRequest(method, s.o.RootURL+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.o.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "listmonk")
+
+	resp, err := s.c.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return body, false, nil
+	}
+
+	// SendGrid returns errors as {"errors": [{"message": "..."}]}.
+	var e struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(body, &e)
+
+	msg := make([]string, 0, len(e.Errors))
+	for _, m := range e.Errors {
+		msg = append(msg, m.Message)
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return nil, retry, fmt.Errorf("SendGrid error (%d): %s", resp.StatusCode, strings.Join(msg, "; "))
+}
@@ -0,0 +1,189 @@
+// Package ses is a messenger that sends e-mails via the Amazon SES v2 HTTP API.
+package ses
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/email"
+)
+
+const (
+	sendPath = "/v2/email/outbound-emails"
+
+	// Tag added to every message with the campaign's UUID.
+	tagCampaign = "listmonk_campaign"
+)
+
+// SES only allows alphanumeric characters, underscores, hyphens,
+// periods and @ in tag names and values.
+var reTag = regexp.MustCompile(`[^a-zA-Z0-9_\-\.@]`)
+
+// Options represents SES messenger options.
+type Options struct {
+	Name             string            `json:"name"`
+	Region           string            `json:"region"`
+	AccessKey        string            `json:"access_key"`
+	SecretKey        string            `json:"secret_key"`
+	ConfigurationSet string            `json:"configuration_set"`
+	Tags             map[string]string `json:"tags"`
+	MaxConns         int               `json:"max_conns"`
+	Retries          int               `json:"max_msg_retries"`
+	Timeout          time.Duration     `json:"timeout"`
+
+	// Optional API endpoint override (eg: VPC endpoints). Defaults to
+	// https://email.$region.amazonaws.com
+	Endpoint string `json:"endpoint"`
+}
+
+// SES represents the Amazon SES messenger.
+type SES struct {
+	o   Options
+	url string
+	c   *http.Client
+}
+
+// sendReq is the SES v2 SendEmail request. Messages are always sent as raw
+// MIME so that custom headers and attachments are supported.
+// SendBulkEmail isn't used as it only works with templates stored on SES,
+// whereas listmonk renders every message itself.
+type sendReq struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses []string `json:"ToAddresses"`
+	} `json:"Destination"`
+	Content struct {
+		Raw struct {
+			Data []byte `json:"Data"`
+		} `json:"Raw"`
+	} `json:"Content"`
+	ConfigurationSetName string `json:"ConfigurationSetName,omitempty"`
+	EmailTags            []tag  `json:"EmailTags,omitempty"`
+}
+
+type tag struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+// New returns a new instance of the SES messenger.
+func New(o Options) (*SES, error) {
+	if o.Region == "" || o.AccessKey == "" || o.SecretKey == "" {
+		return nil, errors.New("SES region, access key and secret key are required")
+	}
+	if o.Endpoint == "" {
+		o.Endpoint = fmt.Sprintf("https://email.%s.amazonaws.com", o.Region)
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	return &SES{
+		o:   o,
+		url: o.Endpoint + sendPath,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (s *SES) Name() string {
+	return s.o.Name
+}
+
+// Push pushes a message to SES.
+func (s *SES) Push(m messenger.Message) error {
+	em := email.MakeEmail(m)
+	raw, err := em.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var r sendReq
+	r.FromEmailAddress = m.From
+	r.Destination.ToAddresses = m.To
+	r.Content.Raw.Data = raw
+	r.ConfigurationSetName = s.o.ConfigurationSet
+
+	for k, v := range s.o.Tags {
+		r.EmailTags = append(r.EmailTags, tag{Name: sanitizeTag(k), Value: sanitizeTag(v)})
+	}
+	if m.Campaign != nil {
+		r.EmailTags = append(r.EmailTags, tag{Name: tagCampaign, Value: m.Campaign.UUID})
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	// Retry on throttling and server errors.
+	for n := 0; ; n++ {
+		retry, err := s.send(b)
+		if err == nil || !retry || n >= s.o.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(n+1) * time.Second)
+	}
+}
+
+// Flush flushes the message queue to the server.
+func (s *SES) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (s *SES) Close() error {
+	s.c.CloseIdleConnections()
+	return nil
+}
+
+// send posts a signed SendEmail request and returns whether a failed
+// request can be retried.
+func (s *SES) send(b []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "listmonk")
+	sign(req, b, s.o.AccessKey, s.o.SecretKey, s.o.Region, time.Now())
+
+	resp, err := s.c.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	// SES returns errors as {"message": "..."}.
+	var e struct {
+		Message string `json:"message"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &e)
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("SES error (%d): %s", resp.StatusCode, e.Message)
+}
+
+func sanitizeTag(s string) string {
+	return reTag.ReplaceAllString(s, "_")
+}
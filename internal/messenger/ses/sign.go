@@ -0,0 +1,86 @@
+package ses
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	service   = "ses"
+	algorithm = "AWS4-HMAC-SHA256"
+)
+
+// sign signs an HTTP request with AWS Signature Version 4.
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func sign(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	var (
+		t       = now.UTC()
+		amzDate = t.Format("20060102T150405Z")
+		day     = t.Format("20060102")
+		payload = hashHex(body)
+	)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	// Canonical headers are lowercased, sorted and trimmed.
+	var (
+		names   = make([]string, 0, len(req.Header))
+		headers = make(map[string]string, len(req.Header))
+	)
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		names = append(names, k)
+		headers[k] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+
+	var ch strings.Builder
+	for _, k := range names {
+		ch.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		ch.String(),
+		signed,
+		payload,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", day, region, service)
+	toSign := strings.Join([]string{algorithm, amzDate, scope, hashHex([]byte(canonical))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, accessKey, scope, signed, sig))
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
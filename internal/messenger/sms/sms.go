@@ -0,0 +1,220 @@
+// Package sms is a messenger that sends text messages via Twilio or
+// a generic HTTP SMS gateway. Phone numbers are read from an attribute
+// in the subscriber's attribs.
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// SMS providers.
+const (
+	ProviderTwilio = "twilio"
+	ProviderHTTP   = "http"
+)
+
+const twilioURL = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+
+// Options represents SMS messenger options.
+type Options struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+
+	// Twilio account SID and auth token. For HTTP gateways, the
+	// auth token, if set, is sent as a bearer token.
+	AccountSID string `json:"account_sid"`
+	AuthToken  string `json:"auth_token"`
+
+	// Sender phone number or ID.
+	From string `json:"from"`
+
+	// Root URL of the HTTP gateway.
+	URL string `json:"url"`
+
+	// The subscriber attribute that has the phone number. eg: "phone".
+	PhoneAttrib string `json:"phone_attrib"`
+
+	MaxConns int           `json:"max_conns"`
+	Retries  int           `json:"max_msg_retries"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// SMS represents the SMS messenger.
+type SMS struct {
+	o Options
+	c *http.Client
+}
+
+// gatewayMsg is the payload that's posted as JSON to HTTP SMS gateways.
+type gatewayMsg struct {
+	To             string `json:"to"`
+	From           string `json:"from"`
+	Body           string `json:"body"`
+	SubscriberUUID string `json:"subscriber_uuid"`
+	CampaignUUID   string `json:"campaign_uuid,omitempty"`
+}
+
+// New returns a new instance of the SMS messenger.
+func New(o Options) (*SMS, error) {
+	switch o.Provider {
+	case ProviderTwilio:
+		if o.AccountSID == "" || o.AuthToken == "" || o.From == "" {
+			return nil, errors.New("Twilio account SID, auth token and from number are required")
+		}
+	case ProviderHTTP:
+		if u, err := url.Parse(o.URL); err != nil || u.Host == "" {
+			return nil, errors.New("invalid SMS gateway URL")
+		}
+	default:
+		return nil, fmt.Errorf("unknown SMS provider: %s", o.Provider)
+	}
+
+	if o.PhoneAttrib == "" {
+		o.PhoneAttrib = "phone"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	return &SMS{
+		o: o,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (s *SMS) Name() string {
+	return s.o.Name
+}
+
+// Push pushes a message to the SMS provider.
+func (s *SMS) Push(m messenger.Message) error {
+	to, _ := m.Subscriber.Attribs[s.o.PhoneAttrib].(string)
+	to = strings.TrimSpace(to)
+	if to == "" {
+		return fmt.Errorf("subscriber %s has no phone number in the `%s` attribute",
+			m.Subscriber.UUID, s.o.PhoneAttrib)
+	}
+
+	// Text messages are sent as plain text. For other content types,
+	// the plain text alt body is preferred.
+	body := m.Body
+	if m.ContentType != models.CampaignContentTypeSMS &&
+		m.ContentType != models.CampaignContentTypePlain && len(m.AltBody) > 0 {
+		body = m.AltBody
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+	switch s.o.Provider {
+	case ProviderTwilio:
+		p := url.Values{}
+		p.Set("To", to)
+		p.Set("From", s.o.From)
+		p.Set("Body", string(body))
+
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf(twilioURL, s.o.AccountSID),
+			strings.NewReader(p.Encode()))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(s.o.AccountSID, s.o.AuthToken)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	default:
+		msg := gatewayMsg{
+			To:             to,
+			From:           s.o.From,
+			Body:           string(body),
+			SubscriberUUID: m.Subscriber.UUID,
+		}
+		if m.Campaign != nil {
+			msg.CampaignUUID = m.Campaign.UUID
+		}
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		req, err = http.NewRequest(http.MethodPost, s.o.URL, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.o.AuthToken != "" {
+			req.Header.Set("Authorization", "Bearer "+s.o.AuthToken)
+		}
+	}
+	req.Header.Set("User-Agent", "listmonk")
+
+	// Retry on throttling and server errors. The request body is
+	// buffered so that it can be replayed.
+	for n := 0; ; n++ {
+		retry, err := s.send(req)
+		if err == nil || !retry || n >= s.o.Retries {
+			return err
+		}
+		time.Sleep(time.Duration(n+1) * time.Second)
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Flush flushes the message queue to the server.
+func (s *SMS) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (s *SMS) Close() error {
+	s.c.CloseIdleConnections()
+	return nil
+}
+
+// send sends a request and returns whether a failed request can be retried.
+func (s *SMS) send(req *http.Request) (bool, error) {
+	resp, err := s.c.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+
+	// Twilio returns errors as {"message": "..."}.
+	var e struct {
+		Message string `json:"message"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &e)
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("SMS error (%d): %s", resp.StatusCode, e.Message)
+}
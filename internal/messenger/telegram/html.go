@@ -0,0 +1,302 @@
+package telegram
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+var errMsgTooLong = errors.New("message can't be split into Telegram messages")
+
+var (
+	reSpaces   = regexp.MustCompile(`[ \t\r\n]+`)
+	reLineEdge = regexp.MustCompile(`[ \t]*\n[ \t]*`)
+	reNewlines = regexp.MustCompile(`\n{3,}`)
+)
+
+// Formatting tags that Telegram supports as-is.
+var allowedTags = map[string]bool{
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true,
+	"s": true, "strike": true, "del": true, "code": true, "pre": true,
+}
+
+// Tags whose content is never shown.
+var hiddenTags = map[string]bool{
+	"head": true, "style": true, "script": true, "title": true,
+}
+
+// Block tags that are separated by line breaks.
+var blockTags = map[string]bool{
+	"p": true, "div": true, "table": true, "tr": true, "ul": true, "ol": true,
+	"blockquote": true, "section": true, "header": true, "footer": true,
+}
+
+// toTelegramHTML reduces an HTML document to the subset of HTML that the
+// Telegram bot API supports. Block elements are turned into line breaks,
+// headings into bold text, list items into bullets and unsupported tags
+// are dropped.
+func toTelegramHTML(s string) string {
+	var (
+		sb     strings.Builder
+		z      = html.NewTokenizer(strings.NewReader(s))
+		hidden = 0
+		pre    = 0
+
+		// Whether each open <a> was written out (links without a href aren't).
+		links []bool
+	)
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		switch tt {
+		case html.TextToken:
+			if hidden > 0 {
+				continue
+			}
+			t := string(z.Text())
+			if pre == 0 {
+				t = reSpaces.ReplaceAllString(t, " ")
+			}
+			sb.WriteString(html.EscapeString(t))
+
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			b, hasAttr := z.TagName()
+			var (
+				tag   = string(b)
+				start = tt != html.EndTagToken
+			)
+
+			if hiddenTags[tag] {
+				if tt == html.StartTagToken {
+					hidden++
+				} else if tt == html.EndTagToken && hidden > 0 {
+					hidden--
+				}
+				continue
+			}
+			if hidden > 0 {
+				continue
+			}
+
+			switch {
+			case allowedTags[tag]:
+				if tag == "pre" {
+					if start {
+						pre++
+					} else if pre > 0 {
+						pre--
+					}
+				}
+				if start {
+					sb.WriteString("<" + tag + ">")
+				} else {
+					sb.WriteString("</" + tag + ">")
+				}
+
+			case tag == "a":
+				if !start {
+					if n := len(links); n > 0 {
+						if links[n-1] {
+							sb.WriteString("</a>")
+						}
+						links = links[:n-1]
+					}
+					continue
+				}
+
+				href := ""
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					if string(k) == "href" {
+						href = string(v)
+					}
+				}
+				if href == "" || tt == html.SelfClosingTagToken {
+					links = append(links, false)
+					continue
+				}
+				sb.WriteString(`<a href="` + html.EscapeString(href) + `">`)
+				links = append(links, true)
+
+			case tag == "br":
+				sb.WriteString("\n")
+
+			case tag == "hr":
+				sb.WriteString("\n\n")
+
+			case tag == "li":
+				if start {
+					sb.WriteString("\n• ")
+				}
+
+			case len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6':
+				if start {
+					sb.WriteString("\n\n<b>")
+				} else {
+					sb.WriteString("</b>\n\n")
+				}
+
+			case blockTags[tag]:
+				sb.WriteString("\n\n")
+			}
+		}
+	}
+
+	out := reLineEdge.ReplaceAllString(sb.String(), "\n")
+	out = reNewlines.ReplaceAllString(out, "\n\n")
+	return strings.TrimSpace(out)
+}
+
+// splitHTML splits Telegram HTML into chunks of at most max characters
+// (including markup), at spaces and line breaks where possible. Tags that
+// are open at the end of a chunk are closed in it and reopened in the next
+// one so that every chunk is valid HTML on its own.
+func splitHTML(s string, max int) ([]string, error) {
+	var (
+		out []string
+		cur strings.Builder
+
+		// Length of the current chunk and of the tags it was reopened with.
+		n, base int
+
+		// Open tags as written (eg: <a href="..">) and their closing tags.
+		open, closes []string
+		closeN       int
+	)
+
+	// flush closes the open tags, ends the current chunk and starts a new
+	// one with the open tags reopened.
+	flush := func() {
+		for i := len(closes) - 1; i >= 0; i-- {
+			cur.WriteString(closes[i])
+		}
+		if c := strings.TrimSpace(cur.String()); hasText(c) {
+			out = append(out, c)
+		}
+
+		cur.Reset()
+		n = 0
+		for _, t := range open {
+			cur.WriteString(t)
+			n += utf8.RuneCountInString(t)
+		}
+		base = n
+	}
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		switch tt {
+		case html.TextToken:
+			for _, w := range splitWords(string(z.Text())) {
+				for w != "" {
+					e := html.EscapeString(w)
+					if n+utf8.RuneCountInString(e)+closeN <= max {
+						cur.WriteString(e)
+						n += utf8.RuneCountInString(e)
+						break
+					}
+
+					// Move the word to the next chunk.
+					if n > base {
+						flush()
+						continue
+					}
+
+					// The word doesn't fit in a chunk by itself. Cut it.
+					cut, l := 0, 0
+					for i, r := range w {
+						rl := utf8.RuneCountInString(html.EscapeString(string(r)))
+						if n+l+rl+closeN > max {
+							break
+						}
+						cut, l = i+utf8.RuneLen(r), l+rl
+					}
+					if cut == 0 {
+						return nil, errMsgTooLong
+					}
+					cur.WriteString(html.EscapeString(w[:cut]))
+					n += l
+					w = w[cut:]
+					flush()
+				}
+			}
+
+		case html.StartTagToken:
+			var (
+				t       = string(z.Raw())
+				name, _ = z.TagName()
+				c       = "</" + string(name) + ">"
+				l       = utf8.RuneCountInString(t)
+			)
+			if n+l+closeN+len(c) > max && n > base {
+				flush()
+			}
+			if n+l+closeN+len(c) > max {
+				return nil, errMsgTooLong
+			}
+			cur.WriteString(t)
+			n += l
+			open, closes = append(open, t), append(closes, c)
+			closeN += len(c)
+
+		case html.EndTagToken:
+			if len(open) == 0 {
+				continue
+			}
+			c := closes[len(closes)-1]
+			open, closes = open[:len(open)-1], closes[:len(closes)-1]
+			closeN -= len(c)
+			cur.WriteString(c)
+			n += len(c)
+		}
+	}
+	flush()
+
+	if len(out) == 0 {
+		return nil, errors.New("empty message")
+	}
+	return out, nil
+}
+
+// splitWords splits text into lines and words, keeping the line breaks and
+// spaces so that joining the pieces gives the original text.
+func splitWords(s string) []string {
+	var out []string
+	for len(s) > 0 {
+		i := strings.IndexAny(s, " \n")
+		if i < 0 {
+			return append(out, s)
+		}
+		out = append(out, s[:i+1])
+		s = s[i+1:]
+	}
+	return out
+}
+
+// hasText checks whether HTML has any text that isn't whitespace.
+func hasText(s string) bool {
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return false
+		case html.TextToken:
+			if strings.TrimSpace(string(z.Text())) != "" {
+				return true
+			}
+		}
+	}
+}
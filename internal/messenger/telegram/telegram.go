@@ -0,0 +1,193 @@
+// Package telegram is a messenger that delivers messages to Telegram chats
+// via the Telegram bot API. Chat IDs are read from an attribute in the
+// subscriber's attribs.
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	apiURL = "https://api.telegram.org/bot%s/sendMessage"
+
+	// Maximum length of a Telegram message. Longer messages are
+	// split into multiple messages.
+	maxMsgLen = 4096
+)
+
+// Options represents Telegram messenger options.
+type Options struct {
+	Name     string `json:"name"`
+	BotToken string `json:"bot_token"`
+
+	// The subscriber attribute that has the chat ID. eg: "telegram_chat_id".
+	ChatIDAttrib string `json:"chat_id_attrib"`
+
+	// Disable link previews in messages.
+	DisablePreview bool `json:"disable_preview"`
+
+	MaxConns int           `json:"max_conns"`
+	Retries  int           `json:"max_msg_retries"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// Telegram represents the Telegram messenger.
+type Telegram struct {
+	o   Options
+	url string
+	c   *http.Client
+}
+
+type sendReq struct {
+	ChatID                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	ParseMode             string `json:"parse_mode"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+// New returns a new instance of the Telegram messenger.
+func New(o Options) (*Telegram, error) {
+	if o.BotToken == "" {
+		return nil, errors.New("Telegram bot token is required")
+	}
+	if o.ChatIDAttrib == "" {
+		o.ChatIDAttrib = "telegram_chat_id"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	return &Telegram{
+		o:   o,
+		url: fmt.Sprintf(apiURL, o.BotToken),
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (t *Telegram) Name() string {
+	return t.o.Name
+}
+
+// Push pushes a message to a Telegram chat.
+func (t *Telegram) Push(m messenger.Message) error {
+	// Chat IDs may be stored as numbers or strings (@channelname).
+	var chatID string
+	switch v := m.Subscriber.Attribs[t.o.ChatIDAttrib].(type) {
+	case string:
+		chatID = strings.TrimSpace(v)
+	case float64:
+		chatID = fmt.Sprintf("%.0f", v)
+	}
+	if chatID == "" {
+		return fmt.Errorf("subscriber %s has no chat ID in the `%s` attribute",
+			m.Subscriber.UUID, t.o.ChatIDAttrib)
+	}
+
+	// Messages are sent with Telegram's HTML formatting. HTML (and Markdown,
+	// which is rendered to HTML) bodies are reduced to the tags that Telegram
+	// supports and plain text bodies are escaped.
+	var text string
+	switch m.ContentType {
+	case models.CampaignContentTypePlain, models.CampaignContentTypeSMS:
+		text = html.EscapeString(string(m.Body))
+	default:
+		text = toTelegramHTML(string(m.Body))
+	}
+	if text == "" {
+		return errors.New("empty message")
+	}
+
+	// Split long messages before sending any part so that a message that
+	// can't be split isn't partially delivered.
+	parts, err := splitHTML(text, maxMsgLen)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		b, err := json.Marshal(sendReq{
+			ChatID:                chatID,
+			Text:                  part,
+			ParseMode:             "HTML",
+			DisableWebPagePreview: t.o.DisablePreview,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Retry on throttling and server errors.
+		for n := 0; ; n++ {
+			retry, err := t.send(b)
+			if err == nil {
+				break
+			}
+			if !retry || n >= t.o.Retries {
+				return err
+			}
+			time.Sleep(time.Duration(n+1) * time.Second)
+		}
+	}
+
+	return nil
+}
+
+// Flush flushes the message queue to the server.
+func (t *Telegram) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (t *Telegram) Close() error {
+	t.c.CloseIdleConnections()
+	return nil
+}
+
+// send posts a message and returns whether a failed request can be retried.
+func (t *Telegram) send(b []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "listmonk")
+
+	resp, err := t.c.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	// Telegram returns errors as {"ok": false, "description": "..."}.
+	var e struct {
+		Description string `json:"description"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &e)
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("Telegram error (%d): %s", resp.StatusCode, e.Description)
+}
@@ -0,0 +1,179 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Record size of the encrypted payload (RFC 8188).
+const recordSize = 4096
+
+var b64 = base64.RawURLEncoding
+
+// GenerateKeys generates a new VAPID (P-256) key pair and returns the
+// URL safe base64 encoded public and private keys.
+func GenerateKeys() (string, string, error) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return b64.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)), b64.EncodeToString(priv), nil
+}
+
+// parsePrivateKey parses a base64 encoded VAPID private key.
+func parsePrivateKey(pub, priv string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeKey(priv)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("invalid VAPID private key")
+	}
+	p, err := decodeKey(pub)
+	if err != nil {
+		return nil, errors.New("invalid VAPID public key")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), p)
+	if x == nil {
+		return nil, errors.New("invalid VAPID public key")
+	}
+
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+		D:         new(big.Int).SetBytes(d),
+	}, nil
+}
+
+// vapidAuth returns the VAPID Authorization header (RFC 8292) for a push endpoint.
+func vapidAuth(endpoint, subject string, pubKey string, key *ecdsa.PrivateKey) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	hdr, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(time.Hour * 12).Unix(),
+		"sub": subject,
+	})
+	unsigned := b64.EncodeToString(hdr) + "." + b64.EncodeToString(claims)
+
+	h := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		return "", err
+	}
+
+	// ES256 signatures are the 32 byte r and s values concatenated.
+	sig := append(padInt(r, 32), padInt(s, 32)...)
+
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, b64.EncodeToString(sig), pubKey), nil
+}
+
+// encrypt encrypts a push message payload for a subscription with
+// the aes128gcm content encoding (RFC 8291).
+func encrypt(payload []byte, p256dh, auth string) ([]byte, error) {
+	uaPub, err := decodeKey(p256dh)
+	if err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	authSecret, err := decodeKey(auth)
+	if err != nil {
+		return nil, errors.New("invalid auth secret")
+	}
+
+	curve := elliptic.P256()
+	ux, uy := elliptic.Unmarshal(curve, uaPub)
+	if ux == nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+
+	// Ephemeral application server key pair and the ECDH shared secret.
+	asPriv, ax, ay, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPub := elliptic.Marshal(curve, ax, ay)
+
+	sx, _ := curve.ScalarMult(ux, uy, asPriv)
+	secret := padInt(sx, 32)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public)
+	info := append(append([]byte("WebPush: info\x00"), uaPub...), asPub...)
+	ikm := hkdf(authSecret, secret, info, 32)
+
+	var (
+		cek   = hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+		nonce = hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record with the last record padding delimiter.
+	data := gcm.Seal(nil, nonce, append(payload, 0x02), nil)
+
+	// Header: salt || record size || key ID length || key ID (as_public).
+	out := make([]byte, 0, 16+4+1+len(asPub)+len(data))
+	out = append(out, salt...)
+	rs := make([]byte, 4)
+	binary.BigEndian.PutUint32(rs, recordSize)
+	out = append(out, rs...)
+	out = append(out, byte(len(asPub)))
+	out = append(out, asPub...)
+	out = append(out, data...)
+
+	return out, nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869) for outputs of up to 32 bytes.
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	m := hmac.New(sha256.New, salt)
+	m.Write(ikm)
+	prk := m.Sum(nil)
+
+	m = hmac.New(sha256.New, prk)
+	m.Write(info)
+	m.Write([]byte{0x01})
+	return m.Sum(nil)[:n]
+}
+
+// padInt returns the big-endian bytes of i left padded to n bytes.
+func padInt(i *big.Int, n int) []byte {
+	out := make([]byte, n)
+	b := i.Bytes()
+	copy(out[n-len(b):], b)
+	return out
+}
+
+// decodeKey decodes a base64 encoded key from browsers which may
+// or may not be padded and URL safe.
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return b64.DecodeString(s)
+}
@@ -0,0 +1,224 @@
+// Package webpush is a messenger that delivers short notifications to
+// browsers via the Web Push protocol with VAPID authentication.
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/safehttp"
+	"github.com/knadh/listmonk/models"
+)
+
+// Name is the name of the web push messenger.
+const Name = "webpush"
+
+// Maximum length of the notification text. Push services accept
+// payloads of about 4KB.
+const maxBodyLen = 1000
+
+var (
+	reTags   = regexp.MustCompile(`(?s)<(head|style|script).*?</(head|style|script)>|<[^>]+>`)
+	reSpaces = regexp.MustCompile(`\s+`)
+)
+
+// Options represents web push messenger options.
+type Options struct {
+	// VAPID key pair (URL safe base64).
+	PublicKey  string `json:"vapid_public_key"`
+	PrivateKey string `json:"vapid_private_key"`
+
+	// Contact (mailto: or https:) URL sent to push services.
+	Subject string `json:"subject"`
+
+	// Time in seconds that push services hold messages for offline browsers.
+	TTL int `json:"ttl"`
+
+	// Root URL of the listmonk install. Clicking on a notification
+	// opens the campaign's message on it.
+	RootURL string `json:"-"`
+
+	MaxConns int           `json:"max_conns"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// Subscription is a browser's push subscription.
+type Subscription struct {
+	Endpoint string `db:"endpoint" json:"endpoint"`
+	P256dh   string `db:"p256dh" json:"p256dh"`
+	Auth     string `db:"auth" json:"auth"`
+}
+
+// Store fetches the push subscriptions of subscribers and deletes
+// subscriptions that have expired.
+type Store interface {
+	GetSubscriptions(subscriberID int) ([]Subscription, error)
+	DeleteSubscription(endpoint string) error
+}
+
+// WebPush represents the web push messenger.
+type WebPush struct {
+	o     Options
+	key   *ecdsa.PrivateKey
+	store Store
+	c     *http.Client
+}
+
+// notification is the JSON payload that's pushed to browsers and
+// shown by the service worker.
+type notification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url,omitempty"`
+}
+
+// New returns a new instance of the web push messenger.
+func New(o Options, s Store) (*WebPush, error) {
+	key, err := parsePrivateKey(o.PublicKey, o.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if o.TTL < 1 {
+		o.TTL = 86400
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	return &WebPush{
+		o:     o,
+		key:   key,
+		store: s,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			// Endpoints come from browsers, so they may not point to
+			// internal addresses.
+			Transport: &http.Transport{
+				DialContext:           safehttp.Dialer(o.Timeout).DialContext,
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (w *WebPush) Name() string {
+	return Name
+}
+
+// Push pushes a notification to all the browsers a subscriber has
+// registered. Subscribers without push subscriptions are skipped.
+func (w *WebPush) Push(m messenger.Message) error {
+	subs, err := w.store.GetSubscriptions(m.Subscriber.ID)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	n := notification{Title: m.Subject, Body: toText(m)}
+	if m.Campaign != nil && w.o.RootURL != "" {
+		n.URL = fmt.Sprintf("%s/campaign/%s/%s", w.o.RootURL, m.Campaign.UUID, m.Subscriber.UUID)
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, s := range subs {
+		if err := w.send(s, payload); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// Flush flushes the message queue to the server.
+func (w *WebPush) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (w *WebPush) Close() error {
+	w.c.CloseIdleConnections()
+	return nil
+}
+
+// send encrypts and posts a notification to a push subscription's endpoint.
+func (w *WebPush) send(s Subscription, payload []byte) error {
+	body, err := encrypt(payload, s.P256dh, s.Auth)
+	if err != nil {
+		return err
+	}
+
+	auth, err := vapidAuth(s.Endpoint, w.o.Subject, w.o.PublicKey, w.key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(w.o.TTL))
+
+	resp, err := w.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+
+	// The subscription has expired or the browser has unsubscribed.
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return w.store.DeleteSubscription(s.Endpoint)
+	}
+
+	return fmt.Errorf("non-OK response from push service: %d", resp.StatusCode)
+}
+
+// toText returns the plain text notification body of a message.
+func toText(m messenger.Message) string {
+	var s string
+	switch {
+	case m.ContentType == models.CampaignContentTypePlain || m.ContentType == models.CampaignContentTypeSMS:
+		s = string(m.Body)
+	case len(m.AltBody) > 0:
+		s = string(m.AltBody)
+	default:
+		s = html.UnescapeString(reTags.ReplaceAllString(string(m.Body), " "))
+	}
+
+	s = strings.TrimSpace(reSpaces.ReplaceAllString(s, " "))
+	if r := []rune(s); len(r) > maxBodyLen {
+		s = string(r[:maxBodyLen-1]) + "…"
+	}
+	return s
+}
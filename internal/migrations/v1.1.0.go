@@ -0,0 +1,708 @@
+package migrations
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf"
+	"github.com/knadh/stuffbin"
+)
+
+// V1_1_0 performs the DB migrations for v.1.1.0.
+func V1_1_0(db *sqlx.DB, fs stuffbin.FileSystem, ko *koanf.Koanf) error {
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS list_folders (
+			id              SERIAL PRIMARY KEY,
+			name            TEXT NOT NULL,
+			parent_id       INTEGER NULL REFERENCES list_folders(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_list_folders_parent_id ON list_folders(parent_id);
+
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS folder_id INTEGER NULL
+			REFERENCES list_folders(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_lists_folder_id ON lists(folder_id);
+	`); err != nil {
+		return err
+	}
+
+	// Adding an enum value can't be run in a transaction block along with
+	// other statements on older Postgres versions.
+	if _, err := db.Exec(`ALTER TYPE list_type ADD VALUE IF NOT EXISTS 'dynamic'`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`ALTER TYPE content_type ADD VALUE IF NOT EXISTS 'visual'`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`ALTER TYPE content_type ADD VALUE IF NOT EXISTS 'sms'`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS query TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS synced_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS from_email TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS reply_to TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS reply_to TEXT NOT NULL DEFAULT '';
+
+		CREATE TABLE IF NOT EXISTS sub_forms (
+			id              SERIAL PRIMARY KEY,
+			uuid            uuid NOT NULL UNIQUE,
+			name            TEXT NOT NULL,
+			list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			fields          JSONB NOT NULL DEFAULT '[]',
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_sub_forms_list_id ON sub_forms(list_id);
+
+		CREATE TABLE IF NOT EXISTS list_webhooks (
+			id              SERIAL PRIMARY KEY,
+			list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			url             TEXT NOT NULL,
+			events          TEXT[] NOT NULL DEFAULT '{}',
+			enabled         BOOLEAN NOT NULL DEFAULT true,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_list_webhooks_list_id ON list_webhooks(list_id);
+
+		CREATE TABLE IF NOT EXISTS push_subscriptions (
+			id              SERIAL PRIMARY KEY,
+			subscriber_id   INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			endpoint        TEXT NOT NULL UNIQUE,
+			p256dh          TEXT NOT NULL,
+			auth            TEXT NOT NULL,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_push_subs_sub_id ON push_subscriptions(subscriber_id);
+
+		CREATE TABLE IF NOT EXISTS template_versions (
+			id              SERIAL PRIMARY KEY,
+			template_id     INTEGER NOT NULL REFERENCES templates(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			version         INTEGER NOT NULL,
+			name            TEXT NOT NULL,
+			body            TEXT NOT NULL,
+			editor          TEXT NOT NULL DEFAULT '',
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			UNIQUE(template_id, version)
+		);
+
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'template_type') THEN
+				CREATE TYPE template_type AS ENUM ('campaign', 'partial');
+			END IF;
+		END$$;
+		ALTER TABLE templates ADD COLUMN IF NOT EXISTS type template_type NOT NULL DEFAULT 'campaign';
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_templates_partial_name ON templates (name) WHERE type = 'partial';
+
+		-- Record the existing templates as their first versions.
+		INSERT INTO template_versions (template_id, version, name, body, created_at)
+			SELECT id, 1, name, body, updated_at FROM templates
+			ON CONFLICT DO NOTHING;
+
+		INSERT INTO settings (key, value) VALUES ('app.dynamic_list_sync_interval', '"1h"'), ('ses', '[]'), ('sendgrid', '[]'), ('mailgun', '[]'), ('sms', '[]'), ('telegram', '[]'),
+			('webpush.enabled', 'false'), ('webpush.vapid_public_key', '""'), ('webpush.vapid_private_key', '""'),
+			('webpush.subject', '""'), ('webpush.ttl', '86400'),
+			('app.failover_messengers', '[]'), ('app.failover_max_errors', '10'), ('app.failover_error_rate', '0'),
+			('app.failover_cooldown', '"10m"'), ('app.domain_routes', '[]'), ('dkim', '[]')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// The sliding window throttle is replaced by per-messenger rate limits.
+	// An enabled sliding window becomes an equivalent hourly limit on the
+	// default e-mail messenger.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value)
+			SELECT 'app.rate_limits',
+				(CASE WHEN (SELECT value FROM settings WHERE key='app.message_sliding_window') = 'true'
+				THEN JSONB_BUILD_ARRAY(JSONB_BUILD_OBJECT('messenger', 'email', 'per_second', 0, 'per_hour',
+					CEIL((SELECT value#>>'{}' FROM settings WHERE key='app.message_sliding_window_rate')::NUMERIC * 3600 /
+					GREATEST(EXTRACT(EPOCH FROM (SELECT value#>>'{}' FROM settings WHERE key='app.message_sliding_window_duration')::INTERVAL), 1))))
+				ELSE '[]' END)
+			ON CONFLICT DO NOTHING;
+		DELETE FROM settings WHERE key LIKE 'app.message_sliding_window%';
+	`); err != nil {
+		return err
+	}
+
+	// Transactional templates.
+	if _, err := db.Exec(`ALTER TYPE template_type ADD VALUE IF NOT EXISTS 'tx'`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`
+		ALTER TABLE templates ADD COLUMN IF NOT EXISTS subject TEXT NOT NULL DEFAULT '';
+		INSERT INTO settings (key, value) VALUES ('app.tx_max_attachment_size', '10') ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Sample data of transactional templates, which is versioned along
+	// with the subject.
+	if _, err := db.Exec(`
+		ALTER TABLE templates ADD COLUMN IF NOT EXISTS sample_data JSONB NOT NULL DEFAULT '{}';
+		ALTER TABLE template_versions ADD COLUMN IF NOT EXISTS subject TEXT NOT NULL DEFAULT '';
+		ALTER TABLE template_versions ADD COLUMN IF NOT EXISTS sample_data JSONB NOT NULL DEFAULT '{}';
+	`); err != nil {
+		return err
+	}
+
+	// Transactional message log.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'tx_status') THEN
+				CREATE TYPE tx_status AS ENUM ('sent', 'failed');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS tx_log (
+			id               BIGSERIAL PRIMARY KEY,
+			subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			email            TEXT NOT NULL,
+			subject          TEXT NOT NULL DEFAULT '',
+			messenger        TEXT NOT NULL,
+			status           tx_status NOT NULL,
+			error            TEXT NOT NULL DEFAULT '',
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_log_email ON tx_log(LOWER(email));
+		CREATE INDEX IF NOT EXISTS idx_tx_log_created_at ON tx_log(created_at);
+
+		INSERT INTO settings (key, value) VALUES ('app.tx_log_enabled', 'false'), ('app.tx_log_retention_days', '30')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Delivery status callbacks of transactional messages.
+	for _, s := range []string{"bounced", "complained"} {
+		if _, err := db.Exec(`ALTER TYPE tx_status ADD VALUE IF NOT EXISTS '` + s + `'`); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(`
+		ALTER TABLE tx_log ADD COLUMN IF NOT EXISTS message_id UUID NULL;
+		CREATE INDEX IF NOT EXISTS idx_tx_log_message_id ON tx_log(message_id);
+
+		CREATE TABLE IF NOT EXISTS tx_callbacks (
+			message_id       UUID NOT NULL PRIMARY KEY,
+			subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			email            TEXT NOT NULL,
+			url              TEXT NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_callbacks_created_at ON tx_callbacks(created_at);
+	`); err != nil {
+		return err
+	}
+
+	// Device and e-mail client analytics of campaign views.
+	if _, err := db.Exec(`
+		ALTER TABLE campaign_views ADD COLUMN IF NOT EXISTS device TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaign_views ADD COLUMN IF NOT EXISTS client TEXT NOT NULL DEFAULT '';
+	`); err != nil {
+		return err
+	}
+
+	// Scheduled transactional messages.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS tx_scheduled (
+			id               BIGSERIAL PRIMARY KEY,
+			message_id       UUID NOT NULL UNIQUE,
+			message          JSONB NOT NULL,
+			send_at          TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_scheduled_send_at ON tx_scheduled(send_at);
+	`); err != nil {
+		return err
+	}
+
+	// GeoIP analytics of campaign views and link clicks.
+	if _, err := db.Exec(`
+		ALTER TABLE campaign_views ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaign_views ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '';
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
+
+		INSERT INTO settings (key, value) VALUES ('privacy.geoip_db', '""')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Event firehose.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+			('events.enabled', 'false'),
+			('events.sink', '"webhook"'),
+			('events.url', '""'),
+			('events.nats_subject', '"listmonk.events"'),
+			('events.batch_size', '100')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Prometheus metrics.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('app.metrics_enabled', 'false'), ('app.metrics_token', '""')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Multi-user admin accounts.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_role') THEN
+				CREATE TYPE user_role AS ENUM ('admin', 'manager', 'analyst', 'editor');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_status') THEN
+				CREATE TYPE user_status AS ENUM ('enabled', 'disabled');
+			END IF;
+		END$$;
+
+		CREATE TABLE IF NOT EXISTS users (
+			id               SERIAL PRIMARY KEY,
+			username         TEXT NOT NULL UNIQUE,
+			name             TEXT NOT NULL,
+			password         TEXT NOT NULL,
+			role             user_role NOT NULL DEFAULT 'analyst',
+			status           user_status NOT NULL DEFAULT 'enabled',
+			list_ids         INTEGER[] NOT NULL DEFAULT '{}',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Single sign-on (OIDC) and login sessions.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id               TEXT NOT NULL PRIMARY KEY,
+			user_id          INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			expires_at       TIMESTAMP WITH TIME ZONE NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+
+		INSERT INTO settings (key, value) VALUES
+			('security.oidc_enabled', 'false'),
+			('security.oidc_provider_url', '""'),
+			('security.oidc_client_id', '""'),
+			('security.oidc_client_secret', '""'),
+			('security.oidc_username_claim', '"email"'),
+			('security.oidc_role_claim', '"groups"'),
+			('security.oidc_role_map', '[]'),
+			('security.oidc_default_role', '""')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Append-only audit log of administrative actions.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id               BIGSERIAL PRIMARY KEY,
+			username         TEXT NOT NULL DEFAULT '',
+			method           TEXT NOT NULL,
+			path             TEXT NOT NULL,
+			resource         TEXT NOT NULL,
+			resource_id      TEXT NOT NULL DEFAULT '',
+			data             JSONB NOT NULL DEFAULT '{}',
+			ip               TEXT NOT NULL DEFAULT '',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_username ON audit_log(username);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log(resource);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+
+		CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+		CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+	`); err != nil {
+		return err
+	}
+
+	// Rate limits on public endpoints.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+			('security.rate_limit_enabled', 'false'),
+			('security.rate_limit_store', '"memory"'),
+			('security.rate_limit_redis_url', '"redis://localhost:6379"'),
+			('security.rate_limit_subscription_rate', '10'),
+			('security.rate_limit_subscription_burst', '5'),
+			('security.rate_limit_tracking_rate', '300'),
+			('security.rate_limit_tracking_burst', '100')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// CAPTCHA and bot checks on public forms. form_key signs the load
+	// time of forms and is generated on startup.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+			('security.captcha_provider', '""'),
+			('security.captcha_site_key', '""'),
+			('security.captcha_secret', '""'),
+			('security.form_min_submit_time', '0'),
+			('security.form_key', '""')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Two-factor authentication and login sessions of the superuser.
+	if _, err := db.Exec(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_recovery_codes TEXT[] NOT NULL DEFAULT '{}';
+		ALTER TABLE sessions ALTER COLUMN user_id DROP NOT NULL;
+	`); err != nil {
+		return err
+	}
+
+	// Responses of write API requests with idempotency keys.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			key              TEXT NOT NULL,
+			username         TEXT NOT NULL DEFAULT '',
+			request_hash     TEXT NOT NULL,
+			status           INTEGER NULL,
+			content_type     TEXT NOT NULL DEFAULT '',
+			response         BYTEA NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+			PRIMARY KEY (key, username)
+		);
+		CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+	`); err != nil {
+		return err
+	}
+
+	// Resized variants of uploaded images.
+	if _, err := db.Exec(`
+		ALTER TABLE media ADD COLUMN IF NOT EXISTS variants JSONB NOT NULL DEFAULT '{}';
+		INSERT INTO settings (key, value) VALUES
+			('upload.thumbnail_width', '90'),
+			('upload.image_variants', '[{"name": "email", "width": 600}]')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Media folders and tags.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS media_folders (
+			id               SERIAL PRIMARY KEY,
+			name             TEXT NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		ALTER TABLE media ADD COLUMN IF NOT EXISTS folder_id INTEGER NULL
+			REFERENCES media_folders(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		ALTER TABLE media ADD COLUMN IF NOT EXISTS tags VARCHAR(100)[] NOT NULL DEFAULT '{}';
+		CREATE INDEX IF NOT EXISTS idx_media_folder_id ON media(folder_id);
+		CREATE INDEX IF NOT EXISTS idx_media_tags ON media USING GIN(tags);
+		CREATE INDEX IF NOT EXISTS idx_media_created_at ON media(created_at);
+	`); err != nil {
+		return err
+	}
+
+	// Monthly partitions of campaign views and link clicks. The existing
+	// tables are replaced with partitioned tables and their rows are copied
+	// into monthly (UTC) partitions.
+	if _, err := db.Exec(`
+		DO $$
+		DECLARE m TIMESTAMP;
+		BEGIN
+			IF (SELECT relkind FROM pg_class WHERE oid = 'campaign_views'::REGCLASS) <> 'p' THEN
+				ALTER TABLE campaign_views RENAME TO campaign_views_old;
+				DROP INDEX IF EXISTS idx_views_camp_id;
+				DROP INDEX IF EXISTS idx_views_subscriber_id;
+
+				CREATE TABLE campaign_views (
+					campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+					subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+					device           TEXT NOT NULL DEFAULT '',
+					client           TEXT NOT NULL DEFAULT '',
+					country          TEXT NOT NULL DEFAULT '',
+					region           TEXT NOT NULL DEFAULT '',
+					created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+				) PARTITION BY RANGE (created_at);
+				CREATE TABLE campaign_views_default PARTITION OF campaign_views DEFAULT;
+				CREATE INDEX idx_views_camp_id ON campaign_views(campaign_id);
+				CREATE INDEX idx_views_subscriber_id ON campaign_views(subscriber_id);
+
+				FOR m IN SELECT GENERATE_SERIES(a, b, '1 month') FROM (
+					SELECT DATE_TRUNC('month', MIN(created_at) AT TIME ZONE 'UTC') a,
+						DATE_TRUNC('month', MAX(created_at) AT TIME ZONE 'UTC') b FROM campaign_views_old
+				) t LOOP
+					EXECUTE FORMAT('CREATE TABLE %I PARTITION OF campaign_views FOR VALUES FROM (%L) TO (%L)',
+						'campaign_views_' || TO_CHAR(m, 'YYYY_MM'), m AT TIME ZONE 'UTC', (m + INTERVAL '1 month') AT TIME ZONE 'UTC');
+				END LOOP;
+
+				INSERT INTO campaign_views (campaign_id, subscriber_id, device, client, country, region, created_at)
+					SELECT campaign_id, subscriber_id, device, client, country, region, COALESCE(created_at, NOW())
+					FROM campaign_views_old;
+				DROP TABLE campaign_views_old;
+			END IF;
+
+			IF (SELECT relkind FROM pg_class WHERE oid = 'link_clicks'::REGCLASS) <> 'p' THEN
+				ALTER TABLE link_clicks RENAME TO link_clicks_old;
+				DROP INDEX IF EXISTS idx_clicks_camp_id;
+				DROP INDEX IF EXISTS idx_clicks_link_id;
+				DROP INDEX IF EXISTS idx_clicks_sub_id;
+
+				CREATE TABLE link_clicks (
+					campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+					link_id          INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE ON UPDATE CASCADE,
+					subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+					country          TEXT NOT NULL DEFAULT '',
+					region           TEXT NOT NULL DEFAULT '',
+					created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+				) PARTITION BY RANGE (created_at);
+				CREATE TABLE link_clicks_default PARTITION OF link_clicks DEFAULT;
+				CREATE INDEX idx_clicks_camp_id ON link_clicks(campaign_id);
+				CREATE INDEX idx_clicks_link_id ON link_clicks(link_id);
+				CREATE INDEX idx_clicks_sub_id ON link_clicks(subscriber_id);
+
+				FOR m IN SELECT GENERATE_SERIES(a, b, '1 month') FROM (
+					SELECT DATE_TRUNC('month', MIN(created_at) AT TIME ZONE 'UTC') a,
+						DATE_TRUNC('month', MAX(created_at) AT TIME ZONE 'UTC') b FROM link_clicks_old
+				) t LOOP
+					EXECUTE FORMAT('CREATE TABLE %I PARTITION OF link_clicks FOR VALUES FROM (%L) TO (%L)',
+						'link_clicks_' || TO_CHAR(m, 'YYYY_MM'), m AT TIME ZONE 'UTC', (m + INTERVAL '1 month') AT TIME ZONE 'UTC');
+				END LOOP;
+
+				INSERT INTO link_clicks (campaign_id, link_id, subscriber_id, country, region, created_at)
+					SELECT campaign_id, link_id, subscriber_id, country, region, COALESCE(created_at, NOW())
+					FROM link_clicks_old;
+				DROP TABLE link_clicks_old;
+			END IF;
+		END $$;
+	`); err != nil {
+		return err
+	}
+
+	// Daily rollups of pruned views and clicks.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS tracking_rollups (
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			link_id          INTEGER NOT NULL DEFAULT 0,
+			day              DATE NOT NULL,
+			views            BIGINT NOT NULL DEFAULT 0,
+			clicks           BIGINT NOT NULL DEFAULT 0,
+
+			PRIMARY KEY (campaign_id, link_id, day)
+		);
+		CREATE INDEX IF NOT EXISTS idx_rollups_day ON tracking_rollups(day);
+
+		INSERT INTO settings (key, value) VALUES ('privacy.analytics_retention_days', '0')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Admin alert channels.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('alerts', '[]'), ('app.alert_bounce_rate', '0')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Public page template sets of lists.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS page_templates (
+			id              SERIAL PRIMARY KEY,
+			name            TEXT NOT NULL,
+			body            TEXT NOT NULL,
+			created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS page_template_id INTEGER NULL
+			REFERENCES page_templates(id) ON DELETE SET NULL ON UPDATE CASCADE;
+	`); err != nil {
+		return err
+	}
+
+	// Public campaign archive.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS archive BOOLEAN NOT NULL DEFAULT false;
+
+		INSERT INTO settings (key, value) VALUES ('app.enable_public_archive', 'false')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Unsubscribe reason survey.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS unsubscribe_feedback (
+			id               BIGSERIAL PRIMARY KEY,
+			campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			reason           TEXT NOT NULL,
+			comment          TEXT NOT NULL DEFAULT '',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_unsub_feedback_camp_id ON unsubscribe_feedback(campaign_id);
+		CREATE INDEX IF NOT EXISTS idx_unsub_feedback_created_at ON unsubscribe_feedback(created_at);
+
+		INSERT INTO settings (key, value) VALUES
+			('privacy.unsubscribe_survey', 'false'),
+			('privacy.unsubscribe_reasons', '["Too frequent", "Not relevant", "Never signed up"]')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// CORS origins of the public JSON API.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('security.cors_origins', '[]')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Per list and campaign List-Unsubscribe headers and unsubscription sources.
+	if _, err := db.Exec(`
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS unsub_header TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS unsub_header_value TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS unsub_header TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS unsub_header_value TEXT NOT NULL DEFAULT '';
+
+		CREATE TABLE IF NOT EXISTS campaign_unsubscribes (
+			id               BIGSERIAL PRIMARY KEY,
+			campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			source           TEXT NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_unsubs_camp_id ON campaign_unsubscribes(campaign_id);
+	`); err != nil {
+		return err
+	}
+
+	// Campaign language.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS lang TEXT NOT NULL DEFAULT '';
+	`); err != nil {
+		return err
+	}
+
+	// Batched tracking writes.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('app.tracking_batch_size', '500')
+		ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Rate limits by the client IP in proxy headers.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('security.rate_limit_trust_proxy', 'false')
+		ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Source of users. Users without passwords were created by single sign-ons.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'source') THEN
+				ALTER TABLE users ADD COLUMN source TEXT NOT NULL DEFAULT 'local';
+				UPDATE users SET source = 'sso' WHERE password = '';
+			END IF;
+		END$$;
+	`); err != nil {
+		return err
+	}
+
+	// Time step of the last accepted TOTP code of users.
+	if _, err := db.Exec(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+	`); err != nil {
+		return err
+	}
+
+	// Instances that are sending campaigns.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS instances (
+			id               TEXT NOT NULL PRIMARY KEY,
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Stored search vectors of campaigns on the public archive.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS archive_tsv TSVECTOR NULL;
+		DROP INDEX IF EXISTS idx_camps_archive;
+		CREATE INDEX IF NOT EXISTS idx_camps_archive_tsv ON campaigns USING GIN (archive_tsv) WHERE archive = true;
+
+		CREATE OR REPLACE FUNCTION campaigns_archive_tsv() RETURNS TRIGGER AS $$
+		BEGIN
+			NEW.archive_tsv = CASE WHEN NEW.archive THEN TO_TSVECTOR('simple', NEW.subject || ' ' || NEW.body) END;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS campaigns_archive_tsv ON campaigns;
+		CREATE TRIGGER campaigns_archive_tsv BEFORE INSERT OR UPDATE OF subject, body, archive ON campaigns
+			FOR EACH ROW EXECUTE PROCEDURE campaigns_archive_tsv();
+
+		UPDATE campaigns SET archive_tsv = TO_TSVECTOR('simple', subject || ' ' || body)
+			WHERE archive = true AND archive_tsv IS NULL;
+	`); err != nil {
+		return err
+	}
+
+	// Key for signing the tokens of hosted message pages, which is
+	// generated on startup.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES ('security.message_key', '""')
+		ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	// Campaigns are prepared (counted) once when they start.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS prepared_at TIMESTAMP WITH TIME ZONE NULL;
+	`); err != nil {
+		return err
+	}
+
+	// Batches of campaigns that instances are sending.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS campaign_leases (
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			instance_id      TEXT NOT NULL REFERENCES instances(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+			PRIMARY KEY (campaign_id, instance_id)
+		);
+	`); err != nil {
+		return err
+	}
+
+	return nil
+}
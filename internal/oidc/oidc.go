@@ -0,0 +1,450 @@
+// Package oidc implements the OpenID Connect authorization code flow for
+// logging into the admin with an external identity provider. The provider
+// is configured with its discovery (issuer) URL, and ID tokens are verified
+// with the provider's published (JWKS) RSA and EC keys.
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register the hashes used for token signatures.
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	httpTimeout = time.Second * 10
+
+	// Leeway for clock skew between the app and the provider when
+	// checking token timestamps.
+	clockSkew = time.Minute
+)
+
+// Config represents the configuration of an OIDC provider.
+type Config struct {
+	// ProviderURL is the issuer URL. The discovery document is at
+	// {ProviderURL}/.well-known/openid-configuration.
+	ProviderURL  string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// Claims are the claims in a verified ID token.
+type Claims map[string]interface{}
+
+// Provider is an OIDC provider.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	// Endpoints and keys are discovered on first use so that an unreachable
+	// provider doesn't hold up the app's startup.
+	disc *discovery
+	keys map[string]crypto.PublicKey
+	mu   sync.Mutex
+}
+
+type discovery struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// New returns a new OIDC provider.
+func New(cfg Config) (*Provider, error) {
+	u, err := url.Parse(cfg.ProviderURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid provider URL")
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("client ID is empty")
+	}
+	cfg.ProviderURL = strings.TrimRight(cfg.ProviderURL, "/")
+
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: httpTimeout},
+	}, nil
+}
+
+// AuthURL returns the provider's authorization URL to redirect the user to.
+// state and nonce are random values that are checked on the callback.
+func (p *Provider) AuthURL(state, nonce string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(d.AuthURL, "?") {
+		sep = "&"
+	}
+	return d.AuthURL + sep + q.Encode(), nil
+}
+
+// Exchange exchanges an authorization code for tokens and returns the claims
+// in the verified ID token.
+func (p *Provider) Exchange(code, nonce string) (Claims, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("client_secret", p.cfg.ClientSecret)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var out struct {
+		IDToken   string `json:"id_token"`
+		Error     string `json:"error"`
+		ErrorDesc string `json:"error_description"`
+	}
+	if err := p.do(req, &out); err != nil {
+		if out.Error != "" {
+			return nil, fmt.Errorf("token exchange failed: %s %s", out.Error, out.ErrorDesc)
+		}
+		return nil, fmt.Errorf("token exchange failed: %v", err)
+	}
+	if out.IDToken == "" {
+		return nil, errors.New("no id_token in the token response")
+	}
+
+	claims, err := p.verify(out.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("invalid nonce in id_token")
+	}
+
+	return claims, nil
+}
+
+// verify verifies the signature and standard claims of an ID token.
+func (p *Provider) verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("invalid id_token header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token signature: %v", err)
+	}
+
+	key, err := p.getKey(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var c Claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("invalid id_token claims: %v", err)
+	}
+
+	// Issuer, audience and expiry.
+	if iss, _ := c["iss"].(string); iss != p.disc.Issuer {
+		return nil, fmt.Errorf("unexpected id_token issuer: %s", iss)
+	}
+	if !c.hasAudience(p.cfg.ClientID) {
+		return nil, errors.New("id_token is not meant for this client")
+	}
+	exp, _ := c["exp"].(float64)
+	if time.Now().Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("id_token has expired")
+	}
+
+	return c, nil
+}
+
+// String returns a string claim. Nested claims can be addressed with
+// dots, eg: realm_access.roles.
+func (c Claims) String(name string) string {
+	v, _ := c.get(name).(string)
+	return v
+}
+
+// Bool returns a boolean claim. Some providers send booleans as strings.
+func (c Claims) Bool(name string) bool {
+	switch v := c.get(name).(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Strings returns a claim that is either a string or a list of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c.get(name).(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func (c Claims) get(name string) interface{} {
+	var cur interface{} = map[string]interface{}(c)
+	for _, k := range strings.Split(name, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[k]
+	}
+	return cur
+}
+
+func (c Claims) hasAudience(clientID string) bool {
+	for _, a := range c.Strings("aud") {
+		if a == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// discover fetches and caches the provider's discovery document.
+func (p *Provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.disc != nil {
+		return p.disc, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.cfg.ProviderURL+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var d discovery
+	if err := p.do(req, &d); err != nil {
+		return nil, fmt.Errorf("error fetching provider configuration: %v", err)
+	}
+	if d.Issuer == "" || d.AuthURL == "" || d.TokenURL == "" || d.JWKSURL == "" {
+		return nil, errors.New("incomplete provider configuration")
+	}
+
+	p.disc = &d
+	return p.disc, nil
+}
+
+// getKey returns the provider's key with the given ID. The keys are
+// refetched if the ID is unknown as providers rotate keys.
+func (p *Provider) getKey(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.disc.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.do(req, &set); err != nil {
+		return nil, fmt.Errorf("error fetching provider keys: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pk, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pk
+		}
+	}
+	p.keys = keys
+
+	k, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown id_token key: %s", kid)
+	}
+	return k, nil
+}
+
+// do makes an HTTP request and decodes the JSON response into out. The
+// response is decoded even on errors to read OAuth error fields.
+func (p *Provider) do(req *http.Request, out interface{}) error {
+	r, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	jErr := json.Unmarshal(b, out)
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-OK response: %d", r.StatusCode)
+	}
+	return jErr
+}
+
+// publicKey returns the RSA or EC public key of a JWK.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var crv elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			crv = elliptic.P256()
+		case "P-384":
+			crv = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: crv, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+// verifySignature verifies a JWS signature with the given algorithm.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported id_token algorithm: %s", alg)
+	}
+
+	hh := h.New()
+	hh.Write(signed)
+	sum := hh.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(k, h, sum, sig); err != nil {
+			return errors.New("invalid id_token signature")
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != size*2 {
+			break
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, sum, r, s) {
+			return errors.New("invalid id_token signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("id_token algorithm %s doesn't match the key", alg)
+}
+
+func decodeSegment(s string, out interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
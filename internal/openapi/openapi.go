@@ -0,0 +1,351 @@
+// Package openapi builds OpenAPI 3 specifications from HTTP routes and the
+// Go types of their request and response bodies. JSON schemas of types are
+// derived by reflection following the rules of encoding/json.
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// Version is the OpenAPI version of the generated specs.
+const Version = "3.0.3"
+
+// Spec is an OpenAPI document.
+type Spec struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Servers    []Server                         `json:"servers,omitempty"`
+	Security   []map[string][]string            `json:"security,omitempty"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+// Info is the metadata of an API.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Server is the base URL of an API.
+type Server struct {
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+// Operation is a method on a path.
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Summary     string              `json:"summary,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Deprecated  bool                `json:"deprecated,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+// Parameter is a path, query or header parameter of an operation.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody is the body of a request.
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body of a content type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components are the reusable schemas and the security schemes of a spec.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme is a method of authentication.
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// Schema is a JSON schema. A schema without a type accepts any value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Builder builds a spec.
+type Builder struct {
+	spec  Spec
+	names map[reflect.Type]string
+}
+
+var (
+	reParam = regexp.MustCompile(`:([^/]+)`)
+
+	// Schemas of types that marshal themselves to JSON.
+	knownTypes = map[reflect.Type]Schema{
+		reflect.TypeOf(time.Time{}):       {Type: "string", Format: "date-time"},
+		reflect.TypeOf(null.Time{}):       {Type: "string", Format: "date-time", Nullable: true},
+		reflect.TypeOf(null.String{}):     {Type: "string", Nullable: true},
+		reflect.TypeOf(null.Int{}):        {Type: "integer", Nullable: true},
+		reflect.TypeOf(null.Int64{}):      {Type: "integer", Format: "int64", Nullable: true},
+		reflect.TypeOf(null.Float64{}):    {Type: "number", Nullable: true},
+		reflect.TypeOf(null.Bool{}):       {Type: "boolean", Nullable: true},
+		reflect.TypeOf(pq.StringArray{}):  {Type: "array", Items: &Schema{Type: "string"}},
+		reflect.TypeOf(pq.Int64Array{}):   {Type: "array", Items: &Schema{Type: "integer", Format: "int64"}},
+		reflect.TypeOf(pq.BoolArray{}):    {Type: "array", Items: &Schema{Type: "boolean"}},
+		reflect.TypeOf(types.JSONText{}):  {},
+		reflect.TypeOf(json.RawMessage{}): {},
+	}
+)
+
+// New returns a new Builder.
+func New(info Info, servers ...Server) *Builder {
+	return &Builder{
+		spec: Spec{
+			OpenAPI: Version,
+			Info:    info,
+			Servers: servers,
+			Paths:   make(map[string]map[string]*Operation),
+			Components: Components{
+				Schemas:         make(map[string]*Schema),
+				SecuritySchemes: make(map[string]SecurityScheme),
+			},
+		},
+		names: make(map[reflect.Type]string),
+	}
+}
+
+// AddSecurity adds a security scheme that all operations accept.
+func (b *Builder) AddSecurity(name string, s SecurityScheme) {
+	b.spec.Components.SecuritySchemes[name] = s
+	b.spec.Security = append(b.spec.Security, map[string][]string{name: {}})
+}
+
+// Add adds an operation on a route path with :param style parameters,
+// which are added to the operation as path parameters. The operation ID is
+// derived from the method and path if it's empty.
+func (b *Builder) Add(method, path string, op Operation) {
+	for _, m := range reParam.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, Parameter{
+			Name:     m[1],
+			In:       "path",
+			Required: true,
+			Schema:   &Schema{Type: "string"},
+		})
+	}
+	if op.OperationID == "" {
+		op.OperationID = OperationID(method, path)
+	}
+
+	p := reParam.ReplaceAllString(path, "{$1}")
+	if _, ok := b.spec.Paths[p]; !ok {
+		b.spec.Paths[p] = make(map[string]*Operation)
+	}
+	b.spec.Paths[p][strings.ToLower(method)] = &op
+}
+
+// Spec returns the spec.
+func (b *Builder) Spec() Spec {
+	return b.spec
+}
+
+// JSON returns a request or response body of the JSON schema of a value.
+func (b *Builder) JSON(v interface{}) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: b.Schema(v)}}
+}
+
+// Schema returns the JSON schema of the type of a value. Named struct types
+// are added to the spec's components and referenced.
+func (b *Builder) Schema(v interface{}) *Schema {
+	if v == nil {
+		return &Schema{}
+	}
+	return b.schemaOf(reflect.TypeOf(v))
+}
+
+func (b *Builder) schemaOf(t reflect.Type) *Schema {
+	if s, ok := knownTypes[t]; ok {
+		return &s
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schemaOf(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		return b.ref(t)
+	}
+
+	// Interfaces and other types that can't be described.
+	return &Schema{}
+}
+
+// ref adds a named struct type to the components and returns a reference to it.
+func (b *Builder) ref(t reflect.Type) *Schema {
+	name, ok := b.names[t]
+	if !ok {
+		name = t.Name()
+
+		// Disambiguate types with the same name from different packages.
+		if _, ok := b.spec.Components.Schemas[name]; ok {
+			pkg := t.PkgPath()
+			name = pkg[strings.LastIndex(pkg, "/")+1:] + name
+		}
+		b.names[t] = name
+
+		// Reserve the name before describing the fields for self-referencing types.
+		b.spec.Components.Schemas[name] = &Schema{}
+		b.spec.Components.Schemas[name] = b.structSchema(t)
+	}
+
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// structSchema describes the JSON object of a struct. Fields of embedded
+// structs are promoted and shallower fields take precedence as in encoding/json.
+func (b *Builder) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for _, f := range jsonFields(t, 0, make(map[string]int)) {
+		s.Properties[f.name] = b.schemaOf(f.typ)
+	}
+	return s
+}
+
+type field struct {
+	name string
+	typ  reflect.Type
+}
+
+func jsonFields(t reflect.Type, depth int, seen map[string]int) []field {
+	var out []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if n := strings.Index(tag, ","); n >= 0 {
+			name, opts = tag[:n], tag[n+1:]
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		// Promote the fields of untagged embedded structs.
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			if _, ok := knownTypes[ft]; !ok {
+				out = append(out, jsonFields(ft, depth+1, seen)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		if d, ok := seen[name]; ok && d <= depth {
+			continue
+		}
+		seen[name] = depth
+
+		typ := f.Type
+		if strings.Contains(opts, "string") {
+			typ = reflect.TypeOf("")
+		}
+
+		// Drop a deeper field with the same name.
+		for j := range out {
+			if out[j].name == name {
+				out = append(out[:j], out[j+1:]...)
+				break
+			}
+		}
+		out = append(out, field{name: name, typ: typ})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// OperationID returns an operation ID derived from a method and a route
+// path, eg: GET /api/lists/:id => getListsById.
+func OperationID(method, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "api" {
+			continue
+		}
+		if strings.HasPrefix(p, ":") {
+			sb.WriteString("By")
+			p = p[1:]
+		}
+		for _, w := range strings.FieldsFunc(p, func(r rune) bool { return r == '-' || r == '_' }) {
+			sb.WriteString(strings.ToUpper(w[:1]) + w[1:])
+		}
+	}
+	return sb.String()
+}
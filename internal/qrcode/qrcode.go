@@ -0,0 +1,515 @@
+// Package qrcode is a minimal QR code encoder for short byte strings such as
+// otpauth:// URIs for enrolling authenticator apps. It encodes in byte mode
+// with the medium (M) error correction level in versions 1 to 10 (up to
+// 213 bytes).
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// ecBlocks is the error correction block structure of a version at the M
+// level: EC codewords per block followed by the number of blocks and their
+// data codewords for the two groups of blocks.
+type ecBlocks struct {
+	ecLen     int
+	n1, data1 int
+	n2, data2 int
+}
+
+var versions = []ecBlocks{
+	{},
+	{10, 1, 16, 0, 0},
+	{16, 1, 28, 0, 0},
+	{26, 1, 44, 0, 0},
+	{18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0},
+	{18, 4, 31, 0, 0},
+	{22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37},
+	{26, 4, 43, 1, 44},
+}
+
+// Format bits of the M error correction level.
+const ecLevelM = 0
+
+// Code is an encoded QR code.
+type Code struct {
+	Size int
+
+	// Modules as [y][x]. true is dark.
+	modules [][]bool
+
+	// Function (non-data) modules.
+	isFunc [][]bool
+}
+
+// ErrTooLong is returned when the data doesn't fit in the largest
+// supported version.
+var ErrTooLong = errors.New("data too long for QR code")
+
+// Encode encodes data in the smallest version that fits it.
+func Encode(data []byte) (*Code, error) {
+	for v := 1; v < len(versions); v++ {
+		b := versions[v]
+		capacity := b.n1*b.data1 + b.n2*b.data2
+
+		// Mode (4 bits) + character count (8 or 16 bits) + data.
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 > capacity*8 {
+			continue
+		}
+
+		c := newCode(v)
+		c.drawCodewords(addECC(makeDataCodewords(data, countBits, capacity), b))
+		c.applyBestMask()
+		return c, nil
+	}
+
+	return nil, ErrTooLong
+}
+
+// At returns whether the module at x, y is dark.
+func (c *Code) At(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// PNG returns the code as a PNG image with scale pixels per module and
+// a 4 module quiet zone.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	const quiet = 4
+	var (
+		n   = (c.Size + quiet*2) * scale
+		img = image.NewGray(image.Rect(0, 0, n, n))
+	)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			mx, my := x/scale-quiet, y/scale-quiet
+			col := color.Gray{Y: 255}
+			if mx >= 0 && my >= 0 && mx < c.Size && my < c.Size && c.modules[my][mx] {
+				col = color.Gray{Y: 0}
+			}
+			img.SetGray(x, y, col)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// makeDataCodewords returns the data codewords: the byte mode indicator,
+// the character count, the data, the terminator and the padding.
+func makeDataCodewords(data []byte, countBits, capacity int) []byte {
+	var bb bitBuffer
+	bb.append(0x4, 4)
+	bb.append(len(data), countBits)
+	for _, d := range data {
+		bb.append(int(d), 8)
+	}
+
+	// Terminator and padding to a byte.
+	if t := capacity*8 - len(bb); t > 0 {
+		if t > 4 {
+			t = 4
+		}
+		bb.append(0, t)
+	}
+	if r := len(bb) % 8; r != 0 {
+		bb.append(0, 8-r)
+	}
+
+	out := make([]byte, 0, capacity)
+	for i := 0; i < len(bb); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bb[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		out = append(out, b)
+	}
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+// addECC splits the data codewords into blocks, computes their error
+// correction codewords and returns all of them interleaved.
+func addECC(data []byte, b ecBlocks) []byte {
+	var (
+		div    = rsDivisor(b.ecLen)
+		blocks [][]byte
+		ecc    [][]byte
+	)
+	for i := 0; i < b.n1+b.n2; i++ {
+		n := b.data1
+		if i >= b.n1 {
+			n = b.data2
+		}
+		blocks = append(blocks, data[:n])
+		ecc = append(ecc, rsRemainder(data[:n], div))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i < b.data1 || i < b.data2; i++ {
+		for _, blk := range blocks {
+			if i < len(blk) {
+				out = append(out, blk[i])
+			}
+		}
+	}
+	for i := 0; i < b.ecLen; i++ {
+		for _, e := range ecc {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+func newCode(version int) *Code {
+	size := version*4 + 17
+	c := &Code{Size: size, modules: make([][]bool, size), isFunc: make([][]bool, size)}
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.isFunc[i] = make([]bool, size)
+	}
+
+	// Timing patterns.
+	for i := 0; i < size; i++ {
+		c.setFunc(6, i, i%2 == 0)
+		c.setFunc(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns.
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	// Alignment patterns except on the finder corners.
+	pos := alignmentPositions(version)
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			c.drawAlignment(pos[i], pos[j])
+		}
+	}
+
+	// Reserve the format bits, which are drawn with the mask.
+	c.drawFormat(0)
+	c.drawVersion(version)
+	return c
+}
+
+func (c *Code) setFunc(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.isFunc[y][x] = true
+}
+
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.setFunc(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunc(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format bits (the error correction
+// level and the mask) with their BCH code.
+func (c *Code) drawFormat(mask int) {
+	data := ecLevelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.setFunc(8, i, bit(bits, i))
+	}
+	c.setFunc(8, 7, bit(bits, 6))
+	c.setFunc(8, 8, bit(bits, 7))
+	c.setFunc(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunc(14-i, 8, bit(bits, i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.setFunc(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunc(8, c.Size-15+i, bit(bits, i))
+	}
+
+	// The dark module.
+	c.setFunc(8, c.Size-8, true)
+}
+
+// drawVersion draws the version bits of versions 7 and above.
+func (c *Code) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		a, b := c.Size-11+i%3, i/3
+		c.setFunc(a, b, bit(bits, i))
+		c.setFunc(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order in two module
+// wide columns from the bottom right, skipping the function modules.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.isFunc[y][x] && i < len(data)*8 {
+					c.modules[y][x] = bit(int(data[i>>3]), 7-(i&7))
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty.
+func (c *Code) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for m := 0; m < 8; m++ {
+		c.applyMask(m)
+		c.drawFormat(m)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = m, p
+		}
+
+		// Masks are XORs, so applying one again undoes it.
+		c.applyMask(m)
+	}
+
+	c.applyMask(best)
+	c.drawFormat(best)
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var inv bool
+			switch mask {
+			case 0:
+				inv = (x+y)%2 == 0
+			case 1:
+				inv = y%2 == 0
+			case 2:
+				inv = x%3 == 0
+			case 3:
+				inv = (x+y)%3 == 0
+			case 4:
+				inv = (x/3+y/2)%2 == 0
+			case 5:
+				inv = x*y%2+x*y%3 == 0
+			case 6:
+				inv = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				inv = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if inv && !c.isFunc[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty returns the penalty score of the current modules with the four
+// rules of the spec: runs of the same color, 2x2 blocks of the same color,
+// finder-like patterns and the imbalance of dark and light modules.
+func (c *Code) penalty() int {
+	var (
+		p    = 0
+		dark = 0
+		at   = func(x, y int, vertical bool) bool {
+			if vertical {
+				return c.modules[x][y]
+			}
+			return c.modules[y][x]
+		}
+	)
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < c.Size; y++ {
+			run := 1
+			for x := 1; x < c.Size; x++ {
+				if at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				p += run - 2
+			}
+
+			// 1:1:3:1:1 finder-like patterns with four light modules on a side.
+			for x := 0; x+10 < c.Size; x++ {
+				a := [11]bool{}
+				for k := range a {
+					a[k] = at(x+k, y, vertical)
+				}
+				if a == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					a == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					p += 40
+				}
+			}
+		}
+	}
+
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				v := c.modules[y][x]
+				if v == c.modules[y-1][x] && v == c.modules[y][x-1] && v == c.modules[y-1][x-1] {
+					p += 3
+				}
+			}
+		}
+	}
+
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10) + total - 1) / total
+	return p + (k-1)*10
+}
+
+// alignmentPositions returns the centre coordinates of the alignment
+// patterns of a version.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	var (
+		n    = version/7 + 2
+		step = (version*8 + n*3 + 5) / (n*4 - 4) * 2
+		out  = make([]int, n)
+	)
+	out[0] = 6
+	for i, pos := n-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		out[i] = pos
+	}
+	return out
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of a degree.
+func rsDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range out {
+			out[j] = gfMul(out[j], root)
+			if j+1 < len(out) {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return out
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of data.
+func rsRemainder(data, div []byte) []byte {
+	out := make([]byte, len(div))
+	for _, b := range data {
+		f := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i := range out {
+			out[i] ^= gfMul(div[i], f)
+		}
+	}
+	return out
+}
+
+// gfMul multiplies two elements of GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>uint(i))&1 == 1)
+	}
+}
+
+func bit(v, i int) bool {
+	return (v>>uint(i))&1 != 0
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
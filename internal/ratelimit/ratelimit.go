@@ -0,0 +1,127 @@
+// Package ratelimit implements per key (eg: IP) token bucket rate limiting
+// with pluggable stores (in-memory or Redis) for the buckets.
+package ratelimit
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the interval at which idle buckets are removed from
+// the in-memory store.
+const sweepInterval = time.Minute
+
+// Limit is a token bucket that holds up to Burst tokens and refills at
+// Rate tokens per minute. Each request takes a token.
+type Limit struct {
+	Rate  int
+	Burst int
+}
+
+// Store takes tokens from the buckets of keys.
+type Store interface {
+	Name() string
+
+	// Take takes a token from the bucket of a key and returns false
+	// if the bucket is empty.
+	Take(key string, l Limit, now time.Time) (bool, error)
+}
+
+// Limiter limits the rate of requests by key.
+type Limiter struct {
+	store Store
+	log   *log.Logger
+}
+
+// New returns a new Limiter with a store.
+func New(s Store, l *log.Logger) *Limiter {
+	return &Limiter{store: s, log: l}
+}
+
+// Allow checks whether a request by key is within the limit. Store errors
+// are logged and the request is allowed so that an unavailable store
+// doesn't take the public pages down.
+func (r *Limiter) Allow(key string, l Limit) bool {
+	if l.Rate < 1 || l.Burst < 1 {
+		return true
+	}
+
+	ok, err := r.store.Take(key, l, time.Now())
+	if err != nil {
+		r.log.Printf("error checking rate limit (%s): %v", r.store.Name(), err)
+		return true
+	}
+	return ok
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// Memory is an in-memory store. Buckets are per instance and aren't shared
+// between multiple instances of the app.
+type Memory struct {
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewMemory returns an in-memory store.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Name returns the store's name.
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+// Take takes a token from the bucket of a key.
+func (m *Memory) Take(key string, l Limit, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > sweepInterval {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, now.Sub(b.last), l)
+	b.last = now
+	b.limit = l
+
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// sweep removes the buckets that have refilled fully as they're no
+// different from new buckets.
+func (m *Memory) sweep(now time.Time) {
+	for k, b := range m.buckets {
+		if refill(b.tokens, now.Sub(b.last), b.limit) >= float64(b.limit.Burst) {
+			delete(m.buckets, k)
+		}
+	}
+	m.lastSweep = now
+}
+
+// refill returns the tokens in a bucket after a duration.
+func refill(tokens float64, d time.Duration, l Limit) float64 {
+	if d > 0 {
+		tokens += d.Minutes() * float64(l.Rate)
+	}
+	if tokens > float64(l.Burst) {
+		tokens = float64(l.Burst)
+	}
+	return tokens
+}
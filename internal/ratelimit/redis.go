@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisPrefix is the prefix of the bucket keys in Redis.
+const redisPrefix = "listmonk:ratelimit:"
+
+// takeScript takes a token from a bucket (a hash of its tokens and the time
+// of the last take in milliseconds) atomically. The bucket expires once it
+// would have refilled fully.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1]) / 60000
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local b = redis.call('HMGET', KEYS[1], 't', 'ts')
+local t = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+t = math.min(burst, t + math.max(0, now - ts) * rate)
+
+local ok = 0
+if t >= 1 then
+	t = t - 1
+	ok = 1
+end
+
+redis.call('HMSET', KEYS[1], 't', tostring(t), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return ok
+`)
+
+// Redis is a store that keeps the buckets in a Redis server so that they're
+// shared by multiple instances of the app. Requests are made over a pool
+// of connections.
+type Redis struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+// NewRedis returns a Redis store for a server URL of the form
+// redis://[[user]:password@]host[:port][/db] or rediss://... for TLS.
+func NewRedis(u string, timeout time.Duration) (*Redis, error) {
+	if !strings.HasPrefix(u, "redis://") && !strings.HasPrefix(u, "rediss://") {
+		return nil, fmt.Errorf("invalid Redis URL: %s", u)
+	}
+
+	o, err := redis.ParseURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	o.DialTimeout = timeout
+	o.ReadTimeout = timeout
+	o.WriteTimeout = timeout
+	o.PoolTimeout = timeout
+
+	return &Redis{client: redis.NewClient(o), timeout: timeout}, nil
+}
+
+// Name returns the store's name.
+func (r *Redis) Name() string {
+	return "redis"
+}
+
+// Take takes a token from the bucket of a key.
+func (r *Redis) Take(key string, l Limit, now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	n, err := takeScript.Run(ctx, r.client, []string{redisPrefix + key}, l.Rate, l.Burst, ms).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
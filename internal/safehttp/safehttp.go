@@ -0,0 +1,85 @@
+// Package safehttp dials connections for HTTP requests to URLs that come
+// from users or subscribers, such as web push endpoints and delivery status
+// callbacks. Connections to loopback, private, link-local and other
+// non-public addresses are refused so that such URLs can't be used to reach
+// internal services.
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrNotPublic is returned when a URL resolves to a non-public address.
+var ErrNotPublic = errors.New("connections to non-public addresses are not allowed")
+
+// Address ranges that aren't publicly routable.
+var blockedNets []*net.IPNet
+
+func init() {
+	for _, c := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+		"240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, _ := net.ParseCIDR(c)
+		blockedNets = append(blockedNets, n)
+	}
+}
+
+// IsPublicIP checks whether an IP is a publicly routable address.
+func IsPublicIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Dialer returns a dialer that refuses to connect to non-public addresses.
+// The check is done on the resolved address that's dialed and not on the
+// hostname, so DNS that resolves differently later can't get around it.
+func Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+				return ErrNotPublic
+			}
+			return nil
+		},
+	}
+}
+
+// CheckURL checks whether a URL is an http(s) URL whose host only resolves
+// to public addresses. It's meant for rejecting bad URLs when they're
+// submitted. Requests should still be made with Dialer.
+func CheckURL(u string) error {
+	p, err := url.Parse(u)
+	if err != nil || (p.Scheme != "https" && p.Scheme != "http") || p.Hostname() == "" {
+		return fmt.Errorf("invalid URL: %s", u)
+	}
+
+	ips, err := net.LookupIP(p.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return ErrNotPublic
+		}
+	}
+	return nil
+}
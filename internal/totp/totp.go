@@ -0,0 +1,89 @@
+// Package totp implements time-based one-time passwords (RFC 6238) with the
+// defaults that authenticator apps support: HMAC-SHA1, 6 digits and a 30
+// second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digits = 6
+	period = 30
+
+	// Number of periods before and after the current one in which codes
+	// are accepted to allow for clock drift.
+	skew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random base32 encoded secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// URI returns the otpauth:// URI of a secret that authenticator apps
+// enroll from a QR code.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", digits))
+	v.Set("period", fmt.Sprintf("%d", period))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Validate checks a code against a secret at a time with the allowed skew
+// and returns the time step (counter) of the code. Callers should reject
+// codes of steps that have already been used so that a code can't be
+// replayed.
+func Validate(secret, c string, t time.Time) (int64, bool) {
+	c = strings.Replace(strings.TrimSpace(c), " ", "", -1)
+	if len(c) != digits {
+		return 0, false
+	}
+
+	key, err := b32.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return 0, false
+	}
+
+	n := t.Unix() / period
+	for i := -skew; i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, uint64(n+int64(i)))), []byte(c)) == 1 {
+			return n + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// code computes the HOTP (RFC 4226) code of a counter.
+func code(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, v%1000000)
+}
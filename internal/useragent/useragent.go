@@ -0,0 +1,116 @@
+// Package useragent classifies the user agents of e-mail open tracking
+// requests into device families and e-mail clients.
+package useragent
+
+import "strings"
+
+// Device families.
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceUnknown = "unknown"
+)
+
+// E-mail clients.
+const (
+	ClientGmail       = "gmail"
+	ClientAppleMail   = "apple_mail"
+	ClientOutlook     = "outlook"
+	ClientYahoo       = "yahoo"
+	ClientThunderbird = "thunderbird"
+	ClientBrowser     = "browser"
+	ClientUnknown     = "unknown"
+)
+
+// UA is a classified user agent.
+type UA struct {
+	Device string
+	Client string
+}
+
+// clientRule maps a (lowercased) user agent substring to an e-mail client.
+// Rules are matched in order.
+type clientRule struct {
+	match  string
+	client string
+}
+
+var clientRules = []clientRule{
+	// Gmail and Yahoo fetch images through proxies that hide the device.
+	{"googleimageproxy", ClientGmail},
+	{"yahoomailproxy", ClientYahoo},
+	{"ymailproxy", ClientYahoo},
+
+	{"microsoft outlook", ClientOutlook},
+	{"ms-office", ClientOutlook},
+	{"msoffice", ClientOutlook},
+	{"outlook-ios", ClientOutlook},
+	{"outlook-android", ClientOutlook},
+	{"thunderbird", ClientThunderbird},
+}
+
+// Parse classifies a user agent string.
+func Parse(ua string) UA {
+	s := strings.ToLower(ua)
+	if s == "" {
+		return UA{Device: DeviceUnknown, Client: ClientUnknown}
+	}
+
+	out := UA{Device: device(s), Client: ClientUnknown}
+	for _, r := range clientRules {
+		if strings.Contains(s, r.match) {
+			out.Client = r.client
+			break
+		}
+	}
+
+	switch out.Client {
+	case ClientGmail, ClientYahoo:
+		out.Device = DeviceUnknown
+	case ClientOutlook:
+		// Outlook on Windows doesn't identify the OS.
+		if out.Device == DeviceUnknown {
+			out.Device = DeviceDesktop
+		}
+	case ClientUnknown:
+		out.Client = webClient(s)
+	}
+
+	return out
+}
+
+// device returns the device family of a lowercased user agent.
+func device(s string) string {
+	switch {
+	case strings.Contains(s, "ipad") || strings.Contains(s, "tablet"):
+		return DeviceTablet
+	case strings.Contains(s, "iphone") || strings.Contains(s, "ipod") ||
+		strings.Contains(s, "mobile") || strings.Contains(s, "windows phone"):
+		return DeviceMobile
+	case strings.Contains(s, "android"):
+		// Android tablets don't have "mobile" in their user agents.
+		return DeviceTablet
+	case strings.Contains(s, "windows") || strings.Contains(s, "macintosh") ||
+		strings.Contains(s, "mac os x") || strings.Contains(s, "linux") ||
+		strings.Contains(s, "cros"):
+		return DeviceDesktop
+	}
+	return DeviceUnknown
+}
+
+// webClient tells apart Apple Mail, which is WebKit without the Safari
+// token, from webmail opened in a browser.
+func webClient(s string) string {
+	isApple := strings.Contains(s, "macintosh") || strings.Contains(s, "iphone") || strings.Contains(s, "ipad")
+	if isApple && strings.Contains(s, "applewebkit") && !strings.Contains(s, "safari") {
+		return ClientAppleMail
+	}
+
+	for _, b := range []string{"chrome", "firefox", "safari", "edge", "opera"} {
+		if strings.Contains(s, b) {
+			return ClientBrowser
+		}
+	}
+	return ClientUnknown
+}
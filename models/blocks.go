@@ -0,0 +1,193 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Block types of the visual content format.
+const (
+	BlockText    = "text"
+	BlockHTML    = "html"
+	BlockImage   = "image"
+	BlockButton  = "button"
+	BlockDivider = "divider"
+	BlockColumns = "columns"
+)
+
+// maxBlockColumns is the maximum number of columns in a columns block.
+const maxBlockColumns = 4
+
+var (
+	regexpBlockColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+	// Template expressions in block attributes (eg: {{ UnsubscribeURL }})
+	// are left unescaped so that they're compiled along with the body.
+	regexpTplExp = regexp.MustCompile(`{{.*?}}`)
+)
+
+// Block is a single structured content block in the visual content format.
+// Fields that are irrelevant to a block's type are ignored.
+type Block struct {
+	Type string `json:"type"`
+
+	// HTML content of text and html blocks.
+	HTML string `json:"html,omitempty"`
+
+	// Image source and alt text of image blocks.
+	Src string `json:"src,omitempty"`
+	Alt string `json:"alt,omitempty"`
+
+	// Link of image and button blocks and the label of button blocks.
+	URL  string `json:"url,omitempty"`
+	Text string `json:"text,omitempty"`
+
+	// left|center|right.
+	Align string `json:"align,omitempty"`
+
+	// Background color of button blocks (#rgb or #rrggbb).
+	Color string `json:"color,omitempty"`
+
+	// Child blocks of each column in columns blocks.
+	Columns [][]Block `json:"columns,omitempty"`
+}
+
+// ParseBlocks parses and validates a visual content body (a JSON array of blocks).
+func ParseBlocks(body string) ([]Block, error) {
+	var out []Block
+	if err := json.Unmarshal([]byte(body), &out); err != nil {
+		return nil, fmt.Errorf("invalid visual content: %v", err)
+	}
+	if err := validateBlocks(out, true); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// RenderBlocks renders a visual content body to e-mail friendly HTML.
+// The output may contain template expressions and is compiled like
+// any other HTML body.
+func RenderBlocks(body string) (string, error) {
+	blocks, err := ParseBlocks(body)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	renderBlocks(&sb, blocks)
+	return sb.String(), nil
+}
+
+// HTMLToBlocks wraps an HTML body in a single html block so that content
+// in other formats can be converted to the visual format.
+func HTMLToBlocks(body string) (string, error) {
+	b, err := json.Marshal([]Block{{Type: BlockHTML, HTML: body}})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func validateBlocks(blocks []Block, allowColumns bool) error {
+	for _, b := range blocks {
+		switch b.Type {
+		case BlockText, BlockHTML, BlockDivider:
+		case BlockImage:
+			if b.Src == "" {
+				return errors.New("image block has no src")
+			}
+		case BlockButton:
+			if b.URL == "" || b.Text == "" {
+				return errors.New("button block needs a url and text")
+			}
+		case BlockColumns:
+			// Columns can't be nested.
+			if !allowColumns {
+				return errors.New("columns blocks can't be nested")
+			}
+			if len(b.Columns) < 1 || len(b.Columns) > maxBlockColumns {
+				return fmt.Errorf("columns block should have 1 to %d columns", maxBlockColumns)
+			}
+			for _, c := range b.Columns {
+				if err := validateBlocks(c, false); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown block type: %s", b.Type)
+		}
+	}
+
+	return nil
+}
+
+func renderBlocks(sb *strings.Builder, blocks []Block) {
+	for _, b := range blocks {
+		align := "left"
+		if b.Align == "center" || b.Align == "right" {
+			align = b.Align
+		}
+
+		switch b.Type {
+		case BlockText:
+			fmt.Fprintf(sb, "<div style=\"text-align: %s;\">%s</div>\n", align, b.HTML)
+
+		case BlockHTML:
+			sb.WriteString(b.HTML)
+			sb.WriteString("\n")
+
+		case BlockImage:
+			img := fmt.Sprintf(`<img src="%s" alt="%s" style="max-width: 100%%; height: auto; border: 0;" />`,
+				escBlockAttr(b.Src), escBlockAttr(b.Alt))
+			if b.URL != "" {
+				img = fmt.Sprintf(`<a href="%s">%s</a>`, escBlockAttr(b.URL), img)
+			}
+			fmt.Fprintf(sb, "<div style=\"text-align: %s;\">%s</div>\n", align, img)
+
+		case BlockButton:
+			color := "#0055d4"
+			if regexpBlockColor.MatchString(b.Color) {
+				color = b.Color
+			}
+			fmt.Fprintf(sb, `<div style="text-align: %s; margin: 15px 0;">`+
+				`<a href="%s" style="display: inline-block; padding: 10px 25px; border-radius: 3px; `+
+				`background: %s; color: #ffffff; text-decoration: none; font-weight: bold;">%s</a></div>`+"\n",
+				align, escBlockAttr(b.URL), color, escBlockAttr(b.Text))
+
+		case BlockDivider:
+			sb.WriteString("<hr style=\"border: 0; border-top: 1px solid #eeeeee; margin: 20px 0;\" />\n")
+
+		case BlockColumns:
+			// Tables are the only reliable way to lay out columns in e-mail clients.
+			w := 100 / len(b.Columns)
+			sb.WriteString("<table width=\"100%\" cellpadding=\"0\" cellspacing=\"0\" border=\"0\" role=\"presentation\"><tr>\n")
+			for _, c := range b.Columns {
+				fmt.Fprintf(sb, "<td width=\"%d%%\" valign=\"top\" style=\"padding: 0 5px;\">\n", w)
+				renderBlocks(sb, c)
+				sb.WriteString("</td>\n")
+			}
+			sb.WriteString("</tr></table>\n")
+		}
+	}
+}
+
+// escBlockAttr HTML escapes a block attribute while preserving
+// template expressions in it.
+func escBlockAttr(s string) string {
+	var (
+		sb   strings.Builder
+		last = 0
+	)
+	for _, m := range regexpTplExp.FindAllStringIndex(s, -1) {
+		sb.WriteString(html.EscapeString(s[last:m[0]]))
+		sb.WriteString(s[m[0]:m[1]])
+		last = m[1]
+	}
+	sb.WriteString(html.EscapeString(s[last:]))
+	return sb.String()
+}
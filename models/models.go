@@ -44,16 +44,56 @@ const (
 	CampaignContentTypeHTML     = "html"
 	CampaignContentTypeMarkdown = "markdown"
 	CampaignContentTypePlain    = "plain"
+	CampaignContentTypeVisual   = "visual"
+	CampaignContentTypeSMS      = "sms"
 
 	// List.
 	ListTypePrivate = "private"
 	ListTypePublic  = "public"
+	ListTypeDynamic = "dynamic"
 	ListOptinSingle = "single"
 	ListOptinDouble = "double"
 
+	// Subscription form field types.
+	SubFormFieldText     = "text"
+	SubFormFieldNumber   = "number"
+	SubFormFieldCheckbox = "checkbox"
+	SubFormFieldSelect   = "select"
+	SubFormFieldDate     = "date"
+
+	// Template.
+	TemplateTypeCampaign = "campaign"
+	TemplateTypePartial  = "partial"
+	TemplateTypeTx       = "tx"
+
+	// Transactional message statuses.
+	TxStatusSent       = "sent"
+	TxStatusFailed     = "failed"
+	TxStatusBounced    = "bounced"
+	TxStatusComplained = "complained"
+
+	// List webhook events.
+	ListWebhookEventSubscribe   = "subscribe"
+	ListWebhookEventUnsubscribe = "unsubscribe"
+
+	// List-Unsubscribe header modes of lists and campaigns. The default
+	// (empty) mode uses the global privacy.unsubscribe_header setting.
+	UnsubHeaderDefault = ""
+	UnsubHeaderURL     = "url"
+	UnsubHeaderMailto  = "mailto"
+	UnsubHeaderBoth    = "both"
+	UnsubHeaderCustom  = "custom"
+	UnsubHeaderNone    = "none"
+
+	// Sources of campaign unsubscriptions.
+	UnsubSourcePage     = "page"
+	UnsubSourceOneClick = "one-click"
+
 	// User.
-	UserTypeSuperadmin = "superadmin"
-	UserTypeUser       = "user"
+	UserRoleAdmin      = "admin"
+	UserRoleManager    = "manager"
+	UserRoleAnalyst    = "analyst"
+	UserRoleEditor     = "editor"
 	UserStatusEnabled  = "enabled"
 	UserStatusDisabled = "disabled"
 
@@ -84,6 +124,10 @@ var regTplFuncs = []regTplFunc{
 		regExp:  regexp.MustCompile(`{{(\s+)?(TrackView|UnsubscribeURL|OptinURL|MessageURL)(\s+)?}}`),
 		replace: `{{ $2 . }}`,
 	},
+	regTplFunc{
+		regExp:  regexp.MustCompile("{{(\\s+)?Partial\\s+?(\"|`)(.+?)(\"|`)(\\s+)?}}"),
+		replace: `{{ Partial "$3" . }}`,
+	},
 }
 
 // AdminNotifCallback is a callback function that's called
@@ -101,11 +145,21 @@ type Base struct {
 type User struct {
 	Base
 
-	Email    string `json:"email"`
-	Name     string `json:"name"`
-	Password string `json:"-"`
-	Type     string `json:"type"`
-	Status   string `json:"status"`
+	Username string `db:"username" json:"username"`
+	Name     string `db:"name" json:"name"`
+	Password string `db:"password" json:"-"`
+	Role     string `db:"role" json:"role"`
+	Status   string `db:"status" json:"status"`
+	Source   string `db:"source" json:"source"`
+
+	// Lists that a list-restricted editor can manage.
+	ListIDs pq.Int64Array `db:"list_ids" json:"list_ids"`
+
+	// Two-factor authentication.
+	TOTPEnabled       bool           `db:"totp_enabled" json:"totp_enabled"`
+	TOTPSecret        string         `db:"totp_secret" json:"-"`
+	TOTPRecoveryCodes pq.StringArray `db:"totp_recovery_codes" json:"-"`
+	TOTPLastStep      int64          `db:"totp_last_step" json:"-"`
 }
 
 // Subscriber represents an e-mail subscriber.
@@ -155,6 +209,14 @@ type List struct {
 	Type            string         `db:"type" json:"type"`
 	Optin           string         `db:"optin" json:"optin"`
 	Tags            pq.StringArray `db:"tags" json:"tags"`
+	FolderID        null.Int       `db:"folder_id" json:"folder_id"`
+	Query           string         `db:"query" json:"query"`
+	SyncedAt        null.Time      `db:"synced_at" json:"synced_at"`
+	FromEmail       string         `db:"from_email" json:"from_email"`
+	ReplyTo         string         `db:"reply_to" json:"reply_to"`
+	PageTemplateID  null.Int       `db:"page_template_id" json:"page_template_id"`
+	UnsubHeader     string         `db:"unsub_header" json:"unsub_header"`
+	UnsubHeaderVal  string         `db:"unsub_header_value" json:"unsub_header_value"`
 	SubscriberCount int            `db:"subscriber_count" json:"subscriber_count"`
 	SubscriberID    int            `db:"subscriber_id" json:"-"`
 
@@ -166,6 +228,63 @@ type List struct {
 	Total int `db:"total" json:"-"`
 }
 
+// ListFolder represents a folder that groups lists. Folders can be nested.
+type ListFolder struct {
+	Base
+
+	Name      string   `db:"name" json:"name"`
+	ParentID  null.Int `db:"parent_id" json:"parent_id"`
+	ListCount int      `db:"list_count" json:"list_count"`
+}
+
+// ListWebhook represents a URL that's posted to on subscription events
+// on a particular list.
+type ListWebhook struct {
+	Base
+
+	ListID  int            `db:"list_id" json:"list_id"`
+	URL     string         `db:"url" json:"url"`
+	Events  pq.StringArray `db:"events" json:"events"`
+	Enabled bool           `db:"enabled" json:"enabled"`
+
+	// Pseudofields joined in when webhooks are fired.
+	ListUUID string `db:"list_uuid" json:"-"`
+	ListName string `db:"list_name" json:"-"`
+}
+
+// PageTemplate represents a set of template definitions that override the
+// default templates of the public pages of the lists that use it.
+type PageTemplate struct {
+	Base
+
+	Name string `db:"name" json:"name"`
+	Body string `db:"body" json:"body"`
+}
+
+// SubForm represents a hosted subscription form for a list that collects
+// custom fields into subscriber attributes.
+type SubForm struct {
+	Base
+
+	UUID   string        `db:"uuid" json:"uuid"`
+	Name   string        `db:"name" json:"name"`
+	ListID int           `db:"list_id" json:"list_id"`
+	Fields SubFormFields `db:"fields" json:"fields"`
+}
+
+// SubFormField represents a custom field on a subscription form. The value
+// of the field is stored in the subscriber's attributes under Name.
+type SubFormField struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Options  []string `json:"options"`
+}
+
+// SubFormFields is the list of custom fields on a subscription form.
+type SubFormFields []SubFormField
+
 // Campaign represents an e-mail campaign.
 type Campaign struct {
 	Base
@@ -176,6 +295,7 @@ type Campaign struct {
 	Name        string         `db:"name" json:"name"`
 	Subject     string         `db:"subject" json:"subject"`
 	FromEmail   string         `db:"from_email" json:"from_email"`
+	ReplyTo     string         `db:"reply_to" json:"reply_to"`
 	Body        string         `db:"body" json:"body"`
 	AltBody     null.String    `db:"altbody" json:"altbody"`
 	SendAt      null.Time      `db:"send_at" json:"send_at"`
@@ -184,6 +304,16 @@ type Campaign struct {
 	Tags        pq.StringArray `db:"tags" json:"tags"`
 	TemplateID  int            `db:"template_id" json:"template_id"`
 	Messenger   string         `db:"messenger" json:"messenger"`
+	Archive     bool           `db:"archive" json:"archive"`
+
+	// List-Unsubscribe header mode (UnsubHeader*) and its mailto address
+	// or custom value.
+	UnsubHeader    string `db:"unsub_header" json:"unsub_header"`
+	UnsubHeaderVal string `db:"unsub_header_value" json:"unsub_header_value"`
+
+	// Lang is the language of the system strings in the campaign's
+	// templates. Empty uses the app's language.
+	Lang string `db:"lang" json:"lang"`
 
 	// TemplateBody is joined in from templates by the next-campaigns query.
 	TemplateBody string             `db:"template_body" json:"-"`
@@ -222,10 +352,164 @@ type Template struct {
 	Base
 
 	Name      string `db:"name" json:"name"`
+	Type      string `db:"type" json:"type"`
+	Subject   string `db:"subject" json:"subject"`
 	Body      string `db:"body" json:"body,omitempty"`
 	IsDefault bool   `db:"is_default" json:"is_default"`
+
+	// Sample data that transactional templates are previewed with.
+	SampleData TemplateData `db:"sample_data" json:"sample_data"`
+
+	// Compiled body and subject of transactional templates.
+	Tpl        *template.Template `json:"-"`
+	SubjectTpl *template.Template `json:"-"`
 }
 
+// TxMessage represents a transactional message sent to a subscriber
+// with a transactional (tx) template.
+type TxMessage struct {
+	SubscriberEmail string `json:"subscriber_email"`
+	SubscriberID    int    `json:"subscriber_id"`
+
+	TemplateID  int                    `json:"template_id"`
+	Data        map[string]interface{} `json:"data"`
+	FromEmail   string                 `json:"from_email"`
+	Headers     map[string]string      `json:"headers"`
+	ContentType string                 `json:"content_type"`
+	Messenger   string                 `json:"messenger"`
+	Attachments []TxAttachment         `json:"attachments"`
+
+	// Optional URL to which the delivery status events of the message
+	// are posted.
+	StatusURL string `json:"status_url"`
+
+	// Optional time at which the message should be sent.
+	SendAt null.Time `json:"send_at"`
+
+	// Unique ID of the message that's assigned when it's sent.
+	MessageID string `json:"-"`
+
+	// Rendered subject and body.
+	Subject string `json:"-"`
+	Body    []byte `json:"-"`
+}
+
+// TxBatch is a batch of transactional messages that share a template and
+// the message options, with the recipients and their data in Messages.
+// The recipient fields of the embedded TxMessage are ignored.
+type TxBatch struct {
+	TxMessage
+
+	Messages []TxBatchMessage `json:"messages"`
+}
+
+// TxBatchMessage is a recipient in a transactional message batch. Headers
+// are merged into the batch's headers.
+type TxBatchMessage struct {
+	SubscriberEmail string                 `json:"subscriber_email"`
+	SubscriberID    int                    `json:"subscriber_id"`
+	Data            map[string]interface{} `json:"data"`
+	Headers         map[string]string      `json:"headers"`
+}
+
+// TxScheduled is a transactional message that's scheduled to be sent later.
+type TxScheduled struct {
+	ID        int64          `db:"id" json:"id"`
+	MessageID string         `db:"message_id" json:"message_id"`
+	Message   types.JSONText `db:"message" json:"message"`
+	SendAt    null.Time      `db:"send_at" json:"send_at"`
+	CreatedAt null.Time      `db:"created_at" json:"created_at"`
+
+	// Pseudofield for getting the total number of entries
+	// in paginated queries.
+	Total int `db:"total" json:"-"`
+}
+
+// TxCallback is the status callback of a sent transactional message.
+type TxCallback struct {
+	MessageID    string    `db:"message_id" json:"message_id"`
+	SubscriberID null.Int  `db:"subscriber_id" json:"subscriber_id"`
+	Email        string    `db:"email" json:"email"`
+	URL          string    `db:"url" json:"url"`
+	CreatedAt    null.Time `db:"created_at" json:"created_at"`
+}
+
+// TxAttachment is a file attached to a transactional message, either as
+// base64 encoded content or as a reference to a file in the media library.
+type TxAttachment struct {
+	Name      string `json:"name"`
+	Content   string `json:"content"`
+	MediaUUID string `json:"media_uuid"`
+}
+
+// TxLog is a logged transactional message send.
+type TxLog struct {
+	ID           int64       `db:"id" json:"id"`
+	MessageID    null.String `db:"message_id" json:"message_id"`
+	SubscriberID null.Int    `db:"subscriber_id" json:"subscriber_id"`
+	TemplateID   null.Int    `db:"template_id" json:"template_id"`
+	TemplateName string      `db:"template_name" json:"template_name"`
+	Email        string      `db:"email" json:"email"`
+	Subject      string      `db:"subject" json:"subject"`
+	Messenger    string      `db:"messenger" json:"messenger"`
+	Status       string      `db:"status" json:"status"`
+	Error        string      `db:"error" json:"error"`
+	CreatedAt    null.Time   `db:"created_at" json:"created_at"`
+
+	// Pseudofield for getting the total number of entries
+	// in paginated queries.
+	Total int `db:"total" json:"-"`
+}
+
+// AuditLog is a logged administrative action.
+type AuditLog struct {
+	ID         int64          `db:"id" json:"id"`
+	Username   string         `db:"username" json:"username"`
+	Method     string         `db:"method" json:"method"`
+	Path       string         `db:"path" json:"path"`
+	Resource   string         `db:"resource" json:"resource"`
+	ResourceID string         `db:"resource_id" json:"resource_id"`
+	Data       types.JSONText `db:"data" json:"data"`
+	IP         string         `db:"ip" json:"ip"`
+	CreatedAt  null.Time      `db:"created_at" json:"created_at"`
+
+	// Pseudofield for getting the total number of entries
+	// in paginated queries.
+	Total int `db:"total" json:"-"`
+}
+
+// UnsubscribeFeedback is the reason a subscriber gave for unsubscribing
+// from a campaign.
+type UnsubscribeFeedback struct {
+	ID           int64     `db:"id" json:"id"`
+	CampaignID   null.Int  `db:"campaign_id" json:"campaign_id"`
+	CampaignName string    `db:"campaign_name" json:"campaign_name"`
+	SubscriberID null.Int  `db:"subscriber_id" json:"subscriber_id"`
+	Reason       string    `db:"reason" json:"reason"`
+	Comment      string    `db:"comment" json:"comment"`
+	CreatedAt    null.Time `db:"created_at" json:"created_at"`
+
+	// Pseudofield for getting the total number of entries
+	// in paginated queries.
+	Total int `db:"total" json:"-"`
+}
+
+// TemplateVersion represents a saved revision of a template.
+type TemplateVersion struct {
+	ID         int          `db:"id" json:"id"`
+	TemplateID int          `db:"template_id" json:"template_id"`
+	Version    int          `db:"version" json:"version"`
+	Name       string       `db:"name" json:"name"`
+	Subject    string       `db:"subject" json:"subject"`
+	Body       string       `db:"body" json:"body,omitempty"`
+	SampleData TemplateData `db:"sample_data" json:"sample_data"`
+	Editor     string       `db:"editor" json:"editor"`
+	CreatedAt  null.Time    `db:"created_at" json:"created_at"`
+}
+
+// TemplateData is the map of sample data of a transactional template.
+type TemplateData map[string]interface{}
+
 // markdown is a global instance of Markdown parser and renderer.
 var markdown = goldmark.New(
 	goldmark.WithRendererOptions(
@@ -284,6 +568,38 @@ func (s SubscriberAttribs) Scan(src interface{}) error {
 	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
 }
 
+// Value returns the JSON marshalled TemplateData.
+func (d TemplateData) Value() (driver.Value, error) {
+	if d == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(d)
+}
+
+// Scan unmarshals JSON into TemplateData.
+func (d *TemplateData) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, d)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, d)
+}
+
+// Value returns the JSON marshalled SubFormFields.
+func (f SubFormFields) Value() (driver.Value, error) {
+	if f == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(f)
+}
+
+// Scan unmarshals JSON into SubFormFields.
+func (f *SubFormFields) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, f)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, f)
+}
+
 // GetIDs returns the list of campaign IDs.
 func (camps Campaigns) GetIDs() []int {
 	IDs := make([]int, len(camps))
@@ -316,11 +632,79 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 	return nil
 }
 
+// CompilePartial compiles a partial template so that it can be
+// included in other templates with the Partial template function.
+func (t *Template) CompilePartial(f template.FuncMap) (*template.Template, error) {
+	body := t.Body
+	for _, r := range regTplFuncs {
+		body = r.regExp.ReplaceAllString(body, r.replace)
+	}
+	return template.New(t.Name).Funcs(f).Parse(body)
+}
+
+// Compile compiles the body and subject of a transactional template.
+func (t *Template) Compile(f template.FuncMap) error {
+	body := t.Body
+	for _, r := range regTplFuncs {
+		body = r.regExp.ReplaceAllString(body, r.replace)
+	}
+	tpl, err := template.New(BaseTpl).Funcs(f).Parse(body)
+	if err != nil {
+		return fmt.Errorf("error compiling transactional template: %v", err)
+	}
+	t.Tpl = tpl
+
+	if strings.Contains(t.Subject, "{{") {
+		subj := t.Subject
+		for _, r := range regTplFuncs {
+			subj = r.regExp.ReplaceAllString(subj, r.replace)
+		}
+		subjTpl, err := template.New(BaseTpl).Funcs(f).Parse(subj)
+		if err != nil {
+			return fmt.Errorf("error compiling subject: %v", err)
+		}
+		t.SubjectTpl = subjTpl
+	}
+
+	return nil
+}
+
+// Render renders the subject and body of a transactional message with a
+// compiled transactional template. Templates can access the subscriber
+// as .Subscriber and the message, including its arbitrary data map, as .Tx.
+func (m *TxMessage) Render(sub Subscriber, tpl *Template) error {
+	data := struct {
+		Subscriber Subscriber
+		Tx         *TxMessage
+	}{sub, m}
+
+	var b bytes.Buffer
+	if err := tpl.Tpl.ExecuteTemplate(&b, BaseTpl, data); err != nil {
+		return err
+	}
+	m.Body = b.Bytes()
+
+	m.Subject = tpl.Subject
+	if tpl.SubjectTpl != nil {
+		var s strings.Builder
+		if err := tpl.SubjectTpl.ExecuteTemplate(&s, BaseTpl, data); err != nil {
+			return err
+		}
+		m.Subject = s.String()
+	}
+
+	return nil
+}
+
 // CompileTemplate compiles a campaign body template into its base
 // template and sets the resultant template to Campaign.Tpl.
 func (c *Campaign) CompileTemplate(f template.FuncMap) error {
-	// Compile the base template.
+	// Compile the base template. Text messages aren't wrapped in
+	// the (HTML) campaign template.
 	body := c.TemplateBody
+	if c.ContentType == CampaignContentTypeSMS {
+		body = `{{ template "` + ContentTpl + `" . }}`
+	}
 	for _, r := range regTplFuncs {
 		body = r.regExp.ReplaceAllString(body, r.replace)
 	}
@@ -329,14 +713,22 @@ func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 		return fmt.Errorf("error compiling base template: %v", err)
 	}
 
-	// If the format is markdown, convert Markdown to HTML.
-	if c.ContentType == CampaignContentTypeMarkdown {
+	// If the format is markdown, convert Markdown to HTML, and if it's
+	// visual, render the blocks to HTML.
+	switch c.ContentType {
+	case CampaignContentTypeMarkdown:
 		var b bytes.Buffer
 		if err := markdown.Convert([]byte(c.Body), &b); err != nil {
 			return err
 		}
 		body = b.String()
-	} else {
+	case CampaignContentTypeVisual:
+		b, err := RenderBlocks(c.Body)
+		if err != nil {
+			return fmt.Errorf("error rendering visual content: %v", err)
+		}
+		body = b
+	default:
 		body = c.Body
 	}
 
@@ -393,14 +785,29 @@ func (c *Campaign) ConvertContent(from, to string) (string, error) {
 
 	// If the format is markdown, convert Markdown to HTML.
 	var out string
-	if from == CampaignContentTypeMarkdown &&
-		(to == CampaignContentTypeHTML || to == CampaignContentTypeRichtext) {
+	switch {
+	case from == CampaignContentTypeMarkdown &&
+		(to == CampaignContentTypeHTML || to == CampaignContentTypeRichtext || to == CampaignContentTypeVisual):
 		var b bytes.Buffer
 		if err := markdown.Convert([]byte(c.Body), &b); err != nil {
 			return out, err
 		}
 		out = b.String()
-	} else {
+
+		if to == CampaignContentTypeVisual {
+			return HTMLToBlocks(out)
+		}
+
+	// Visual blocks can be rendered to HTML, but the structure is lost.
+	case from == CampaignContentTypeVisual &&
+		(to == CampaignContentTypeHTML || to == CampaignContentTypeRichtext):
+		return RenderBlocks(c.Body)
+
+	case (from == CampaignContentTypeHTML || from == CampaignContentTypeRichtext) &&
+		to == CampaignContentTypeVisual:
+		return HTMLToBlocks(c.Body)
+
+	default:
 		return out, errors.New("unknown formats to convert")
 	}
 
@@ -9,10 +9,17 @@ SELECT * FROM subscribers WHERE
         WHEN $3 != '' THEN email = $3
     END;
 
+-- name: get-subscribers-by-ids
+SELECT * FROM subscribers WHERE id = ANY($1::INT[]);
+
 -- name: subscriber-exists
 -- Check if a subscriber exists by id or UUID.
 SELECT exists (SELECT true FROM subscribers WHERE CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END);
 
+-- name: get-subscriber-lang
+-- Get the language (attribs.lang) of a subscriber by UUID.
+SELECT COALESCE(attribs->>'lang', '') FROM subscribers WHERE uuid = $1;
+
 -- name: get-subscribers-by-emails
 -- Get subscribers by emails.
 SELECT * FROM subscribers WHERE email=ANY($1);
@@ -188,7 +195,8 @@ sub AS (
 UPDATE subscriber_lists SET status = 'unsubscribed' WHERE
     subscriber_id = (SELECT id FROM sub) AND status != 'unsubscribed' AND
     -- If $3 is false, unsubscribe from the campaign's lists, otherwise all lists.
-    CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM lists) ELSE list_id != 0 END;
+    CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM lists) ELSE list_id != 0 END
+    RETURNING list_id;
 
 -- privacy
 -- name: export-subscriber-data
@@ -222,6 +230,43 @@ SELECT (SELECT email FROM prof) as email,
         COALESCE((SELECT JSON_AGG(t) FROM views t), '[]') AS campaign_views,
         COALESCE((SELECT JSON_AGG(t) FROM clicks t), '[]') AS link_clicks;
 
+-- unsubscribe feedback
+-- name: insert-unsubscribe-feedback
+-- Records the reason a subscriber ($2) gave for unsubscribing from a campaign ($1), both by UUID.
+INSERT INTO unsubscribe_feedback (campaign_id, subscriber_id, reason, comment)
+    VALUES((SELECT id FROM campaigns WHERE uuid = $1), (SELECT id FROM subscribers WHERE uuid = $2), $3, $4);
+
+-- name: query-unsubscribe-feedback
+-- Responses are fetched newest first. $1 = 0 fetches the responses of all campaigns.
+SELECT COUNT(*) OVER () AS total, f.id, f.campaign_id, COALESCE(campaigns.name, '') AS campaign_name,
+    f.subscriber_id, f.reason, f.comment, f.created_at
+    FROM unsubscribe_feedback f
+    LEFT JOIN campaigns ON (campaigns.id = f.campaign_id)
+    WHERE ($1 = 0 OR f.campaign_id = $1)
+    AND ($2::TIMESTAMP WITH TIME ZONE IS NULL OR f.created_at >= $2)
+    AND ($3::TIMESTAMP WITH TIME ZONE IS NULL OR f.created_at < $3)
+    ORDER BY f.id DESC
+    OFFSET $4 LIMIT (CASE WHEN $5 = 0 THEN NULL ELSE $5 END);
+
+-- name: get-unsubscribe-feedback-summary
+-- Number of responses by reason. $1 = 0 counts the responses of all campaigns.
+SELECT reason, COUNT(*) AS count FROM unsubscribe_feedback
+    WHERE ($1 = 0 OR campaign_id = $1)
+    AND ($2::TIMESTAMP WITH TIME ZONE IS NULL OR created_at >= $2)
+    AND ($3::TIMESTAMP WITH TIME ZONE IS NULL OR created_at < $3)
+    GROUP BY reason ORDER BY count DESC, reason;
+
+-- campaign unsubscribes
+-- name: register-campaign-unsubscribe
+-- Records an unsubscription of a subscriber ($2) from a campaign ($1), both by UUID,
+-- with its source (page, one-click).
+INSERT INTO campaign_unsubscribes (campaign_id, subscriber_id, source)
+    VALUES((SELECT id FROM campaigns WHERE uuid = $1), (SELECT id FROM subscribers WHERE uuid = $2), $3);
+
+-- name: get-campaign-unsubscribe-sources
+SELECT source AS name, COUNT(*) AS count FROM campaign_unsubscribes
+    WHERE campaign_id = $1 GROUP BY source ORDER BY count DESC;
+
 -- Partial and RAW queries used to construct arbitrary subscriber
 -- queries for segmentation follow.
 
@@ -241,6 +286,8 @@ SELECT COUNT(*) OVER () AS total, subscribers.* FROM subscribers
         AND subscriber_lists.subscriber_id = subscribers.id
     )
     WHERE subscriber_lists.list_id = ALL($1::INT[])
+    -- Optional list IDs (eg: lists in a folder) the subscriber should belong to any of.
+    AND ($4::INT[] IS NULL OR subscribers.id IN (SELECT subscriber_id FROM subscriber_lists WHERE list_id = ANY($4::INT[])))
     %s
     ORDER BY %s %s OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
 
@@ -257,6 +304,7 @@ SELECT s.id, s.uuid, s.email, s.name, s.status, s.attribs, s.created_at, s.updat
         AND sl.subscriber_id = s.id
     )
     WHERE sl.list_id = ALL($1::INT[]) AND id > $2
+    AND ($4::INT[] IS NULL OR s.id IN (SELECT subscriber_id FROM subscriber_lists WHERE list_id = ANY($4::INT[])))
     %s
     ORDER BY s.id ASC LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
 
@@ -321,7 +369,10 @@ SELECT * FROM lists WHERE (CASE WHEN $1 = '' THEN 1=1 ELSE type=$1::list_type EN
 -- name: query-lists
 WITH ls AS (
 	SELECT COUNT(*) OVER () AS total, lists.* FROM lists
-    WHERE ($1 = 0 OR id = $1) OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END)
+    WHERE ($1 = 0 OR id = $1)
+    -- Optional list IDs (eg: lists in a folder) to filter.
+    AND ($4::INT[] IS NULL OR id = ANY($4::INT[]))
+    OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END)
 ),
 counts AS (
 	SELECT COUNT(*) as subscriber_count, list_id FROM subscriber_lists WHERE status != 'unsubscribed' GROUP BY list_id
@@ -338,7 +389,8 @@ SELECT * FROM lists WHERE (CASE WHEN $1 != '' THEN optin=$1::list_optin ELSE TRU
     END) ORDER BY name;
 
 -- name: create-list
-INSERT INTO lists (uuid, name, type, optin, tags) VALUES($1, $2, $3, $4, $5) RETURNING id;
+INSERT INTO lists (uuid, name, type, optin, tags, folder_id, query, from_email, reply_to, page_template_id, unsub_header, unsub_header_value)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id;
 
 -- name: update-list
 UPDATE lists SET
@@ -346,15 +398,195 @@ UPDATE lists SET
     type=(CASE WHEN $3 != '' THEN $3::list_type ELSE type END),
     optin=(CASE WHEN $4 != '' THEN $4::list_optin ELSE optin END),
     tags=$5::VARCHAR(100)[],
+    folder_id=$6,
+    -- A dynamic list keeps its saved query if none is given.
+    query=(CASE WHEN (CASE WHEN $3 != '' THEN $3::list_type ELSE type END) = 'dynamic'
+        THEN COALESCE(NULLIF($7, ''), query) ELSE '' END),
+    from_email=$8,
+    reply_to=$9,
+    page_template_id=$10,
+    unsub_header=$11,
+    unsub_header_value=$12,
     updated_at=NOW()
 WHERE id = $1;
 
+-- name: get-list-sender
+-- Get the first non-empty default sender, reply-to and List-Unsubscribe header
+-- among the given lists in the order of the list IDs.
+WITH unsub AS (
+    SELECT unsub_header, unsub_header_value FROM lists WHERE id = ANY($1::INT[]) AND unsub_header != ''
+        ORDER BY ARRAY_POSITION($1::INT[], id) LIMIT 1
+)
+SELECT
+    COALESCE((SELECT from_email FROM lists WHERE id = ANY($1::INT[]) AND from_email != ''
+        ORDER BY ARRAY_POSITION($1::INT[], id) LIMIT 1), '') AS from_email,
+    COALESCE((SELECT reply_to FROM lists WHERE id = ANY($1::INT[]) AND reply_to != ''
+        ORDER BY ARRAY_POSITION($1::INT[], id) LIMIT 1), '') AS reply_to,
+    COALESCE((SELECT unsub_header FROM unsub), '') AS unsub_header,
+    COALESCE((SELECT unsub_header_value FROM unsub), '') AS unsub_header_value;
+
+-- name: get-dynamic-lists
+-- Get one or all dynamic lists.
+SELECT * FROM lists WHERE type = 'dynamic' AND ($1 = 0 OR id = $1) ORDER BY id;
+
+-- name: get-campaign-dynamic-lists
+-- Get the dynamic lists of a campaign so that their subscriptions can be
+-- synced right before it's sent.
+SELECT * FROM lists WHERE type = 'dynamic' AND id IN (
+    SELECT list_id FROM campaign_lists WHERE campaign_id = $1
+);
+
+-- name: sync-dynamic-list
+-- raw: true
+-- Syncs the subscriptions of a dynamic list ($3) with the subscribers matching
+-- its saved query. Subscriptions of subscribers who no longer match are removed.
+-- Unsubscriptions are left untouched so that they are retained across syncs.
+WITH subs AS (%s),
+del AS (
+    DELETE FROM subscriber_lists WHERE list_id = $3 AND status != 'unsubscribed'
+    AND subscriber_id != ALL(ARRAY(SELECT id FROM subs))
+),
+u AS (
+    UPDATE lists SET synced_at=NOW() WHERE id = $3
+)
+INSERT INTO subscriber_lists (subscriber_id, list_id, status)
+    (SELECT id, $3, 'confirmed' FROM subs)
+    ON CONFLICT (subscriber_id, list_id) DO NOTHING;
+
 -- name: update-lists-date
 UPDATE lists SET updated_at=NOW() WHERE id = ANY($1);
 
 -- name: delete-lists
 DELETE FROM lists WHERE id = ALL($1);
 
+-- list folders
+-- name: get-list-folders
+-- Get one or all folders along with the number of lists directly under each.
+SELECT list_folders.*, COUNT(lists.id) AS list_count FROM list_folders
+    LEFT JOIN lists ON (lists.folder_id = list_folders.id)
+    WHERE ($1 = 0 OR list_folders.id = $1)
+    GROUP BY list_folders.id ORDER BY list_folders.name;
+
+-- name: get-list-folder-list-ids
+-- Get the IDs of all lists in a folder and all of its sub-folders.
+WITH RECURSIVE tree AS (
+    SELECT id FROM list_folders WHERE id = $1
+    UNION
+    SELECT f.id FROM list_folders f INNER JOIN tree ON (f.parent_id = tree.id)
+)
+SELECT COALESCE(ARRAY_AGG(id), '{}') FROM lists WHERE folder_id = ANY(SELECT id FROM tree);
+
+-- name: create-list-folder
+INSERT INTO list_folders (name, parent_id) VALUES($1, $2) RETURNING id;
+
+-- name: update-list-folder
+-- A folder cannot be moved under itself or any of its own sub-folders.
+WITH RECURSIVE tree AS (
+    SELECT id FROM list_folders WHERE id = $1
+    UNION
+    SELECT f.id FROM list_folders f INNER JOIN tree ON (f.parent_id = tree.id)
+)
+UPDATE list_folders SET
+    name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
+    parent_id=$3::INT,
+    updated_at=NOW()
+WHERE id = $1 AND ($3::INT IS NULL OR $3::INT != ALL(ARRAY(SELECT id FROM tree)));
+
+-- name: delete-list-folder
+-- Lists and sub-folders in the folder are moved to the root.
+DELETE FROM list_folders WHERE id = $1;
+
+
+-- list webhooks
+-- name: get-list-webhooks
+SELECT * FROM list_webhooks WHERE list_id = $1 AND ($2 = 0 OR id = $2) ORDER BY id;
+
+-- name: get-event-list-webhooks
+-- Get the enabled webhooks of the given lists that are registered for an event.
+SELECT list_webhooks.*, lists.uuid AS list_uuid, lists.name AS list_name FROM list_webhooks
+    INNER JOIN lists ON (lists.id = list_webhooks.list_id)
+    WHERE list_webhooks.enabled AND list_webhooks.list_id = ANY($1::INT[])
+    AND $2 = ANY(list_webhooks.events);
+
+-- name: create-list-webhook
+INSERT INTO list_webhooks (list_id, url, events, enabled) VALUES($1, $2, $3, $4) RETURNING id;
+
+-- name: update-list-webhook
+UPDATE list_webhooks SET
+    url=$3,
+    events=$4,
+    enabled=$5,
+    updated_at=NOW()
+WHERE id = $1 AND list_id = $2;
+
+-- name: delete-list-webhook
+DELETE FROM list_webhooks WHERE id = $1 AND list_id = $2;
+
+
+-- push subscriptions
+-- name: get-push-subscriptions
+SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE subscriber_id = $1;
+
+-- name: upsert-push-subscription
+-- Register a browser's push subscription against a subscriber (UUID). An endpoint
+-- that's already registered to another subscriber is left as is.
+INSERT INTO push_subscriptions (subscriber_id, endpoint, p256dh, auth)
+    VALUES((SELECT id FROM subscribers WHERE uuid = $1), $2, $3, $4)
+    ON CONFLICT (endpoint) DO UPDATE
+    SET p256dh=EXCLUDED.p256dh, auth=EXCLUDED.auth, updated_at=NOW()
+    WHERE push_subscriptions.subscriber_id = EXCLUDED.subscriber_id;
+
+-- name: delete-push-subscription
+-- Delete a push subscription, optionally only if it belongs to the given subscriber (UUID).
+DELETE FROM push_subscriptions WHERE endpoint = $1
+    AND ($2 = '' OR subscriber_id = (SELECT id FROM subscribers WHERE uuid::TEXT = $2));
+
+
+-- subscription forms
+-- name: get-sub-forms
+-- Get one form by ID or UUID, or all forms.
+SELECT * FROM sub_forms WHERE
+    CASE WHEN $1 > 0 THEN id = $1 WHEN $2 != '' THEN uuid = $2::UUID ELSE true END
+    ORDER BY created_at;
+
+-- name: create-sub-form
+INSERT INTO sub_forms (uuid, name, list_id, fields) VALUES($1, $2, $3, $4) RETURNING id;
+
+-- name: update-sub-form
+UPDATE sub_forms SET
+    name=$2,
+    list_id=$3,
+    fields=$4,
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: delete-sub-form
+DELETE FROM sub_forms WHERE id = $1;
+
+
+-- page templates
+-- name: get-page-templates
+-- Get one page template set by ID, or all of them without their bodies.
+SELECT id, name, (CASE WHEN $1 > 0 THEN body ELSE '' END) AS body, created_at, updated_at
+    FROM page_templates WHERE ($1 = 0 OR id = $1) ORDER BY name;
+
+-- name: create-page-template
+INSERT INTO page_templates (name, body) VALUES($1, $2) RETURNING id;
+
+-- name: update-page-template
+UPDATE page_templates SET name=$2, body=$3, updated_at=NOW() WHERE id = $1;
+
+-- name: delete-page-template
+DELETE FROM page_templates WHERE id = $1;
+
+-- name: get-campaign-page-template
+-- Get the page template set of the first list of a campaign that has one.
+SELECT COALESCE((SELECT l.page_template_id FROM campaign_lists cl
+    JOIN campaigns c ON (c.id = cl.campaign_id)
+    JOIN lists l ON (l.id = cl.list_id)
+    WHERE c.uuid = $1 AND l.page_template_id IS NOT NULL
+    ORDER BY l.id LIMIT 1), 0);
+
 
 -- campaigns
 -- name: create-campaign
@@ -386,8 +618,8 @@ counts AS (
     AND subscribers.status='enabled'
 ),
 camp AS (
-    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, tags, messenger, template_id, to_send, max_subscriber_id)
-        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts)
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, tags, messenger, template_id, to_send, max_subscriber_id, reply_to, archive, unsub_header, unsub_header_value, lang)
+        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts), $14, $15, $16, $17, $18
         RETURNING id
 )
 INSERT INTO campaign_lists (campaign_id, list_id, list_name)
@@ -401,10 +633,10 @@ INSERT INTO campaign_lists (campaign_id, list_id, list_name)
 -- there's a COUNT() OVER() that still returns the total result count
 -- for pagination in the frontend, albeit being a field that'll repeat
 -- with every resultant row.
-SELECT  c.id, c.uuid, c.name, c.subject, c.from_email,
+SELECT  c.id, c.uuid, c.name, c.subject, c.from_email, c.reply_to,
         c.messenger, c.started_at, c.to_send, c.sent, c.type,
         c.body, c.altbody, c.send_at, c.status, c.content_type, c.tags,
-        c.template_id, c.created_at, c.updated_at,
+        c.template_id, c.archive, c.unsub_header, c.unsub_header_value, c.lang, c.created_at, c.updated_at,
         COUNT(*) OVER () AS total,
         (
             SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(l)), '[]') FROM (
@@ -417,6 +649,8 @@ FROM campaigns c
 WHERE ($1 = 0 OR id = $1)
     AND status=ANY(CASE WHEN ARRAY_LENGTH($2::campaign_status[], 1) != 0 THEN $2::campaign_status[] ELSE ARRAY[status] END)
     AND ($3 = '' OR CONCAT(name, subject) ILIKE $3)
+    -- Optional list IDs (eg: lists in a folder) the campaign should target.
+    AND ($6::INT[] IS NULL OR c.id IN (SELECT campaign_id FROM campaign_lists WHERE list_id = ANY($6::INT[])))
 ORDER BY %s %s OFFSET $4 LIMIT (CASE WHEN $5 = 0 THEN NULL ELSE $5 END);
 
 -- name: get-campaign
@@ -426,6 +660,27 @@ SELECT campaigns.*,
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
     WHERE CASE WHEN $1 > 0 THEN campaigns.id = $1 ELSE uuid = $2 END;
 
+-- name: update-campaign-archive
+UPDATE campaigns SET archive=$2, updated_at=NOW() WHERE id = $1;
+
+-- name: query-archived-campaigns
+-- Query campaigns published on the public archive. $1 is a full-text query
+-- that's matched against the stored search vectors, and $2, optional tags
+-- that the campaigns should all have.
+SELECT COUNT(*) OVER () AS total, id, uuid, subject, tags,
+    COALESCE(started_at, send_at, created_at) AS send_at
+    FROM campaigns
+    WHERE archive = true AND type = 'regular' AND status = ANY('{running, finished}')
+    AND ($1 = '' OR archive_tsv @@ PLAINTO_TSQUERY('simple', $1))
+    AND (CARDINALITY($2::VARCHAR(100)[]) = 0 OR tags @> $2::VARCHAR(100)[])
+    ORDER BY COALESCE(started_at, send_at, created_at) DESC OFFSET $3 LIMIT $4;
+
+-- name: get-archive-tags
+-- Get the tags of campaigns published on the public archive.
+SELECT DISTINCT UNNEST(tags) AS tag FROM campaigns
+    WHERE archive = true AND type = 'regular' AND status = ANY('{running, finished}')
+    ORDER BY tag;
+
 -- name: get-campaign-stats
 -- This query is used to lazy load campaign stats (views, counts, list of lists) given a list of campaign IDs.
 -- The query returns results in the same order as the given campaign IDs, and for non-existent campaign IDs,
@@ -435,14 +690,27 @@ WITH lists AS (
     SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', list_id, 'name', list_name)) AS lists FROM campaign_lists
     WHERE campaign_id = ANY($1) GROUP BY campaign_id
 ), views AS (
-    SELECT campaign_id, COUNT(campaign_id) as num FROM campaign_views
-    WHERE campaign_id = ANY($1)
-    GROUP BY campaign_id
+    -- Views and clicks that have been pruned are counted from the rollups.
+    SELECT campaign_id, SUM(num)::BIGINT AS num FROM (
+        SELECT campaign_id, COUNT(campaign_id) as num FROM campaign_views
+        WHERE campaign_id = ANY($1)
+        GROUP BY campaign_id
+        UNION ALL
+        SELECT campaign_id, SUM(views) FROM tracking_rollups
+        WHERE campaign_id = ANY($1)
+        GROUP BY campaign_id
+    ) v GROUP BY campaign_id
 ),
 clicks AS (
-    SELECT campaign_id, COUNT(campaign_id) as num FROM link_clicks
-    WHERE campaign_id = ANY($1)
-    GROUP BY campaign_id
+    SELECT campaign_id, SUM(num)::BIGINT AS num FROM (
+        SELECT campaign_id, COUNT(campaign_id) as num FROM link_clicks
+        WHERE campaign_id = ANY($1)
+        GROUP BY campaign_id
+        UNION ALL
+        SELECT campaign_id, SUM(clicks) FROM tracking_rollups
+        WHERE campaign_id = ANY($1)
+        GROUP BY campaign_id
+    ) c GROUP BY campaign_id
 )
 SELECT id as campaign_id,
     COALESCE(v.num, 0) AS views,
@@ -472,31 +740,31 @@ SELECT id, status, to_send, sent, started_at, updated_at
     FROM campaigns
     WHERE status=$1;
 
--- name: next-campaigns
--- Retreives campaigns that are running (or scheduled and the time's up) and need
--- to be processed. It updates the to_send count and max_subscriber_id of the campaign,
--- that is, the total number of subscribers to be processed across all lists of a campaign.
--- Thus, it has a sideaffect.
--- In addition, it finds the max_subscriber_id, the upper limit across all lists of
--- a campaign. This is used to fetch and slice subscribers for the campaign in next-subscriber-campaigns.
+-- name: get-campaigns-to-prepare
+-- Get the campaigns that are running (or scheduled and the time's up) whose
+-- subscribers haven't been counted since they started.
+SELECT id, name FROM campaigns
+    WHERE (status='running' OR (status='scheduled' AND NOW() >= send_at))
+    AND prepared_at IS NULL;
+
+-- name: prepare-campaign
+-- Prepares a campaign that's starting to be processed. It updates the to_send
+-- count and max_subscriber_id of the campaign, that is, the total number of
+-- subscribers to be processed across all lists of a campaign and the upper
+-- limit of their IDs, which is used to fetch and slice subscribers for the
+-- campaign in next-campaign-subscribers. Scheduled campaigns are set to running.
 WITH camps AS (
-    -- Get all running campaigns and their template bodies (if the template's deleted, the default template body instead)
-    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
-    FROM campaigns
-    LEFT JOIN templates ON (templates.id = campaigns.template_id)
-    WHERE (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
-    AND NOT(campaigns.id = ANY($1::INT[]))
+    SELECT id, type FROM campaigns
+    WHERE id = $1 AND prepared_at IS NULL
+    AND (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
 ),
 campLists AS (
-    -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
     SELECT id AS list_id, campaign_id, optin FROM lists
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
-    WHERE campaign_lists.campaign_id = ANY(SELECT id FROM camps)
+    WHERE campaign_lists.campaign_id = $1
 ),
 counts AS (
-    -- For each campaign above, get the total number of subscribers and the max_subscriber_id
-    -- across all its lists.
-    SELECT id AS campaign_id,
+    SELECT camps.id AS campaign_id,
                  COUNT(DISTINCT(subscriber_lists.subscriber_id)) AS to_send,
                  COALESCE(MAX(subscriber_lists.subscriber_id), 0) AS max_subscriber_id
     FROM camps
@@ -516,18 +784,25 @@ counts AS (
         END)
     )
     GROUP BY camps.id
-),
-u AS (
-    -- For each campaign, update the to_send count and set the max_subscriber_id.
-    UPDATE campaigns AS ca
+)
+UPDATE campaigns AS ca
     SET to_send = co.to_send,
-        status = (CASE WHEN status != 'running' THEN 'running' ELSE status END),
+        status = 'running',
         max_subscriber_id = co.max_subscriber_id,
+        prepared_at = NOW(),
         started_at=(CASE WHEN ca.started_at IS NULL THEN NOW() ELSE ca.started_at END)
-    FROM (SELECT * FROM counts) co
-    WHERE ca.id = co.campaign_id
-)
-SELECT * FROM camps;
+    FROM counts co
+    WHERE ca.id = co.campaign_id;
+
+-- name: next-campaigns
+-- Retreives running campaigns that have been prepared and need to be processed
+-- along with their template bodies (if the template's deleted, the default
+-- template body instead).
+SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    FROM campaigns
+    LEFT JOIN templates ON (templates.id = campaigns.template_id)
+    WHERE status='running' AND prepared_at IS NOT NULL
+    AND NOT(campaigns.id = ANY($1::INT[]));
 
 -- name: next-campaign-subscribers
 -- Returns a batch of subscribers in a given campaign starting from the last checkpoint
@@ -600,6 +875,11 @@ WITH camp AS (
         tags=$10::VARCHAR(100)[],
         messenger=$11,
         template_id=$12,
+        reply_to=$14,
+        archive=$15,
+        unsub_header=$16,
+        unsub_header_value=$17,
+        lang=$18,
         updated_at=NOW()
     WHERE id = $1 RETURNING id
 ),
@@ -620,7 +900,50 @@ UPDATE campaigns SET
 WHERE id=$1;
 
 -- name: update-campaign-status
-UPDATE campaigns SET status=$2, updated_at=NOW() WHERE id = $1;
+-- The subscribers of a campaign are counted again when it's started or
+-- resumed after its status changes.
+UPDATE campaigns SET status=$2,
+    prepared_at=(CASE WHEN status != $2 THEN NULL ELSE prepared_at END),
+    updated_at=NOW()
+    WHERE id = $1;
+
+-- name: finish-campaign
+-- Marks a campaign as finished if it's still running and no instance has
+-- a batch of it in flight. No rows are updated if another instance has
+-- already finished it or will finish it.
+UPDATE campaigns SET status='finished', updated_at=NOW() WHERE id = $1 AND status='running'
+    AND NOT EXISTS (SELECT 1 FROM campaign_leases WHERE campaign_id = $1);
+
+-- name: lock-campaigns
+-- Takes an advisory lock for the rest of the transaction that serializes
+-- the fetching of a campaign's subscriber batches across instances.
+-- $1 is the namespace of the lock and $2 is the ID of the campaign.
+SELECT PG_ADVISORY_XACT_LOCK($1, $2);
+
+-- name: lease-campaign
+-- Records that an instance ($2) is sending a batch of a campaign ($1) if $3
+-- is true, or that it has no batch of it left.
+WITH del AS (
+    DELETE FROM campaign_leases WHERE campaign_id = $1 AND instance_id = $2 AND NOT $3
+)
+INSERT INTO campaign_leases (campaign_id, instance_id)
+    SELECT $1, $2 WHERE $3 AND EXISTS (SELECT 1 FROM instances WHERE id = $2)
+    ON CONFLICT (campaign_id, instance_id) DO NOTHING;
+
+-- name: ping-instance
+-- Records that an instance is alive, removes instances that haven't been
+-- seen for $2 seconds and returns the number of live instances.
+WITH up AS (
+    INSERT INTO instances (id) VALUES($1)
+    ON CONFLICT (id) DO UPDATE SET updated_at=NOW()
+),
+del AS (
+    DELETE FROM instances WHERE id != $1 AND updated_at < NOW() - MAKE_INTERVAL(secs => $2)
+)
+SELECT COUNT(*) + 1 FROM instances WHERE id != $1 AND updated_at >= NOW() - MAKE_INTERVAL(secs => $2);
+
+-- name: delete-instance
+DELETE FROM instances WHERE id=$1;
 
 -- name: delete-campaign
 DELETE FROM campaigns WHERE id=$1;
@@ -631,77 +954,442 @@ WITH view AS (
     LEFT JOIN subscribers ON (CASE WHEN $2::TEXT != '' THEN subscribers.uuid = $2::UUID ELSE FALSE END)
     WHERE campaigns.uuid = $1
 )
-INSERT INTO campaign_views (campaign_id, subscriber_id)
-    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view));
+INSERT INTO campaign_views (campaign_id, subscriber_id, device, client, country, region)
+    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view), $3, $4, $5, $6);
+
+-- name: register-campaign-views
+-- Inserts a batch of views. Each array has one element per view. Views of
+-- non-existent campaigns are skipped.
+INSERT INTO campaign_views (campaign_id, subscriber_id, device, client, country, region, created_at)
+    SELECT c.id, s.id, v.device, v.client, v.country, v.region, v.created_at
+    FROM UNNEST($1::UUID[], $2::TEXT[], $3::TEXT[], $4::TEXT[], $5::TEXT[], $6::TEXT[], $7::TEXT[]::TIMESTAMP WITH TIME ZONE[])
+        AS v(camp_uuid, sub_uuid, device, client, country, region, created_at)
+    INNER JOIN campaigns c ON (c.uuid = v.camp_uuid)
+    LEFT JOIN subscribers s ON (s.uuid = NULLIF(v.sub_uuid, '')::UUID);
+
+-- name: get-campaign-view-devices
+-- Aggregates the views of a campaign by device family and e-mail client.
+-- Views recorded before devices were tracked are counted as unknown.
+SELECT 'device' AS type, COALESCE(NULLIF(device, ''), 'unknown') AS name, COUNT(*) AS count
+    FROM campaign_views WHERE campaign_id = $1 GROUP BY 2
+UNION ALL
+SELECT 'client' AS type, COALESCE(NULLIF(client, ''), 'unknown') AS name, COUNT(*) AS count
+    FROM campaign_views WHERE campaign_id = $1 GROUP BY 2
+ORDER BY type, count DESC;
+
+-- name: get-campaign-geo
+-- Aggregates the views and clicks of a campaign by country and region.
+-- $1 = 0 aggregates all campaigns created in the last $2 days for the dashboard.
+WITH views AS (
+    SELECT country, region, COUNT(*) AS count FROM campaign_views
+    WHERE ($1 = 0 OR campaign_id = $1) AND ($1 != 0 OR created_at > NOW() - MAKE_INTERVAL(days => $2))
+    AND country != '' GROUP BY country, region
+),
+clicks AS (
+    SELECT country, region, COUNT(*) AS count FROM link_clicks
+    WHERE ($1 = 0 OR campaign_id = $1) AND ($1 != 0 OR created_at > NOW() - MAKE_INTERVAL(days => $2))
+    AND country != '' GROUP BY country, region
+)
+SELECT COALESCE(v.country, c.country) AS country, COALESCE(v.region, c.region) AS region,
+    COALESCE(v.count, 0) AS views, COALESCE(c.count, 0) AS clicks
+    FROM views v FULL OUTER JOIN clicks c ON (c.country = v.country AND c.region = v.region)
+    ORDER BY views DESC, clicks DESC;
+
+-- name: get-campaign-link-clicks
+-- Total and unique clicks of every link in a campaign with the distribution of
+-- the clicks over time since the campaign started. Unique clicks are only
+-- available with individual subscriber tracking.
+WITH camp AS (
+    SELECT id, COALESCE(started_at, created_at) AS started_at FROM campaigns WHERE id = $1
+),
+clicks AS (
+    SELECT link_id, subscriber_id, link_clicks.created_at,
+        EXTRACT(EPOCH FROM link_clicks.created_at - camp.started_at) / 3600 AS hours
+    FROM link_clicks JOIN camp ON (camp.id = link_clicks.campaign_id)
+)
+SELECT links.id, links.url, COUNT(*) AS clicks,
+    COUNT(DISTINCT clicks.subscriber_id) AS unique_clicks,
+    MIN(clicks.created_at) AS first_click, MAX(clicks.created_at) AS last_click,
+    JSON_BUILD_ARRAY(
+        JSON_BUILD_OBJECT('bucket', '1h', 'count', COUNT(*) FILTER (WHERE hours < 1)),
+        JSON_BUILD_OBJECT('bucket', '6h', 'count', COUNT(*) FILTER (WHERE hours >= 1 AND hours < 6)),
+        JSON_BUILD_OBJECT('bucket', '24h', 'count', COUNT(*) FILTER (WHERE hours >= 6 AND hours < 24)),
+        JSON_BUILD_OBJECT('bucket', '3d', 'count', COUNT(*) FILTER (WHERE hours >= 24 AND hours < 72)),
+        JSON_BUILD_OBJECT('bucket', '7d', 'count', COUNT(*) FILTER (WHERE hours >= 72 AND hours < 168)),
+        JSON_BUILD_OBJECT('bucket', 'later', 'count', COUNT(*) FILTER (WHERE hours >= 168))
+    ) AS timing
+FROM clicks JOIN links ON (links.id = clicks.link_id)
+GROUP BY links.id ORDER BY clicks DESC, links.id;
+
+-- name: export-tracking-events
+-- Raw view and click events of campaigns in a date range, oldest first.
+-- $1 = '' exports both views and clicks. $2 = 0 exports all campaigns.
+SELECT * FROM (
+    SELECT 'view' AS type, campaigns.id AS campaign_id, campaigns.uuid AS campaign_uuid,
+        COALESCE(subscribers.uuid::TEXT, '') AS subscriber_uuid, '' AS url, v.created_at
+    FROM campaign_views v
+    JOIN campaigns ON (campaigns.id = v.campaign_id)
+    LEFT JOIN subscribers ON (subscribers.id = v.subscriber_id)
+    WHERE ($1 = '' OR $1 = 'view') AND ($2 = 0 OR v.campaign_id = $2)
+    AND ($3::TIMESTAMP WITH TIME ZONE IS NULL OR v.created_at >= $3)
+    AND ($4::TIMESTAMP WITH TIME ZONE IS NULL OR v.created_at < $4)
+    UNION ALL
+    SELECT 'click' AS type, campaigns.id AS campaign_id, campaigns.uuid AS campaign_uuid,
+        COALESCE(subscribers.uuid::TEXT, '') AS subscriber_uuid, links.url, l.created_at
+    FROM link_clicks l
+    JOIN campaigns ON (campaigns.id = l.campaign_id)
+    JOIN links ON (links.id = l.link_id)
+    LEFT JOIN subscribers ON (subscribers.id = l.subscriber_id)
+    WHERE ($1 = '' OR $1 = 'click') AND ($2 = 0 OR l.campaign_id = $2)
+    AND ($3::TIMESTAMP WITH TIME ZONE IS NULL OR l.created_at >= $3)
+    AND ($4::TIMESTAMP WITH TIME ZONE IS NULL OR l.created_at < $4)
+) e ORDER BY created_at;
 
 -- users
 -- name: get-users
-SELECT * FROM users WHERE $1 = 0 OR id = $1 OFFSET $2 LIMIT $3;
+SELECT id, username, name, role, status, list_ids, totp_enabled, created_at, updated_at FROM users
+    WHERE $1 = 0 OR id = $1 ORDER BY id;
+
+-- name: get-user-by-username
+-- Returns an enabled user along with the password hash for authentication.
+SELECT * FROM users WHERE username = $1 AND status = 'enabled';
 
 -- name: create-user
-INSERT INTO users (email, name, password, type, status) VALUES($1, $2, $3, $4, $5) RETURNING id;
+INSERT INTO users (username, name, password, role, status, list_ids)
+    VALUES($1, $2, $3, $4, $5, $6) RETURNING id;
 
 -- name: update-user
 UPDATE users SET
-    email=(CASE WHEN $2 != '' THEN $2 ELSE email END),
-    name=(CASE WHEN $3 != '' THEN $3 ELSE name END),
+    username=$2,
+    name=$3,
     password=(CASE WHEN $4 != '' THEN $4 ELSE password END),
-    type=(CASE WHEN $5 != '' THEN $5::user_type ELSE type END),
-    status=(CASE WHEN $6 != '' THEN $6::user_status ELSE status END),
+    role=$5,
+    status=$6,
+    list_ids=$7,
     updated_at=NOW()
 WHERE id = $1;
 
 -- name: delete-user
--- Delete a user, except for the primordial super admin.
-DELETE FROM users WHERE $1 != 1 AND id=$1;
+DELETE FROM users WHERE id = $1;
+
+-- name: count-users
+SELECT COUNT(*) FROM users;
+
+-- name: upsert-sso-user
+-- Creates a user logging in with single sign-on the first time (without a
+-- password) with the role from the identity provider and updates the name
+-- after. The role of an existing user is only changed by admins. Users that
+-- weren't created by single sign-ons aren't returned and can't log in with it.
+INSERT INTO users (username, name, password, role, status, source)
+    VALUES($1, $2, '', $3, 'enabled', 'sso')
+    ON CONFLICT (username) DO UPDATE SET name=$2, updated_at=NOW()
+    WHERE users.source = 'sso'
+    RETURNING *;
+
+-- name: upsert-admin-user
+-- Creates an admin user or resets the password of an existing user, who's
+-- made an enabled admin without 2FA.
+INSERT INTO users (username, name, password, role, status)
+    VALUES($1, $1, $2, 'admin', 'enabled')
+    ON CONFLICT (username) DO UPDATE SET password=$2, role='admin', status='enabled',
+        totp_secret='', totp_enabled=false, totp_recovery_codes='{}', updated_at=NOW();
+
+-- name: update-user-totp
+-- Sets the TOTP secret of a user ($2), enables or disables it ($3) and sets
+-- the hashes of the recovery codes ($4).
+UPDATE users SET totp_secret=$2, totp_enabled=$3, totp_recovery_codes=$4, updated_at=NOW()
+    WHERE id = $1;
+
+-- name: use-totp-step
+-- Records the time step of a user's accepted TOTP code if it's later than
+-- the last one. A code can't be reused in its validity window.
+UPDATE users SET totp_last_step=$2 WHERE id = $1 AND totp_last_step < $2;
+
+-- name: use-totp-recovery-code
+-- Removes a recovery code (hash) of a user if it exists. A code can only
+-- be used once.
+UPDATE users SET totp_recovery_codes=ARRAY_REMOVE(totp_recovery_codes, $2)
+    WHERE id = $1 AND $2 = ANY(totp_recovery_codes);
+
+-- name: create-session
+-- Creates a login session and deletes expired sessions.
+WITH d AS (
+    DELETE FROM sessions WHERE expires_at < NOW()
+)
+INSERT INTO sessions (id, user_id, expires_at) VALUES($1, $2, $3);
+
+-- name: get-session-user
+SELECT users.* FROM sessions
+    INNER JOIN users ON (users.id = sessions.user_id)
+    WHERE sessions.id = $1 AND sessions.expires_at > NOW() AND users.status = 'enabled';
+
+-- name: get-superuser-session
+-- Checks whether a session is a valid session of the superuser.
+SELECT COUNT(*) FROM sessions WHERE id = $1 AND user_id IS NULL AND expires_at > NOW();
+
+-- name: delete-session
+DELETE FROM sessions WHERE id = $1;
+
+-- name: count-subscribers-outside-lists
+-- Counts the given subscribers ($1) that aren't on any of the given lists ($2).
+SELECT COUNT(*) FROM UNNEST($1::INT[]) AS s(id)
+    WHERE NOT EXISTS (
+        SELECT 1 FROM subscriber_lists WHERE subscriber_id = s.id AND list_id = ANY($2::INT[])
+    );
+
+
+-- idempotency keys
+-- name: insert-idempotency-key
+-- Claims a key for a request. A key whose response has expired ($4 is the
+-- cutoff time) is reclaimed. No row is returned if the key is taken.
+-- Other expired keys are deleted.
+WITH d AS (
+    DELETE FROM idempotency_keys WHERE created_at < $4 AND NOT (key = $1 AND username = $2)
+)
+INSERT INTO idempotency_keys (key, username, request_hash) VALUES($1, $2, $3)
+    ON CONFLICT (key, username) DO UPDATE SET request_hash = $3, status = NULL,
+        content_type = '', response = NULL, created_at = NOW()
+    WHERE idempotency_keys.created_at < $4
+    RETURNING key;
+
+-- name: get-idempotency-key
+SELECT * FROM idempotency_keys WHERE key = $1 AND username = $2;
+
+-- name: update-idempotency-key
+UPDATE idempotency_keys SET status = $3, content_type = $4, response = $5
+    WHERE key = $1 AND username = $2;
+
+-- name: delete-idempotency-key
+DELETE FROM idempotency_keys WHERE key = $1 AND username = $2;
+
+
+-- audit log
+-- name: insert-audit-log
+INSERT INTO audit_log (username, method, path, resource, resource_id, data, ip)
+    VALUES($1, $2, $3, $4, $5, $6, $7);
+
+-- name: query-audit-log
+-- Entries are fetched newest first. $7 is an optional ID cursor to fetch
+-- the entries older than a given entry.
+SELECT COUNT(*) OVER () AS total, audit_log.* FROM audit_log
+    WHERE ($1 = '' OR username = $1)
+    AND ($2 = '' OR resource = $2)
+    AND ($3 = '' OR resource_id = $3)
+    AND ($4 = '' OR method = $4)
+    AND ($5::TIMESTAMP WITH TIME ZONE IS NULL OR created_at >= $5)
+    AND ($6::TIMESTAMP WITH TIME ZONE IS NULL OR created_at < $6)
+    AND ($7::BIGINT = 0 OR id < $7)
+    ORDER BY id DESC
+    OFFSET $8 LIMIT (CASE WHEN $9 = 0 THEN NULL ELSE $9 END);
 
 
 -- templates
 -- name: get-templates
 -- Only if the second param ($2) is true, body is returned.
-SELECT id, name, (CASE WHEN $2 = false THEN body ELSE '' END) as body,
-    is_default, created_at, updated_at
-    FROM templates WHERE $1 = 0 OR id = $1
+-- If $3 is set, only templates of that type are returned.
+SELECT id, name, type, subject, (CASE WHEN $2 = false THEN body ELSE '' END) as body,
+    sample_data, is_default, created_at, updated_at
+    FROM templates WHERE ($1 = 0 OR id = $1) AND ($3 = '' OR type = $3::template_type)
     ORDER BY created_at;
 
 -- name: create-template
-INSERT INTO templates (name, body) VALUES($1, $2) RETURNING id;
+-- Create a template and record it as the template's first version.
+WITH tpl AS (
+    INSERT INTO templates (name, body, type, subject, sample_data) VALUES($1, $2, $4, $5, $6)
+        RETURNING id, name, subject, body, sample_data
+),
+v AS (
+    INSERT INTO template_versions (template_id, version, name, subject, body, sample_data, editor)
+        SELECT id, 1, name, subject, body, sample_data, $3 FROM tpl
+)
+SELECT id FROM tpl;
 
 -- name: update-template
-UPDATE templates SET
-    name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
-    body=(CASE WHEN $3 != '' THEN $3 ELSE body END),
-    updated_at=NOW()
-WHERE id = $1;
+-- Update a template and record the updated template as its next version.
+WITH tpl AS (
+    UPDATE templates SET
+        name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
+        body=(CASE WHEN $3 != '' THEN $3 ELSE body END),
+        subject=$5,
+        sample_data=$6,
+        updated_at=NOW()
+    WHERE id = $1 RETURNING id, name, subject, body, sample_data
+)
+INSERT INTO template_versions (template_id, version, name, subject, body, sample_data, editor)
+    SELECT id, COALESCE((SELECT MAX(version) FROM template_versions WHERE template_id = $1), 0) + 1,
+    name, subject, body, sample_data, $4 FROM tpl;
+
+-- name: get-template-versions
+-- Get the versions of a template ($1), or a single version if $2 > 0.
+-- Only if the third param ($3) is true, body is returned.
+SELECT id, template_id, version, name, subject, (CASE WHEN $3 = false THEN body ELSE '' END) as body,
+    sample_data, editor, created_at
+    FROM template_versions WHERE template_id = $1 AND ($2 = 0 OR version = $2)
+    ORDER BY version DESC;
+
+-- name: rollback-template
+-- Restore the name, subject, body and sample data of a template to a past
+-- version ($2) and record the restored template as its next version.
+WITH v AS (
+    SELECT name, subject, body, sample_data FROM template_versions WHERE template_id = $1 AND version = $2
+),
+tpl AS (
+    UPDATE templates SET name=v.name, subject=v.subject, body=v.body, sample_data=v.sample_data, updated_at=NOW()
+    FROM v WHERE templates.id = $1
+    RETURNING templates.id, templates.name, templates.subject, templates.body, templates.sample_data
+)
+INSERT INTO template_versions (template_id, version, name, subject, body, sample_data, editor)
+    SELECT id, COALESCE((SELECT MAX(version) FROM template_versions WHERE template_id = $1), 0) + 1,
+    name, subject, body, sample_data, $3 FROM tpl;
 
 -- name: set-default-template
+-- Partials can't be set as the default template.
 WITH u AS (
-    UPDATE templates SET is_default=true WHERE id=$1 RETURNING id
+    UPDATE templates SET is_default=true WHERE id=$1 AND type = 'campaign' RETURNING id
 )
-UPDATE templates SET is_default=false WHERE id != $1;
+UPDATE templates SET is_default=false WHERE id != $1 AND EXISTS (SELECT 1 FROM u);
 
 -- name: delete-template
 -- Delete a template as long as there's more than one. One deletion, set all campaigns
 -- with that template to the default template instead.
 WITH tpl AS (
-    DELETE FROM templates WHERE id = $1 AND (SELECT COUNT(id) FROM templates) > 1 AND is_default = false RETURNING id
+    DELETE FROM templates WHERE id = $1 AND is_default = false AND
+        (type != 'campaign' OR (SELECT COUNT(id) FROM templates WHERE type = 'campaign') > 1)
+    RETURNING id
 ),
 def AS (
     SELECT id FROM templates WHERE is_default = true LIMIT 1
+),
+camps AS (
+    UPDATE campaigns SET template_id = (SELECT id FROM def) WHERE (SELECT id FROM tpl) > 0 AND template_id = $1
 )
-UPDATE campaigns SET template_id = (SELECT id FROM def) WHERE (SELECT id FROM tpl) > 0 AND template_id = $1
-    RETURNING (SELECT id FROM tpl);
+SELECT COALESCE((SELECT id FROM tpl), 0);
 
 
 -- media
 -- name: insert-media
-INSERT INTO media (uuid, filename, thumb, provider, created_at) VALUES($1, $2, $3, $4, NOW());
-
--- name: get-media
-SELECT * FROM media WHERE provider=$1 ORDER BY created_at DESC;
+INSERT INTO media (uuid, filename, thumb, variants, provider, folder_id, tags, created_at)
+    VALUES($1, $2, $3, $4, $5, $6, $7, NOW());
+
+-- name: query-media
+-- Media of a provider, newest first, optionally filtered by a filename search
+-- ($2), a folder ($3, -1 for media without a folder), tags that all have to
+-- match ($4) and an upload date range ($5, $6).
+SELECT COUNT(*) OVER () AS total, media.* FROM media
+    WHERE provider = $1
+    AND ($2 = '' OR filename ILIKE $2)
+    AND (CASE WHEN $3 = -1 THEN folder_id IS NULL WHEN $3 > 0 THEN folder_id = $3 ELSE TRUE END)
+    AND (CARDINALITY($4::VARCHAR(100)[]) = 0 OR tags @> $4)
+    AND ($5::TIMESTAMP WITH TIME ZONE IS NULL OR created_at >= $5)
+    AND ($6::TIMESTAMP WITH TIME ZONE IS NULL OR created_at < $6)
+    ORDER BY created_at DESC, id DESC
+    OFFSET $7 LIMIT (CASE WHEN $8 = 0 THEN NULL ELSE $8 END);
+
+-- name: get-media-item
+SELECT * FROM media WHERE id = $1;
+
+-- name: update-media
+UPDATE media SET folder_id = $2, tags = $3 WHERE id = $1;
+
+-- name: get-media-tags
+SELECT COALESCE(ARRAY_AGG(DISTINCT t ORDER BY t), '{}') FROM media, UNNEST(tags) t WHERE provider = $1;
+
+-- name: get-media-by-uuids
+SELECT * FROM media WHERE uuid = ANY($1::UUID[]);
 
 -- name: delete-media
-DELETE FROM media WHERE id=$1 RETURNING filename;
+DELETE FROM media WHERE id=$1 RETURNING filename, thumb, variants;
+
+-- name: get-orphan-media
+-- Media of a provider uploaded before $2 whose files aren't referenced in any
+-- campaign, template, template version, page template, scheduled tx message
+-- (or its attachments by UUID) or setting. Variant filenames contain the
+-- original filename and match as well.
+-- $3 optionally restricts the check to the given IDs.
+SELECT media.* FROM media
+    WHERE provider = $1 AND created_at < $2
+    AND (CARDINALITY($3::INT[]) = 0 OR id = ANY($3::INT[]))
+    AND NOT EXISTS (SELECT 1 FROM campaigns WHERE
+        POSITION(media.filename IN campaigns.body) > 0 OR POSITION(media.filename IN COALESCE(campaigns.altbody, '')) > 0)
+    AND NOT EXISTS (SELECT 1 FROM templates WHERE
+        POSITION(media.filename IN templates.body) > 0 OR POSITION(media.filename IN templates.subject) > 0)
+    AND NOT EXISTS (SELECT 1 FROM template_versions WHERE POSITION(media.filename IN template_versions.body) > 0)
+    AND NOT EXISTS (SELECT 1 FROM page_templates WHERE POSITION(media.filename IN page_templates.body) > 0)
+    AND NOT EXISTS (SELECT 1 FROM tx_scheduled WHERE POSITION(media.filename IN tx_scheduled.message::TEXT) > 0)
+    AND NOT EXISTS (SELECT 1 FROM tx_scheduled WHERE
+        tx_scheduled.message->'attachments' @> JSONB_BUILD_ARRAY(JSONB_BUILD_OBJECT('media_uuid', media.uuid)))
+    AND NOT EXISTS (SELECT 1 FROM settings WHERE POSITION(media.filename IN settings.value::TEXT) > 0)
+    ORDER BY created_at;
+
+-- name: get-media-folders
+-- Get one or all folders along with the number of media files in each.
+SELECT media_folders.*, COUNT(media.id) AS media_count FROM media_folders
+    LEFT JOIN media ON (media.folder_id = media_folders.id)
+    WHERE ($1 = 0 OR media_folders.id = $1)
+    GROUP BY media_folders.id ORDER BY media_folders.name;
+
+-- name: create-media-folder
+INSERT INTO media_folders (name) VALUES($1) RETURNING id;
+
+-- name: update-media-folder
+UPDATE media_folders SET name = $2, updated_at = NOW() WHERE id = $1;
+
+-- name: delete-media-folder
+-- Media in the folder are moved to the root.
+DELETE FROM media_folders WHERE id = $1;
+
+-- transactional message log
+-- name: insert-tx-log
+INSERT INTO tx_log (subscriber_id, template_id, email, subject, messenger, status, error, message_id)
+    VALUES(NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5, $6, $7, NULLIF($8, '')::UUID);
+
+-- name: update-tx-log-status
+UPDATE tx_log SET status=$2::tx_status, error=$3 WHERE message_id = $1;
+
+-- name: query-tx-log
+-- Entries are fetched newest first. $7 is an optional ID cursor to fetch
+-- the entries older than a given entry.
+SELECT COUNT(*) OVER () AS total, tx_log.*, COALESCE(templates.name, '') AS template_name FROM tx_log
+    LEFT JOIN templates ON (templates.id = tx_log.template_id)
+    WHERE ($1 = '' OR tx_log.email ILIKE $1 OR tx_log.subject ILIKE $1)
+    AND ($2 = '' OR tx_log.status = $2::tx_status)
+    AND ($3 = 0 OR tx_log.template_id = $3)
+    AND ($4 = 0 OR tx_log.subscriber_id = $4)
+    AND ($5::TIMESTAMP WITH TIME ZONE IS NULL OR tx_log.created_at >= $5)
+    AND ($6::TIMESTAMP WITH TIME ZONE IS NULL OR tx_log.created_at < $6)
+    AND ($7::BIGINT = 0 OR tx_log.id < $7)
+    ORDER BY tx_log.id DESC
+    OFFSET $8 LIMIT (CASE WHEN $9 = 0 THEN NULL ELSE $9 END);
+
+-- name: delete-tx-log
+-- Deletes the log entries older than N days.
+DELETE FROM tx_log WHERE created_at < NOW() - MAKE_INTERVAL(days => $1::INT);
+
+-- name: delete-tx-callbacks
+-- Deletes the status callbacks older than N days.
+DELETE FROM tx_callbacks WHERE created_at < NOW() - MAKE_INTERVAL(days => $1::INT);
+
+-- name: insert-tx-scheduled
+INSERT INTO tx_scheduled (message_id, message, send_at) VALUES($1, $2, $3);
+
+-- name: query-tx-scheduled
+-- The attachments in the scheduled messages are left out.
+SELECT COUNT(*) OVER () AS total, id, message_id, message - 'attachments' AS message, send_at, created_at
+    FROM tx_scheduled ORDER BY send_at, id
+    OFFSET $1 LIMIT (CASE WHEN $2 = 0 THEN NULL ELSE $2 END);
+
+-- name: get-due-tx-scheduled
+SELECT id, message_id, message, send_at, created_at FROM tx_scheduled
+    WHERE send_at <= NOW() ORDER BY send_at, id LIMIT $1;
+
+-- name: delete-tx-scheduled
+DELETE FROM tx_scheduled WHERE message_id = $1;
+
+-- name: insert-tx-callback
+INSERT INTO tx_callbacks (message_id, subscriber_id, email, url) VALUES($1, NULLIF($2, 0), $3, $4);
+
+-- name: get-tx-callback
+SELECT * FROM tx_callbacks WHERE message_id = $1;
 
 -- links
 -- name: create-link
@@ -711,32 +1399,138 @@ INSERT INTO links (uuid, url) VALUES($1, $2) ON CONFLICT (url) DO UPDATE SET url
 WITH link AS(
     SELECT id, url FROM links WHERE uuid = $1
 )
-INSERT INTO link_clicks (campaign_id, subscriber_id, link_id) VALUES(
+INSERT INTO link_clicks (campaign_id, subscriber_id, link_id, country, region) VALUES(
     (SELECT id FROM campaigns WHERE uuid = $2),
     (SELECT id FROM subscribers WHERE
         (CASE WHEN $3::TEXT != '' THEN subscribers.uuid = $3::UUID ELSE FALSE END)
     ),
-    (SELECT id FROM link)
+    (SELECT id FROM link),
+    $4,
+    $5
 ) RETURNING (SELECT url FROM link);
 
+-- name: register-link-clicks
+-- Inserts a batch of link clicks. Each array has one element per click.
+-- Clicks of non-existent links are skipped.
+INSERT INTO link_clicks (campaign_id, subscriber_id, link_id, country, region, created_at)
+    SELECT c.id, s.id, l.id, v.country, v.region, v.created_at
+    FROM UNNEST($1::UUID[], $2::TEXT[], $3::TEXT[], $4::TEXT[], $5::TEXT[], $6::TEXT[]::TIMESTAMP WITH TIME ZONE[])
+        AS v(link_uuid, camp_uuid, sub_uuid, country, region, created_at)
+    INNER JOIN links l ON (l.uuid = v.link_uuid)
+    LEFT JOIN campaigns c ON (c.uuid = NULLIF(v.camp_uuid, '')::UUID)
+    LEFT JOIN subscribers s ON (s.uuid = NULLIF(v.sub_uuid, '')::UUID);
+
+-- name: get-link-url
+SELECT url FROM links WHERE uuid = $1;
+
 -- name: get-dashboard-charts
 WITH clicks AS (
     -- Clicks by day for the last 3 months
     SELECT JSON_AGG(ROW_TO_JSON(row))
-    FROM (SELECT COUNT(*) AS count, created_at::DATE as date
-          FROM link_clicks GROUP by date ORDER BY date DESC LIMIT 100
+    FROM (SELECT SUM(count)::BIGINT AS count, date FROM (
+            SELECT COUNT(*) AS count, created_at::DATE as date FROM link_clicks GROUP by date
+            UNION ALL
+            SELECT SUM(clicks), day FROM tracking_rollups WHERE clicks > 0 GROUP BY day
+          ) c GROUP BY date ORDER BY date DESC LIMIT 100
     ) row
 ),
 views AS (
     -- Views by day for the last 3 months
     SELECT JSON_AGG(ROW_TO_JSON(row))
-    FROM (SELECT COUNT(*) AS count, created_at::DATE as date
-          FROM campaign_views GROUP by date ORDER BY date DESC LIMIT 100
+    FROM (SELECT SUM(count)::BIGINT AS count, date FROM (
+            SELECT COUNT(*) AS count, created_at::DATE as date FROM campaign_views GROUP by date
+            UNION ALL
+            SELECT SUM(views), day FROM tracking_rollups WHERE views > 0 GROUP BY day
+          ) v GROUP BY date ORDER BY date DESC LIMIT 100
     ) row
 )
 SELECT JSON_BUILD_OBJECT('link_clicks', COALESCE((SELECT * FROM clicks), '[]'),
                         'campaign_views', COALESCE((SELECT * FROM views), '[]'));
 
+-- name: get-dashboard-stats
+-- Time series of sends, views, clicks, bounces and new subscribers between
+-- $1 and $2 in buckets of $3 (hour, day, week). Campaign sends are counted in
+-- the bucket the campaign started in as individual sends aren't recorded.
+-- Transactional sends and bounces are only available with the tx log enabled.
+-- Pruned views and clicks are counted from their daily rollups.
+WITH buckets AS (
+    SELECT GENERATE_SERIES(DATE_TRUNC($3::TEXT, $1::TIMESTAMP WITH TIME ZONE),
+        $2::TIMESTAMP WITH TIME ZONE - INTERVAL '1 microsecond', ('1 ' || $3::TEXT)::INTERVAL) AS ts
+),
+sends AS (
+    SELECT DATE_TRUNC($3::TEXT, started_at) AS ts, SUM(sent) AS count FROM campaigns
+        WHERE started_at >= $1::TIMESTAMP WITH TIME ZONE AND started_at < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+    UNION ALL
+    SELECT DATE_TRUNC($3::TEXT, created_at) AS ts, COUNT(*) AS count FROM tx_log
+        WHERE status != 'failed' AND created_at >= $1::TIMESTAMP WITH TIME ZONE AND created_at < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+),
+views AS (
+    SELECT ts, SUM(count)::BIGINT AS count FROM (
+        SELECT DATE_TRUNC($3::TEXT, created_at) AS ts, COUNT(*) AS count FROM campaign_views
+            WHERE created_at >= $1::TIMESTAMP WITH TIME ZONE AND created_at < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+        UNION ALL
+        SELECT DATE_TRUNC($3::TEXT, day::TIMESTAMP WITH TIME ZONE) AS ts, SUM(views) AS count FROM tracking_rollups
+            WHERE views > 0 AND day >= DATE_TRUNC('day', $1::TIMESTAMP WITH TIME ZONE) AND day < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+    ) v GROUP BY ts
+),
+clicks AS (
+    SELECT ts, SUM(count)::BIGINT AS count FROM (
+        SELECT DATE_TRUNC($3::TEXT, created_at) AS ts, COUNT(*) AS count FROM link_clicks
+            WHERE created_at >= $1::TIMESTAMP WITH TIME ZONE AND created_at < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+        UNION ALL
+        SELECT DATE_TRUNC($3::TEXT, day::TIMESTAMP WITH TIME ZONE) AS ts, SUM(clicks) AS count FROM tracking_rollups
+            WHERE clicks > 0 AND day >= DATE_TRUNC('day', $1::TIMESTAMP WITH TIME ZONE) AND day < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+    ) c GROUP BY ts
+),
+bounces AS (
+    SELECT DATE_TRUNC($3::TEXT, created_at) AS ts, COUNT(*) AS count FROM tx_log
+        WHERE status = 'bounced' AND created_at >= $1::TIMESTAMP WITH TIME ZONE AND created_at < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+),
+subs AS (
+    SELECT DATE_TRUNC($3::TEXT, created_at) AS ts, COUNT(*) AS count FROM subscribers
+        WHERE created_at >= $1::TIMESTAMP WITH TIME ZONE AND created_at < $2::TIMESTAMP WITH TIME ZONE GROUP BY 1
+)
+SELECT b.ts,
+    COALESCE((SELECT SUM(count) FROM sends WHERE sends.ts = b.ts), 0) AS sends,
+    COALESCE(views.count, 0) AS views,
+    COALESCE(clicks.count, 0) AS clicks,
+    COALESCE(bounces.count, 0) AS bounces,
+    COALESCE(subs.count, 0) AS subscribers
+FROM buckets b
+LEFT JOIN views ON (views.ts = b.ts)
+LEFT JOIN clicks ON (clicks.ts = b.ts)
+LEFT JOIN bounces ON (bounces.ts = b.ts)
+LEFT JOIN subs ON (subs.ts = b.ts)
+ORDER BY b.ts;
+
+-- name: get-deliverability
+-- Delivery outcomes of the transactional message log between $1 and $2,
+-- aggregated by time buckets of $3 (hour, day, week), by messenger, and by
+-- recipient domain. Bounces and complaints update the status of sent messages,
+-- so every message that didn't fail counts as delivered to the server.
+WITH log AS (
+    SELECT DATE_TRUNC($3::TEXT, created_at) AS ts, messenger,
+        LOWER(SPLIT_PART(email, '@', 2)) AS domain, status
+    FROM tx_log
+    WHERE created_at >= $1::TIMESTAMP WITH TIME ZONE AND created_at < $2::TIMESTAMP WITH TIME ZONE
+)
+SELECT (CASE WHEN GROUPING(ts) = 0 THEN 'series' WHEN GROUPING(messenger) = 0 THEN 'messenger' ELSE 'domain' END) AS type,
+    ts, COALESCE(messenger, domain, '') AS name,
+    COUNT(*) AS attempts,
+    COUNT(*) FILTER (WHERE status != 'failed') AS sent,
+    COUNT(*) FILTER (WHERE status = 'bounced') AS bounced,
+    COUNT(*) FILTER (WHERE status = 'complained') AS complained,
+    COUNT(*) FILTER (WHERE status = 'failed') AS failed
+FROM log
+GROUP BY GROUPING SETS ((ts), (messenger), (domain))
+ORDER BY type, ts, attempts DESC;
+
+-- name: get-bounce-rate
+-- Number of transactional messages sent and bounced in the last $1 interval.
+SELECT COUNT(*) FILTER (WHERE status != 'failed') AS sent,
+    COUNT(*) FILTER (WHERE status = 'bounced') AS bounced
+    FROM tx_log WHERE created_at >= NOW() - $1::INTERVAL;
+
 -- name: get-dashboard-counts
 SELECT JSON_BUILD_OBJECT('subscribers', JSON_BUILD_OBJECT(
                             'total', (SELECT COUNT(*) FROM subscribers),
@@ -773,3 +1567,64 @@ SELECT JSON_OBJECT_AGG(key, value) AS settings
 UPDATE settings AS s SET value = c.value
     -- For each key in the incoming JSON map, update the row with the key and its value.
     FROM(SELECT * FROM JSONB_EACH($1)) AS c(key, value) WHERE s.key = c.key;
+
+-- name: init-secret-setting
+-- Sets a secret setting (eg: a signing key) to $2 if it's empty. Instances
+-- starting at the same time end up with the same value.
+INSERT INTO settings (key, value) VALUES($1, TO_JSONB($2::TEXT))
+    ON CONFLICT (key) DO UPDATE SET value = (CASE WHEN settings.value = '""' THEN EXCLUDED.value ELSE settings.value END);
+
+-- partitions
+-- name: partition-exists
+SELECT TO_REGCLASS($1) IS NOT NULL;
+
+-- name: get-partitions
+-- Get the names of the partitions of a table.
+SELECT c.relname FROM pg_inherits i JOIN pg_class c ON (c.oid = i.inhrelid)
+    WHERE i.inhparent = $1::REGCLASS ORDER BY c.relname;
+
+-- name: create-partition
+-- Raw query template that creates the partition %[2]s of the table %[1]s for the range
+-- [%[4]s, %[5]s). Rows in the default partition %[3]s that fall in the range are moved
+-- to the new partition as the default partition can't have them once it's created.
+ALTER TABLE %[1]s DETACH PARTITION %[3]s;
+CREATE TABLE IF NOT EXISTS %[2]s PARTITION OF %[1]s FOR VALUES FROM (%[4]s) TO (%[5]s);
+WITH moved AS (
+    DELETE FROM %[3]s WHERE created_at >= %[4]s AND created_at < %[5]s RETURNING *
+)
+INSERT INTO %[1]s SELECT * FROM moved;
+ALTER TABLE %[1]s ATTACH PARTITION %[3]s DEFAULT;
+
+-- name: rollup-tracking
+-- Adds the views and clicks of campaigns in [$1, $2) to their daily (UTC) rollups
+-- before they're pruned.
+WITH counts AS (
+    SELECT campaign_id, 0 AS link_id, (created_at AT TIME ZONE 'UTC')::DATE AS day, COUNT(*) AS views, 0 AS clicks
+        FROM campaign_views WHERE created_at >= $1 AND created_at < $2 GROUP BY 1, 3
+    UNION ALL
+    SELECT campaign_id, link_id, (created_at AT TIME ZONE 'UTC')::DATE AS day, 0 AS views, COUNT(*) AS clicks
+        FROM link_clicks WHERE campaign_id IS NOT NULL AND created_at >= $1 AND created_at < $2 GROUP BY 1, 2, 3
+)
+INSERT INTO tracking_rollups (campaign_id, link_id, day, views, clicks)
+    SELECT campaign_id, link_id, day, SUM(views), SUM(clicks) FROM counts GROUP BY 1, 2, 3
+    ON CONFLICT (campaign_id, link_id, day) DO UPDATE
+    SET views = tracking_rollups.views + EXCLUDED.views, clicks = tracking_rollups.clicks + EXCLUDED.clicks;
+
+-- name: delete-tracking
+-- Deletes the views and clicks before $1 and returns the number of deleted views and clicks.
+WITH views AS (
+    DELETE FROM campaign_views WHERE created_at < $1 RETURNING 1
+),
+clicks AS (
+    DELETE FROM link_clicks WHERE created_at < $1 RETURNING 1
+)
+SELECT (SELECT COUNT(*) FROM views) AS views, (SELECT COUNT(*) FROM clicks) AS clicks;
+
+-- name: drop-partition
+-- Raw query template that drops the partition %s.
+DROP TABLE IF EXISTS %s;
+
+-- name: vacuum-db
+-- Raw query that reclaims the space of deleted rows and updates the planner statistics.
+-- It's run outside a transaction.
+VACUUM (ANALYZE);
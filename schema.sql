@@ -1,10 +1,14 @@
-DROP TYPE IF EXISTS list_type CASCADE; CREATE TYPE list_type AS ENUM ('public', 'private', 'temporary');
+DROP TYPE IF EXISTS list_type CASCADE; CREATE TYPE list_type AS ENUM ('public', 'private', 'temporary', 'dynamic');
 DROP TYPE IF EXISTS list_optin CASCADE; CREATE TYPE list_optin AS ENUM ('single', 'double');
 DROP TYPE IF EXISTS subscriber_status CASCADE; CREATE TYPE subscriber_status AS ENUM ('enabled', 'disabled', 'blocklisted');
 DROP TYPE IF EXISTS subscription_status CASCADE; CREATE TYPE subscription_status AS ENUM ('unconfirmed', 'confirmed', 'unsubscribed');
 DROP TYPE IF EXISTS campaign_status CASCADE; CREATE TYPE campaign_status AS ENUM ('draft', 'running', 'scheduled', 'paused', 'cancelled', 'finished');
 DROP TYPE IF EXISTS campaign_type CASCADE; CREATE TYPE campaign_type AS ENUM ('regular', 'optin');
-DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain', 'markdown');
+DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain', 'markdown', 'visual', 'sms');
+DROP TYPE IF EXISTS template_type CASCADE; CREATE TYPE template_type AS ENUM ('campaign', 'partial', 'tx');
+DROP TYPE IF EXISTS tx_status CASCADE; CREATE TYPE tx_status AS ENUM ('sent', 'failed', 'bounced', 'complained');
+DROP TYPE IF EXISTS user_role CASCADE; CREATE TYPE user_role AS ENUM ('admin', 'manager', 'analyst', 'editor');
+DROP TYPE IF EXISTS user_status CASCADE; CREATE TYPE user_status AS ENUM ('enabled', 'disabled');
 
 -- subscribers
 DROP TABLE IF EXISTS subscribers CASCADE;
@@ -23,6 +27,35 @@ CREATE TABLE subscribers (
 DROP INDEX IF EXISTS idx_subs_email; CREATE UNIQUE INDEX idx_subs_email ON subscribers(LOWER(email));
 DROP INDEX IF EXISTS idx_subs_status; CREATE INDEX idx_subs_status ON subscribers(status);
 
+-- list folders
+DROP TABLE IF EXISTS list_folders CASCADE;
+CREATE TABLE list_folders (
+    id              SERIAL PRIMARY KEY,
+    name            TEXT NOT NULL,
+
+    -- Folders can be nested. When a parent folder is deleted,
+    -- its sub-folders move up to the root.
+    parent_id       INTEGER NULL REFERENCES list_folders(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_list_folders_parent_id; CREATE INDEX idx_list_folders_parent_id ON list_folders(parent_id);
+
+-- public page templates
+DROP TABLE IF EXISTS page_templates CASCADE;
+CREATE TABLE page_templates (
+    id              SERIAL PRIMARY KEY,
+    name            TEXT NOT NULL,
+
+    -- Template definitions ({{ define "header" }} ...) that override the
+    -- default public page templates for lists that use the set.
+    body            TEXT NOT NULL,
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- lists
 DROP TABLE IF EXISTS lists CASCADE;
 CREATE TABLE lists (
@@ -32,10 +65,29 @@ CREATE TABLE lists (
     type            list_type NOT NULL,
     optin           list_optin NOT NULL DEFAULT 'single',
     tags            VARCHAR(100)[],
+    folder_id       INTEGER NULL REFERENCES list_folders(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Saved subscriber query expression for 'dynamic' lists.
+    query           TEXT NOT NULL DEFAULT '',
+    synced_at       TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Default sender and reply-to for campaigns sent to the list.
+    from_email      TEXT NOT NULL DEFAULT '',
+    reply_to        TEXT NOT NULL DEFAULT '',
+
+    -- Template set of the list's public pages.
+    page_template_id INTEGER NULL REFERENCES page_templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- List-Unsubscribe header of campaigns sent to the list (url, mailto, both,
+    -- custom, none) and its mailto address or custom value. Empty uses the
+    -- global setting.
+    unsub_header       TEXT NOT NULL DEFAULT '',
+    unsub_header_value TEXT NOT NULL DEFAULT '',
 
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+DROP INDEX IF EXISTS idx_lists_folder_id; CREATE INDEX idx_lists_folder_id ON lists(folder_id);
 
 DROP TABLE IF EXISTS subscriber_lists CASCADE;
 CREATE TABLE subscriber_lists (
@@ -52,18 +104,84 @@ DROP INDEX IF EXISTS idx_sub_lists_sub_id; CREATE INDEX idx_sub_lists_sub_id ON
 DROP INDEX IF EXISTS idx_sub_lists_list_id; CREATE INDEX idx_sub_lists_list_id ON subscriber_lists(list_id);
 DROP INDEX IF EXISTS idx_sub_lists_status; CREATE INDEX idx_sub_lists_status ON subscriber_lists(status);
 
+-- list webhooks
+DROP TABLE IF EXISTS list_webhooks CASCADE;
+CREATE TABLE list_webhooks (
+    id              SERIAL PRIMARY KEY,
+    list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    url             TEXT NOT NULL,
+    events          TEXT[] NOT NULL DEFAULT '{}',
+    enabled         BOOLEAN NOT NULL DEFAULT true,
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_list_webhooks_list_id; CREATE INDEX idx_list_webhooks_list_id ON list_webhooks(list_id);
+
+-- subscription forms
+DROP TABLE IF EXISTS sub_forms CASCADE;
+CREATE TABLE sub_forms (
+    id              SERIAL PRIMARY KEY,
+    uuid            uuid NOT NULL UNIQUE,
+    name            TEXT NOT NULL,
+    list_id         INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Custom fields collected into subscriber attributes.
+    fields          JSONB NOT NULL DEFAULT '[]',
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_sub_forms_list_id; CREATE INDEX idx_sub_forms_list_id ON sub_forms(list_id);
+
+-- browser push subscriptions
+DROP TABLE IF EXISTS push_subscriptions CASCADE;
+CREATE TABLE push_subscriptions (
+    id              SERIAL PRIMARY KEY,
+    subscriber_id   INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    endpoint        TEXT NOT NULL UNIQUE,
+    p256dh          TEXT NOT NULL,
+    auth            TEXT NOT NULL,
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_push_subs_sub_id; CREATE INDEX idx_push_subs_sub_id ON push_subscriptions(subscriber_id);
+
 -- templates
 DROP TABLE IF EXISTS templates CASCADE;
 CREATE TABLE templates (
     id              SERIAL PRIMARY KEY,
     name            TEXT NOT NULL,
+    type            template_type NOT NULL DEFAULT 'campaign',
+    subject         TEXT NOT NULL DEFAULT '',
     body            TEXT NOT NULL,
     is_default      BOOLEAN NOT NULL DEFAULT false,
 
+    -- Sample data that transactional templates are previewed with.
+    sample_data     JSONB NOT NULL DEFAULT '{}',
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 CREATE UNIQUE INDEX ON templates (is_default) WHERE is_default = true;
+CREATE UNIQUE INDEX ON templates (name) WHERE type = 'partial';
+
+-- template versions
+DROP TABLE IF EXISTS template_versions CASCADE;
+CREATE TABLE template_versions (
+    id              SERIAL PRIMARY KEY,
+    template_id     INTEGER NOT NULL REFERENCES templates(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    version         INTEGER NOT NULL,
+    name            TEXT NOT NULL,
+    subject         TEXT NOT NULL DEFAULT '',
+    body            TEXT NOT NULL,
+    sample_data     JSONB NOT NULL DEFAULT '{}',
+    editor          TEXT NOT NULL DEFAULT '',
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(template_id, version)
+);
 
 
 -- campaigns
@@ -74,6 +192,7 @@ CREATE TABLE campaigns (
     name             TEXT NOT NULL,
     subject          TEXT NOT NULL,
     from_email       TEXT NOT NULL,
+    reply_to         TEXT NOT NULL DEFAULT '',
     body             TEXT NOT NULL,
     altbody          TEXT NULL,
     content_type     content_type NOT NULL DEFAULT 'richtext',
@@ -89,16 +208,44 @@ CREATE TABLE campaigns (
     messenger        TEXT NOT NULL,
     template_id      INTEGER REFERENCES templates(id) ON DELETE SET DEFAULT DEFAULT 1,
 
+    -- Whether the campaign is published on the public archive and the
+    -- full-text search vector of its subject and body when it is.
+    archive          BOOLEAN NOT NULL DEFAULT false,
+    archive_tsv      TSVECTOR NULL,
+
+    -- List-Unsubscribe header mode and value. Empty uses the global setting.
+    unsub_header       TEXT NOT NULL DEFAULT '',
+    unsub_header_value TEXT NOT NULL DEFAULT '',
+
+    -- Language of the system strings (L) in the campaign's templates.
+    -- Empty uses the app's language.
+    lang             TEXT NOT NULL DEFAULT '',
+
     -- Progress and stats.
     to_send            INT NOT NULL DEFAULT 0,
     sent               INT NOT NULL DEFAULT 0,
     max_subscriber_id  INT NOT NULL DEFAULT 0,
     last_subscriber_id INT NOT NULL DEFAULT 0,
 
+    -- Time at which the subscribers of the campaign's lists were counted
+    -- when it started. It's reset when the status changes.
+    prepared_at      TIMESTAMP WITH TIME ZONE NULL,
+
     started_at       TIMESTAMP WITH TIME ZONE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+DROP INDEX IF EXISTS idx_camps_archive_tsv; CREATE INDEX idx_camps_archive_tsv ON campaigns USING GIN (archive_tsv) WHERE archive = true;
+
+-- Keep the search vectors of campaigns on the archive up to date.
+CREATE OR REPLACE FUNCTION campaigns_archive_tsv() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.archive_tsv = CASE WHEN NEW.archive THEN TO_TSVECTOR('simple', NEW.subject || ' ' || NEW.body) END;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER campaigns_archive_tsv BEFORE INSERT OR UPDATE OF subject, body, archive ON campaigns
+    FOR EACH ROW EXECUTE PROCEDURE campaigns_archive_tsv();
 
 DROP TABLE IF EXISTS campaign_lists CASCADE;
 CREATE TABLE campaign_lists (
@@ -119,11 +266,32 @@ CREATE TABLE campaign_views (
 
     -- Subscribers may be deleted, but the view counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
-    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-);
+
+    -- Device family and e-mail client parsed from the user agent.
+    device           TEXT NOT NULL DEFAULT '',
+    client           TEXT NOT NULL DEFAULT '',
+
+    -- Country and region (ISO codes) looked up from the IP, which isn't stored.
+    country          TEXT NOT NULL DEFAULT '',
+    region           TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+
+-- Monthly (UTC) partitions, eg: campaign_views_2021_01, are created by the app
+-- ahead of time. Rows without a partition go to the default partition.
+) PARTITION BY RANGE (created_at);
+CREATE TABLE campaign_views_default PARTITION OF campaign_views DEFAULT;
 DROP INDEX IF EXISTS idx_views_camp_id; CREATE INDEX idx_views_camp_id ON campaign_views(campaign_id);
 DROP INDEX IF EXISTS idx_views_subscriber_id; CREATE INDEX idx_views_subscriber_id ON campaign_views(subscriber_id);
 
+-- media folders
+DROP TABLE IF EXISTS media_folders CASCADE;
+CREATE TABLE media_folders (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- media
 DROP TABLE IF EXISTS media CASCADE;
 CREATE TABLE media (
@@ -132,8 +300,16 @@ CREATE TABLE media (
     provider         TEXT NOT NULL DEFAULT '',
     filename         TEXT NOT NULL,
     thumb            TEXT NOT NULL,
+    folder_id        INTEGER NULL REFERENCES media_folders(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    tags             VARCHAR(100)[] NOT NULL DEFAULT '{}',
+
+    -- Filenames of the resized variants of an image by their names.
+    variants         JSONB NOT NULL DEFAULT '{}',
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+DROP INDEX IF EXISTS idx_media_folder_id; CREATE INDEX idx_media_folder_id ON media(folder_id);
+DROP INDEX IF EXISTS idx_media_tags; CREATE INDEX idx_media_tags ON media USING GIN(tags);
+DROP INDEX IF EXISTS idx_media_created_at; CREATE INDEX idx_media_created_at ON media(created_at);
 
 -- links
 DROP TABLE IF EXISTS links CASCADE;
@@ -151,12 +327,199 @@ CREATE TABLE link_clicks (
 
     -- Subscribers may be deleted, but the link counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
-    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-);
+
+    -- Country and region (ISO codes) looked up from the IP, which isn't stored.
+    country          TEXT NOT NULL DEFAULT '',
+    region           TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+
+-- Partitioned by month like campaign_views.
+) PARTITION BY RANGE (created_at);
+CREATE TABLE link_clicks_default PARTITION OF link_clicks DEFAULT;
 DROP INDEX IF EXISTS idx_clicks_camp_id; CREATE INDEX idx_clicks_camp_id ON link_clicks(campaign_id);
 DROP INDEX IF EXISTS idx_clicks_link_id; CREATE INDEX idx_clicks_link_id ON link_clicks(link_id);
 DROP INDEX IF EXISTS idx_clicks_sub_id; CREATE INDEX idx_clicks_sub_id ON link_clicks(subscriber_id);
 
+-- Daily counts of the views (link_id = 0) and link clicks of campaigns that are
+-- retained when old views and clicks are pruned.
+DROP TABLE IF EXISTS tracking_rollups CASCADE;
+CREATE TABLE tracking_rollups (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    link_id          INTEGER NOT NULL DEFAULT 0,
+    day              DATE NOT NULL,
+    views            BIGINT NOT NULL DEFAULT 0,
+    clicks           BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (campaign_id, link_id, day)
+);
+DROP INDEX IF EXISTS idx_rollups_day; CREATE INDEX idx_rollups_day ON tracking_rollups(day);
+
+-- Reasons that subscribers give for unsubscribing from a campaign.
+DROP TABLE IF EXISTS unsubscribe_feedback CASCADE;
+CREATE TABLE unsubscribe_feedback (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    reason           TEXT NOT NULL,
+    comment          TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_unsub_feedback_camp_id; CREATE INDEX idx_unsub_feedback_camp_id ON unsubscribe_feedback(campaign_id);
+DROP INDEX IF EXISTS idx_unsub_feedback_created_at; CREATE INDEX idx_unsub_feedback_created_at ON unsubscribe_feedback(created_at);
+
+-- Unsubscriptions from campaigns and where they came from: the
+-- unsubscribe page or a one-click (RFC 8058) request from an e-mail client.
+DROP TABLE IF EXISTS campaign_unsubscribes CASCADE;
+CREATE TABLE campaign_unsubscribes (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    source           TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_unsubs_camp_id; CREATE INDEX idx_camp_unsubs_camp_id ON campaign_unsubscribes(campaign_id);
+
+-- transactional message log
+DROP TABLE IF EXISTS tx_log CASCADE;
+CREATE TABLE tx_log (
+    id               BIGSERIAL PRIMARY KEY,
+    message_id       UUID NULL,
+
+    -- Subscribers and templates may be deleted, but the log should remain.
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    email            TEXT NOT NULL,
+    subject          TEXT NOT NULL DEFAULT '',
+    messenger        TEXT NOT NULL,
+    status           tx_status NOT NULL,
+    error            TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_tx_log_email; CREATE INDEX idx_tx_log_email ON tx_log(LOWER(email));
+DROP INDEX IF EXISTS idx_tx_log_created_at; CREATE INDEX idx_tx_log_created_at ON tx_log(created_at);
+DROP INDEX IF EXISTS idx_tx_log_message_id; CREATE INDEX idx_tx_log_message_id ON tx_log(message_id);
+
+-- scheduled transactional messages
+DROP TABLE IF EXISTS tx_scheduled CASCADE;
+CREATE TABLE tx_scheduled (
+    id               BIGSERIAL PRIMARY KEY,
+    message_id       UUID NOT NULL UNIQUE,
+    message          JSONB NOT NULL,
+    send_at          TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_tx_scheduled_send_at; CREATE INDEX idx_tx_scheduled_send_at ON tx_scheduled(send_at);
+
+-- transactional message status callbacks
+DROP TABLE IF EXISTS tx_callbacks CASCADE;
+CREATE TABLE tx_callbacks (
+    message_id       UUID NOT NULL PRIMARY KEY,
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    email            TEXT NOT NULL,
+    url              TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_tx_callbacks_created_at; CREATE INDEX idx_tx_callbacks_created_at ON tx_callbacks(created_at);
+
+-- admin users
+DROP TABLE IF EXISTS users CASCADE;
+CREATE TABLE users (
+    id               SERIAL PRIMARY KEY,
+    username         TEXT NOT NULL UNIQUE,
+    name             TEXT NOT NULL,
+    password         TEXT NOT NULL,
+    role             user_role NOT NULL DEFAULT 'analyst',
+    status           user_status NOT NULL DEFAULT 'enabled',
+
+    -- Lists that list-restricted editors can manage.
+    list_ids         INTEGER[] NOT NULL DEFAULT '{}',
+
+    -- Two-factor authentication (TOTP) and the hashes of its recovery codes.
+    totp_secret          TEXT NOT NULL DEFAULT '',
+    totp_enabled         BOOLEAN NOT NULL DEFAULT false,
+    totp_recovery_codes  TEXT[] NOT NULL DEFAULT '{}',
+    totp_last_step       BIGINT NOT NULL DEFAULT 0,
+
+    -- How the user was created: local (by an admin) or sso (on their first
+    -- single sign-on). Single sign-ons only log in sso users.
+    source           TEXT NOT NULL DEFAULT 'local',
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- admin login sessions. user_id is NULL for the superuser in the config.
+DROP TABLE IF EXISTS sessions CASCADE;
+CREATE TABLE sessions (
+    id               TEXT NOT NULL PRIMARY KEY,
+    user_id          INTEGER NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at       TIMESTAMP WITH TIME ZONE NOT NULL
+);
+DROP INDEX IF EXISTS idx_sessions_expires_at; CREATE INDEX idx_sessions_expires_at ON sessions(expires_at);
+
+-- responses of write API requests made with an Idempotency-Key header.
+-- status is NULL while the original request is in progress.
+DROP TABLE IF EXISTS idempotency_keys CASCADE;
+CREATE TABLE idempotency_keys (
+    key              TEXT NOT NULL,
+    username         TEXT NOT NULL DEFAULT '',
+    request_hash     TEXT NOT NULL,
+    status           INTEGER NULL,
+    content_type     TEXT NOT NULL DEFAULT '',
+    response         BYTEA NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (key, username)
+);
+DROP INDEX IF EXISTS idx_idempotency_keys_created_at; CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+
+-- instances (the main instance and sending workers) that are sending
+-- campaigns. Each instance updates its row periodically and the send
+-- rates are divided by the number of live instances.
+DROP TABLE IF EXISTS instances CASCADE;
+CREATE TABLE instances (
+    id               TEXT NOT NULL PRIMARY KEY,
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- batches of subscribers of campaigns that instances are sending. A campaign
+-- is only finished once no instance has a batch of it.
+DROP TABLE IF EXISTS campaign_leases CASCADE;
+CREATE TABLE campaign_leases (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    instance_id      TEXT NOT NULL REFERENCES instances(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (campaign_id, instance_id)
+);
+
+-- append-only log of administrative actions
+DROP TABLE IF EXISTS audit_log CASCADE;
+CREATE TABLE audit_log (
+    id               BIGSERIAL PRIMARY KEY,
+    username         TEXT NOT NULL DEFAULT '',
+    method           TEXT NOT NULL,
+    path             TEXT NOT NULL,
+    resource         TEXT NOT NULL,
+    resource_id      TEXT NOT NULL DEFAULT '',
+    data             JSONB NOT NULL DEFAULT '{}',
+    ip               TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_audit_log_username; CREATE INDEX idx_audit_log_username ON audit_log(username);
+DROP INDEX IF EXISTS idx_audit_log_resource; CREATE INDEX idx_audit_log_resource ON audit_log(resource);
+DROP INDEX IF EXISTS idx_audit_log_created_at; CREATE INDEX idx_audit_log_created_at ON audit_log(created_at);
+
+-- Entries can't be updated or deleted.
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+
 -- settings
 DROP TABLE IF EXISTS settings CASCADE;
 CREATE TABLE settings (
@@ -173,20 +536,59 @@ INSERT INTO settings (key, value) VALUES
     ('app.concurrency', '10'),
     ('app.message_rate', '10'),
     ('app.batch_size', '1000'),
+    ('app.tracking_batch_size', '500'),
     ('app.max_send_errors', '1000'),
-    ('app.message_sliding_window', 'false'),
-    ('app.message_sliding_window_duration', '"1h"'),
-    ('app.message_sliding_window_rate', '10000'),
+    ('app.rate_limits', '[]'),
     ('app.enable_public_subscription_page', 'true'),
+    ('app.enable_public_archive', 'false'),
     ('app.check_updates', 'true'),
     ('app.notify_emails', '["admin1@mysite.com", "admin2@mysite.com"]'),
     ('app.lang', '"en"'),
+    ('app.dynamic_list_sync_interval', '"1h"'),
+    ('app.failover_messengers', '[]'),
+    ('app.failover_max_errors', '10'),
+    ('app.failover_error_rate', '0'),
+    ('app.failover_cooldown', '"10m"'),
+    ('app.domain_routes', '[]'),
+    ('app.tx_max_attachment_size', '10'),
+    ('app.tx_log_enabled', 'false'),
+    ('app.tx_log_retention_days', '30'),
+    ('app.metrics_enabled', 'false'),
+    ('app.metrics_token', '""'),
+    ('app.alert_bounce_rate', '0'),
+    ('security.oidc_enabled', 'false'),
+    ('security.oidc_provider_url', '""'),
+    ('security.oidc_client_id', '""'),
+    ('security.oidc_client_secret', '""'),
+    ('security.oidc_username_claim', '"email"'),
+    ('security.oidc_role_claim', '"groups"'),
+    ('security.oidc_role_map', '[]'),
+    ('security.oidc_default_role', '""'),
+    ('security.rate_limit_enabled', 'false'),
+    ('security.rate_limit_store', '"memory"'),
+    ('security.rate_limit_redis_url', '"redis://localhost:6379"'),
+    ('security.rate_limit_trust_proxy', 'false'),
+    ('security.rate_limit_subscription_rate', '10'),
+    ('security.rate_limit_subscription_burst', '5'),
+    ('security.rate_limit_tracking_rate', '300'),
+    ('security.rate_limit_tracking_burst', '100'),
+    ('security.captcha_provider', '""'),
+    ('security.captcha_site_key', '""'),
+    ('security.captcha_secret', '""'),
+    ('security.form_min_submit_time', '0'),
+    ('security.cors_origins', '[]'),
+    ('security.form_key', '""'),
+    ('security.message_key', '""'),
     ('privacy.individual_tracking', 'false'),
     ('privacy.unsubscribe_header', 'true'),
+    ('privacy.unsubscribe_survey', 'false'),
+    ('privacy.unsubscribe_reasons', '["Too frequent", "Not relevant", "Never signed up"]'),
     ('privacy.allow_blocklist', 'true'),
     ('privacy.allow_export', 'true'),
     ('privacy.allow_wipe', 'true'),
     ('privacy.exportable', '["profile", "subscriptions", "campaign_views", "link_clicks"]'),
+    ('privacy.geoip_db', '""'),
+    ('privacy.analytics_retention_days', '0'),
     ('upload.provider', '"filesystem"'),
     ('upload.filesystem.upload_path', '"uploads"'),
     ('upload.filesystem.upload_uri', '"/uploads"'),
@@ -198,7 +600,26 @@ INSERT INTO settings (key, value) VALUES
     ('upload.s3.bucket_path', '"/"'),
     ('upload.s3.bucket_type', '"public"'),
     ('upload.s3.expiry', '"14d"'),
+    ('upload.thumbnail_width', '90'),
+    ('upload.image_variants', '[{"name": "email", "width": 600}]'),
     ('smtp',
         '[{"enabled":true, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_enabled":true,"tls_skip_verify":false,"email_headers":[]},
           {"enabled":false, "host":"smtp2.yoursite.com","port":587,"auth_protocol":"plain","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_enabled":false,"tls_skip_verify":false,"email_headers":[]}]'),
-    ('messengers', '[]');
+    ('dkim', '[]'),
+    ('messengers', '[]'),
+    ('ses', '[]'),
+    ('sendgrid', '[]'),
+    ('mailgun', '[]'),
+    ('sms', '[]'),
+    ('telegram', '[]'),
+    ('alerts', '[]'),
+    ('webpush.enabled', 'false'),
+    ('webpush.vapid_public_key', '""'),
+    ('webpush.vapid_private_key', '""'),
+    ('webpush.subject', '""'),
+    ('webpush.ttl', '86400'),
+    ('events.enabled', 'false'),
+    ('events.sink', '"webhook"'),
+    ('events.url', '""'),
+    ('events.nats_subject', '"listmonk.events"'),
+    ('events.batch_size', '100');
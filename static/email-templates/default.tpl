@@ -76,6 +76,9 @@
     </div>
     
     <div class="footer" style="text-align: center;font-size: 12px;color: #888;">
+        <p>
+            <a href="{{ MessageURL }}" style="color: #888;">{{ L.T "email.viewInBrowser" }}</a>
+        </p>
         <p>
             {{ L.T "email.unsubHelp" }}
             <a href="{{ UnsubscribeURL }}" style="color: #888;">{{ L.T "email.unsub" }}</a>
@@ -0,0 +1,17 @@
+<html>
+<body>
+    <p>Hello {{ .Subscriber.Name }}</p>
+
+    <p>
+        <strong>Order number: </strong> {{ .Tx.Data.order_id }}<br />
+        <strong>Shipping date: </strong> {{ .Tx.Data.shipping_date }}<br />
+    </p>
+
+    <br />
+    <p>
+        Transactional templates support Go templating and the data passed
+        to the template is available as {{ "{{ .Tx.Data.* }}" }}. The subscriber
+        is available as {{ "{{ .Subscriber.* }}" }}.
+    </p>
+</body>
+</html>
@@ -0,0 +1,19 @@
+// Service worker that shows listmonk web push notifications.
+self.addEventListener('push', (e) => {
+  if (!e.data) {
+    return;
+  }
+
+  const n = e.data.json();
+  e.waitUntil(self.registration.showNotification(n.title, {
+    body: n.body,
+    data: { url: n.url },
+  }));
+});
+
+self.addEventListener('notificationclick', (e) => {
+  e.notification.close();
+  if (e.notification.data && e.notification.data.url) {
+    e.waitUntil(self.clients.openWindow(e.notification.data.url));
+  }
+});
@@ -0,0 +1,47 @@
+// Registers the browser for listmonk web push notifications against a
+// subscriber. Usage: listmonkPush.subscribe('https://listmonk.site.com', subscriberUUID)
+window.listmonkPush = {
+  subscribe: async (rootURL, subUUID) => {
+    if (!('serviceWorker' in navigator) || !('PushManager' in window)) {
+      throw new Error('push notifications are not supported');
+    }
+
+    const resp = await fetch(`${rootURL}/push/key`);
+    if (!resp.ok) {
+      throw new Error('push notifications are not enabled');
+    }
+    const { data } = await resp.json();
+
+    // URL safe base64 to bytes.
+    const b64 = data.public_key.replace(/-/g, '+').replace(/_/g, '/');
+    const key = Uint8Array.from(atob(b64 + '='.repeat((4 - (b64.length % 4)) % 4)),
+      (c) => c.charCodeAt(0));
+
+    const reg = await navigator.serviceWorker.register(`${rootURL}/public/static/push-sw.js`);
+    const sub = await reg.pushManager.subscribe({
+      userVisibleOnly: true,
+      applicationServerKey: key,
+    });
+
+    return fetch(`${rootURL}/subscription/push/${subUUID}`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(sub),
+    });
+  },
+
+  unsubscribe: async (rootURL, subUUID) => {
+    const reg = await navigator.serviceWorker.getRegistration(`${rootURL}/public/static/push-sw.js`);
+    const sub = reg ? await reg.pushManager.getSubscription() : null;
+    if (!sub) {
+      return null;
+    }
+    await sub.unsubscribe();
+
+    return fetch(`${rootURL}/subscription/push/${subUUID}`, {
+      method: 'DELETE',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ endpoint: sub.endpoint }),
+    });
+  },
+};